@@ -0,0 +1,60 @@
+package ec2stack
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ssm"
+)
+
+var osSSMPaths = map[string]string{
+	"amazon-linux-2023": "/aws/service/ami-amazon-linux-latest/al2023-ami-kernel-default-x86_64",
+	"amazon-linux-2":    "/aws/service/ami-amazon-linux-latest/amzn2-ami-hvm-x86_64-gp2",
+	"ubuntu-24.04":      "/aws/service/canonical/ubuntu/server/24.04/stable/current/amd64/hvm/ebs-gp2/ami-id",
+	"ubuntu-22.04":      "/aws/service/canonical/ubuntu/server/22.04/stable/current/amd64/hvm/ebs-gp2/ami-id",
+	"ubuntu-20.04":      "/aws/service/canonical/ubuntu/server/20.04/stable/current/amd64/hvm/ebs-gp2/ami-id",
+	"debian-12":         "/aws/service/debian/release/12/latest/amd64",
+	"debian-11":         "/aws/service/debian/release/11/latest/amd64",
+}
+
+// osFamilyDefaults maps an OS family to the OS used when only the family is given
+var osFamilyDefaults = map[string]string{
+	"al2023": "amazon-linux-2023",
+	"ubuntu": "ubuntu-24.04",
+	"debian": "debian-12",
+}
+
+// osFamilyOf returns the OS family for a supported OS name
+func osFamilyOf(osName string) string {
+	switch {
+	case strings.HasPrefix(osName, "amazon-linux"):
+		return "al2023"
+	case strings.HasPrefix(osName, "ubuntu"):
+		return "ubuntu"
+	case strings.HasPrefix(osName, "debian"):
+		return "debian"
+	}
+	return ""
+}
+
+func lookupAMI(ctx context.Context, ssmClient *ssm.Client, osName string) (string, error) {
+	ssmPath, ok := osSSMPaths[osName]
+	if !ok {
+		var supported []string
+		for k := range osSSMPaths {
+			supported = append(supported, k)
+		}
+		return "", fmt.Errorf("unsupported OS %q, supported: %v", osName, supported)
+	}
+
+	result, err := ssmClient.GetParameter(ctx, &ssm.GetParameterInput{
+		Name: aws.String(ssmPath),
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to lookup AMI for %s: %w", osName, err)
+	}
+
+	return *result.Parameter.Value, nil
+}
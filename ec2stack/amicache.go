@@ -0,0 +1,122 @@
+package ec2stack
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/ssm"
+)
+
+// amiCacheTTL is how long an AMI ID resolved from SSM is reused. The SSM
+// "latest" parameters change every few weeks, so a few hours is safe.
+const amiCacheTTL = 6 * time.Hour
+
+// amiCacheMu serializes reads and writes of the cache file between the
+// member stacks of a count config
+var amiCacheMu sync.Mutex
+
+// amiCacheEntry is one resolved AMI in the cache file
+type amiCacheEntry struct {
+	AMIID      string    `json:"ami_id"`
+	ResolvedAt time.Time `json:"resolved_at"`
+}
+
+// cachePath returns the path of a cache file under the user's cache
+// directory (~/.cache/aws-ec2/<name> on Linux)
+func cachePath(name string) (string, error) {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return "", fmt.Errorf("failed to find cache directory: %w", err)
+	}
+	return filepath.Join(dir, "aws-ec2", name), nil
+}
+
+// amiCacheKey keys the cache by region and SSM parameter path, since the
+// same parameter resolves to a different AMI in every region
+func amiCacheKey(region, ssmPath string) string {
+	return region + ":" + ssmPath
+}
+
+// readCacheFile returns the entries of a cache file; a missing or
+// unreadable file is an empty cache
+func readCacheFile[E any](path string) map[string]E {
+	entries := map[string]E{}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return entries
+	}
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return map[string]E{}
+	}
+	return entries
+}
+
+// writeCacheFile replaces a cache file, writing to a temporary file first
+// so a concurrent run never reads a partial file
+func writeCacheFile[E any](path string, entries map[string]E) error {
+	data, err := json.MarshalIndent(entries, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), strings.TrimSuffix(filepath.Base(path), ".json")+"-*.json")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// resolveAMI returns the AMI for osName in region, from the on-disk cache
+// when a fresh entry exists and from SSM otherwise. The cache is only an
+// optimization: problems reading or writing it are logged at debug level.
+func (c *Client) resolveAMI(ctx context.Context, ssmClient *ssm.Client, region, osName string) (string, error) {
+	ssmPath, ok := osSSMPaths[osName]
+	if !ok || c.NoAMICache {
+		return lookupAMI(ctx, ssmClient, osName)
+	}
+	path, err := cachePath("ami.json")
+	if err != nil {
+		debugf(ctx, "AMI cache disabled: %v", err)
+		return lookupAMI(ctx, ssmClient, osName)
+	}
+
+	key := amiCacheKey(region, ssmPath)
+	amiCacheMu.Lock()
+	entry, found := readCacheFile[amiCacheEntry](path)[key]
+	amiCacheMu.Unlock()
+	if found && entry.AMIID != "" && time.Since(entry.ResolvedAt) < amiCacheTTL {
+		debugf(ctx, "AMI for %s in %s from cache %s (resolved %s)", osName, region, path, entry.ResolvedAt.Format(time.RFC3339))
+		return entry.AMIID, nil
+	}
+
+	amiID, err := lookupAMI(ctx, ssmClient, osName)
+	if err != nil {
+		return "", err
+	}
+
+	amiCacheMu.Lock()
+	defer amiCacheMu.Unlock()
+	entries := readCacheFile[amiCacheEntry](path)
+	entries[key] = amiCacheEntry{AMIID: amiID, ResolvedAt: time.Now().UTC()}
+	if err := writeCacheFile(path, entries); err != nil {
+		debugf(ctx, "failed to update AMI cache %s: %v", path, err)
+	}
+	return amiID, nil
+}
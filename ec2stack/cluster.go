@@ -0,0 +1,274 @@
+package ec2stack
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"sync"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/cloudformation"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	"github.com/aws/aws-sdk-go-v2/service/route53"
+)
+
+// maxParallelStacks bounds how many member stacks of a count config are
+// created or deleted at once
+const maxParallelStacks = 4
+
+// memberName returns the stack name of the i-th (1-based) member of a
+// count config
+func memberName(stackName string, i int) string {
+	return fmt.Sprintf("%s-%d", stackName, i)
+}
+
+// memberKind names the setting that makes vm a config of member stacks,
+// count or regions, and is empty for a single stack
+func memberKind(vm *VMConfig) string {
+	switch {
+	case len(vm.Regions) > 0:
+		return "regions"
+	case vm.Count > 1:
+		return "count"
+	}
+	return ""
+}
+
+// copyMemberConfig returns a copy of cfg for a member stack, with its
+// hostnames and name tag suffixed and no members of its own
+func copyMemberConfig(cfg *Config, suffix string) (*Config, error) {
+	data, err := json.Marshal(cfg)
+	if err != nil {
+		return nil, fmt.Errorf("failed to copy config: %w", err)
+	}
+	var member Config
+	if err := json.Unmarshal(data, &member); err != nil {
+		return nil, fmt.Errorf("failed to copy config: %w", err)
+	}
+	member.Source = cfg.Source
+
+	vm := member.VM
+	vm.Count = 0
+	vm.Regions = nil
+	vm.Instances = nil
+	if vm.Hostname != "" {
+		vm.Hostname = vm.Hostname + "-" + suffix
+	}
+	if vm.NameTag != "" {
+		vm.NameTag = vm.NameTag + "-" + suffix
+	}
+	if member.DNS != nil && member.DNS.Hostname != "" {
+		member.DNS.Hostname = member.DNS.Hostname + "-" + suffix
+	}
+	return &member, nil
+}
+
+// memberConfig returns a copy of cfg for the i-th member: a single stack
+// with numbered hostnames that reuses, but does not own, the parent's network
+func memberConfig(cfg *Config, i int) (*Config, error) {
+	member, err := copyMemberConfig(cfg, strconv.Itoa(i))
+	if err != nil {
+		return nil, err
+	}
+	vm := member.VM
+	vm.CreatedVPC = false
+	vm.CreatedSubnet = false
+	vm.InternetGatewayID = ""
+	vm.RouteTableID = ""
+	vm.RouteTableAssociation = ""
+	return member, nil
+}
+
+// createStacks creates cfg.VM.Count member stacks concurrently and records
+// each one that got as far as a stack ID in cfg.VM.Instances, so a failed
+// create can still be cleaned up with DeleteStack
+func (c *Client) createStacks(ctx context.Context, stackName string, cfg *Config) (*Config, error) {
+	vm := cfg.VM
+	infof(ctx, "\n=== Creating %d Stacks ===", vm.Count)
+
+	awsCfg, err := c.LoadAWSConfig(ctx, vm.Region)
+	if err != nil {
+		return cfg, fmt.Errorf("failed to load AWS config: %w", err)
+	}
+	ec2Client := ec2.NewFromConfig(awsCfg)
+	cfClient := cloudformation.NewFromConfig(awsCfg)
+	for i := range vm.Count {
+		if err := checkStackAbsent(ctx, cfClient, memberName(stackName, i+1)); err != nil {
+			return cfg, err
+		}
+	}
+	// A type from a launch template is checked by each member instead
+	for _, instanceType := range vm.InstanceTypes() {
+		if err := c.checkInstanceTypeOffered(ctx, ec2Client, vm.Region, instanceType); err != nil {
+			return cfg, err
+		}
+	}
+	// Resolve the network once so the members don't each create a VPC
+	if err := ensureNetwork(ctx, ec2Client, vm, stackName); err != nil {
+		return cfg, err
+	}
+
+	members := make([]*Config, vm.Count)
+	for i := range members {
+		members[i], err = memberConfig(cfg, i+1)
+		if err != nil {
+			return cfg, err
+		}
+	}
+
+	errs := make([]error, len(members))
+	sem := make(chan struct{}, maxParallelStacks)
+	var wg sync.WaitGroup
+	for i, member := range members {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+			name := memberName(stackName, i+1)
+			_, errs[i] = c.createOne(withStack(ctx, name), name, member)
+		}()
+	}
+	wg.Wait()
+
+	vm.Instances = nil
+	var failures []error
+	for i, member := range members {
+		if errs[i] != nil {
+			failures = append(failures, fmt.Errorf("%s: %w", memberName(stackName, i+1), errs[i]))
+		}
+		if member.VM.StackID == "" {
+			continue
+		}
+		vm.Instances = append(vm.Instances, InstanceConfig{
+			StackName:            member.VM.StackName,
+			StackID:              member.VM.StackID,
+			InstanceID:           member.VM.InstanceID,
+			PublicIP:             member.VM.PublicIP,
+			PublicDNSName:        member.VM.PublicDNSName,
+			PrivateIP:            member.VM.PrivateIP,
+			Zone:                 member.VM.Zone,
+			DNS:                  member.DNS,
+			SecondaryIPs:         member.VM.SecondaryIPs,
+			UserDataObject:       member.VM.UserDataObject,
+			LaunchedInstanceType: member.VM.LaunchedInstanceType,
+		})
+		vm.AMIID = member.VM.AMIID
+	}
+
+	if len(failures) > 0 {
+		return cfg, fmt.Errorf("%d of %d stacks failed to create: %w", len(failures), len(members), errors.Join(failures...))
+	}
+	return cfg, nil
+}
+
+// deleteStacks deletes the member stacks of a count or regions config and
+// their DNS records, then the networks they used: the shared one of a count
+// config, or each region's own. Members that fail to delete stay in the
+// config so the delete can be retried.
+func (c *Client) deleteStacks(ctx context.Context, awsCfg aws.Config, cfg *Config, configFile string) error {
+	r53Client := route53.NewFromConfig(awsCfg)
+	instances := cfg.VM.Instances
+
+	// Members of a regions config are deleted in their own region
+	memberCfg := func(inst *InstanceConfig) (aws.Config, error) {
+		if inst.Region == "" {
+			return awsCfg, nil
+		}
+		regionCfg, err := c.LoadAWSConfig(ctx, inst.Region)
+		if err != nil {
+			return aws.Config{}, fmt.Errorf("failed to load AWS config for %s: %w", inst.Region, err)
+		}
+		return regionCfg, nil
+	}
+
+	// Check protection on every member before deleting any of them
+	for i := range instances {
+		inst := &instances[i]
+		if inst.StackID == "" {
+			continue
+		}
+		instCfg, err := memberCfg(inst)
+		if err != nil {
+			return err
+		}
+		if err := c.checkTerminationProtection(ctx, cloudformation.NewFromConfig(instCfg), inst.StackName); err != nil {
+			return err
+		}
+	}
+
+	errs := make([]error, len(instances))
+	sem := make(chan struct{}, maxParallelStacks)
+	var wg sync.WaitGroup
+	for i := range instances {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+			inst := &instances[i]
+			ctx := withStack(ctx, inst.StackName)
+			instCfg, err := memberCfg(inst)
+			if err != nil {
+				errs[i] = err
+				return
+			}
+			if inst.DNS != nil && !c.KeepDNS {
+				deleteDNSResources(ctx, r53Client, inst.DNS, c.WaitDNS)
+				clearDNSOutputs(inst.DNS)
+			}
+			if inst.StackID != "" {
+				errs[i] = deleteCloudFormationStack(ctx, cloudformation.NewFromConfig(instCfg), inst.StackName, c.cfnRoleARN(cfg.VM))
+			}
+			if errs[i] != nil {
+				return
+			}
+			if inst.UserDataObject != "" {
+				c.deleteUserDataObject(ctx, instCfg, inst.UserDataObject)
+			}
+			if inst.Network != nil {
+				deleteNetworkStackNested(ctx, ec2.NewFromConfig(instCfg), inst.Network.vmConfig())
+				inst.Network = nil
+			}
+		}()
+	}
+	wg.Wait()
+
+	var remaining []InstanceConfig
+	var failures []error
+	for i, inst := range instances {
+		if errs[i] != nil {
+			failures = append(failures, fmt.Errorf("%s: %w", inst.StackName, errs[i]))
+			remaining = append(remaining, inst)
+			continue
+		}
+		if c.KeepDNS && inst.DNS != nil {
+			// Keep the record details so -dns-only can remove them later
+			remaining = append(remaining, InstanceConfig{StackName: inst.StackName, DNS: inst.DNS, Region: inst.Region})
+		}
+	}
+
+	if len(failures) == 0 {
+		if cfg.VM.CreatedVPC || cfg.VM.CreatedSubnet || cfg.VM.InternetGatewayID != "" {
+			deleteNetworkStackNested(ctx, ec2.NewFromConfig(awsCfg), cfg.VM)
+		}
+		clearVMOutputs(cfg.VM)
+	}
+	cfg.VM.Instances = remaining
+
+	if configFile != "" {
+		if err := WriteConfig(configFile, cfg); err != nil {
+			warnf(ctx, "failed to update config file: %v", err)
+		} else {
+			infof(ctx, "Config updated: %s", configFile)
+		}
+	}
+
+	if len(failures) > 0 {
+		return fmt.Errorf("%d of %d stacks failed to delete: %w", len(failures), len(instances), errors.Join(failures...))
+	}
+	infof(ctx, "%d stacks deleted successfully", len(instances))
+	return nil
+}
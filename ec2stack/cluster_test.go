@@ -0,0 +1,170 @@
+package ec2stack
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestMemberConfig(t *testing.T) {
+	cfg := &Config{
+		VM: &VMConfig{
+			Count:         3,
+			Hostname:      "web",
+			NameTag:       "web",
+			VpcID:         "vpc-1",
+			CreatedVPC:    true,
+			CreatedSubnet: true,
+			RouteTableID:  "rtb-1",
+			Instances:     []InstanceConfig{{StackName: "web-1"}},
+		},
+		DNS:    &DNSConfig{Hostname: "app", Domain: "example.com"},
+		Source: "stacks/web.json",
+	}
+	member, err := memberConfig(cfg, 2)
+	if err != nil {
+		t.Fatalf("memberConfig() error = %v", err)
+	}
+	vm := member.VM
+	if vm.Count != 0 || vm.Instances != nil || memberKind(vm) != "" {
+		t.Errorf("memberConfig() count = %d, instances = %v, want a single stack", vm.Count, vm.Instances)
+	}
+	if vm.Hostname != "web-2" || vm.NameTag != "web-2" || member.DNS.Hostname != "app-2" {
+		t.Errorf("memberConfig() hostname = %s, name tag = %s, dns hostname = %s, want them suffixed -2", vm.Hostname, vm.NameTag, member.DNS.Hostname)
+	}
+	if vm.VpcID != "vpc-1" || vm.CreatedVPC || vm.CreatedSubnet || vm.RouteTableID != "" {
+		t.Errorf("memberConfig() vpc = %s, created = %t/%t, route table = %q, want the parent's VPC without owning it", vm.VpcID, vm.CreatedVPC, vm.CreatedSubnet, vm.RouteTableID)
+	}
+	if member.Source != cfg.Source {
+		t.Errorf("memberConfig() source = %q, want %q", member.Source, cfg.Source)
+	}
+	if cfg.VM.Hostname != "web" || !cfg.VM.CreatedVPC || len(cfg.VM.Instances) != 1 || cfg.DNS.Hostname != "app" {
+		t.Errorf("memberConfig() changed the parent config: %+v", cfg.VM)
+	}
+	if got := memberName("web", 2); got != "web-2" {
+		t.Errorf("memberName() = %s, want web-2", got)
+	}
+}
+
+// stackResponse answers DescribeStacks with one stack
+func stackResponse(name, status string, protected bool) string {
+	protection := ""
+	if protected {
+		protection = `<EnableTerminationProtection>true</EnableTerminationProtection>`
+	}
+	return describeStacksResponse(`<member><StackName>` + name + `</StackName><StackStatus>` + status + `</StackStatus>` + protection + `</member>`)
+}
+
+// deniedResponse is the error of a call the credentials may not make
+const deniedResponse = `<ErrorResponse><Error><Type>Sender</Type><Code>AccessDenied</Code><Message>not allowed</Message></Error></ErrorResponse>`
+
+func TestClientDeleteStacks(t *testing.T) {
+	tests := []struct {
+		name          string
+		keepDNS       bool
+		responses     map[string][]string
+		wantErr       string
+		wantConfig    bool     // want a ConfigError
+		wantRemaining []string // members left in the config
+		wantDeletes   int      // DeleteStack calls
+	}{
+		{
+			name: "all deleted",
+			responses: map[string][]string{
+				"DescribeStacks web-1": {stackResponse("web-1", "CREATE_COMPLETE", false), stackResponse("web-1", "CREATE_COMPLETE", false), stackGoneResponse},
+				"DescribeStacks web-2": {stackResponse("web-2", "CREATE_COMPLETE", false), stackResponse("web-2", "CREATE_COMPLETE", false), stackGoneResponse},
+				"DeleteStack":          {`<DeleteStackResponse></DeleteStackResponse>`},
+			},
+			wantDeletes: 2,
+		},
+		{
+			name: "failed member kept",
+			responses: map[string][]string{
+				"DescribeStacks web-1": {stackResponse("web-1", "CREATE_COMPLETE", false), stackResponse("web-1", "CREATE_COMPLETE", false), stackGoneResponse},
+				"DescribeStacks web-2": {stackResponse("web-2", "CREATE_COMPLETE", false)},
+				"DeleteStack":          {`<DeleteStackResponse></DeleteStackResponse>`},
+				"DeleteStack web-2":    {deniedResponse},
+			},
+			wantErr:       "1 of 2 stacks failed to delete: web-2: failed to delete stack",
+			wantRemaining: []string{"web-2"},
+			wantDeletes:   2,
+		},
+		{
+			name: "protected member stops the delete",
+			responses: map[string][]string{
+				"DescribeStacks web-1": {stackResponse("web-1", "CREATE_COMPLETE", false)},
+				"DescribeStacks web-2": {stackResponse("web-2", "CREATE_COMPLETE", true)},
+			},
+			wantErr:       "stack web-2 has termination protection enabled",
+			wantConfig:    true,
+			wantRemaining: []string{"web-1", "web-2"},
+		},
+		{
+			name:    "records kept",
+			keepDNS: true,
+			responses: map[string][]string{
+				"DescribeStacks": {stackGoneResponse},
+			},
+			wantRemaining: []string{"web-1", "web-2"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stub := &stubAWS{responses: tt.responses}
+			c := newStubClient(t, stub)
+			c.KeepDNS = tt.keepDNS
+			cfg := &Config{VM: &VMConfig{
+				Count:      2,
+				Region:     "us-west-2",
+				VpcID:      "vpc-1",
+				CreatedVPC: tt.wantErr != "", // deleted only once every member is
+				AMIID:      "ami-1",
+				Instances: []InstanceConfig{
+					{StackName: "web-1", StackID: "arn:aws:cloudformation:us-west-2:123456789012:stack/web-1/1", DNS: &DNSConfig{Hostname: "web-1", Domain: "example.com"}},
+					{StackName: "web-2", StackID: "arn:aws:cloudformation:us-west-2:123456789012:stack/web-2/2", DNS: &DNSConfig{Hostname: "web-2", Domain: "example.com"}},
+				},
+			}}
+			if !tt.keepDNS {
+				for i := range cfg.VM.Instances {
+					cfg.VM.Instances[i].DNS = nil
+				}
+			}
+			awsCfg, err := c.LoadAWSConfig(context.Background(), "us-west-2")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			err = c.deleteStacks(context.Background(), awsCfg, cfg, "")
+			if tt.wantErr != "" {
+				var cfgErr *ConfigError
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) || errors.As(err, &cfgErr) != tt.wantConfig {
+					t.Fatalf("deleteStacks() error = %v, want it to contain %q", err, tt.wantErr)
+				}
+				if cfg.VM.AMIID == "" || !cfg.VM.CreatedVPC {
+					t.Errorf("deleteStacks() cleared the outputs of a config with members left")
+				}
+			} else {
+				if err != nil {
+					t.Fatalf("deleteStacks() error = %v", err)
+				}
+				if cfg.VM.AMIID != "" {
+					t.Errorf("deleteStacks() left ami_id %s", cfg.VM.AMIID)
+				}
+			}
+			var remaining []string
+			for _, inst := range cfg.VM.Instances {
+				remaining = append(remaining, inst.StackName)
+				if tt.keepDNS && (inst.DNS == nil || inst.StackID != "") {
+					t.Errorf("deleteStacks() kept %+v, want only the stack name and records", inst)
+				}
+			}
+			if strings.Join(remaining, ",") != strings.Join(tt.wantRemaining, ",") {
+				t.Errorf("deleteStacks() left %v, want %v", remaining, tt.wantRemaining)
+			}
+			if got := stub.calls["DeleteStack"]; got != tt.wantDeletes {
+				t.Errorf("DeleteStack called %d times, want %d", got, tt.wantDeletes)
+			}
+		})
+	}
+}
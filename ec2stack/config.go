@@ -0,0 +1,1340 @@
+package ec2stack
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+type User struct {
+	Username       string `json:"username" toml:"username"`
+	GitHubUsername string `json:"github_username" toml:"github_username"`
+}
+
+type DNSRecord struct {
+	Name  string `json:"name" toml:"name"`
+	Type  string `json:"type" toml:"type"`
+	Value string `json:"value" toml:"value"`
+	TTL   int    `json:"ttl" toml:"ttl"`
+
+	// ZoneID is set when the record lives outside the primary zone
+	ZoneID string `json:"zone_id,omitempty" toml:"zone_id,omitempty"`
+
+	// Routing fields, set for records guarded by a health check or
+	// created under a routing policy
+	SetIdentifier string       `json:"set_identifier,omitempty" toml:"set_identifier,omitempty"`
+	MultiValue    bool         `json:"multi_value,omitempty" toml:"multi_value,omitempty"`
+	HealthCheckID string       `json:"health_check_id,omitempty" toml:"health_check_id,omitempty"`
+	LatencyRegion string       `json:"latency_region,omitempty" toml:"latency_region,omitempty"`
+	GeoLocation   *GeoLocation `json:"geolocation,omitempty" toml:"geolocation,omitempty"`
+}
+
+// DNSRoutingPolicy makes the primary record one of a set of records for
+// the same name, from which Route53 answers by the resolver's latency or
+// location. With vm.regions every region's member joins the set.
+type DNSRoutingPolicy struct {
+	// Type is "latency" or "geolocation"
+	Type string `json:"type" toml:"type"`
+
+	// SetIdentifier names this record within the set. It defaults to the
+	// latency region, or to the location for geolocation.
+	SetIdentifier string `json:"set_identifier,omitempty" toml:"set_identifier,omitempty"`
+
+	// Region is the latency region the record answers for. It defaults to
+	// the stack's region, and is required for a DNS-only config.
+	Region string `json:"region,omitempty" toml:"region,omitempty"`
+
+	// Location is the geolocation the record answers for; Locations gives
+	// one per vm.regions entry instead
+	Location  *GeoLocation           `json:"location,omitempty" toml:"location,omitempty"`
+	Locations map[string]GeoLocation `json:"locations,omitempty" toml:"locations,omitempty"`
+}
+
+// GeoLocation is a Route53 geolocation: a continent, or a country with an
+// optional subdivision. Country "*" is the default for unmatched locations.
+type GeoLocation struct {
+	ContinentCode   string `json:"continent_code,omitempty" toml:"continent_code,omitempty"`
+	CountryCode     string `json:"country_code,omitempty" toml:"country_code,omitempty"`
+	SubdivisionCode string `json:"subdivision_code,omitempty" toml:"subdivision_code,omitempty"`
+}
+
+// HealthCheckConfig describes a Route53 health check against the target IP
+type HealthCheckConfig struct {
+	Protocol         string `json:"protocol,omitempty" toml:"protocol,omitempty"`
+	Port             int    `json:"port,omitempty" toml:"port,omitempty"`
+	Path             string `json:"path,omitempty" toml:"path,omitempty"`
+	FailureThreshold int    `json:"failure_threshold,omitempty" toml:"failure_threshold,omitempty"`
+
+	// Output fields
+	ID string `json:"id,omitempty" toml:"id,omitempty"`
+}
+
+// New nested configuration structure
+type Config struct {
+	// AWSProfile is the shared config profile the stack's account is
+	// reached with. Only the name is kept here; a -profile flag wins.
+	AWSProfile string `json:"aws_profile,omitempty" toml:"aws_profile,omitempty"`
+
+	// PostDeleteCommand is run by the local shell after a successful
+	// delete, with the deleted stack's outputs in its environment
+	PostDeleteCommand string `json:"post_delete_command,omitempty" toml:"post_delete_command,omitempty"`
+
+	VM  *VMConfig  `json:"vm,omitempty" toml:"vm,omitempty"`
+	DNS *DNSConfig `json:"dns,omitempty" toml:"dns,omitempty"`
+
+	// Source is the file the config was read from, set by ReadConfig
+	Source string `json:"-" toml:"-"`
+
+	// envRefs are the values expanded from environment variables, which
+	// WriteConfig writes back as references
+	envRefs map[string]envRef
+}
+
+type VMConfig struct {
+	Region   string `json:"region,omitempty" toml:"region,omitempty"`
+	OS       string `json:"os,omitempty" toml:"os,omitempty"`
+	OSFamily string `json:"os_family,omitempty" toml:"os_family,omitempty"`
+
+	// InstanceType is one instance type, or a fallback list tried in order
+	// when EC2 has no capacity for a type: a comma-separated string, or a
+	// JSON list, which is kept as the comma-separated form
+	InstanceType string `json:"instance_type,omitempty" toml:"instance_type,omitempty"`
+
+	CloudInitFile string   `json:"cloud_init_file,omitempty" toml:"cloud_init_file,omitempty"`
+	WorkingDir    string   `json:"working_dir,omitempty" toml:"working_dir,omitempty"`
+	Packages      []string `json:"packages,omitempty" toml:"packages,omitempty"`
+	Users         []User   `json:"users,omitempty" toml:"users,omitempty"`
+	VpcID         string   `json:"vpc_id,omitempty" toml:"vpc_id,omitempty"`
+	SubnetID      string   `json:"subnet_id,omitempty" toml:"subnet_id,omitempty"`
+
+	// Hostname is set on the instance at boot. It defaults to the DNS
+	// hostname, and the DNS domain is appended when there is one.
+	Hostname string `json:"hostname,omitempty" toml:"hostname,omitempty"`
+
+	// CompressUserData gzips the user data before base64 encoding. It is
+	// enabled automatically when the uncompressed payload exceeds the EC2 limit.
+	CompressUserData bool `json:"compress_user_data,omitempty" toml:"compress_user_data,omitempty"`
+
+	// UserDataBucket is an S3 bucket, in the stack's region, to host the
+	// user data in when it is too large to pass inline
+	UserDataBucket string `json:"user_data_bucket,omitempty" toml:"user_data_bucket,omitempty"`
+
+	// NameTag overrides the Name tag of the instance, and of the security
+	// group as NameTag-sg. Unset, both are named after the stack.
+	NameTag string `json:"name_tag,omitempty" toml:"name_tag,omitempty"`
+
+	SecurityGroupDescription string `json:"security_group_description,omitempty" toml:"security_group_description,omitempty"`
+
+	// AdditionalSecurityGroupIDs are existing security groups, in the
+	// instance's VPC, attached alongside the stack's own group
+	AdditionalSecurityGroupIDs []string `json:"additional_security_group_ids,omitempty" toml:"additional_security_group_ids,omitempty"`
+
+	// Ports lists the inbound rules (e.g. "22", "8080@10.0.0.0/8"). Ports
+	// without their own @CIDR are opened to DefaultCIDR.
+	Ports       []string `json:"ports,omitempty" toml:"ports,omitempty"`
+	DefaultCIDR string   `json:"default_cidr,omitempty" toml:"default_cidr,omitempty"`
+
+	// IPv6Ingress also opens each port open to 0.0.0.0/0 to ::/0. Ports
+	// can be opened to IPv6 ranges individually with @CIDR.
+	IPv6Ingress bool `json:"ipv6_ingress,omitempty" toml:"ipv6_ingress,omitempty"`
+
+	// SSHPort is the port sshd listens on, 22 when unset. Another port is
+	// opened in place of 22, set in the SSH command and configured on the
+	// instance.
+	SSHPort int `json:"ssh_port,omitempty" toml:"ssh_port,omitempty"`
+
+	// Timezone (an IANA name such as Europe/Berlin) and Locale (such as
+	// de_DE.UTF-8) are applied by the default setup script. The names are
+	// only checked for form; one the image does not know is reported in
+	// the instance's console output.
+	Timezone string `json:"timezone,omitempty" toml:"timezone,omitempty"`
+	Locale   string `json:"locale,omitempty" toml:"locale,omitempty"`
+
+	// MOTD is a message added to /etc/motd below the welcome line the
+	// default setup script writes there
+	MOTD string `json:"motd,omitempty" toml:"motd,omitempty"`
+
+	// BakeKeys fetches the users' SSH keys from GitHub when the stack is
+	// created and writes them into the user data, so the instance does not
+	// need to reach GitHub at boot
+	BakeKeys bool `json:"bake_keys,omitempty" toml:"bake_keys,omitempty"`
+
+	// InstallDocker has the default setup script install Docker, start it
+	// and add the users to the docker group. A cloud_init_file replaces
+	// that step, as it does Packages.
+	InstallDocker bool `json:"install_docker,omitempty" toml:"install_docker,omitempty"`
+
+	// SwapSizeGB adds a swap file of this many GiB at /swapfile, set up by
+	// the default setup script so a cloud_init_file is unaffected
+	SwapSizeGB int `json:"swap_size_gb,omitempty" toml:"swap_size_gb,omitempty"`
+
+	// EgressRules restricts outbound traffic using the same syntax as port
+	// rules (e.g. "443", "53/udp@10.0.0.2/32"). When empty, AWS allows all egress.
+	EgressRules []string `json:"egress_rules,omitempty" toml:"egress_rules,omitempty"`
+
+	// LaunchTemplateID launches from an EC2 launch template, which then
+	// supplies the image and instance type. An explicit os or instance_type
+	// overrides the template's. LaunchTemplateVersion defaults to the
+	// template's default version.
+	LaunchTemplateID      string `json:"launch_template_id,omitempty" toml:"launch_template_id,omitempty"`
+	LaunchTemplateVersion string `json:"launch_template_version,omitempty" toml:"launch_template_version,omitempty"`
+
+	// Root volume settings. IOPS applies to gp3 and io1, throughput to gp3
+	// only. When RootVolumeType is empty the AMI's default volume is used.
+	RootVolumeType       string `json:"root_volume_type,omitempty" toml:"root_volume_type,omitempty"`
+	RootVolumeIOPS       int    `json:"root_volume_iops,omitempty" toml:"root_volume_iops,omitempty"`
+	RootVolumeThroughput int    `json:"root_volume_throughput,omitempty" toml:"root_volume_throughput,omitempty"`
+
+	// EncryptRootVolume encrypts the root volume with KMSKeyID, or with the
+	// account's default EBS key when no key is given
+	EncryptRootVolume bool   `json:"encrypt_root_volume,omitempty" toml:"encrypt_root_volume,omitempty"`
+	KMSKeyID          string `json:"kms_key_id,omitempty" toml:"kms_key_id,omitempty"`
+
+	// EnableTerminationProtection turns on CloudFormation termination
+	// protection once the stack is created. Deleting then requires -force.
+	EnableTerminationProtection bool `json:"enable_termination_protection,omitempty" toml:"enable_termination_protection,omitempty"`
+
+	// EnableSSM attaches an instance profile with the
+	// AmazonSSMManagedInstanceCore policy so the instance can be managed
+	// through SSM. WaitForCloudInit and PostCreateCommand require it.
+	EnableSSM        bool `json:"enable_ssm,omitempty" toml:"enable_ssm,omitempty"`
+	WaitForCloudInit bool `json:"wait_for_cloud_init,omitempty" toml:"wait_for_cloud_init,omitempty"`
+
+	// InstanceProfileName attaches an existing instance profile. The
+	// stack then creates no role or profile of its own, even with
+	// EnableSSM, so the profile must grant SSM access itself.
+	InstanceProfileName string `json:"instance_profile_name,omitempty" toml:"instance_profile_name,omitempty"`
+
+	// InlinePolicy is an IAM policy document, as a JSON string, added to
+	// the role the stack creates for EnableSSM, for narrow grants such as
+	// reading one S3 bucket
+	InlinePolicy string `json:"inline_policy,omitempty" toml:"inline_policy,omitempty"`
+
+	// StackPolicy protects the stack's resources from updates: "default"
+	// denies replacing or removing the instance, and anything else is a
+	// stack policy document as a JSON string or the path of a file with one
+	StackPolicy string `json:"stack_policy,omitempty" toml:"stack_policy,omitempty"`
+
+	// CloudFormationRoleARN is the service role CloudFormation uses to
+	// create and delete the stack, so the caller's own credentials only
+	// need to pass it (iam:PassRole) rather than manage every resource
+	CloudFormationRoleARN string `json:"cloudformation_role_arn,omitempty" toml:"cloudformation_role_arn,omitempty"`
+
+	// PostCreateCommand is run on the instance through SSM once the stack is
+	// up. A non-zero exit fails the create unless ContinueOnError is set.
+	PostCreateCommand string `json:"post_create_command,omitempty" toml:"post_create_command,omitempty"`
+	ContinueOnError   bool   `json:"continue_on_error,omitempty" toml:"continue_on_error,omitempty"`
+
+	// ShutdownBehavior is what a shutdown from inside the instance does:
+	// stop (the default) or terminate
+	ShutdownBehavior string `json:"shutdown_behavior,omitempty" toml:"shutdown_behavior,omitempty"`
+
+	// DetailedMonitoring turns on one-minute CloudWatch metrics for the
+	// instance, which CloudWatch bills separately
+	DetailedMonitoring bool `json:"detailed_monitoring,omitempty" toml:"detailed_monitoring,omitempty"`
+
+	// NoPublicIP launches without a public IP, for instances reached over
+	// a VPN or bastion. DNS records then point at the private IP.
+	NoPublicIP bool `json:"no_public_ip,omitempty" toml:"no_public_ip,omitempty"`
+
+	// ElasticIPAllocationID associates an Elastic IP you own with the
+	// instance. Deleting the stack disassociates it but keeps it allocated.
+	ElasticIPAllocationID string `json:"elastic_ip_allocation_id,omitempty" toml:"elastic_ip_allocation_id,omitempty"`
+
+	// BastionHost is a jump host, as host or host:port, for reaching an
+	// instance without a public IP. The SSH command and SSH config entry
+	// then go through it to the private IP, as BastionUser when set.
+	BastionHost string `json:"bastion_host,omitempty" toml:"bastion_host,omitempty"`
+	BastionUser string `json:"bastion_user,omitempty" toml:"bastion_user,omitempty"`
+
+	// TemplateFile is a CloudFormation template used instead of the
+	// generated one. It must declare the InstanceId and PublicIP outputs
+	// (PrivateIP with NoPublicIP); of the parameters ImageId, InstanceType,
+	// VpcId, SubnetId and UserData it is passed the ones it declares.
+	TemplateFile string `json:"template_file,omitempty" toml:"template_file,omitempty"`
+
+	// AvailabilityZone pins the instance to a zone; a discovered or created
+	// subnet is picked in that zone and a configured subnet must be in it
+	AvailabilityZone string `json:"availability_zone,omitempty" toml:"availability_zone,omitempty"`
+
+	// PlacementGroup launches into an existing placement group. Set
+	// PlacementStrategy (cluster, spread or partition) instead to have the
+	// stack create a group of its own, deleted with the stack.
+	PlacementGroup    string `json:"placement_group,omitempty" toml:"placement_group,omitempty"`
+	PlacementStrategy string `json:"placement_strategy,omitempty" toml:"placement_strategy,omitempty"`
+
+	// SecondaryPrivateIPs adds that many private IPs to the instance's
+	// network interface, e.g. one per TLS service. They are recorded in
+	// SecondaryIPs and can be targeted by dns.alias_secondary_ips.
+	SecondaryPrivateIPs int `json:"secondary_private_ips,omitempty" toml:"secondary_private_ips,omitempty"`
+
+	// Count launches that many identical stacks, <name>-1 to <name>-N,
+	// each with its own DNS record <hostname>-N.<domain>. They share one
+	// network and are recorded in Instances; 0 or 1 creates a single stack.
+	Count int `json:"count,omitempty" toml:"count,omitempty"`
+
+	// Regions launches one stack per region, <name>-<region>, each with its
+	// own DNS record <hostname>-<region>.<domain> and its region's network.
+	// They are recorded in Instances; Region is then not used for the VM.
+	Regions []string `json:"regions,omitempty" toml:"regions,omitempty"`
+
+	// Output fields
+	StackName     string `json:"stack_name,omitempty" toml:"stack_name,omitempty"`
+	StackID       string `json:"stack_id,omitempty" toml:"stack_id,omitempty"`
+	InstanceID    string `json:"instance_id,omitempty" toml:"instance_id,omitempty"`
+	PublicIP      string `json:"public_ip,omitempty" toml:"public_ip,omitempty"`
+	PrivateIP     string `json:"private_ip,omitempty" toml:"private_ip,omitempty"`
+	SecurityGroup string `json:"security_group,omitempty" toml:"security_group,omitempty"`
+	AMIID         string `json:"ami_id,omitempty" toml:"ami_id,omitempty"`
+
+	// PublicDNSName is the ec2-...amazonaws.com name EC2 assigned with the
+	// public IP. It is empty when the VPC has DNS hostnames turned off.
+	PublicDNSName string `json:"public_dns_name,omitempty" toml:"public_dns_name,omitempty"`
+
+	// Zone is the availability zone the instance was launched in
+	Zone string `json:"zone,omitempty" toml:"zone,omitempty"`
+
+	// LaunchedInstanceType is the type a fallback list launched; it is only
+	// set when InstanceType lists more than one
+	LaunchedInstanceType string `json:"launched_instance_type,omitempty" toml:"launched_instance_type,omitempty"`
+
+	// SSMRoleName and SSMInstanceProfile name the role and profile the
+	// stack created for EnableSSM
+	SSMRoleName        string `json:"ssm_role_name,omitempty" toml:"ssm_role_name,omitempty"`
+	SSMInstanceProfile string `json:"ssm_instance_profile,omitempty" toml:"ssm_instance_profile,omitempty"`
+
+	// SecondaryIPs are the secondary private IPs, in the order assigned
+	SecondaryIPs []string `json:"secondary_ips,omitempty" toml:"secondary_ips,omitempty"`
+
+	// UserDataObject is the s3://bucket/key the user data was uploaded to,
+	// removed on delete
+	UserDataObject string `json:"user_data_object,omitempty" toml:"user_data_object,omitempty"`
+
+	// Instances lists the member stacks of a count create
+	Instances []InstanceConfig `json:"instances,omitempty" toml:"instances,omitempty"`
+
+	// Network resources for cleanup
+	CreatedVPC            bool   `json:"created_vpc,omitempty" toml:"created_vpc,omitempty"`
+	CreatedSubnet         bool   `json:"created_subnet,omitempty" toml:"created_subnet,omitempty"`
+	InternetGatewayID     string `json:"internet_gateway_id,omitempty" toml:"internet_gateway_id,omitempty"`
+	RouteTableID          string `json:"route_table_id,omitempty" toml:"route_table_id,omitempty"`
+	RouteTableAssociation string `json:"route_table_association_id,omitempty" toml:"route_table_association_id,omitempty"`
+}
+
+// InstanceConfig records one member stack of a count create. DNS holds the
+// member's own records so they can be deleted with it.
+type InstanceConfig struct {
+	StackName      string     `json:"stack_name" toml:"stack_name"`
+	StackID        string     `json:"stack_id,omitempty" toml:"stack_id,omitempty"`
+	InstanceID     string     `json:"instance_id,omitempty" toml:"instance_id,omitempty"`
+	PublicIP       string     `json:"public_ip,omitempty" toml:"public_ip,omitempty"`
+	PublicDNSName  string     `json:"public_dns_name,omitempty" toml:"public_dns_name,omitempty"`
+	PrivateIP      string     `json:"private_ip,omitempty" toml:"private_ip,omitempty"`
+	Zone           string     `json:"zone,omitempty" toml:"zone,omitempty"`
+	SecondaryIPs   []string   `json:"secondary_ips,omitempty" toml:"secondary_ips,omitempty"`
+	UserDataObject string     `json:"user_data_object,omitempty" toml:"user_data_object,omitempty"`
+	DNS            *DNSConfig `json:"dns,omitempty" toml:"dns,omitempty"`
+
+	// LaunchedInstanceType is the type the member's fallback list launched
+	LaunchedInstanceType string `json:"launched_instance_type,omitempty" toml:"launched_instance_type,omitempty"`
+
+	// Region and Network are set for the members of a regions config,
+	// which each use their own region's network. Network records what the
+	// member created there, for delete to remove.
+	Region  string         `json:"region,omitempty" toml:"region,omitempty"`
+	Network *MemberNetwork `json:"network,omitempty" toml:"network,omitempty"`
+}
+
+// MemberNetwork is the network a member of a regions config created
+type MemberNetwork struct {
+	VpcID                 string `json:"vpc_id,omitempty" toml:"vpc_id,omitempty"`
+	SubnetID              string `json:"subnet_id,omitempty" toml:"subnet_id,omitempty"`
+	CreatedVPC            bool   `json:"created_vpc,omitempty" toml:"created_vpc,omitempty"`
+	CreatedSubnet         bool   `json:"created_subnet,omitempty" toml:"created_subnet,omitempty"`
+	InternetGatewayID     string `json:"internet_gateway_id,omitempty" toml:"internet_gateway_id,omitempty"`
+	RouteTableID          string `json:"route_table_id,omitempty" toml:"route_table_id,omitempty"`
+	RouteTableAssociation string `json:"route_table_association_id,omitempty" toml:"route_table_association_id,omitempty"`
+}
+
+type DNSConfig struct {
+	Hostname     string   `json:"hostname,omitempty" toml:"hostname,omitempty"`
+	Domain       string   `json:"domain,omitempty" toml:"domain,omitempty"`
+	TTL          *int     `json:"ttl,omitempty" toml:"ttl,omitempty"`
+	IsApexDomain bool     `json:"is_apex_domain,omitempty" toml:"is_apex_domain,omitempty"`
+	CNAMEAliases []string `json:"cname_aliases,omitempty" toml:"cname_aliases,omitempty"`
+	TargetIP     string   `json:"target_ip,omitempty" toml:"target_ip,omitempty"`
+
+	// Aliases are additional FQDNs that get their own A record pointing at
+	// the target IP. Each alias may live in a different hosted zone.
+	Aliases []string `json:"aliases,omitempty" toml:"aliases,omitempty"`
+
+	// AliasSecondaryIPs points aliases at one of the instance's secondary
+	// private IPs instead of the target IP, by 1-based index into
+	// vm.secondary_ips. Each key must also be listed in Aliases.
+	AliasSecondaryIPs map[string]int `json:"alias_secondary_ips,omitempty" toml:"alias_secondary_ips,omitempty"`
+
+	// HealthCheck, when set, creates a Route53 health check and attaches it
+	// to the primary record so Route53 stops answering with an unhealthy IP.
+	HealthCheck *HealthCheckConfig `json:"health_check,omitempty" toml:"health_check,omitempty"`
+
+	// RoutingPolicy, when set, creates the primary record under latency or
+	// geolocation routing instead of as the only record for its name
+	RoutingPolicy *DNSRoutingPolicy `json:"routing_policy,omitempty" toml:"routing_policy,omitempty"`
+
+	// TXTRecords maps names to TXT values created in the same zone, e.g.
+	// for ACME DNS-01 or SES verification. Names are relative to the
+	// domain; "@" is the domain itself. Values are given unquoted.
+	TXTRecords map[string]string `json:"txt_records,omitempty" toml:"txt_records,omitempty"`
+
+	// PrivateZone selects the private hosted zone for the domain instead of
+	// the public one. Records then point at the instance's private IP.
+	PrivateZone bool `json:"private_zone,omitempty" toml:"private_zone,omitempty"`
+
+	// Output fields. ZoneID may also be configured; ZoneLookedUp marks one
+	// that create looked up, which delete clears again.
+	ZoneID       string      `json:"zone_id,omitempty" toml:"zone_id,omitempty"`
+	ZoneLookedUp bool        `json:"zone_looked_up,omitempty" toml:"zone_looked_up,omitempty"`
+	FQDN         string      `json:"fqdn,omitempty" toml:"fqdn,omitempty"`
+	DNSRecords   []DNSRecord `json:"dns_records,omitempty" toml:"dns_records,omitempty"`
+}
+
+// Legacy flat configuration structure (kept for backward compatibility)
+type StackConfig struct {
+	// Input fields (user provides)
+	GitHubUsername string   `json:"github_username,omitempty"`
+	Users          []User   `json:"users,omitempty"`
+	InstanceType   string   `json:"instance_type,omitempty"`
+	OS             string   `json:"os,omitempty"`
+	CloudInitFile  string   `json:"cloud_init_file,omitempty"`
+	WorkingDir     string   `json:"working_dir,omitempty"`
+	Packages       []string `json:"packages,omitempty"`
+	Hostname       string   `json:"hostname,omitempty"`
+	Domain         string   `json:"domain,omitempty"`
+	TTL            *int     `json:"ttl,omitempty"`
+	IsApexDomain   bool     `json:"is_apex_domain,omitempty"`
+	CNAMEAliases   []string `json:"cname_aliases,omitempty"`
+	VpcID          string   `json:"vpc_id,omitempty"`
+	SubnetID       string   `json:"subnet_id,omitempty"`
+	AWSProfile     string   `json:"aws_profile,omitempty"`
+
+	// Output fields (program fills in)
+	StackName     string      `json:"stack_name,omitempty"`
+	StackID       string      `json:"stack_id,omitempty"`
+	Region        string      `json:"region,omitempty"`
+	AMIID         string      `json:"ami_id,omitempty"`
+	InstanceID    string      `json:"instance_id,omitempty"`
+	PublicIP      string      `json:"public_ip,omitempty"`
+	PublicDNSName string      `json:"public_dns_name,omitempty"`
+	SecurityGroup string      `json:"security_group,omitempty"`
+	ZoneID        string      `json:"zone_id,omitempty"`
+	FQDN          string      `json:"fqdn,omitempty"`
+	SSHCommand    string      `json:"ssh_command,omitempty"`
+	DNSRecords    []DNSRecord `json:"dns_records,omitempty"`
+
+	// Network resources created by this tool (for cleanup)
+	CreatedVPC            bool   `json:"created_vpc,omitempty"`
+	CreatedSubnet         bool   `json:"created_subnet,omitempty"`
+	InternetGatewayID     string `json:"internet_gateway_id,omitempty"`
+	RouteTableID          string `json:"route_table_id,omitempty"`
+	RouteTableAssociation string `json:"route_table_association_id,omitempty"`
+}
+
+// ConfigError marks an error caused by invalid input rather than AWS
+type ConfigError struct {
+	err error
+}
+
+func (e *ConfigError) Error() string { return e.err.Error() }
+
+func (e *ConfigError) Unwrap() error { return e.err }
+
+func configErrorf(format string, args ...any) error {
+	return &ConfigError{fmt.Errorf(format, args...)}
+}
+
+// isTOMLFile reports whether a config file is TOML rather than JSON
+func isTOMLFile(filename string) bool {
+	return strings.HasSuffix(filename, ".toml")
+}
+
+func resolveConfigPath(stackName string) string {
+	// First, check if ./stacks/<stackName>.json (or .toml) exists
+	for _, ext := range []string{".json", ".toml"} {
+		stacksPath := fmt.Sprintf("stacks/%s%s", stackName, ext)
+		if _, err := os.Stat(stacksPath); err == nil {
+			return stacksPath
+		}
+	}
+
+	// Otherwise, treat stackName as a path (with or without .json/.toml)
+	if strings.HasSuffix(stackName, ".json") || isTOMLFile(stackName) {
+		return stackName
+	}
+	if _, err := os.Stat(stackName + ".toml"); err == nil {
+		return stackName + ".toml"
+	}
+	return fmt.Sprintf("%s.json", stackName)
+}
+
+// ReadConfig loads the config for a stack from stacks/<name>.json or from
+// name treated as a path, and returns it with the file it was read from.
+// Legacy flat configs are converted to the nested format.
+func ReadConfig(stackName string) (*Config, string, error) {
+	filename := resolveConfigPath(stackName)
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, filename, configErrorf("failed to read config file %s: %w", filename, err)
+	}
+
+	if isTOMLFile(filename) {
+		if data, err = tomlToJSON(data); err != nil {
+			return nil, filename, configErrorf("failed to parse config file %s: %w", filename, err)
+		}
+	}
+	config, err := ParseConfig(data)
+	if err != nil {
+		return nil, filename, fmt.Errorf("%s: %w", filename, err)
+	}
+	config.Source = filename
+	return config, filename, nil
+}
+
+// ParseConfig parses a config that did not come from a file, such as one
+// piped on stdin, and applies the shared defaults files and built-in
+// defaults. Legacy flat configs are converted to the nested format.
+// Source is left empty.
+func ParseConfig(data []byte) (*Config, error) {
+	data, err := applySharedDefaults(data)
+	if err != nil {
+		return nil, err
+	}
+	data, refs, err := expandConfigEnv(data)
+	if err != nil {
+		return nil, err
+	}
+
+	// Try nested format first
+	var config Config
+	if err := json.Unmarshal(data, &config); err == nil {
+		if config.VM != nil || config.DNS != nil {
+			// Apply defaults
+			applyConfigDefaults(&config)
+			config.envRefs = refs
+			return &config, nil
+		}
+	} else {
+		// A document with a vm or dns section is nested, so its error is
+		// the one to report rather than the flat format's
+		var sections map[string]json.RawMessage
+		if json.Unmarshal(data, &sections) == nil && (sections["vm"] != nil || sections["dns"] != nil) {
+			return nil, configErrorf("failed to parse config: %w", err)
+		}
+	}
+
+	// Fall back to flat format for backward compatibility
+	var flatConfig StackConfig
+	if err := json.Unmarshal(data, &flatConfig); err != nil {
+		return nil, configErrorf("failed to parse config: %w", err)
+	}
+
+	infof(context.Background(), "Note: Using legacy flat config format (still supported)")
+	config = *convertFlatToNested(&flatConfig)
+	applyConfigDefaults(&config)
+	config.envRefs = flatEnvRefs(refs, &flatConfig)
+	return &config, nil
+}
+
+// MarshalConfig renders the config as it is used, with defaults applied
+// and environment references expanded, as indented JSON or as TOML
+func MarshalConfig(config *Config, toml bool) ([]byte, error) {
+	if toml {
+		data, err := marshalTOML(config)
+		if err != nil {
+			return nil, fmt.Errorf("failed to marshal config as TOML: %w", err)
+		}
+		return data, nil
+	}
+	data, err := json.MarshalIndent(config, "", "  ")
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal config: %w", err)
+	}
+	return data, nil
+}
+
+// WriteConfig writes the config back to filename as indented JSON, or as
+// TOML when filename ends in .toml
+func WriteConfig(filename string, config *Config) error {
+	data, err := json.MarshalIndent(config, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal config: %w", err)
+	}
+	if len(config.envRefs) > 0 {
+		if data, err = restoreEnvRefs(data, config.envRefs); err != nil {
+			return fmt.Errorf("failed to marshal config: %w", err)
+		}
+	}
+	if isTOMLFile(filename) {
+		// The references are only put back in the JSON, so the TOML is
+		// written from a config decoded from it
+		var written Config
+		if err := json.Unmarshal(data, &written); err != nil {
+			return fmt.Errorf("failed to marshal config as TOML: %w", err)
+		}
+		if data, err = marshalTOML(&written); err != nil {
+			return fmt.Errorf("failed to marshal config as TOML: %w", err)
+		}
+	}
+	return os.WriteFile(filename, data, 0644)
+}
+
+// stackNamePattern matches the names CloudFormation accepts for a stack
+var stackNamePattern = regexp.MustCompile(`^[A-Za-z][A-Za-z0-9-]{0,127}$`)
+
+// awsProfilePattern matches a shared config profile name, which is the
+// text of an ini section header
+var awsProfilePattern = regexp.MustCompile(`^[^\s\[\]]{1,128}$`)
+
+// defaultSSHPort is where sshd listens unless ssh_port moves it
+const defaultSSHPort = 22
+
+// SSHPortNumber returns the port sshd listens on
+func (vm *VMConfig) SSHPortNumber() int {
+	if vm.SSHPort == 0 {
+		return defaultSSHPort
+	}
+	return vm.SSHPort
+}
+
+// ProxyJump returns the ssh -J / ProxyJump value for the bastion, or ""
+// without one
+func (vm *VMConfig) ProxyJump() string {
+	if vm.BastionHost == "" || vm.BastionUser == "" {
+		return vm.BastionHost
+	}
+	return vm.BastionUser + "@" + vm.BastionHost
+}
+
+// UnmarshalJSON accepts instance_type as a string or a list of strings,
+// joining a list with commas
+func (vm *VMConfig) UnmarshalJSON(data []byte) error {
+	type plain VMConfig
+	aux := struct {
+		*plain
+		InstanceType json.RawMessage `json:"instance_type,omitempty"`
+	}{plain: (*plain)(vm)}
+	if err := json.Unmarshal(data, &aux); err != nil {
+		// The wrapper type would otherwise leave the field unnamed
+		var typeErr *json.UnmarshalTypeError
+		if errors.As(err, &typeErr) && typeErr.Field != "" {
+			return fmt.Errorf("vm.%s must be of type %s, got %s", typeErr.Field, typeErr.Type, typeErr.Value)
+		}
+		return err
+	}
+	instanceTypes, err := stringOrList(aux.InstanceType)
+	if err != nil {
+		return fmt.Errorf("instance_type must be a string or a list of strings")
+	}
+	vm.InstanceType = strings.Join(instanceTypes, ",")
+	return nil
+}
+
+// InstanceTypes returns the types InstanceType lists, in the order they are
+// tried
+func (vm *VMConfig) InstanceTypes() []string {
+	if vm.InstanceType == "" {
+		return nil
+	}
+	instanceTypes := strings.Split(vm.InstanceType, ",")
+	for i, instanceType := range instanceTypes {
+		instanceTypes[i] = strings.TrimSpace(instanceType)
+	}
+	return instanceTypes
+}
+
+// EffectiveInstanceType returns the type the stack runs, or is to run: the
+// one a fallback list launched, else the first listed
+func (vm *VMConfig) EffectiveInstanceType() string {
+	if vm.LaunchedInstanceType != "" {
+		return vm.LaunchedInstanceType
+	}
+	if instanceTypes := vm.InstanceTypes(); len(instanceTypes) > 0 {
+		return instanceTypes[0]
+	}
+	return ""
+}
+
+// CloneConfig copies the config of stack src to stacks/<dst>.json (or
+// .toml, like the source) with the fields create fills in cleared, ready
+// to create a second stack from. An existing config for dst is only
+// replaced with overwrite. It returns the file written.
+func CloneConfig(src, dst string, overwrite bool) (string, error) {
+	if !stackNamePattern.MatchString(dst) {
+		return "", configErrorf("invalid stack name %q (letters, digits and hyphens, starting with a letter)", dst)
+	}
+	config, srcFile, err := ReadConfig(src)
+	if err != nil {
+		return "", err
+	}
+
+	ext := ".json"
+	if isTOMLFile(srcFile) {
+		ext = ".toml"
+	}
+	dstFile := fmt.Sprintf("stacks/%s%s", dst, ext)
+	if filepath.Clean(dstFile) == filepath.Clean(srcFile) {
+		return "", configErrorf("cannot clone %s onto itself", srcFile)
+	}
+	if !overwrite {
+		for _, existing := range []string{".json", ".toml"} {
+			path := fmt.Sprintf("stacks/%s%s", dst, existing)
+			if _, err := os.Stat(path); err == nil {
+				return "", configErrorf("%s already exists; use -force to overwrite it", path)
+			}
+		}
+	}
+
+	if config.VM != nil {
+		clearVMOutputs(config.VM)
+	}
+	if config.DNS != nil {
+		clearDNSOutputs(config.DNS)
+	}
+	if err := os.MkdirAll("stacks", 0755); err != nil {
+		return "", err
+	}
+	if err := WriteConfig(dstFile, config); err != nil {
+		return "", err
+	}
+	return dstFile, nil
+}
+
+func convertFlatToNested(flat *StackConfig) *Config {
+	config := &Config{AWSProfile: flat.AWSProfile}
+
+	// Determine if we have VM configuration
+	hasVM := len(flat.Users) > 0 || flat.GitHubUsername != "" || flat.InstanceType != ""
+
+	// Create VM section if we have VM-related fields
+	if hasVM {
+		config.VM = &VMConfig{
+			Region:                flat.Region,
+			OS:                    flat.OS,
+			InstanceType:          flat.InstanceType,
+			CloudInitFile:         flat.CloudInitFile,
+			WorkingDir:            flat.WorkingDir,
+			Packages:              flat.Packages,
+			Users:                 flat.Users,
+			VpcID:                 flat.VpcID,
+			SubnetID:              flat.SubnetID,
+			StackName:             flat.StackName,
+			StackID:               flat.StackID,
+			InstanceID:            flat.InstanceID,
+			PublicIP:              flat.PublicIP,
+			PublicDNSName:         flat.PublicDNSName,
+			SecurityGroup:         flat.SecurityGroup,
+			AMIID:                 flat.AMIID,
+			CreatedVPC:            flat.CreatedVPC,
+			CreatedSubnet:         flat.CreatedSubnet,
+			InternetGatewayID:     flat.InternetGatewayID,
+			RouteTableID:          flat.RouteTableID,
+			RouteTableAssociation: flat.RouteTableAssociation,
+		}
+
+		// Handle legacy github_username field
+		if flat.GitHubUsername != "" && len(flat.Users) == 0 {
+			config.VM.Users = []User{{Username: flat.GitHubUsername, GitHubUsername: flat.GitHubUsername}}
+		}
+	}
+
+	// Create DNS section if we have DNS-related fields
+	if flat.Domain != "" {
+		config.DNS = &DNSConfig{
+			Hostname:     flat.Hostname,
+			Domain:       flat.Domain,
+			TTL:          flat.TTL,
+			IsApexDomain: flat.IsApexDomain,
+			CNAMEAliases: flat.CNAMEAliases,
+			TargetIP:     flat.PublicIP, // Use PublicIP from VM if present
+			ZoneID:       flat.ZoneID,
+			FQDN:         flat.FQDN,
+			DNSRecords:   flat.DNSRecords,
+		}
+	}
+
+	return config
+}
+
+// flatDNSKeys are the keys of a legacy flat config that convertFlatToNested
+// moves to the dns section; the rest but aws_profile go to the vm section
+var flatDNSKeys = map[string]bool{
+	"hostname":       true,
+	"domain":         true,
+	"ttl":            true,
+	"is_apex_domain": true,
+	"cname_aliases":  true,
+	"zone_id":        true,
+	"fqdn":           true,
+	"dns_records":    true,
+}
+
+// flatEnvRefs moves the environment references of a legacy flat config to
+// the paths convertFlatToNested gives their values, so WriteConfig, which
+// writes the nested format, still puts them back
+func flatEnvRefs(refs map[string]envRef, flat *StackConfig) map[string]envRef {
+	if len(refs) == 0 {
+		return nil
+	}
+	nested := make(map[string]envRef, len(refs))
+	for path, ref := range refs {
+		key, _, _ := strings.Cut(strings.TrimPrefix(path, "/"), "/")
+		switch {
+		case key == "aws_profile":
+			nested[path] = ref
+		case key == "github_username":
+			if len(flat.Users) == 0 {
+				nested["/vm/users/0/username"] = ref
+				nested["/vm/users/0/github_username"] = ref
+			}
+		case key == "public_ip":
+			nested["/vm"+path] = ref
+			nested["/dns/target_ip"] = ref
+		case flatDNSKeys[key]:
+			nested["/dns"+path] = ref
+		default:
+			nested["/vm"+path] = ref
+		}
+	}
+	return nested
+}
+
+func applyConfigDefaults(config *Config) {
+	if config.VM != nil {
+		if config.VM.Region == "" {
+			config.VM.Region = "us-east-1"
+		}
+		// A launch template supplies the image and instance type
+		// unless they are set explicitly
+		hasTemplate := config.VM.LaunchTemplateID != ""
+		if config.VM.OS == "" && !hasTemplate {
+			if osName, ok := osFamilyDefaults[config.VM.OSFamily]; ok {
+				config.VM.OS = osName
+			} else {
+				config.VM.OS = "ubuntu-22.04"
+			}
+		}
+		if config.VM.OSFamily == "" {
+			config.VM.OSFamily = osFamilyOf(config.VM.OS)
+		}
+		if config.VM.InstanceType == "" && !hasTemplate {
+			config.VM.InstanceType = "t3.micro"
+		}
+	}
+
+	if config.DNS != nil {
+		if config.DNS.TTL == nil {
+			ttl := defaultTTL
+			config.DNS.TTL = &ttl
+		}
+		if hc := config.DNS.HealthCheck; hc != nil {
+			if hc.Protocol == "" {
+				hc.Protocol = "HTTP"
+			}
+			hc.Protocol = strings.ToUpper(hc.Protocol)
+			if hc.Port == 0 {
+				hc.Port = 80
+				if hc.Protocol == "HTTPS" {
+					hc.Port = 443
+				}
+			}
+			if hc.Path == "" && hc.Protocol != "TCP" {
+				hc.Path = "/"
+			}
+			if hc.FailureThreshold == 0 {
+				hc.FailureThreshold = 3
+			}
+		}
+	}
+}
+
+// instanceTypePattern matches instance type names such as t3.micro or
+// c7i-flex.large
+var instanceTypePattern = regexp.MustCompile(`^[a-z][a-z0-9-]*\.[a-z0-9]+$`)
+
+// availabilityZonePattern matches zone names such as us-east-1a or the
+// Local Zone us-west-2-lax-1a
+var availabilityZonePattern = regexp.MustCompile(`^[a-z]{2}(-[a-z0-9]+)+[a-z]$`)
+
+// regionPattern matches region names such as us-east-1 or us-gov-west-1
+var regionPattern = regexp.MustCompile(`^[a-z]{2}(-[a-z]+)+-[0-9]+$`)
+
+// txtNamePattern matches a txt_records name: dot-separated labels, which
+// may start with an underscore as in _acme-challenge.dev
+var txtNamePattern = regexp.MustCompile(`^_?[a-zA-Z0-9]([a-zA-Z0-9-]*[a-zA-Z0-9])?(\._?[a-zA-Z0-9]([a-zA-Z0-9-]*[a-zA-Z0-9])?)*$`)
+
+// maxTXTValueLength leaves room within Route53's 4000 character limit for
+// the quotes around each 255 character string
+const maxTXTValueLength = 3900
+
+// elasticIPAllocationIDPattern matches an Elastic IP allocation ID
+var elasticIPAllocationIDPattern = regexp.MustCompile(`^eipalloc-[0-9a-f]{8,17}$`)
+
+// bastionHostPattern matches a bastion_host: a host name or IPv4 address
+// with an optional port
+var bastionHostPattern = regexp.MustCompile(`^[A-Za-z0-9]([A-Za-z0-9.-]*[A-Za-z0-9])?(:[0-9]{1,5})?$`)
+
+// bastionUserPattern matches a bastion_user login name
+var bastionUserPattern = regexp.MustCompile(`^[A-Za-z0-9_][A-Za-z0-9._-]*$`)
+
+// securityGroupIDPattern matches an EC2 security group ID
+var securityGroupIDPattern = regexp.MustCompile(`^sg-[0-9a-f]{8,17}$`)
+
+// maxAdditionalSecurityGroups leaves room for the stack's own group within
+// the 16 groups an interface can have at most
+const maxAdditionalSecurityGroups = 15
+
+// s3BucketPattern matches S3 bucket names
+var s3BucketPattern = regexp.MustCompile(`^[a-z0-9][a-z0-9.-]{1,61}[a-z0-9]$`)
+
+// roleARNPattern matches an IAM role ARN, with an optional path
+var roleARNPattern = regexp.MustCompile(`^arn:aws(-[a-z]+)*:iam::[0-9]{12}:role/([\w+=,.@-]+/)*[\w+=,.@-]{1,64}$`)
+
+// IsRoleARN reports whether arn looks like an IAM role ARN
+func IsRoleARN(arn string) bool {
+	return roleARNPattern.MatchString(arn)
+}
+
+// instanceProfileNamePattern matches IAM instance profile names
+var instanceProfileNamePattern = regexp.MustCompile(`^[\w+=,.@-]{1,128}$`)
+
+// maxSecondaryPrivateIPs is the most any instance type allows on one
+// network interface besides the primary IP; the type's own limit is
+// checked at create
+const maxSecondaryPrivateIPs = 49
+
+// timezonePattern matches IANA time zone names such as America/New_York,
+// Etc/GMT+5 and UTC
+var timezonePattern = regexp.MustCompile(`^[A-Za-z][A-Za-z0-9_+-]*(/[A-Za-z0-9_+-]+){0,2}$`)
+
+// localePattern matches locale names such as en_US.UTF-8, de_DE, C.UTF-8
+// and sr_RS@latin
+var localePattern = regexp.MustCompile(`^([a-z]{2,3}(_[A-Z]{2})?|C|POSIX)(\.[A-Za-z0-9-]+)?(@[a-z]+)?$`)
+
+// hostnamePattern matches a single DNS label of a hostname
+var hostnamePattern = regexp.MustCompile(`^[a-zA-Z0-9]([a-zA-Z0-9-]{0,61}[a-zA-Z0-9])?$`)
+
+// placementGroupPattern matches the placement group names this tool
+// accepts; EC2 allows up to 255 characters
+var placementGroupPattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]{0,254}$`)
+
+// githubUsernamePattern matches a GitHub login: letters and digits, with
+// single hyphens between them
+var githubUsernamePattern = regexp.MustCompile(`^[A-Za-z0-9]+(-[A-Za-z0-9]+)*$`)
+
+// maxGitHubUsernameLength is the longest login GitHub allows
+const maxGitHubUsernameLength = 39
+
+// ValidateConfig checks the config for mistakes before any AWS call is made
+// and reports every problem found, not just the first. It also normalizes a
+// few values (such as zone_id) in place.
+func ValidateConfig(cfg *Config) error {
+	if cfg.VM == nil && cfg.DNS == nil {
+		return configErrorf("config must have at least one of 'vm' or 'dns' sections")
+	}
+
+	var problems []string
+	add := func(format string, args ...any) {
+		problems = append(problems, fmt.Sprintf(format, args...))
+	}
+
+	if cfg.AWSProfile != "" && !awsProfilePattern.MatchString(cfg.AWSProfile) {
+		add("invalid aws_profile %q: a profile name has no spaces or brackets", cfg.AWSProfile)
+	}
+
+	// Validate VM users if VM section exists
+	if cfg.VM != nil {
+		if len(cfg.VM.Users) == 0 {
+			add("VM section requires at least one user in 'users' array")
+		}
+		// Validate each user
+		seen := make(map[string]bool)
+		for i, user := range cfg.VM.Users {
+			if user.GitHubUsername == "" {
+				add("vm.users[%d]: github_username cannot be empty", i)
+			} else if len(user.GitHubUsername) > maxGitHubUsernameLength || !githubUsernamePattern.MatchString(user.GitHubUsername) {
+				// The name is also written into the setup script, which runs as root
+				add("vm.users[%d]: invalid github_username %q (letters, digits and single hyphens, at most %d characters)", i, user.GitHubUsername, maxGitHubUsernameLength)
+			}
+			if user.Username == "" {
+				add("vm.users[%d]: username cannot be empty", i)
+				continue
+			}
+			if seen[user.Username] {
+				add("duplicate username: %s", user.Username)
+			}
+			seen[user.Username] = true
+			if !isValidLinuxUsername(user.Username) {
+				add("invalid username format: %s (must be lowercase alphanumeric, start with letter)", user.Username)
+			}
+		}
+		if cfg.VM.Hostname != "" && !isValidHostname(cfg.VM.Hostname) {
+			add("invalid vm.hostname %q (letters, digits, hyphens and dots only)", cfg.VM.Hostname)
+		}
+		listed := make(map[string]bool)
+		for _, instanceType := range cfg.VM.InstanceTypes() {
+			if !instanceTypePattern.MatchString(instanceType) {
+				add("invalid instance_type %q (expected <family>.<size>, e.g. t3.micro)", instanceType)
+			} else if listed[instanceType] {
+				add("instance_type lists %s more than once", instanceType)
+			}
+			listed[instanceType] = true
+		}
+		if _, ok := osFamilyDefaults[cfg.VM.OSFamily]; !ok && cfg.VM.OSFamily != "" {
+			add("unsupported os_family %q (supported: al2023, ubuntu, debian)", cfg.VM.OSFamily)
+		}
+		if family := osFamilyOf(cfg.VM.OS); family != "" && family != cfg.VM.OSFamily {
+			add("os %q does not belong to os_family %q", cfg.VM.OS, cfg.VM.OSFamily)
+		}
+		if err := validateSecurityGroupDescription(cfg.VM.SecurityGroupDescription); err != nil {
+			add("%v", err)
+		}
+		if err := validateNameTag(cfg.VM.NameTag); err != nil {
+			add("%v", err)
+		}
+		if cfg.VM.BastionHost != "" && !bastionHostPattern.MatchString(cfg.VM.BastionHost) {
+			add("invalid bastion_host %q (expected host or host:port)", cfg.VM.BastionHost)
+		}
+		if cfg.VM.BastionUser != "" {
+			if cfg.VM.BastionHost == "" {
+				add("bastion_user requires bastion_host")
+			} else if !bastionUserPattern.MatchString(cfg.VM.BastionUser) {
+				add("invalid bastion_user %q", cfg.VM.BastionUser)
+			}
+		}
+		if n := len(cfg.VM.AdditionalSecurityGroupIDs); n > maxAdditionalSecurityGroups {
+			add("additional_security_group_ids lists %d groups, maximum is %d", n, maxAdditionalSecurityGroups)
+		}
+		for i, id := range cfg.VM.AdditionalSecurityGroupIDs {
+			if !securityGroupIDPattern.MatchString(id) {
+				add("invalid additional_security_group_ids entry %q (expected sg-<hex>)", id)
+			} else if slices.Contains(cfg.VM.AdditionalSecurityGroupIDs[:i], id) {
+				add("additional_security_group_ids lists %s twice", id)
+			}
+		}
+		if err := validateRootVolume(cfg.VM); err != nil {
+			add("%v", err)
+		}
+		if err := validateKMSKey(cfg.VM); err != nil {
+			add("%v", err)
+		}
+		if err := validatePackages(cfg.VM.Packages); err != nil {
+			add("%v", err)
+		}
+		if tz := cfg.VM.Timezone; tz != "" && !timezonePattern.MatchString(tz) {
+			add("invalid timezone %q (expected an IANA name such as Europe/Berlin or UTC)", tz)
+		}
+		if slices.Contains(strings.Split(cfg.VM.MOTD, "\n"), motdDelimiter) {
+			add("motd cannot contain a line that is just %s", motdDelimiter)
+		}
+		if locale := cfg.VM.Locale; locale != "" && !localePattern.MatchString(locale) {
+			add("invalid locale %q (expected a name such as en_US.UTF-8 or C.UTF-8)", locale)
+		}
+		if cfg.VM.SwapSizeGB < 0 || cfg.VM.SwapSizeGB > maxSwapSizeGB {
+			add("swap_size_gb must be 0 (off) to %d, got %d", maxSwapSizeGB, cfg.VM.SwapSizeGB)
+		}
+		if cfg.VM.SSHPort < 0 || cfg.VM.SSHPort > 65535 {
+			add("ssh_port must be between 1 and 65535, got %d", cfg.VM.SSHPort)
+		}
+		if _, err := ingressRules(cfg.VM); err != nil {
+			add("invalid ports: %v", err)
+		}
+		if _, err := parseRuleSpecs(cfg.VM.EgressRules, "0.0.0.0/0"); err != nil {
+			add("invalid egress_rules: %v", err)
+		}
+		if cfg.VM.WaitForCloudInit && !cfg.VM.EnableSSM {
+			add("wait_for_cloud_init requires enable_ssm: the instance needs an SSM instance profile")
+		}
+		if cfg.VM.PostCreateCommand != "" && !cfg.VM.EnableSSM {
+			add("post_create_command requires enable_ssm: the instance needs an SSM instance profile")
+		}
+		if bucket := cfg.VM.UserDataBucket; bucket != "" && !s3BucketPattern.MatchString(bucket) {
+			add("invalid user_data_bucket %q (3-63 lowercase letters, digits, dots and hyphens)", bucket)
+		}
+		if cfg.VM.InlinePolicy != "" {
+			if !cfg.VM.EnableSSM || cfg.VM.InstanceProfileName != "" {
+				add("inline_policy requires enable_ssm without instance_profile_name: it is added to the role the stack creates")
+			}
+			if _, err := compactPolicy(cfg.VM.InlinePolicy); err != nil {
+				add("%v", err)
+			}
+		}
+		if cfg.VM.StackPolicy != "" {
+			if _, err := stackPolicyBody(cfg.VM); err != nil {
+				add("stack_policy: %v", err)
+			}
+		}
+		if arn := cfg.VM.CloudFormationRoleARN; arn != "" && !IsRoleARN(arn) {
+			add("invalid cloudformation_role_arn %q (expected arn:aws:iam::<account>:role/<name>)", arn)
+		}
+		if name := cfg.VM.InstanceProfileName; name != "" && !instanceProfileNamePattern.MatchString(name) {
+			add("invalid instance_profile_name %q (up to 128 letters, digits and +=,.@_-)", name)
+		}
+		if cfg.VM.LaunchTemplateID != "" && !launchTemplateIDPattern.MatchString(cfg.VM.LaunchTemplateID) {
+			add("invalid launch_template_id %q (expected lt-<hex>)", cfg.VM.LaunchTemplateID)
+		}
+		if cfg.VM.LaunchTemplateVersion != "" {
+			if cfg.VM.LaunchTemplateID == "" {
+				add("launch_template_version requires launch_template_id")
+			} else if !launchTemplateVersionPattern.MatchString(cfg.VM.LaunchTemplateVersion) {
+				add("invalid launch_template_version %q (expected a number, $Latest or $Default)", cfg.VM.LaunchTemplateVersion)
+			}
+		}
+		if az := cfg.VM.AvailabilityZone; az != "" {
+			if !availabilityZonePattern.MatchString(az) || !strings.HasPrefix(az, cfg.VM.Region) {
+				add("invalid availability_zone %q (expected a zone in %s, e.g. %sa)", az, cfg.VM.Region, cfg.VM.Region)
+			}
+		}
+		if cfg.VM.PlacementGroup != "" && cfg.VM.PlacementStrategy != "" {
+			add("placement_group and placement_strategy cannot both be set")
+		}
+		// The name is written into the template as a quoted YAML string
+		if group := cfg.VM.PlacementGroup; group != "" && !placementGroupPattern.MatchString(group) {
+			add("invalid placement_group %q (letters, digits, dots, hyphens and underscores, at most 255 characters)", group)
+		}
+		switch cfg.VM.PlacementStrategy {
+		case "", "cluster", "spread", "partition":
+		default:
+			add("unsupported placement_strategy %q (supported: cluster, spread, partition)", cfg.VM.PlacementStrategy)
+		}
+		if cfg.VM.PlacementStrategy != "" && cfg.VM.Count > 1 {
+			// Each member stack would create a group of its own
+			add("count cannot be used with placement_strategy; create the group and set placement_group")
+		}
+		switch cfg.VM.ShutdownBehavior {
+		case "", "stop", "terminate":
+		default:
+			add("unsupported shutdown_behavior %q (supported: stop, terminate)", cfg.VM.ShutdownBehavior)
+		}
+		if id := cfg.VM.ElasticIPAllocationID; id != "" {
+			if !elasticIPAllocationIDPattern.MatchString(id) {
+				add("invalid elastic_ip_allocation_id %q (expected eipalloc-<hex>)", id)
+			}
+			if cfg.VM.NoPublicIP {
+				add("elastic_ip_allocation_id cannot be used with no_public_ip")
+			}
+			if cfg.VM.Count > 1 {
+				add("elastic_ip_allocation_id cannot be used with count: an Elastic IP belongs to one instance")
+			}
+			if cfg.VM.TemplateFile != "" {
+				add("elastic_ip_allocation_id cannot be used with template_file")
+			}
+		}
+		if cfg.VM.NoPublicIP && cfg.DNS != nil && cfg.DNS.HealthCheck != nil {
+			add("health_check cannot be used with no_public_ip: Route53 health checkers cannot reach private IPs")
+		}
+		if cfg.VM.CloudInitFile != "" {
+			// Render it now so a missing file or template error stops the
+			// create before anything is launched
+			if _, err := processCloudInitTemplate(resolveCloudInitPath(cfg.VM.CloudInitFile), cloudInitTemplateData(cfg.VM, cfg.DNS)); err != nil {
+				add("cloud_init_file: %v", err)
+			}
+		}
+		if cfg.VM.TemplateFile != "" {
+			if _, err := readTemplateFile(cfg.VM); err != nil {
+				add("template_file: %v", err)
+			}
+			if cfg.VM.LaunchTemplateID != "" {
+				add("template_file cannot be used with launch_template_id")
+			}
+		}
+		if cfg.VM.SecondaryPrivateIPs < 0 || cfg.VM.SecondaryPrivateIPs > maxSecondaryPrivateIPs {
+			add("secondary_private_ips must be between 0 and %d, got %d", maxSecondaryPrivateIPs, cfg.VM.SecondaryPrivateIPs)
+		}
+		if cfg.VM.Count < 0 {
+			add("count must not be negative, got %d", cfg.VM.Count)
+		}
+		for i, region := range cfg.VM.Regions {
+			if !regionPattern.MatchString(region) {
+				add("invalid regions entry %q (expected a region such as us-east-1)", region)
+			} else if slices.Contains(cfg.VM.Regions[:i], region) {
+				add("regions lists %s twice", region)
+			}
+		}
+		if len(cfg.VM.Regions) > 0 {
+			// These name resources that exist in one region only
+			if cfg.VM.Count > 1 {
+				add("regions cannot be used with count")
+			}
+			for _, field := range []struct {
+				name string
+				set  bool
+			}{
+				{"vpc_id", cfg.VM.VpcID != ""},
+				{"subnet_id", cfg.VM.SubnetID != ""},
+				{"availability_zone", cfg.VM.AvailabilityZone != ""},
+				{"launch_template_id", cfg.VM.LaunchTemplateID != ""},
+				{"elastic_ip_allocation_id", cfg.VM.ElasticIPAllocationID != ""},
+				{"additional_security_group_ids", len(cfg.VM.AdditionalSecurityGroupIDs) > 0},
+				{"placement_group", cfg.VM.PlacementGroup != ""},
+				{"kms_key_id", cfg.VM.KMSKeyID != ""},
+				{"user_data_bucket", cfg.VM.UserDataBucket != ""},
+			} {
+				if field.set {
+					add("regions cannot be used with %s, which belongs to one region", field.name)
+				}
+			}
+		}
+		if multi := memberKind(cfg.VM); multi != "" && cfg.DNS != nil {
+			// Every member would claim the same names
+			if cfg.DNS.IsApexDomain {
+				add("%s cannot be used with is_apex_domain", multi)
+			}
+			if len(cfg.DNS.CNAMEAliases) > 0 || len(cfg.DNS.Aliases) > 0 {
+				add("%s cannot be used with cname_aliases or aliases", multi)
+			}
+			if cfg.DNS.TargetIP != "" {
+				add("%s cannot be used with target_ip", multi)
+			}
+			if len(cfg.DNS.TXTRecords) > 0 {
+				add("%s cannot be used with txt_records", multi)
+			}
+		}
+	}
+
+	// Validate DNS config if DNS section exists
+	if cfg.DNS != nil {
+		if cfg.DNS.Hostname != "" && cfg.DNS.Domain == "" {
+			add("hostname requires domain to be specified")
+		}
+		// The domain is also written into the setup script, which runs as root
+		if cfg.DNS.Domain != "" && !isValidHostname(strings.TrimSuffix(cfg.DNS.Domain, ".")) {
+			add("invalid domain %q (letters, digits, hyphens and dots only)", cfg.DNS.Domain)
+		}
+		if len(cfg.DNS.CNAMEAliases) > 0 {
+			if cfg.DNS.Hostname == "" || cfg.DNS.Domain == "" {
+				add("cname_aliases requires both hostname and domain")
+			}
+			seen := make(map[string]bool)
+			for _, alias := range cfg.DNS.CNAMEAliases {
+				if alias == "" {
+					add("cname_aliases cannot contain empty strings")
+					continue
+				}
+				if alias == cfg.DNS.Hostname {
+					add("cname_aliases cannot duplicate primary hostname: %s", alias)
+				}
+				if seen[alias] {
+					add("duplicate cname_alias: %s", alias)
+				}
+				seen[alias] = true
+			}
+		}
+		if cfg.DNS.IsApexDomain && cfg.DNS.Domain == "" {
+			add("is_apex_domain requires domain to be specified")
+		}
+		if cfg.DNS.PrivateZone && cfg.DNS.HealthCheck != nil {
+			add("health_check cannot be used with private_zone: Route53 health checkers cannot reach private IPs")
+		}
+		if hc := cfg.DNS.HealthCheck; hc != nil {
+			switch hc.Protocol {
+			case "HTTP", "HTTPS", "TCP":
+			default:
+				add("health_check.protocol must be HTTP, HTTPS or TCP, got %q", hc.Protocol)
+			}
+			if hc.Port < 1 || hc.Port > 65535 {
+				add("health_check.port must be between 1 and 65535, got %d", hc.Port)
+			}
+			if hc.Protocol != "TCP" && !strings.HasPrefix(hc.Path, "/") {
+				add("health_check.path must start with /, got %q", hc.Path)
+			}
+			if hc.FailureThreshold < 1 || hc.FailureThreshold > 10 {
+				add("health_check.failure_threshold must be between 1 and 10, got %d", hc.FailureThreshold)
+			}
+		}
+		if cfg.DNS.RoutingPolicy != nil {
+			if err := validateRoutingPolicy(cfg); err != nil {
+				add("%v", err)
+			}
+		}
+		if ttl := cfg.DNS.TTL; ttl != nil && (*ttl < 1 || *ttl > maxTTL) {
+			add("invalid ttl %d: must be between 1 and %d seconds", *ttl, maxTTL)
+		}
+		if cfg.DNS.ZoneID != "" {
+			cfg.DNS.ZoneID = strings.TrimPrefix(cfg.DNS.ZoneID, "/hostedzone/")
+			if !isValidZoneID(cfg.DNS.ZoneID) {
+				add("invalid zone_id %q (expected a Route53 hosted zone ID starting with Z)", cfg.DNS.ZoneID)
+			}
+		}
+		if len(cfg.DNS.TXTRecords) > 0 && cfg.DNS.Domain == "" {
+			add("txt_records requires domain to be specified")
+		}
+		for name, value := range cfg.DNS.TXTRecords {
+			if name != "@" && !txtNamePattern.MatchString(name) {
+				add("invalid txt_records name %q (a name relative to the domain, or @)", name)
+			}
+			if value == "" {
+				add("txt_records.%s: value cannot be empty", name)
+			} else if len(value) > maxTXTValueLength {
+				add("txt_records.%s: value is %d characters, maximum is %d", name, len(value), maxTXTValueLength)
+			}
+		}
+		for alias, index := range cfg.DNS.AliasSecondaryIPs {
+			if !slices.Contains(cfg.DNS.Aliases, alias) {
+				add("alias_secondary_ips: %s is not listed in aliases", alias)
+			}
+			if cfg.VM == nil || index < 1 || index > cfg.VM.SecondaryPrivateIPs {
+				secondary := 0
+				if cfg.VM != nil {
+					secondary = cfg.VM.SecondaryPrivateIPs
+				}
+				add("alias_secondary_ips: %s has index %d, but the instance has %d secondary private IP(s)", alias, index, secondary)
+			}
+		}
+		seen := make(map[string]bool)
+		for _, alias := range cfg.DNS.Aliases {
+			if !strings.Contains(strings.TrimSuffix(alias, "."), ".") {
+				add("aliases must be fully qualified domain names: %q", alias)
+			}
+			if cfg.DNS.Hostname != "" && alias == cfg.DNS.Hostname+"."+cfg.DNS.Domain {
+				add("aliases cannot duplicate primary hostname: %s", alias)
+			}
+			if seen[alias] {
+				add("duplicate alias: %s", alias)
+			}
+			seen[alias] = true
+		}
+	}
+
+	switch len(problems) {
+	case 0:
+		return nil
+	case 1:
+		return configErrorf("%s", problems[0])
+	}
+	return configErrorf("%d problems in config:\n  - %s", len(problems), strings.Join(problems, "\n  - "))
+}
+
+func isValidLinuxUsername(username string) bool {
+	if len(username) == 0 || len(username) > 32 {
+		return false
+	}
+
+	// Must start with lowercase letter
+	if username[0] < 'a' || username[0] > 'z' {
+		return false
+	}
+
+	// Rest can be alphanumeric, underscore, or hyphen
+	for _, ch := range username {
+		if !((ch >= 'a' && ch <= 'z') || (ch >= '0' && ch <= '9') || ch == '_' || ch == '-') {
+			return false
+		}
+	}
+
+	return true
+}
@@ -0,0 +1,214 @@
+package ec2stack
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+// ignoreUserDefaults keeps the shared defaults file of the user running
+// the tests out of the configs they parse
+func ignoreUserDefaults(t *testing.T) {
+	t.Setenv("XDG_CONFIG_HOME", t.TempDir())
+	t.Setenv("HOME", t.TempDir())
+}
+
+// parseTestConfig parses a config the way ReadConfig does
+func parseTestConfig(t *testing.T, data string) *Config {
+	t.Helper()
+	ignoreUserDefaults(t)
+	cfg, err := ParseConfig([]byte(data))
+	if err != nil {
+		t.Fatalf("ParseConfig() error = %v", err)
+	}
+	return cfg
+}
+
+func TestValidateConfig(t *testing.T) {
+	const users = `"users": [{"username": "alice", "github_username": "alice"}]`
+	tests := []struct {
+		name    string
+		config  string
+		wantErr []string
+	}{
+		{
+			name:   "vm only",
+			config: `{"vm": {` + users + `}}`,
+		},
+		{
+			name:   "vm and dns",
+			config: `{"vm": {` + users + `, "ports": ["22", "443/tcp@10.0.0.0/8"]}, "dns": {"hostname": "web", "domain": "example.com.", "ttl": 60}}`,
+		},
+		{
+			name:   "instance type fallback list",
+			config: `{"vm": {` + users + `, "instance_type": ["t3.micro", "t3a.micro"]}}`,
+		},
+		{
+			name:   "placement group",
+			config: `{"vm": {` + users + `, "placement_group": "web_cluster-1.a"}}`,
+		},
+		{
+			name:   "dns only",
+			config: `{"dns": {"hostname": "web", "domain": "example.com", "target_ip": "203.0.113.7"}}`,
+		},
+		{
+			name:    "no users",
+			config:  `{"vm": {"region": "us-east-1"}}`,
+			wantErr: []string{"VM section requires at least one user"},
+		},
+		{
+			name:    "bad users",
+			config:  `{"vm": {"users": [{"username": "Alice", "github_username": "a"}, {"username": "bob"}, {"username": "bob", "github_username": "b"}]}}`,
+			wantErr: []string{"invalid username format: Alice", "vm.users[1]: github_username cannot be empty", "duplicate username: bob"},
+		},
+		{
+			name:    "bad github usernames",
+			config:  `{"vm": {"users": [{"username": "alice", "github_username": "alice;reboot"}, {"username": "bob", "github_username": "bob--smith"}, {"username": "carol", "github_username": "` + strings.Repeat("c", 40) + `"}]}}`,
+			wantErr: []string{`vm.users[0]: invalid github_username "alice;reboot"`, `vm.users[1]: invalid github_username "bob--smith"`, "vm.users[2]: invalid github_username"},
+		},
+		{
+			name:    "bad instance types",
+			config:  `{"vm": {` + users + `, "instance_type": ["t3.micro", "large", "t3.micro"]}}`,
+			wantErr: []string{`invalid instance_type "large"`, "instance_type lists t3.micro more than once"},
+		},
+		{
+			name:    "bad ports",
+			config:  `{"vm": {` + users + `, "ports": ["99999"]}}`,
+			wantErr: []string{"invalid ports"},
+		},
+		{
+			name:    "ssm options without ssm",
+			config:  `{"vm": {` + users + `, "wait_for_cloud_init": true}}`,
+			wantErr: []string{"wait_for_cloud_init requires enable_ssm"},
+		},
+		{
+			name:    "quote in placement group",
+			config:  `{"vm": {` + users + `, "placement_group": "web\"\nImageId: ami-0"}}`,
+			wantErr: []string{`invalid placement_group "web\"\nImageId: ami-0"`},
+		},
+		{
+			name:    "swap too large",
+			config:  `{"vm": {` + users + `, "swap_size_gb": 65}}`,
+			wantErr: []string{"swap_size_gb must be 0 (off) to 64, got 65"},
+		},
+		{
+			name:    "explicit ttl of 0",
+			config:  `{"vm": {` + users + `}, "dns": {"hostname": "web", "domain": "example.com", "ttl": 0}}`,
+			wantErr: []string{"invalid ttl 0"},
+		},
+		{
+			name:    "shell metacharacters in domain",
+			config:  `{"vm": {` + users + `}, "dns": {"hostname": "web", "domain": "example.com;reboot"}}`,
+			wantErr: []string{`invalid domain "example.com;reboot"`},
+		},
+		{
+			name:    "bad zone id",
+			config:  `{"vm": {` + users + `}, "dns": {"hostname": "web", "domain": "example.com", "zone_id": "/hostedzone/ABC"}}`,
+			wantErr: []string{`invalid zone_id "ABC"`},
+		},
+		{
+			name:    "every problem reported",
+			config:  `{"vm": {"instance_type": "huge"}, "dns": {"hostname": "web", "domain": "example.com", "ttl": -5}}`,
+			wantErr: []string{"3 problems in config", "at least one user", `invalid instance_type "huge"`, "invalid ttl -5"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := parseTestConfig(t, tt.config)
+			err := ValidateConfig(cfg)
+			if len(tt.wantErr) == 0 {
+				if err != nil {
+					t.Fatalf("ValidateConfig() error = %v", err)
+				}
+				return
+			}
+			var cfgErr *ConfigError
+			if !errors.As(err, &cfgErr) {
+				t.Fatalf("ValidateConfig() error = %v, want a ConfigError", err)
+			}
+			for _, want := range tt.wantErr {
+				if !strings.Contains(err.Error(), want) {
+					t.Errorf("ValidateConfig() error = %v, want it to contain %q", err, want)
+				}
+			}
+		})
+	}
+}
+
+func TestParseConfigDefaults(t *testing.T) {
+	tests := []struct {
+		name             string
+		config           string
+		wantRegion       string
+		wantOS           string
+		wantInstanceType string
+		wantTTL          int
+	}{
+		{
+			name:             "built-in defaults",
+			config:           `{"vm": {}, "dns": {"domain": "example.com"}}`,
+			wantRegion:       "us-east-1",
+			wantOS:           "ubuntu-22.04",
+			wantInstanceType: "t3.micro",
+			wantTTL:          300,
+		},
+		{
+			name:             "set values kept",
+			config:           `{"vm": {"region": "eu-west-1", "os": "debian-12", "instance_type": "t3.small"}, "dns": {"domain": "example.com", "ttl": 60}}`,
+			wantRegion:       "eu-west-1",
+			wantOS:           "debian-12",
+			wantInstanceType: "t3.small",
+			wantTTL:          60,
+		},
+		{
+			name:             "legacy flat format",
+			config:           `{"region": "us-west-2", "domain": "example.com", "hostname": "web", "github_username": "alice"}`,
+			wantRegion:       "us-west-2",
+			wantOS:           "ubuntu-22.04",
+			wantInstanceType: "t3.micro",
+			wantTTL:          300,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := parseTestConfig(t, tt.config)
+			if cfg.VM == nil || cfg.DNS == nil {
+				t.Fatalf("ParseConfig() = %+v, want vm and dns sections", cfg)
+			}
+			if cfg.VM.Region != tt.wantRegion {
+				t.Errorf("region = %q, want %q", cfg.VM.Region, tt.wantRegion)
+			}
+			if cfg.VM.OS != tt.wantOS {
+				t.Errorf("os = %q, want %q", cfg.VM.OS, tt.wantOS)
+			}
+			if cfg.VM.InstanceType != tt.wantInstanceType {
+				t.Errorf("instance_type = %q, want %q", cfg.VM.InstanceType, tt.wantInstanceType)
+			}
+			if got := cfg.DNS.RecordTTL(); got != tt.wantTTL {
+				t.Errorf("ttl = %d, want %d", got, tt.wantTTL)
+			}
+		})
+	}
+}
+
+func TestParseConfigErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		config  string
+		wantErr string
+	}{
+		{name: "not JSON", config: `{"vm": `, wantErr: "failed to parse config"},
+		{name: "nested type error", config: `{"vm": {"swap_size_gb": "two"}}`, wantErr: "vm.swap_size_gb must be of type int, got string"},
+		{name: "bad instance_type", config: `{"vm": {"instance_type": 3}}`, wantErr: "instance_type must be a string or a list of strings"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ignoreUserDefaults(t)
+			_, err := ParseConfig([]byte(tt.config))
+			var cfgErr *ConfigError
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) || !errors.As(err, &cfgErr) {
+				t.Fatalf("ParseConfig() error = %v, want a ConfigError containing %q", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,114 @@
+package ec2stack
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// defaultsFiles returns the shared defaults files that exist, highest
+// precedence first: stacks/defaults.json, then defaults.json in the user's
+// config directory (~/.config/aws-ec2 on Linux). Either may be TOML.
+func defaultsFiles() []string {
+	bases := []string{filepath.Join("stacks", "defaults")}
+	if dir, err := os.UserConfigDir(); err == nil {
+		bases = append(bases, filepath.Join(dir, "aws-ec2", "defaults"))
+	}
+
+	var files []string
+	for _, base := range bases {
+		for _, ext := range []string{".json", ".toml"} {
+			if _, err := os.Stat(base + ext); err == nil {
+				files = append(files, base+ext)
+				break
+			}
+		}
+	}
+	return files
+}
+
+// IsDefaultsFile reports whether path is a shared defaults file rather
+// than a stack config
+func IsDefaultsFile(path string) bool {
+	name := filepath.Base(path)
+	return name == "defaults.json" || name == "defaults.toml"
+}
+
+// applySharedDefaults merges the shared defaults files under a config in
+// the nested format, so values the config sets win. Defaults only fill in
+// the vm and dns sections the config already has: a dns default must not
+// add DNS records to a VM-only stack. Legacy flat configs are returned
+// unchanged.
+func applySharedDefaults(data []byte) ([]byte, error) {
+	var cfg map[string]any
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		// Reported by the caller's own parse
+		return data, nil
+	}
+	if cfg["vm"] == nil && cfg["dns"] == nil {
+		return data, nil
+	}
+
+	files := defaultsFiles()
+	if len(files) == 0 {
+		return data, nil
+	}
+	for _, path := range files {
+		defaults, err := readDefaultsFile(path)
+		if err != nil {
+			return nil, err
+		}
+		for _, section := range []string{"vm", "dns"} {
+			dst, ok := cfg[section].(map[string]any)
+			src, hasDefaults := defaults[section].(map[string]any)
+			if ok && hasDefaults {
+				fillMissing(dst, src)
+			}
+		}
+		debugf(context.Background(), "Applied defaults from %s", path)
+	}
+	return json.Marshal(cfg)
+}
+
+// readDefaultsFile reads a defaults file, which uses the nested format and
+// may only have vm and dns sections
+func readDefaultsFile(path string) (map[string]any, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read defaults file %s: %w", path, err)
+	}
+	if isTOMLFile(path) {
+		if data, err = tomlToJSON(data); err != nil {
+			return nil, configErrorf("failed to parse defaults file %s: %v", path, err)
+		}
+	}
+	var defaults map[string]any
+	if err := json.Unmarshal(data, &defaults); err != nil {
+		return nil, configErrorf("failed to parse defaults file %s: %v", path, err)
+	}
+	for key := range defaults {
+		if key != "vm" && key != "dns" {
+			return nil, configErrorf("defaults file %s: unexpected key %q (only vm and dns sections are allowed)", path, key)
+		}
+	}
+	return defaults, nil
+}
+
+// fillMissing copies the keys of src that dst lacks into dst, descending
+// into objects both have. Arrays and other values in dst are kept whole.
+func fillMissing(dst, src map[string]any) {
+	for key, value := range src {
+		existing, ok := dst[key]
+		if !ok {
+			dst[key] = value
+			continue
+		}
+		dstObj, dstIsObj := existing.(map[string]any)
+		srcObj, srcIsObj := value.(map[string]any)
+		if dstIsObj && srcIsObj {
+			fillMissing(dstObj, srcObj)
+		}
+	}
+}
@@ -0,0 +1,105 @@
+package ec2stack
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	ec2types "github.com/aws/aws-sdk-go-v2/service/ec2/types"
+)
+
+// InstanceStateNotFound is the State of an instance EC2 no longer knows,
+// as happens an hour or so after it is terminated
+const InstanceStateNotFound = "not-found"
+
+// InstanceDetails is the live EC2 view of one of a stack's instances
+type InstanceDetails struct {
+	InstanceID string `json:"instance_id"`
+
+	// State is the EC2 instance state, such as running or stopped, or
+	// InstanceStateNotFound. StateReason says why it last changed, when
+	// EC2 gives a reason.
+	State       string `json:"state"`
+	StateReason string `json:"state_reason,omitempty"`
+
+	InstanceType     string     `json:"instance_type,omitempty"`
+	LaunchTime       *time.Time `json:"launch_time,omitempty"`
+	AvailabilityZone string     `json:"availability_zone,omitempty"`
+	PublicIP         string     `json:"public_ip,omitempty"`
+	PrivateIP        string     `json:"private_ip,omitempty"`
+
+	// SecurityGroups lists the attached groups as "sg-... (name)"
+	SecurityGroups []string `json:"security_groups,omitempty"`
+}
+
+// Gone reports whether the instance was terminated, or is no longer known
+func (d InstanceDetails) Gone() bool {
+	return d.State == string(ec2types.InstanceStateNameTerminated) || d.State == InstanceStateNotFound
+}
+
+// DescribeStackInstances returns the live details of the instances
+// recorded in the stack's config, in config order. An instance terminated
+// outside this tool is returned with a State for which Gone is true rather
+// than as an error.
+func (c *Client) DescribeStackInstances(ctx context.Context, stackName string) ([]InstanceDetails, error) {
+	ctx = withStack(ctx, stackName)
+	_, _, instances, err := readInstances(stackName)
+	if err != nil {
+		return nil, err
+	}
+	groups, err := c.groupByRegion(ctx, instances)
+	if err != nil {
+		return nil, err
+	}
+
+	// A filter, unlike InstanceIds, does not fail on unknown instances
+	current := make(map[string]ec2types.Instance)
+	for _, group := range groups {
+		paginator := ec2.NewDescribeInstancesPaginator(group.ec2Client, &ec2.DescribeInstancesInput{
+			Filters: []ec2types.Filter{{Name: aws.String("instance-id"), Values: group.ids}},
+		})
+		for paginator.HasMorePages() {
+			page, err := paginator.NextPage(ctx)
+			if err != nil {
+				return nil, fmt.Errorf("failed to describe instances: %w", err)
+			}
+			for _, reservation := range page.Reservations {
+				for _, instance := range reservation.Instances {
+					current[aws.ToString(instance.InstanceId)] = instance
+				}
+			}
+		}
+	}
+
+	details := make([]InstanceDetails, 0, len(instances))
+	for _, inst := range instances {
+		instance, ok := current[inst.ID]
+		if !ok {
+			details = append(details, InstanceDetails{InstanceID: inst.ID, State: InstanceStateNotFound})
+			continue
+		}
+		d := InstanceDetails{
+			InstanceID:   inst.ID,
+			InstanceType: string(instance.InstanceType),
+			LaunchTime:   instance.LaunchTime,
+			PublicIP:     aws.ToString(instance.PublicIpAddress),
+			PrivateIP:    aws.ToString(instance.PrivateIpAddress),
+		}
+		if instance.State != nil {
+			d.State = string(instance.State.Name)
+		}
+		if instance.StateReason != nil {
+			d.StateReason = aws.ToString(instance.StateReason.Message)
+		}
+		if instance.Placement != nil {
+			d.AvailabilityZone = aws.ToString(instance.Placement.AvailabilityZone)
+		}
+		for _, group := range instance.SecurityGroups {
+			d.SecurityGroups = append(d.SecurityGroups, fmt.Sprintf("%s (%s)", aws.ToString(group.GroupId), aws.ToString(group.GroupName)))
+		}
+		details = append(details, d)
+	}
+	return details, nil
+}
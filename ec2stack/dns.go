@@ -0,0 +1,838 @@
+package ec2stack
+
+import (
+	"context"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"math/big"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/route53"
+	r53types "github.com/aws/aws-sdk-go-v2/service/route53/types"
+)
+
+func lookupZoneID(ctx context.Context, r53Client *route53.Client, domain string, private bool) (string, error) {
+	// Ensure domain ends with a dot for Route53
+	if !strings.HasSuffix(domain, ".") {
+		domain = domain + "."
+	}
+
+	input := &route53.ListHostedZonesByNameInput{
+		DNSName: aws.String(domain),
+	}
+
+	result, err := r53Client.ListHostedZonesByName(ctx, input)
+	if err != nil {
+		return "", fmt.Errorf("failed to list hosted zones: %w", err)
+	}
+
+	// A public and a private zone may share a name; pick the requested kind
+	for _, zone := range result.HostedZones {
+		isPrivate := zone.Config != nil && zone.Config.PrivateZone
+		if *zone.Name == domain && isPrivate == private {
+			// Zone ID format: /hostedzone/Z1234567890ABC
+			zoneID := strings.TrimPrefix(*zone.Id, "/hostedzone/")
+			return zoneID, nil
+		}
+	}
+
+	return "", fmt.Errorf("%w for domain: %s", errZoneNotFound, domain)
+}
+
+var errZoneNotFound = errors.New("hosted zone not found")
+
+// maxTTL is the largest record TTL Route53 accepts
+const maxTTL = 2147483647
+
+// defaultTTL is the record TTL when the config does not set one
+const defaultTTL = 300
+
+// RecordTTL returns the TTL the config's records are created with
+func (d *DNSConfig) RecordTTL() int {
+	if d.TTL == nil {
+		return defaultTTL
+	}
+	return *d.TTL
+}
+
+// isValidZoneID reports whether id looks like a Route53 hosted zone ID
+func isValidZoneID(id string) bool {
+	if len(id) < 2 || len(id) > 32 || id[0] != 'Z' {
+		return false
+	}
+	for _, ch := range id {
+		if !((ch >= 'A' && ch <= 'Z') || (ch >= '0' && ch <= '9')) {
+			return false
+		}
+	}
+	return true
+}
+
+// lookupZoneForName finds the most specific hosted zone containing name by
+// trying each parent domain in turn. The domain of the zone found is
+// returned too, and whether its ID came from the zone cache.
+func (c *Client) lookupZoneForName(ctx context.Context, r53Client *route53.Client, name string, private bool) (zoneID, domain string, cached bool, err error) {
+	labels := strings.Split(strings.TrimSuffix(name, "."), ".")
+	for i := 0; i < len(labels)-1; i++ {
+		domain = strings.Join(labels[i:], ".")
+		zoneID, cached, err = c.resolveZoneID(ctx, r53Client, domain, private)
+		if err == nil {
+			return zoneID, domain, cached, nil
+		}
+		if !errors.Is(err, errZoneNotFound) {
+			return "", "", false, err
+		}
+	}
+	return "", "", false, fmt.Errorf("%w for name: %s", errZoneNotFound, name)
+}
+
+func createARecord(ctx context.Context, r53Client *route53.Client, zoneID, name, ip string, ttl int) (string, error) {
+	if !strings.HasSuffix(name, ".") {
+		name = name + "."
+	}
+
+	input := &route53.ChangeResourceRecordSetsInput{
+		HostedZoneId: aws.String(zoneID),
+		ChangeBatch: &r53types.ChangeBatch{
+			Changes: []r53types.Change{
+				{
+					Action: r53types.ChangeActionUpsert,
+					ResourceRecordSet: &r53types.ResourceRecordSet{
+						Name: aws.String(name),
+						Type: r53types.RRTypeA,
+						TTL:  aws.Int64(int64(ttl)),
+						ResourceRecords: []r53types.ResourceRecord{
+							{Value: aws.String(ip)},
+						},
+					},
+				},
+			},
+		},
+	}
+
+	debugf(ctx, "Route53 UPSERT A %s -> %s (zone %s, ttl %d)", name, ip, zoneID, ttl)
+	return applyDNSChange(ctx, r53Client, input)
+}
+
+// checkExistingRecord looks up the current record for name/type before it is
+// upserted. Records already pointing at value, or at a value this config
+// created previously (owned), are updated freely; anything else is refused
+// unless force is set, to avoid hijacking names used elsewhere. A non-empty
+// setID limits the check to that member of a routing set, so records of
+// other members, such as other regions', are left alone.
+func checkExistingRecord(ctx context.Context, r53Client *route53.Client, zoneID, name string, rrType r53types.RRType, setID, value string, owned map[string]bool, force bool) error {
+	if !strings.HasSuffix(name, ".") {
+		name = name + "."
+	}
+
+	// A routing set may hold up to 100 records of one name and type
+	maxItems := int32(1)
+	if setID != "" {
+		maxItems = 100
+	}
+	result, err := r53Client.ListResourceRecordSets(ctx, &route53.ListResourceRecordSetsInput{
+		HostedZoneId:    aws.String(zoneID),
+		StartRecordName: aws.String(name),
+		StartRecordType: rrType,
+		MaxItems:        aws.Int32(maxItems),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to check existing records for %s: %w", name, err)
+	}
+
+	var existing []string
+	for _, rrset := range result.ResourceRecordSets {
+		if !strings.EqualFold(aws.ToString(rrset.Name), name) || rrset.Type != rrType {
+			continue
+		}
+		if setID != "" && aws.ToString(rrset.SetIdentifier) != setID {
+			continue
+		}
+		for _, rr := range rrset.ResourceRecords {
+			existing = append(existing, strings.TrimSuffix(aws.ToString(rr.Value), "."))
+		}
+	}
+
+	if len(existing) == 0 {
+		infof(ctx, "  Creating new %s record: %s", rrType, name)
+		return nil
+	}
+
+	value = strings.TrimSuffix(value, ".")
+	foreign := false
+	for _, v := range existing {
+		if v != value && !owned[v] {
+			foreign = true
+		}
+	}
+
+	switch {
+	case len(existing) == 1 && existing[0] == value:
+		infof(ctx, "  %s record %s already points to %s", rrType, name, value)
+	case !foreign:
+		infof(ctx, "  Updating %s record: %s (%s -> %s)", rrType, name, strings.Join(existing, ","), value)
+	case force:
+		warnf(ctx, "overwriting %s record %s (%s -> %s)", rrType, name, strings.Join(existing, ","), value)
+	default:
+		return fmt.Errorf("%s record %s already exists pointing to %s, not created by this config (use -force-dns to overwrite)", rrType, name, strings.Join(existing, ","))
+	}
+
+	return nil
+}
+
+// plainRecordToReplace returns the record of name and type without a set
+// identifier, if there is one. A record with a set identifier, as used for
+// health checks and routing policies, cannot exist next to it, so it has to
+// be replaced in the same change. As in checkExistingRecord, a record
+// pointing elsewhere that this config did not create is only replaced with
+// force.
+func plainRecordToReplace(ctx context.Context, r53Client *route53.Client, zoneID, name string, rrType r53types.RRType, value string, owned map[string]bool, force bool) (*r53types.ResourceRecordSet, error) {
+	if !strings.HasSuffix(name, ".") {
+		name = name + "."
+	}
+	result, err := r53Client.ListResourceRecordSets(ctx, &route53.ListResourceRecordSetsInput{
+		HostedZoneId:    aws.String(zoneID),
+		StartRecordName: aws.String(name),
+		StartRecordType: rrType,
+		MaxItems:        aws.Int32(100),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to check existing records for %s: %w", name, err)
+	}
+	for _, rrset := range result.ResourceRecordSets {
+		if !strings.EqualFold(aws.ToString(rrset.Name), name) || rrset.Type != rrType || rrset.SetIdentifier != nil {
+			continue
+		}
+		var existing []string
+		foreign := false
+		for _, rr := range rrset.ResourceRecords {
+			v := strings.TrimSuffix(aws.ToString(rr.Value), ".")
+			existing = append(existing, v)
+			if v != strings.TrimSuffix(value, ".") && !owned[v] {
+				foreign = true
+			}
+		}
+		if foreign && !force {
+			return nil, fmt.Errorf("%s record %s already exists pointing to %s, not created by this config (use -force-dns to replace it)", rrType, name, strings.Join(existing, ","))
+		}
+		return &rrset, nil
+	}
+	return nil, nil
+}
+
+func createCNAMERecord(ctx context.Context, r53Client *route53.Client, zoneID, name, target string, ttl int) (string, error) {
+	if !strings.HasSuffix(name, ".") {
+		name = name + "."
+	}
+	if !strings.HasSuffix(target, ".") {
+		target = target + "."
+	}
+
+	input := &route53.ChangeResourceRecordSetsInput{
+		HostedZoneId: aws.String(zoneID),
+		ChangeBatch: &r53types.ChangeBatch{
+			Changes: []r53types.Change{
+				{
+					Action: r53types.ChangeActionUpsert,
+					ResourceRecordSet: &r53types.ResourceRecordSet{
+						Name: aws.String(name),
+						Type: r53types.RRTypeCname,
+						TTL:  aws.Int64(int64(ttl)),
+						ResourceRecords: []r53types.ResourceRecord{
+							{Value: aws.String(target)},
+						},
+					},
+				},
+			},
+		},
+	}
+
+	debugf(ctx, "Route53 UPSERT CNAME %s -> %s (zone %s, ttl %d)", name, target, zoneID, ttl)
+	return applyDNSChange(ctx, r53Client, input)
+}
+
+// resourceRecordSet builds the Route53 record set for a stored record
+func resourceRecordSet(record DNSRecord) *r53types.ResourceRecordSet {
+	name := record.Name
+	if !strings.HasSuffix(name, ".") {
+		name = name + "."
+	}
+	value := record.Value
+	if record.Type == "CNAME" && !strings.HasSuffix(value, ".") {
+		value = value + "."
+	}
+	if record.Type == "TXT" {
+		value = quoteTXT(value)
+	}
+
+	rrset := &r53types.ResourceRecordSet{
+		Name: aws.String(name),
+		Type: r53types.RRType(record.Type),
+		TTL:  aws.Int64(int64(record.TTL)),
+		ResourceRecords: []r53types.ResourceRecord{
+			{Value: aws.String(value)},
+		},
+	}
+	if record.SetIdentifier != "" {
+		rrset.SetIdentifier = aws.String(record.SetIdentifier)
+	}
+	if record.MultiValue {
+		rrset.MultiValueAnswer = aws.Bool(true)
+	}
+	if record.HealthCheckID != "" {
+		rrset.HealthCheckId = aws.String(record.HealthCheckID)
+	}
+	if record.LatencyRegion != "" {
+		rrset.Region = r53types.ResourceRecordSetRegion(record.LatencyRegion)
+	}
+	if loc := record.GeoLocation; loc != nil {
+		rrset.GeoLocation = &r53types.GeoLocation{}
+		if loc.ContinentCode != "" {
+			rrset.GeoLocation.ContinentCode = aws.String(loc.ContinentCode)
+		}
+		if loc.CountryCode != "" {
+			rrset.GeoLocation.CountryCode = aws.String(loc.CountryCode)
+		}
+		if loc.SubdivisionCode != "" {
+			rrset.GeoLocation.SubdivisionCode = aws.String(loc.SubdivisionCode)
+		}
+	}
+	return rrset
+}
+
+// changeDNSRecord applies a single change for a stored record and returns
+// the Route53 change ID
+func changeDNSRecord(ctx context.Context, r53Client *route53.Client, zoneID string, action r53types.ChangeAction, record DNSRecord) (string, error) {
+	debugf(ctx, "Route53 %s %s %s -> %s (zone %s, ttl %d)", action, record.Type, record.Name, record.Value, zoneID, record.TTL)
+	return applyDNSChange(ctx, r53Client, &route53.ChangeResourceRecordSetsInput{
+		HostedZoneId: aws.String(zoneID),
+		ChangeBatch: &r53types.ChangeBatch{
+			Changes: []r53types.Change{
+				{
+					Action:            action,
+					ResourceRecordSet: resourceRecordSet(record),
+				},
+			},
+		},
+	})
+}
+
+// applyDNSChange submits a change batch and returns its change ID, which
+// waitForDNSChanges can wait on
+func applyDNSChange(ctx context.Context, r53Client *route53.Client, input *route53.ChangeResourceRecordSetsInput) (string, error) {
+	result, err := r53Client.ChangeResourceRecordSets(ctx, input)
+	if err != nil {
+		return "", err
+	}
+	return aws.ToString(result.ChangeInfo.Id), nil
+}
+
+// dnsChangeTimeout bounds the wait for one Route53 change to reach INSYNC
+const dnsChangeTimeout = 5 * time.Minute
+
+// waitForDNSChanges waits until Route53 reports each change INSYNC, i.e.
+// applied on all of the zone's name servers
+func waitForDNSChanges(ctx context.Context, r53Client *route53.Client, changeIDs []string) error {
+	if len(changeIDs) == 0 {
+		return nil
+	}
+	infof(ctx, "Waiting for %d DNS change(s) to propagate...", len(changeIDs))
+	waiter := route53.NewResourceRecordSetsChangedWaiter(r53Client)
+	for _, id := range changeIDs {
+		err := waiterError(waiter.Wait(ctx, &route53.GetChangeInput{Id: aws.String(id)}, dnsChangeTimeout))
+		if err != nil {
+			return fmt.Errorf("DNS change %s is not in sync: %w", id, err)
+		}
+	}
+	infof(ctx, "DNS changes in sync")
+	return nil
+}
+
+// createHealthCheck creates a Route53 health check probing ip
+func createHealthCheck(ctx context.Context, r53Client *route53.Client, hc *HealthCheckConfig, ip, name string) (string, error) {
+	hcConfig := &r53types.HealthCheckConfig{
+		Type:             r53types.HealthCheckType(hc.Protocol),
+		IPAddress:        aws.String(ip),
+		Port:             aws.Int32(int32(hc.Port)),
+		FailureThreshold: aws.Int32(int32(hc.FailureThreshold)),
+		RequestInterval:  aws.Int32(30),
+	}
+	if hc.Protocol != "TCP" {
+		hcConfig.ResourcePath = aws.String(hc.Path)
+	}
+
+	result, err := r53Client.CreateHealthCheck(ctx, &route53.CreateHealthCheckInput{
+		CallerReference:   aws.String(fmt.Sprintf("%s-%d", name, time.Now().UnixNano())),
+		HealthCheckConfig: hcConfig,
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to create health check: %w", err)
+	}
+	id := *result.HealthCheck.Id
+
+	// Name the health check so it is recognisable in the console
+	_, err = r53Client.ChangeTagsForResource(ctx, &route53.ChangeTagsForResourceInput{
+		ResourceId:   aws.String(id),
+		ResourceType: r53types.TagResourceTypeHealthcheck,
+		AddTags: []r53types.Tag{
+			{Key: aws.String("Name"), Value: aws.String(name)},
+		},
+	})
+	if err != nil {
+		warnf(ctx, "failed to tag health check %s: %v", id, err)
+	}
+
+	return id, nil
+}
+
+func deleteHealthCheck(ctx context.Context, r53Client *route53.Client, id string) error {
+	_, err := r53Client.DeleteHealthCheck(ctx, &route53.DeleteHealthCheckInput{
+		HealthCheckId: aws.String(id),
+	})
+	return err
+}
+
+// updateDNSTarget repoints the A records and health check that target
+// oldIP at newIP, after a start gave the instance a new address. Records
+// for a target_ip other than the instance's are left alone.
+func updateDNSTarget(ctx context.Context, r53Client *route53.Client, dns *DNSConfig, oldIP, newIP string) error {
+	if dns.TargetIP != "" && dns.TargetIP != oldIP {
+		infof(ctx, "DNS records point at target_ip %s, leaving them unchanged", dns.TargetIP)
+		return nil
+	}
+
+	if dns.HealthCheck != nil && dns.HealthCheck.ID != "" {
+		_, err := r53Client.UpdateHealthCheck(ctx, &route53.UpdateHealthCheckInput{
+			HealthCheckId: aws.String(dns.HealthCheck.ID),
+			IPAddress:     aws.String(newIP),
+		})
+		if err != nil {
+			return fmt.Errorf("failed to update health check %s: %w", dns.HealthCheck.ID, err)
+		}
+	}
+
+	updated := 0
+	for i := range dns.DNSRecords {
+		record := &dns.DNSRecords[i]
+		if record.Type != "A" || record.Value != oldIP {
+			continue
+		}
+		zoneID := dns.ZoneID
+		if record.ZoneID != "" {
+			zoneID = record.ZoneID
+		}
+		record.Value = newIP
+		if _, err := changeDNSRecord(ctx, r53Client, zoneID, r53types.ChangeActionUpsert, *record); err != nil {
+			return fmt.Errorf("failed to update %s: %w", record.Name, err)
+		}
+		updated++
+	}
+	dns.TargetIP = newIP
+	infof(ctx, "Updated %d DNS record(s) to %s", updated, newIP)
+	return nil
+}
+
+// deleteDNSRecord deletes a previously created record and returns the
+// change ID. The record's own zone takes precedence over zoneID. Route53
+// matches deletes on the whole record set, so the stored routing fields
+// pick out this record from others of its name in a routing set.
+func deleteDNSRecord(ctx context.Context, r53Client *route53.Client, zoneID string, record DNSRecord) (string, error) {
+	if record.ZoneID != "" {
+		zoneID = record.ZoneID
+	}
+
+	switch record.Type {
+	case "A", "CNAME", "TXT":
+		return changeDNSRecord(ctx, r53Client, zoneID, r53types.ChangeActionDelete, record)
+	}
+	return "", fmt.Errorf("unsupported record type %s", record.Type)
+}
+
+// quoteTXT quotes a TXT value the way Route53 requires: backslashes and
+// quotes escaped, and split into quoted strings of at most 255 characters
+func quoteTXT(value string) string {
+	value = strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(value)
+	var parts []string
+	for len(value) > 255 {
+		// Don't split an escape sequence: an odd run of backslashes at
+		// the end means the last one escapes the next character
+		n := 255
+		backslashes := 0
+		for i := n - 1; i >= 0 && value[i] == '\\'; i-- {
+			backslashes++
+		}
+		if backslashes%2 == 1 {
+			n--
+		}
+		parts = append(parts, `"`+value[:n]+`"`)
+		value = value[n:]
+	}
+	return strings.Join(append(parts, `"`+value+`"`), " ")
+}
+
+// txtRecordName returns the FQDN of a txt_records name
+func txtRecordName(name, domain string) string {
+	if name == "@" {
+		return domain
+	}
+	return name + "." + domain
+}
+
+// deleteDNSResources removes the records and health check recorded in the
+// DNS config, and with wait waits for the deletes to propagate. Failures
+// are logged so the rest of the cleanup still runs.
+func deleteDNSResources(ctx context.Context, r53Client *route53.Client, dns *DNSConfig, wait bool) {
+	if dns.ZoneID == "" || len(dns.DNSRecords) == 0 {
+		return
+	}
+
+	infof(ctx, "Deleting %d DNS record(s)...", len(dns.DNSRecords))
+	var changeIDs []string
+	for _, record := range dns.DNSRecords {
+		infof(ctx, "  Deleting %s record: %s -> %s", record.Type, record.Name, record.Value)
+
+		changeID, err := deleteDNSRecord(ctx, r53Client, dns.ZoneID, record)
+		if err != nil {
+			warnf(ctx, "failed to delete DNS record %s: %v", record.Name, err)
+			continue
+		}
+		changeIDs = append(changeIDs, changeID)
+	}
+	infof(ctx, "DNS records deleted")
+	if wait {
+		if err := waitForDNSChanges(ctx, r53Client, changeIDs); err != nil {
+			warnf(ctx, "%v", err)
+		}
+	}
+
+	// The health check can only be removed once no record references it
+	if dns.HealthCheck != nil && dns.HealthCheck.ID != "" {
+		if err := deleteHealthCheck(ctx, r53Client, dns.HealthCheck.ID); err != nil {
+			warnf(ctx, "failed to delete health check %s: %v", dns.HealthCheck.ID, err)
+		} else {
+			infof(ctx, "Deleted health check: %s", dns.HealthCheck.ID)
+		}
+	}
+}
+
+// clearDNSOutputs resets the DNS fields filled in by create
+func clearDNSOutputs(dns *DNSConfig) {
+	// A configured ZoneID is kept
+	if dns.ZoneLookedUp {
+		dns.ZoneID = ""
+		dns.ZoneLookedUp = false
+	}
+	dns.FQDN = ""
+	if dns.HealthCheck != nil {
+		dns.HealthCheck.ID = ""
+	}
+	dns.DNSRecords = []DNSRecord{}
+}
+
+func deleteCreatedRecords(ctx context.Context, r53Client *route53.Client, zoneID string, records []DNSRecord) {
+	for _, record := range records {
+		deleteDNSRecord(ctx, r53Client, zoneID, record)
+	}
+}
+
+// createDNSResources creates DNS records and returns created records.
+// Existing records pointing elsewhere are only overwritten when ForceDNS is set.
+// Aliases in alias_secondary_ips point at their entry in secondaryIPs.
+// A zone ID from the zone cache that Route53 no longer knows is dropped
+// from the cache, so running again looks the zone up afresh.
+func (c *Client) createDNSResources(ctx context.Context, dns *DNSConfig, publicIP string, secondaryIPs []string, region string) (err error) {
+	if ttl := dns.RecordTTL(); ttl < 60 {
+		warnf(ctx, "ttl %d is below 60 seconds, resolvers will query Route53 very frequently", ttl)
+	}
+
+	// Load AWS config with region
+	awsCfg, err := c.LoadAWSConfig(ctx, region)
+	if err != nil {
+		return fmt.Errorf("failed to load AWS config: %w", err)
+	}
+
+	r53Client := route53.NewFromConfig(awsCfg)
+
+	// Domains whose zone ID came from the cache, in case it is stale
+	var cachedDomains []string
+	defer func() {
+		var noZone *r53types.NoSuchHostedZone
+		if len(cachedDomains) == 0 || !errors.As(err, &noZone) {
+			return
+		}
+		for _, domain := range cachedDomains {
+			c.forgetZoneID(ctx, domain, dns.PrivateZone)
+			if domain == dns.Domain {
+				dns.ZoneID = ""
+				dns.ZoneLookedUp = false
+			}
+		}
+		err = fmt.Errorf("%w (the cached zone ID was stale and has been dropped; run again to look it up)", err)
+	}()
+
+	// Lookup zone ID unless one was given explicitly. One a previous create
+	// looked up is looked up again, in case the zone was recreated.
+	if dns.ZoneID != "" && !dns.ZoneLookedUp {
+		infof(ctx, "Using configured Zone ID: %s", dns.ZoneID)
+	} else {
+		infof(ctx, "Looking up zone ID for %s...", dns.Domain)
+		zoneID, cached, err := c.resolveZoneID(ctx, r53Client, dns.Domain, dns.PrivateZone)
+		if err != nil {
+			return fmt.Errorf("failed to lookup zone ID: %w", err)
+		}
+		found := fmt.Sprintf("Found Zone ID: %s", zoneID)
+		if cached {
+			cachedDomains = append(cachedDomains, dns.Domain)
+			found += " (cached)"
+		}
+		infoWith(ctx, found, "zone_id", zoneID)
+		dns.ZoneID = zoneID
+		dns.ZoneLookedUp = true
+	}
+
+	// Determine target IP
+	targetIP := publicIP
+	if dns.TargetIP != "" {
+		targetIP = dns.TargetIP
+	}
+	if targetIP == "" {
+		return configErrorf("no address for the DNS records: the instance has no IP to point at and target_ip is not set")
+	}
+
+	// Values from a previous run of this config may be overwritten safely
+	owned := make(map[string]bool)
+	for _, record := range dns.DNSRecords {
+		owned[strings.TrimSuffix(record.Value, ".")] = true
+		if record.Type == "TXT" {
+			owned[quoteTXT(record.Value)] = true
+		}
+	}
+
+	var createdRecords []DNSRecord
+	var changeIDs []string
+	succeeded := false
+
+	// 1. Create primary A record (hostname.domain -> IP)
+	if dns.Hostname != "" {
+		fqdn := fmt.Sprintf("%s.%s", dns.Hostname, dns.Domain)
+		record := DNSRecord{
+			Name:  fqdn,
+			Type:  "A",
+			Value: targetIP,
+			TTL:   dns.RecordTTL(),
+		}
+		// Health-checked records without a routing policy use multivalue
+		// routing, which is the simplest policy under which Route53 honours
+		// the health check
+		setID := ""
+		if dns.RoutingPolicy != nil {
+			dns.RoutingPolicy.apply(&record, region)
+			setID = record.SetIdentifier
+			infof(ctx, "Using %s routing, set identifier %s", dns.RoutingPolicy.Type, setID)
+		} else if dns.HealthCheck != nil {
+			record.SetIdentifier = fqdn
+			record.MultiValue = true
+		}
+		if err := checkExistingRecord(ctx, r53Client, dns.ZoneID, fqdn, r53types.RRTypeA, setID, targetIP, owned, c.ForceDNS); err != nil {
+			return err
+		}
+		// Checked before the health check is created, so a refusal leaves
+		// nothing behind
+		var plain *r53types.ResourceRecordSet
+		if record.SetIdentifier != "" {
+			if plain, err = plainRecordToReplace(ctx, r53Client, dns.ZoneID, fqdn, r53types.RRTypeA, targetIP, owned, c.ForceDNS); err != nil {
+				return err
+			}
+		}
+
+		if dns.HealthCheck != nil {
+			infof(ctx, "Creating %s health check on %s:%d...", dns.HealthCheck.Protocol, targetIP, dns.HealthCheck.Port)
+			hcID, err := createHealthCheck(ctx, r53Client, dns.HealthCheck, targetIP, fqdn)
+			if err != nil {
+				return err
+			}
+			infof(ctx, "Created health check: %s", hcID)
+			dns.HealthCheck.ID = hcID
+			record.HealthCheckID = hcID
+			defer func() {
+				if !succeeded {
+					deleteHealthCheck(ctx, r53Client, hcID)
+					dns.HealthCheck.ID = ""
+				}
+			}()
+		}
+
+		var changeID string
+		if plain != nil {
+			// Route53 refuses the new record next to the plain one, so
+			// both changes go in one batch
+			infof(ctx, "  Replacing plain A record %s with one for set %s", fqdn, record.SetIdentifier)
+			debugf(ctx, "Route53 DELETE A %s, CREATE A %s -> %s (zone %s)", fqdn, fqdn, targetIP, dns.ZoneID)
+			changeID, err = applyDNSChange(ctx, r53Client, &route53.ChangeResourceRecordSetsInput{
+				HostedZoneId: aws.String(dns.ZoneID),
+				ChangeBatch: &r53types.ChangeBatch{
+					Changes: []r53types.Change{
+						{Action: r53types.ChangeActionDelete, ResourceRecordSet: plain},
+						{Action: r53types.ChangeActionCreate, ResourceRecordSet: resourceRecordSet(record)},
+					},
+				},
+			})
+		} else {
+			changeID, err = changeDNSRecord(ctx, r53Client, dns.ZoneID, r53types.ChangeActionUpsert, record)
+		}
+		if err != nil {
+			return fmt.Errorf("failed to create primary A record: %w", err)
+		}
+		changeIDs = append(changeIDs, changeID)
+		createdRecords = append(createdRecords, record)
+		dns.FQDN = fqdn
+	}
+
+	// 2. Create CNAME records (alias.domain -> hostname.domain)
+	if dns.Hostname != "" && len(dns.CNAMEAliases) > 0 {
+		targetFQDN := fmt.Sprintf("%s.%s", dns.Hostname, dns.Domain)
+		for _, alias := range dns.CNAMEAliases {
+			aliasFQDN := fmt.Sprintf("%s.%s", alias, dns.Domain)
+			if err := checkExistingRecord(ctx, r53Client, dns.ZoneID, aliasFQDN, r53types.RRTypeCname, "", targetFQDN, owned, c.ForceDNS); err != nil {
+				deleteCreatedRecords(ctx, r53Client, dns.ZoneID, createdRecords)
+				return err
+			}
+			changeID, err := createCNAMERecord(ctx, r53Client, dns.ZoneID, aliasFQDN, targetFQDN, dns.RecordTTL())
+			if err != nil {
+				deleteCreatedRecords(ctx, r53Client, dns.ZoneID, createdRecords)
+				return fmt.Errorf("failed to create CNAME %s: %w", aliasFQDN, err)
+			}
+			changeIDs = append(changeIDs, changeID)
+			createdRecords = append(createdRecords, DNSRecord{
+				Name:  aliasFQDN,
+				Type:  "CNAME",
+				Value: targetFQDN,
+				TTL:   dns.RecordTTL(),
+			})
+		}
+	}
+
+	// 3. Create apex A record (domain -> IP)
+	if dns.IsApexDomain {
+		if err := checkExistingRecord(ctx, r53Client, dns.ZoneID, dns.Domain, r53types.RRTypeA, "", targetIP, owned, c.ForceDNS); err != nil {
+			deleteCreatedRecords(ctx, r53Client, dns.ZoneID, createdRecords)
+			return err
+		}
+		changeID, err := createARecord(ctx, r53Client, dns.ZoneID, dns.Domain, targetIP, dns.RecordTTL())
+		if err != nil {
+			deleteCreatedRecords(ctx, r53Client, dns.ZoneID, createdRecords)
+			return fmt.Errorf("failed to create apex A record: %w", err)
+		}
+		changeIDs = append(changeIDs, changeID)
+		createdRecords = append(createdRecords, DNSRecord{
+			Name:  dns.Domain,
+			Type:  "A",
+			Value: targetIP,
+			TTL:   dns.RecordTTL(),
+		})
+		if dns.FQDN == "" {
+			dns.FQDN = dns.Domain
+		}
+	}
+
+	// 4. Create alias A records (alias FQDN -> IP), resolving each zone
+	for _, alias := range dns.Aliases {
+		aliasIP := targetIP
+		if index, ok := dns.AliasSecondaryIPs[alias]; ok {
+			if index < 1 || index > len(secondaryIPs) {
+				deleteCreatedRecords(ctx, r53Client, dns.ZoneID, createdRecords)
+				return configErrorf("alias %s wants secondary IP %d, but the instance has %d", alias, index, len(secondaryIPs))
+			}
+			aliasIP = secondaryIPs[index-1]
+		}
+		aliasZoneID := dns.ZoneID
+		if !strings.HasSuffix(alias, "."+dns.Domain) {
+			var aliasDomain string
+			var cached bool
+			aliasZoneID, aliasDomain, cached, err = c.lookupZoneForName(ctx, r53Client, alias, dns.PrivateZone)
+			if err != nil {
+				deleteCreatedRecords(ctx, r53Client, dns.ZoneID, createdRecords)
+				return fmt.Errorf("failed to lookup zone for alias %s: %w", alias, err)
+			}
+			if cached {
+				cachedDomains = append(cachedDomains, aliasDomain)
+			}
+		}
+
+		if err := checkExistingRecord(ctx, r53Client, aliasZoneID, alias, r53types.RRTypeA, "", aliasIP, owned, c.ForceDNS); err != nil {
+			deleteCreatedRecords(ctx, r53Client, dns.ZoneID, createdRecords)
+			return err
+		}
+		changeID, err := createARecord(ctx, r53Client, aliasZoneID, alias, aliasIP, dns.RecordTTL())
+		if err != nil {
+			deleteCreatedRecords(ctx, r53Client, dns.ZoneID, createdRecords)
+			return fmt.Errorf("failed to create alias A record %s: %w", alias, err)
+		}
+		changeIDs = append(changeIDs, changeID)
+		record := DNSRecord{
+			Name:  alias,
+			Type:  "A",
+			Value: aliasIP,
+			TTL:   dns.RecordTTL(),
+		}
+		if aliasZoneID != dns.ZoneID {
+			record.ZoneID = aliasZoneID
+		}
+		createdRecords = append(createdRecords, record)
+	}
+
+	// 5. Create TXT records (name.domain -> value), in name order
+	txtNames := make([]string, 0, len(dns.TXTRecords))
+	for name := range dns.TXTRecords {
+		txtNames = append(txtNames, name)
+	}
+	sort.Strings(txtNames)
+	for _, name := range txtNames {
+		record := DNSRecord{
+			Name:  txtRecordName(name, dns.Domain),
+			Type:  "TXT",
+			Value: dns.TXTRecords[name],
+			TTL:   dns.RecordTTL(),
+		}
+		if err := checkExistingRecord(ctx, r53Client, dns.ZoneID, record.Name, r53types.RRTypeTxt, "", quoteTXT(record.Value), owned, c.ForceDNS); err != nil {
+			deleteCreatedRecords(ctx, r53Client, dns.ZoneID, createdRecords)
+			return err
+		}
+		changeID, err := changeDNSRecord(ctx, r53Client, dns.ZoneID, r53types.ChangeActionUpsert, record)
+		if err != nil {
+			deleteCreatedRecords(ctx, r53Client, dns.ZoneID, createdRecords)
+			return fmt.Errorf("failed to create TXT record %s: %w", record.Name, err)
+		}
+		changeIDs = append(changeIDs, changeID)
+		createdRecords = append(createdRecords, record)
+	}
+
+	infof(ctx, "Created %d DNS record(s) successfully", len(createdRecords))
+	dns.DNSRecords = createdRecords
+	succeeded = true
+
+	if c.WaitDNS {
+		return waitForDNSChanges(ctx, r53Client, changeIDs)
+	}
+	return nil
+}
+
+func generateRandomHostname() (string, error) {
+	const charset = "abcdefghijklmnopqrstuvwxyz0123456789"
+	const length = 8
+	result := make([]byte, length)
+
+	for i := range result {
+		num, err := rand.Int(rand.Reader, big.NewInt(int64(len(charset))))
+		if err != nil {
+			return "", fmt.Errorf("failed to generate random hostname: %w", err)
+		}
+		result[i] = charset[num.Int64()]
+	}
+
+	return string(result), nil
+}
@@ -0,0 +1,49 @@
+package ec2stack
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestQuoteTXT(t *testing.T) {
+	tests := []struct {
+		name  string
+		value string
+		want  string
+	}{
+		{name: "plain", value: "v=spf1 -all", want: `"v=spf1 -all"`},
+		{name: "empty", value: "", want: `""`},
+		{name: "quotes and backslashes", value: `say "hi" \o/`, want: `"say \"hi\" \\o/"`},
+		{name: "exactly 255", value: strings.Repeat("a", 255), want: `"` + strings.Repeat("a", 255) + `"`},
+		{
+			name:  "split at 255",
+			value: strings.Repeat("a", 300),
+			want:  `"` + strings.Repeat("a", 255) + `" "` + strings.Repeat("a", 45) + `"`,
+		},
+		{
+			name:  "split into three",
+			value: strings.Repeat("b", 600),
+			want:  `"` + strings.Repeat("b", 255) + `" "` + strings.Repeat("b", 255) + `" "` + strings.Repeat("b", 90) + `"`,
+		},
+		{
+			// The escaped quote would straddle the split: it moves whole
+			// to the second string
+			name:  "escape not split",
+			value: strings.Repeat("a", 254) + `"b`,
+			want:  `"` + strings.Repeat("a", 254) + `" "\"b"`,
+		},
+		{
+			// An escaped backslash ending exactly at 255 stays whole
+			name:  "escaped backslash at the boundary",
+			value: strings.Repeat("a", 253) + `\` + "b",
+			want:  `"` + strings.Repeat("a", 253) + `\\" "b"`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := quoteTXT(tt.value); got != tt.want {
+				t.Errorf("quoteTXT() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,262 @@
+package ec2stack
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// envExemptKeys are config keys whose values are never expanded: a
+// launch_template_version may be the literal $Latest or $Default, a
+// post_create_command is a shell command expanded on the instance, and a
+// post_delete_command is expanded by the local shell with the outputs set
+var envExemptKeys = map[string]bool{
+	"launch_template_version": true,
+	"post_create_command":     true,
+	"post_delete_command":     true,
+}
+
+// envRef records a config string that referenced environment variables,
+// so WriteConfig can put the reference back instead of its value
+type envRef struct {
+	raw      string
+	expanded string
+}
+
+// expandConfigEnv expands ${VAR} and $VAR references in the string values
+// of a JSON config. $$ is a literal $. Every unset variable is reported in
+// one error rather than expanded to an empty string. The expanded strings
+// are returned by their path in the document.
+func expandConfigEnv(data []byte) ([]byte, map[string]envRef, error) {
+	if !bytes.Contains(data, []byte("$")) {
+		return data, nil, nil
+	}
+	var doc any
+	if err := json.Unmarshal(data, &doc); err != nil {
+		// Reported by the caller's own parse
+		return data, nil, nil
+	}
+
+	refs := make(map[string]envRef)
+	missing := make(map[string]bool)
+	var walk func(v any, path, key string) (any, error)
+	walk = func(v any, path, key string) (any, error) {
+		switch v := v.(type) {
+		case map[string]any:
+			for k, child := range v {
+				expanded, err := walk(child, path+"/"+k, k)
+				if err != nil {
+					return nil, err
+				}
+				v[k] = expanded
+			}
+		case []any:
+			for i, child := range v {
+				expanded, err := walk(child, path+"/"+strconv.Itoa(i), key)
+				if err != nil {
+					return nil, err
+				}
+				v[i] = expanded
+			}
+		case string:
+			if envExemptKeys[key] || !strings.Contains(v, "$") {
+				return v, nil
+			}
+			expanded, err := expandEnvString(v, missing)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", strings.TrimPrefix(path, "/"), err)
+			}
+			refs[path] = envRef{raw: v, expanded: expanded}
+			return expanded, nil
+		}
+		return v, nil
+	}
+	doc, err := walk(doc, "", "")
+	if err != nil {
+		return nil, nil, configErrorf("%v", err)
+	}
+	if len(missing) > 0 {
+		names := make([]string, 0, len(missing))
+		for name := range missing {
+			names = append(names, name)
+		}
+		slices.Sort(names)
+		return nil, nil, configErrorf("config references unset environment variable(s): %s", strings.Join(names, ", "))
+	}
+
+	data, err = json.Marshal(doc)
+	if err != nil {
+		return nil, nil, err
+	}
+	return data, refs, nil
+}
+
+// expandEnvString expands the references in s, adding unset variables to
+// missing
+func expandEnvString(s string, missing map[string]bool) (string, error) {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] != '$' || i == len(s)-1 {
+			b.WriteByte(s[i])
+			continue
+		}
+		var name string
+		switch next := s[i+1]; {
+		case next == '$':
+			b.WriteByte('$')
+			i++
+			continue
+		case next == '{':
+			end := strings.IndexByte(s[i:], '}')
+			if end < 0 {
+				return "", fmt.Errorf("unterminated ${ in %q", s)
+			}
+			name = s[i+2 : i+end]
+			if !isEnvName(name) {
+				return "", fmt.Errorf("invalid variable name %q in %q", name, s)
+			}
+			i += end
+		case isEnvNameStart(next):
+			j := i + 1
+			for j < len(s) && isEnvNameChar(s[j]) {
+				j++
+			}
+			name = s[i+1 : j]
+			i = j - 1
+		default:
+			// Not a reference, such as a trailing "$5"
+			b.WriteByte('$')
+			continue
+		}
+		value, ok := os.LookupEnv(name)
+		if !ok {
+			missing[name] = true
+		}
+		b.WriteString(value)
+	}
+	return b.String(), nil
+}
+
+func isEnvNameStart(c byte) bool {
+	return c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
+
+func isEnvNameChar(c byte) bool {
+	return isEnvNameStart(c) || (c >= '0' && c <= '9')
+}
+
+func isEnvName(name string) bool {
+	if name == "" || !isEnvNameStart(name[0]) {
+		return false
+	}
+	for i := 1; i < len(name); i++ {
+		if !isEnvNameChar(name[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+// restoreEnvRefs puts the environment references back into a marshaled
+// config, for the values that still hold what they expanded to. Key order
+// is kept so the file reads like the struct it came from.
+func restoreEnvRefs(data []byte, refs map[string]envRef) ([]byte, error) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	doc, err := decodeOrdered(dec)
+	if err != nil {
+		return nil, err
+	}
+	var walk func(v any, path string) any
+	walk = func(v any, path string) any {
+		switch v := v.(type) {
+		case *orderedTable:
+			for _, k := range v.keys {
+				v.values[k] = walk(v.values[k], path+"/"+k)
+			}
+		case []any:
+			for i, child := range v {
+				v[i] = walk(child, path+"/"+strconv.Itoa(i))
+			}
+		case string:
+			if ref, ok := refs[path]; ok && ref.expanded == v {
+				return ref.raw
+			}
+		}
+		return v
+	}
+	return json.MarshalIndent(walk(doc, ""), "", "  ")
+}
+
+// orderedTable is a JSON object with its keys in document order
+type orderedTable struct {
+	keys   []string
+	values map[string]any
+}
+
+// MarshalJSON writes the object with its keys in document order
+func (t *orderedTable) MarshalJSON() ([]byte, error) {
+	var b bytes.Buffer
+	b.WriteByte('{')
+	for i, key := range t.keys {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		k, err := json.Marshal(key)
+		if err != nil {
+			return nil, err
+		}
+		v, err := json.Marshal(t.values[key])
+		if err != nil {
+			return nil, err
+		}
+		b.Write(k)
+		b.WriteByte(':')
+		b.Write(v)
+	}
+	b.WriteByte('}')
+	return b.Bytes(), nil
+}
+
+// decodeOrdered reads one JSON value, decoding objects as *orderedTable
+func decodeOrdered(dec *json.Decoder) (any, error) {
+	tok, err := dec.Token()
+	if err != nil {
+		return nil, err
+	}
+	switch tok {
+	case json.Delim('{'):
+		t := &orderedTable{values: map[string]any{}}
+		for dec.More() {
+			keyTok, err := dec.Token()
+			if err != nil {
+				return nil, err
+			}
+			key := keyTok.(string)
+			value, err := decodeOrdered(dec)
+			if err != nil {
+				return nil, err
+			}
+			t.keys = append(t.keys, key)
+			t.values[key] = value
+		}
+		_, err := dec.Token() // }
+		return t, err
+	case json.Delim('['):
+		values := []any{}
+		for dec.More() {
+			value, err := decodeOrdered(dec)
+			if err != nil {
+				return nil, err
+			}
+			values = append(values, value)
+		}
+		_, err := dec.Token() // ]
+		return values, err
+	}
+	return tok, nil
+}
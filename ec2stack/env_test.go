@@ -0,0 +1,214 @@
+package ec2stack
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestExpandEnvString(t *testing.T) {
+	t.Setenv("EC2_TEST_NAME", "dev")
+	t.Setenv("EC2_TEST_EMPTY", "")
+
+	tests := []struct {
+		name        string
+		in          string
+		want        string
+		wantMissing string
+		wantErr     string
+	}{
+		{name: "braced", in: "${EC2_TEST_NAME}.example.com", want: "dev.example.com"},
+		{name: "bare", in: "web-$EC2_TEST_NAME-1", want: "web-dev-1"},
+		{name: "set but empty", in: "a${EC2_TEST_EMPTY}b", want: "ab"},
+		{name: "escaped dollar", in: "cost $$5", want: "cost $5"},
+		{name: "dollar before a digit", in: "$5 off", want: "$5 off"},
+		{name: "trailing dollar", in: "end$", want: "end$"},
+		{name: "unset", in: "${EC2_TEST_UNSET}", want: "", wantMissing: "EC2_TEST_UNSET"},
+		{name: "unterminated", in: "${EC2_TEST_NAME", wantErr: "unterminated ${"},
+		{name: "invalid name", in: "${1ABC}", wantErr: `invalid variable name "1ABC"`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			missing := make(map[string]bool)
+			got, err := expandEnvString(tt.in, missing)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("expandEnvString(%q) error = %v, want it to contain %q", tt.in, err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("expandEnvString(%q) error = %v", tt.in, err)
+			}
+			if got != tt.want {
+				t.Errorf("expandEnvString(%q) = %q, want %q", tt.in, got, tt.want)
+			}
+			if tt.wantMissing != "" && !missing[tt.wantMissing] {
+				t.Errorf("expandEnvString(%q) did not report %s as unset", tt.in, tt.wantMissing)
+			}
+			if tt.wantMissing == "" && len(missing) > 0 {
+				t.Errorf("expandEnvString(%q) reported %v as unset", tt.in, missing)
+			}
+		})
+	}
+}
+
+func TestExpandConfigEnv(t *testing.T) {
+	t.Setenv("EC2_TEST_REGION", "eu-west-1")
+
+	tests := []struct {
+		name     string
+		in       string
+		want     string
+		wantRefs []string
+		wantErr  string
+	}{
+		{
+			name: "no references",
+			in:   `{"vm":{"region":"us-east-1"}}`,
+			want: `{"vm":{"region":"us-east-1"}}`,
+		},
+		{
+			name:     "nested values",
+			in:       `{"vm":{"region":"$EC2_TEST_REGION","packages":["a","${EC2_TEST_REGION}-b"]}}`,
+			want:     `{"vm":{"packages":["a","eu-west-1-b"],"region":"eu-west-1"}}`,
+			wantRefs: []string{"/vm/region", "/vm/packages/1"},
+		},
+		{
+			name: "exempt keys",
+			in:   `{"vm":{"launch_template_version":"$Latest","post_create_command":"echo $HOME"}}`,
+			want: `{"vm":{"launch_template_version":"$Latest","post_create_command":"echo $HOME"}}`,
+		},
+		{
+			name:    "every unset variable reported",
+			in:      `{"vm":{"region":"$EC2_TEST_B","os":"$EC2_TEST_A"}}`,
+			wantErr: "unset environment variable(s): EC2_TEST_A, EC2_TEST_B",
+		},
+		{
+			name:    "invalid reference",
+			in:      `{"dns":{"domain":"${EC2_TEST_REGION"}}`,
+			wantErr: "dns/domain: unterminated ${",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, refs, err := expandConfigEnv([]byte(tt.in))
+			if tt.wantErr != "" {
+				var cfgErr *ConfigError
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) || !errors.As(err, &cfgErr) {
+					t.Fatalf("expandConfigEnv() error = %v, want a ConfigError containing %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("expandConfigEnv() error = %v", err)
+			}
+			if string(got) != tt.want {
+				t.Errorf("expandConfigEnv() = %s, want %s", got, tt.want)
+			}
+			if len(refs) != len(tt.wantRefs) {
+				t.Errorf("expandConfigEnv() recorded %d references, want %d", len(refs), len(tt.wantRefs))
+			}
+			for _, path := range tt.wantRefs {
+				if _, ok := refs[path]; !ok {
+					t.Errorf("expandConfigEnv() did not record the reference at %s", path)
+				}
+			}
+		})
+	}
+}
+
+func TestRestoreEnvRefs(t *testing.T) {
+	refs := map[string]envRef{
+		"/vm/region":     {raw: "$REGION", expanded: "eu-west-1"},
+		"/vm/packages/0": {raw: "${PKG}", expanded: "git"},
+		"/dns/domain":    {raw: "$DOMAIN", expanded: "example.com"},
+	}
+	tests := []struct {
+		name string
+		in   string
+		want string
+	}{
+		{
+			name: "unchanged values get their reference back",
+			in:   `{"vm":{"region":"eu-west-1","packages":["git","vim"]}}`,
+			want: `{"vm":{"region":"$REGION","packages":["${PKG}","vim"]}}`,
+		},
+		{
+			name: "changed values are kept",
+			in:   `{"vm":{"region":"us-east-1"},"dns":{"domain":"example.com"}}`,
+			want: `{"vm":{"region":"us-east-1"},"dns":{"domain":"$DOMAIN"}}`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := restoreEnvRefs([]byte(tt.in), refs)
+			if err != nil {
+				t.Fatalf("restoreEnvRefs() error = %v", err)
+			}
+			compact := strings.Join(strings.Fields(string(got)), "")
+			if want := strings.ReplaceAll(tt.want, " ", ""); compact != want {
+				t.Errorf("restoreEnvRefs() = %s, want %s", compact, want)
+			}
+		})
+	}
+}
+
+func TestWriteConfigKeepsEnvRefs(t *testing.T) {
+	t.Setenv("EC2_TEST_REGION", "eu-west-1")
+	t.Setenv("EC2_TEST_USER", "alice")
+	t.Setenv("EC2_TEST_DOMAIN", "example.com")
+
+	tests := []struct {
+		name   string
+		config string
+		file   string
+		want   []string
+	}{
+		{
+			name:   "nested",
+			config: `{"vm": {"region": "$EC2_TEST_REGION", "users": [{"username": "alice", "github_username": "$EC2_TEST_USER"}]}, "dns": {"domain": "${EC2_TEST_DOMAIN}"}}`,
+			file:   "web.json",
+			want:   []string{`"region": "$EC2_TEST_REGION"`, `"github_username": "$EC2_TEST_USER"`, `"domain": "${EC2_TEST_DOMAIN}"`},
+		},
+		{
+			name:   "legacy flat",
+			config: `{"region": "$EC2_TEST_REGION", "github_username": "$EC2_TEST_USER", "domain": "${EC2_TEST_DOMAIN}", "public_ip": "203.0.113.7"}`,
+			file:   "web.json",
+			want:   []string{`"region": "$EC2_TEST_REGION"`, `"github_username": "$EC2_TEST_USER"`, `"domain": "${EC2_TEST_DOMAIN}"`},
+		},
+		{
+			name:   "TOML",
+			config: `{"vm": {"region": "$EC2_TEST_REGION", "users": [{"username": "alice", "github_username": "$EC2_TEST_USER"}]}, "dns": {"domain": "${EC2_TEST_DOMAIN}"}}`,
+			file:   "web.toml",
+			want:   []string{`region = '$EC2_TEST_REGION'`, `github_username = '$EC2_TEST_USER'`, `domain = '${EC2_TEST_DOMAIN}'`},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := parseTestConfig(t, tt.config)
+			if cfg.VM.Region != "eu-west-1" || cfg.DNS.Domain != "example.com" {
+				t.Fatalf("ParseConfig() region = %q, domain = %q, want them expanded", cfg.VM.Region, cfg.DNS.Domain)
+			}
+
+			path := filepath.Join(t.TempDir(), tt.file)
+			if err := WriteConfig(path, cfg); err != nil {
+				t.Fatalf("WriteConfig() error = %v", err)
+			}
+			data, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, want := range tt.want {
+				if !strings.Contains(string(data), want) {
+					t.Errorf("WriteConfig() wrote\n%s\nwant it to contain %s", data, want)
+				}
+			}
+			if strings.Contains(string(data), "eu-west-1") {
+				t.Errorf("WriteConfig() wrote the expanded region:\n%s", data)
+			}
+		})
+	}
+}
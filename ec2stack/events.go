@@ -0,0 +1,193 @@
+package ec2stack
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/cloudformation"
+	"github.com/aws/aws-sdk-go-v2/service/cloudformation/types"
+)
+
+// eventPollInterval is how often stack events are polled while waiting
+const eventPollInterval = 5 * time.Second
+
+// tailStackEvents prints stack events as they arrive until done is closed,
+// then prints any events left over from the final poll. Events from before
+// since are skipped. The resource in progress is recorded in progress,
+// which may be nil.
+func tailStackEvents(ctx context.Context, cfClient *cloudformation.Client, stackName string, since time.Time, done <-chan struct{}, progress *waitProgress) {
+	seen := make(map[string]bool)
+	ticker := time.NewTicker(eventPollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-done:
+			printNewStackEvents(ctx, cfClient, stackName, since, seen, progress)
+			return
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			printNewStackEvents(ctx, cfClient, stackName, since, seen, progress)
+		}
+	}
+}
+
+// printNewStackEvents prints events not yet in seen and not before since,
+// oldest first. Errors are ignored; the waiter reports stack failures.
+func printNewStackEvents(ctx context.Context, cfClient *cloudformation.Client, stackName string, since time.Time, seen map[string]bool, progress *waitProgress) {
+	var events []types.StackEvent
+	paginator := cloudformation.NewDescribeStackEventsPaginator(cfClient, &cloudformation.DescribeStackEventsInput{
+		StackName: aws.String(stackName),
+	})
+	// Events are returned newest first, so stop at the first page with an event already shown
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return
+		}
+		done := false
+		for _, event := range page.StackEvents {
+			if seen[aws.ToString(event.EventId)] {
+				done = true
+				break
+			}
+			events = append(events, event)
+		}
+		if done {
+			break
+		}
+	}
+
+	slices.Reverse(events)
+	for _, event := range events {
+		seen[aws.ToString(event.EventId)] = true
+		if aws.ToTime(event.Timestamp).Before(since) {
+			continue
+		}
+		printStackEvent(ctx, event)
+		progress.update(stackName, event)
+	}
+}
+
+func printStackEvent(ctx context.Context, event types.StackEvent) {
+	timestamp := ""
+	if event.Timestamp != nil {
+		timestamp = event.Timestamp.Local().Format("15:04:05")
+	}
+	line := fmt.Sprintf("  %s  %-32s %-28s %s", timestamp, aws.ToString(event.LogicalResourceId), aws.ToString(event.ResourceType), event.ResourceStatus)
+	if reason := aws.ToString(event.ResourceStatusReason); reason != "" {
+		line += "  " + reason
+	}
+	infof(ctx, "%s", line)
+
+	if strings.HasSuffix(string(event.ResourceStatus), "_FAILED") {
+		errorf(ctx, "%s %s: %s", aws.ToString(event.LogicalResourceId), event.ResourceStatus, aws.ToString(event.ResourceStatusReason))
+	}
+}
+
+// StackEvent is one CloudFormation stack event, for an audit record of a
+// create or delete
+type StackEvent struct {
+	Timestamp            time.Time `json:"timestamp"`
+	StackName            string    `json:"stack_name"`
+	LogicalResourceID    string    `json:"logical_resource_id"`
+	PhysicalResourceID   string    `json:"physical_resource_id,omitempty"`
+	ResourceType         string    `json:"resource_type"`
+	ResourceStatus       string    `json:"resource_status"`
+	ResourceStatusReason string    `json:"resource_status_reason,omitempty"`
+}
+
+// StackEvents returns the event history of the given stacks from since on,
+// oldest first; a zero since returns all of it. Stack IDs rather than names
+// are needed so deleted stacks can still be read; the region is taken from
+// each ID.
+func (c *Client) StackEvents(ctx context.Context, stackIDs []string, since time.Time) ([]StackEvent, error) {
+	var events []StackEvent
+	for _, stackID := range stackIDs {
+		region, err := stackIDRegion(stackID)
+		if err != nil {
+			return nil, err
+		}
+		awsCfg, err := c.LoadAWSConfig(ctx, region)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load AWS config: %w", err)
+		}
+		paginator := cloudformation.NewDescribeStackEventsPaginator(cloudformation.NewFromConfig(awsCfg), &cloudformation.DescribeStackEventsInput{
+			StackName: aws.String(stackID),
+		})
+		for paginator.HasMorePages() {
+			page, err := paginator.NextPage(ctx)
+			if err != nil {
+				return nil, fmt.Errorf("failed to describe stack events for %s: %w", stackID, err)
+			}
+			for _, event := range page.StackEvents {
+				if aws.ToTime(event.Timestamp).Before(since) {
+					continue
+				}
+				events = append(events, StackEvent{
+					Timestamp:            aws.ToTime(event.Timestamp),
+					StackName:            aws.ToString(event.StackName),
+					LogicalResourceID:    aws.ToString(event.LogicalResourceId),
+					PhysicalResourceID:   aws.ToString(event.PhysicalResourceId),
+					ResourceType:         aws.ToString(event.ResourceType),
+					ResourceStatus:       string(event.ResourceStatus),
+					ResourceStatusReason: aws.ToString(event.ResourceStatusReason),
+				})
+			}
+		}
+	}
+
+	// Pages are newest first; a stable sort keeps same-second events in
+	// the order CloudFormation recorded them
+	slices.Reverse(events)
+	slices.SortStableFunc(events, func(a, b StackEvent) int {
+		return a.Timestamp.Compare(b.Timestamp)
+	})
+	return events, nil
+}
+
+// printStackFailures prints the resources that failed in a stack, so a
+// rollback can be diagnosed without opening the console
+func printStackFailures(ctx context.Context, cfClient *cloudformation.Client, stackName string) {
+	var failed []types.StackEvent
+	paginator := cloudformation.NewDescribeStackEventsPaginator(cfClient, &cloudformation.DescribeStackEventsInput{
+		StackName: aws.String(stackName),
+	})
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			warnf(ctx, "could not fetch stack events: %v", err)
+			return
+		}
+		for _, event := range page.StackEvents {
+			if strings.Contains(string(event.ResourceStatus), "FAILED") {
+				failed = append(failed, event)
+			}
+		}
+	}
+
+	// Logged as errors so they still show with -q
+	kmsFailure := false
+	if len(failed) > 0 {
+		var b strings.Builder
+		b.WriteString("failed resources:")
+		slices.Reverse(failed)
+		for _, event := range failed {
+			reason := aws.ToString(event.ResourceStatusReason)
+			fmt.Fprintf(&b, "\n  %-32s %-22s %s", aws.ToString(event.LogicalResourceId), event.ResourceStatus, reason)
+			if strings.Contains(reason, "KMS") {
+				kmsFailure = true
+			}
+		}
+		errorf(ctx, "%s", b.String())
+	}
+	if kmsFailure {
+		errorf(ctx, "the KMS key could not be used. Check that it exists in this region, is enabled, and that its key policy lets you and EC2 use it (kms:CreateGrant, kms:Decrypt, kms:GenerateDataKeyWithoutPlaintext, kms:ReEncrypt*).")
+	}
+	errorf(ctx, "a rolled back stack cannot be updated; run -delete -n %s to clean it up.", stackName)
+}
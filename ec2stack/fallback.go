@@ -0,0 +1,106 @@
+package ec2stack
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/cloudformation"
+	"github.com/aws/aws-sdk-go-v2/service/cloudformation/types"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+)
+
+// capacityReasons are the fragments of a failed resource's status reason
+// that mean EC2 had no capacity for the instance type, so another type may
+// still launch
+var capacityReasons = []string{
+	"InsufficientInstanceCapacity",
+	"do not have sufficient",
+}
+
+// createVMWithFallback creates the VM stack with each of the types
+// vm.InstanceType lists in turn, until one launches. A stack that rolled
+// back for lack of capacity is deleted before the next type is tried; any
+// other failure ends the create. vm.InstanceType keeps the list and the
+// type that launched is recorded in vm.LaunchedInstanceType. A single type
+// is created as is.
+func (c *Client) createVMWithFallback(ctx context.Context, vm *VMConfig, dns *DNSConfig, stackName string, tags []types.Tag) (string, string, error) {
+	instanceTypes := vm.InstanceTypes()
+	if len(instanceTypes) < 2 {
+		return c.createVMResources(ctx, vm, dns, stackName, tags)
+	}
+
+	// Check the whole list up front, so a type that is not offered does
+	// not only turn up after a rollback
+	awsCfg, err := c.LoadAWSConfig(ctx, vm.Region)
+	if err != nil {
+		return "", "", fmt.Errorf("failed to load AWS config: %w", err)
+	}
+	ec2Client := ec2.NewFromConfig(awsCfg)
+	for _, instanceType := range instanceTypes {
+		if err := c.checkInstanceTypeOffered(ctx, ec2Client, vm.Region, instanceType); err != nil {
+			return "", "", err
+		}
+	}
+	cfClient := cloudformation.NewFromConfig(awsCfg)
+	infof(ctx, "Instance types to try: %s", strings.Join(instanceTypes, ", "))
+
+	list := vm.InstanceType
+	defer func() { vm.InstanceType = list }()
+	vm.LaunchedInstanceType = ""
+	for i, instanceType := range instanceTypes {
+		vm.InstanceType = instanceType
+		publicIP, region, err := c.createVMResources(ctx, vm, dns, stackName, tags)
+		if err == nil {
+			vm.LaunchedInstanceType = instanceType
+			infoWith(ctx, fmt.Sprintf("Launched instance type: %s", instanceType), "instance_type", instanceType)
+			return publicIP, region, nil
+		}
+		if vm.StackID == "" || i == len(instanceTypes)-1 || ctx.Err() != nil {
+			return "", "", err
+		}
+
+		reason, ok := capacityFailure(ctx, cfClient, vm.StackID)
+		if !ok {
+			return "", "", err
+		}
+		next := instanceTypes[i+1]
+		warnf(ctx, "no capacity for %s: %s", instanceType, reason)
+		infof(ctx, "Deleting the rolled back stack to retry with %s...", next)
+		if derr := deleteCloudFormationStack(ctx, cfClient, vm.StackID, c.cfnRoleARN(vm)); derr != nil {
+			return "", "", fmt.Errorf("%w (deleting the stack to retry with %s failed: %v)", err, next, derr)
+		}
+		vm.StackName = ""
+		vm.StackID = ""
+	}
+	// Not reached: the last type returns above
+	return "", "", fmt.Errorf("no instance type to create")
+}
+
+// capacityFailure returns the reason a resource of the stack stackID failed
+// for lack of EC2 capacity, and whether there is one
+func capacityFailure(ctx context.Context, cfClient *cloudformation.Client, stackID string) (string, bool) {
+	paginator := cloudformation.NewDescribeStackEventsPaginator(cfClient, &cloudformation.DescribeStackEventsInput{
+		StackName: aws.String(stackID),
+	})
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			warnf(ctx, "could not fetch stack events: %v", err)
+			return "", false
+		}
+		for _, event := range page.StackEvents {
+			if event.ResourceStatus != types.ResourceStatusCreateFailed {
+				continue
+			}
+			reason := aws.ToString(event.ResourceStatusReason)
+			for _, fragment := range capacityReasons {
+				if strings.Contains(reason, fragment) {
+					return reason, true
+				}
+			}
+		}
+	}
+	return "", false
+}
@@ -0,0 +1,234 @@
+package ec2stack
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/cloudformation"
+	"github.com/aws/aws-sdk-go-v2/service/cloudformation/types"
+	"github.com/aws/aws-sdk-go-v2/service/route53"
+	r53types "github.com/aws/aws-sdk-go-v2/service/route53/types"
+)
+
+// ForceDeleteStack deletes the stack called stackName in region without
+// reading a local config. What the config would record is read from the
+// stack instead: its outputs give the instance's IPs and its FQDN tag the
+// DNS name. Records that point at the instance in the hosted zone for that
+// name are deleted on a best-effort basis before the stack. Only stacks
+// tagged Purpose=EC2Instance are deleted. An empty region falls back to the
+// AWS config, then us-east-1.
+func (c *Client) ForceDeleteStack(ctx context.Context, stackName, region string) error {
+	ctx = withStack(ctx, stackName)
+	awsCfg, err := c.LoadAWSConfig(ctx, region)
+	if err != nil {
+		return fmt.Errorf("failed to load AWS config: %w", err)
+	}
+	if awsCfg.Region == "" {
+		awsCfg.Region = defaultRegion
+	}
+	cfClient := cloudformation.NewFromConfig(awsCfg)
+
+	result, err := cfClient.DescribeStacks(ctx, &cloudformation.DescribeStacksInput{
+		StackName: aws.String(stackName),
+	})
+	if err != nil {
+		if isStackNotFound(err) {
+			return configErrorf("stack %s not found in %s (use -region to look in another region)", stackName, awsCfg.Region)
+		}
+		return fmt.Errorf("failed to describe stack: %w", err)
+	}
+	if len(result.Stacks) == 0 {
+		return configErrorf("stack %s not found in %s (use -region to look in another region)", stackName, awsCfg.Region)
+	}
+	stack := result.Stacks[0]
+	if !hasTag(stack.Tags, "Purpose", "EC2Instance") {
+		return configErrorf("stack %s has no Purpose=EC2Instance tag, so it was not created by this tool; refusing to delete it", stackName)
+	}
+
+	infof(ctx, "Using AWS Region: %s", awsCfg.Region)
+	infof(ctx, "Force-deleting Stack: %s", stackName)
+	infof(ctx, "Note: no config file is used, so network resources and user data in S3 are not cleaned up")
+
+	if err := c.checkTerminationProtection(ctx, cfClient, stackName); err != nil {
+		return err
+	}
+
+	if c.KeepDNS {
+		infof(ctx, "Keeping DNS records (-keep-dns)")
+	} else {
+		c.deleteDiscoveredRecords(ctx, route53.NewFromConfig(awsCfg), stack)
+	}
+
+	if err := deleteCloudFormationStack(ctx, cfClient, stackName, c.cfnRoleARN(nil)); err != nil {
+		return err
+	}
+
+	infof(ctx, "Stack deleted successfully")
+	return nil
+}
+
+// deleteDiscoveredRecords deletes the records a create of stack most likely
+// made, found from its FQDN tag and IP outputs: the A records named exactly
+// the FQDN in the hosted zones for it, when every value is the instance's
+// IP, and CNAMEs to the name. The private IP only counts in a private zone,
+// as other VPCs reuse it. Aliases in other zones and TXT records cannot be
+// found this way. Failures are warned about; the stack is deleted anyway.
+func (c *Client) deleteDiscoveredRecords(ctx context.Context, r53Client *route53.Client, stack types.Stack) {
+	fqdn := ""
+	for _, tag := range stack.Tags {
+		if aws.ToString(tag.Key) == "FQDN" {
+			fqdn = strings.TrimSuffix(aws.ToString(tag.Value), ".")
+		}
+	}
+	if fqdn == "" {
+		infof(ctx, "The stack has no FQDN tag, so there are no DNS records to look for")
+		return
+	}
+	var publicIP, privateIP string
+	for _, output := range stack.Outputs {
+		switch aws.ToString(output.OutputKey) {
+		case "PublicIP":
+			publicIP = aws.ToString(output.OutputValue)
+		case "PrivateIP":
+			privateIP = aws.ToString(output.OutputValue)
+		}
+	}
+	if publicIP == "" && privateIP == "" {
+		infof(ctx, "The stack has no IP outputs, so there are no DNS records to look for")
+		return
+	}
+
+	zones, err := discoverZones(ctx, r53Client, fqdn)
+	if err != nil {
+		warnf(ctx, "DNS records are left alone: %v", err)
+		return
+	}
+	if len(zones) == 0 {
+		warnf(ctx, "no hosted zone found for %s; DNS records are left alone", fqdn)
+		return
+	}
+
+	infof(ctx, "Looking for DNS records of %s...", fqdn)
+	var changeIDs, healthChecks []string
+	for _, zone := range zones {
+		zoneID := zone.id
+		ips := make(map[string]bool)
+		if publicIP != "" {
+			ips[publicIP] = true
+		}
+		if zone.private && privateIP != "" {
+			ips[privateIP] = true
+		}
+		paginator := route53.NewListResourceRecordSetsPaginator(r53Client, &route53.ListResourceRecordSetsInput{
+			HostedZoneId: aws.String(zoneID),
+		})
+		for paginator.HasMorePages() {
+			page, err := paginator.NextPage(ctx)
+			if err != nil {
+				warnf(ctx, "failed to list records in zone %s: %v", zoneID, err)
+				break
+			}
+			for _, rrset := range page.ResourceRecordSets {
+				if !pointsAtInstance(rrset, fqdn, ips) {
+					continue
+				}
+				name := strings.TrimSuffix(aws.ToString(rrset.Name), ".")
+				infof(ctx, "  Deleting %s record: %s", rrset.Type, name)
+				changeID, err := applyDNSChange(ctx, r53Client, &route53.ChangeResourceRecordSetsInput{
+					HostedZoneId: aws.String(zoneID),
+					ChangeBatch: &r53types.ChangeBatch{
+						Changes: []r53types.Change{
+							{Action: r53types.ChangeActionDelete, ResourceRecordSet: &rrset},
+						},
+					},
+				})
+				if err != nil {
+					warnf(ctx, "failed to delete DNS record %s: %v", name, err)
+					continue
+				}
+				changeIDs = append(changeIDs, changeID)
+				if rrset.HealthCheckId != nil {
+					healthChecks = append(healthChecks, aws.ToString(rrset.HealthCheckId))
+				}
+			}
+		}
+	}
+	if len(changeIDs) == 0 {
+		infof(ctx, "No DNS records point at the instance")
+		return
+	}
+	infof(ctx, "Deleted %d DNS record(s)", len(changeIDs))
+	if c.WaitDNS {
+		if err := waitForDNSChanges(ctx, r53Client, changeIDs); err != nil {
+			warnf(ctx, "%v", err)
+		}
+	}
+
+	// The health check can only be removed once no record references it
+	for _, id := range healthChecks {
+		if err := deleteHealthCheck(ctx, r53Client, id); err != nil {
+			warnf(ctx, "failed to delete health check %s: %v", id, err)
+		} else {
+			infof(ctx, "Deleted health check: %s", id)
+		}
+	}
+}
+
+// discoveredZone is a hosted zone force-delete looks for records in
+type discoveredZone struct {
+	id      string
+	private bool
+}
+
+// discoverZones returns the public and private hosted zones for the most
+// specific domain of fqdn that has any, trying fqdn itself first
+func discoverZones(ctx context.Context, r53Client *route53.Client, fqdn string) ([]discoveredZone, error) {
+	labels := strings.Split(fqdn, ".")
+	// A zone needs at least a second-level name
+	for i := 0; i < len(labels)-1; i++ {
+		domain := strings.Join(labels[i:], ".")
+		var zones []discoveredZone
+		for _, private := range []bool{false, true} {
+			zoneID, err := lookupZoneID(ctx, r53Client, domain, private)
+			if errors.Is(err, errZoneNotFound) {
+				continue
+			}
+			if err != nil {
+				return nil, err
+			}
+			zones = append(zones, discoveredZone{id: zoneID, private: private})
+		}
+		if len(zones) > 0 {
+			return zones, nil
+		}
+	}
+	return nil, nil
+}
+
+// pointsAtInstance reports whether rrset is an A record for fqdn answering
+// only with ips, or a CNAME to fqdn. An A record of another name is never
+// the instance's, whatever its values: IPs are recycled.
+func pointsAtInstance(rrset r53types.ResourceRecordSet, fqdn string, ips map[string]bool) bool {
+	if rrset.AliasTarget != nil || len(rrset.ResourceRecords) == 0 {
+		return false
+	}
+	switch rrset.Type {
+	case r53types.RRTypeA:
+		if !strings.EqualFold(strings.TrimSuffix(aws.ToString(rrset.Name), "."), fqdn) {
+			return false
+		}
+		for _, rr := range rrset.ResourceRecords {
+			if !ips[aws.ToString(rr.Value)] {
+				return false
+			}
+		}
+		return true
+	case r53types.RRTypeCname:
+		target := strings.TrimSuffix(aws.ToString(rrset.ResourceRecords[0].Value), ".")
+		return strings.EqualFold(target, fqdn)
+	}
+	return false
+}
@@ -0,0 +1,139 @@
+package ec2stack
+
+import (
+	"context"
+	"errors"
+	"maps"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	r53types "github.com/aws/aws-sdk-go-v2/service/route53/types"
+)
+
+func TestPointsAtInstance(t *testing.T) {
+	ips := map[string]bool{"203.0.113.7": true}
+	record := func(name string, rrType r53types.RRType, values ...string) r53types.ResourceRecordSet {
+		rrset := r53types.ResourceRecordSet{Name: aws.String(name), Type: rrType}
+		for _, v := range values {
+			rrset.ResourceRecords = append(rrset.ResourceRecords, r53types.ResourceRecord{Value: aws.String(v)})
+		}
+		return rrset
+	}
+	alias := record("web.example.com.", r53types.RRTypeA)
+	alias.AliasTarget = &r53types.AliasTarget{DNSName: aws.String("lb.example.com.")}
+
+	tests := []struct {
+		name  string
+		rrset r53types.ResourceRecordSet
+		want  bool
+	}{
+		{name: "A record of the name", rrset: record("Web.Example.com.", r53types.RRTypeA, "203.0.113.7"), want: true},
+		{name: "A record with another value", rrset: record("web.example.com.", r53types.RRTypeA, "203.0.113.7", "198.51.100.1")},
+		{name: "A record of another name", rrset: record("old.example.com.", r53types.RRTypeA, "203.0.113.7")},
+		{name: "CNAME to the name", rrset: record("www.example.com.", r53types.RRTypeCname, "web.example.com."), want: true},
+		{name: "CNAME elsewhere", rrset: record("www.example.com.", r53types.RRTypeCname, "api.example.com.")},
+		{name: "alias", rrset: alias},
+		{name: "TXT", rrset: record("web.example.com.", r53types.RRTypeTxt, `"203.0.113.7"`)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := pointsAtInstance(tt.rrset, "web.example.com", ips); got != tt.want {
+				t.Errorf("pointsAtInstance() = %t, want %t", got, tt.want)
+			}
+		})
+	}
+}
+
+// taggedStackResponse answers DescribeStacks with a stack named web that
+// has the given tags, as key=value pairs, and public IP output
+func taggedStackResponse(tags ...string) string {
+	var b strings.Builder
+	for _, tag := range tags {
+		key, value, _ := strings.Cut(tag, "=")
+		b.WriteString(`<member><Key>` + key + `</Key><Value>` + value + `</Value></member>`)
+	}
+	return describeStacksResponse(`<member><StackName>web</StackName><StackStatus>CREATE_COMPLETE</StackStatus><Tags>` + b.String() + `</Tags>` +
+		`<Outputs><member><OutputKey>PublicIP</OutputKey><OutputValue>203.0.113.7</OutputValue></member></Outputs></member>`)
+}
+
+func TestClientForceDeleteStack(t *testing.T) {
+	const (
+		zones = "GET /2013-04-01/hostedzonesbyname"
+		rrset = "/2013-04-01/hostedzone/Z0123456789ABC/rrset"
+	)
+	tagged := taggedStackResponse("Purpose=EC2Instance", "FQDN=web.example.com")
+	dnsResponses := map[string][]string{
+		"DescribeStacks": {tagged, tagged, tagged, stackGoneResponse},
+		"DeleteStack":    {`<DeleteStackResponse></DeleteStackResponse>`},
+		zones:            {`<ListHostedZonesByNameResponse><HostedZones><HostedZone><Id>/hostedzone/Z0123456789ABC</Id><Name>example.com.</Name><CallerReference>1</CallerReference><Config><PrivateZone>false</PrivateZone></Config></HostedZone></HostedZones><IsTruncated>false</IsTruncated><MaxItems>100</MaxItems></ListHostedZonesByNameResponse>`},
+		"POST " + rrset:  {changeRecordsResponse},
+		"GET " + rrset: {listRecordsResponse(
+			`<ResourceRecordSet><Name>web.example.com.</Name><Type>A</Type><TTL>300</TTL><ResourceRecords><ResourceRecord><Value>203.0.113.7</Value></ResourceRecord></ResourceRecords></ResourceRecordSet>`,
+			`<ResourceRecordSet><Name>old.example.com.</Name><Type>A</Type><TTL>300</TTL><ResourceRecords><ResourceRecord><Value>203.0.113.7</Value></ResourceRecord></ResourceRecords></ResourceRecordSet>`,
+			`<ResourceRecordSet><Name>www.example.com.</Name><Type>CNAME</Type><TTL>300</TTL><ResourceRecords><ResourceRecord><Value>web.example.com</Value></ResourceRecord></ResourceRecords></ResourceRecordSet>`,
+		)},
+	}
+
+	tests := []struct {
+		name        string
+		keepDNS     bool
+		responses   map[string][]string
+		wantErr     string
+		wantDeletes int      // DeleteStack calls
+		wantRecords []string // names of the records deleted
+	}{
+		{
+			name:      "not found",
+			responses: map[string][]string{"DescribeStacks": {stackGoneResponse}},
+			wantErr:   "stack web not found in us-west-2",
+		},
+		{
+			name:      "not created by this tool",
+			responses: map[string][]string{"DescribeStacks": {taggedStackResponse("Purpose=Database")}},
+			wantErr:   "stack web has no Purpose=EC2Instance tag",
+		},
+		{
+			name:        "records then stack deleted",
+			responses:   dnsResponses,
+			wantDeletes: 1,
+			wantRecords: []string{"web.example.com.", "www.example.com."},
+		},
+		{
+			name:        "records kept",
+			keepDNS:     true,
+			responses:   dnsResponses,
+			wantDeletes: 1,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// The stub consumes responses, and two cases share them
+			stub := &stubAWS{responses: maps.Clone(tt.responses)}
+			c := newStubClient(t, stub)
+			c.KeepDNS = tt.keepDNS
+
+			err := c.ForceDeleteStack(context.Background(), "web", "us-west-2")
+			if tt.wantErr != "" {
+				var cfgErr *ConfigError
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) || !errors.As(err, &cfgErr) {
+					t.Fatalf("ForceDeleteStack() error = %v, want a ConfigError containing %q", err, tt.wantErr)
+				}
+			} else if err != nil {
+				t.Fatalf("ForceDeleteStack() error = %v", err)
+			}
+			if got := stub.calls["DeleteStack"]; got != tt.wantDeletes {
+				t.Errorf("DeleteStack called %d times, want %d", got, tt.wantDeletes)
+			}
+			changes := stub.bodies["POST "+rrset]
+			if len(changes) != len(tt.wantRecords) {
+				t.Fatalf("deleted %d records, want %v", len(changes), tt.wantRecords)
+			}
+			for i, name := range tt.wantRecords {
+				if !strings.Contains(changes[i], "<Action>DELETE</Action>") || !strings.Contains(changes[i], "<Name>"+name+"</Name>") {
+					t.Errorf("change %d = %s, want the deletion of %s", i, changes[i], name)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,141 @@
+package ec2stack
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	"github.com/aws/aws-sdk-go-v2/service/ssm"
+)
+
+const (
+	// hostKeyTimeout bounds the wait for an instance's host keys to show
+	// up in its console output
+	hostKeyTimeout = 5 * time.Minute
+
+	// hostKeyPollInterval is the pause between console output reads
+	hostKeyPollInterval = 10 * time.Second
+)
+
+// cloud-init prints the host keys between these lines on the console
+const (
+	hostKeysBegin = "-----BEGIN SSH HOST KEY KEYS-----"
+	hostKeysEnd   = "-----END SSH HOST KEY KEYS-----"
+)
+
+// HostKeys returns an instance's SSH host public keys as "<type> <key>"
+// lines. With enable_ssm they are read from /etc/ssh through SSM;
+// otherwise from the block cloud-init prints on the console, which can
+// take a few minutes to appear. A member of a regions config is looked up
+// in its own region.
+func (c *Client) HostKeys(ctx context.Context, vm *VMConfig, instanceID string) ([]string, error) {
+	region := vm.Region
+	for _, inst := range vm.Instances {
+		if inst.InstanceID == instanceID && inst.Region != "" {
+			region = inst.Region
+		}
+	}
+	awsCfg, err := c.LoadAWSConfig(ctx, region)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load AWS config: %w", err)
+	}
+	if vm.EnableSSM {
+		return hostKeysFromSSM(ctx, ssm.NewFromConfig(awsCfg), instanceID)
+	}
+	return hostKeysFromConsole(ctx, ec2.NewFromConfig(awsCfg), instanceID)
+}
+
+func hostKeysFromSSM(ctx context.Context, ssmClient *ssm.Client, instanceID string) ([]string, error) {
+	if err := waitForSSMAgent(ctx, ssmClient, instanceID); err != nil {
+		return nil, err
+	}
+	inv, err := runSSMCommand(ctx, ssmClient, instanceID, []string{"cat /etc/ssh/ssh_host_*_key.pub"})
+	if err != nil {
+		return nil, err
+	}
+	keys := parseHostKeys(aws.ToString(inv.StandardOutputContent))
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("no host keys found in /etc/ssh on %s", instanceID)
+	}
+	return keys, nil
+}
+
+func hostKeysFromConsole(ctx context.Context, ec2Client *ec2.Client, instanceID string) ([]string, error) {
+	ctx, cancel := context.WithTimeout(ctx, hostKeyTimeout)
+	defer cancel()
+
+	// The latest output needs a Nitro instance; older types only have the
+	// buffered output, which lags a few minutes behind
+	latest := true
+	for {
+		result, err := ec2Client.GetConsoleOutput(ctx, &ec2.GetConsoleOutputInput{
+			InstanceId: aws.String(instanceID),
+			Latest:     aws.Bool(latest),
+		})
+		if err != nil && latest && ctx.Err() == nil {
+			debugf(ctx, "latest console output unavailable, using buffered output: %v", err)
+			latest = false
+			continue
+		}
+		if err == nil {
+			output, derr := base64.StdEncoding.DecodeString(aws.ToString(result.Output))
+			if derr != nil {
+				return nil, fmt.Errorf("failed to decode console output: %w", derr)
+			}
+			if block, ok := consoleHostKeyBlock(string(output)); ok {
+				if keys := parseHostKeys(block); len(keys) > 0 {
+					return keys, nil
+				}
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			if err != nil {
+				return nil, fmt.Errorf("failed to read console output of %s: %w", instanceID, err)
+			}
+			return nil, fmt.Errorf("host keys of %s did not appear in its console output within %s", instanceID, hostKeyTimeout)
+		case <-time.After(hostKeyPollInterval):
+			debugf(ctx, "host keys not in console output yet, retrying")
+		}
+	}
+}
+
+// consoleHostKeyBlock returns the text between the host key markers
+func consoleHostKeyBlock(output string) (string, bool) {
+	start := strings.Index(output, hostKeysBegin)
+	if start < 0 {
+		return "", false
+	}
+	rest := output[start+len(hostKeysBegin):]
+	end := strings.Index(rest, hostKeysEnd)
+	if end < 0 {
+		return "", false
+	}
+	return rest[:end], true
+}
+
+// parseHostKeys picks the "<type> <key>" pairs out of public key lines,
+// skipping console prefixes and comments
+func parseHostKeys(text string) []string {
+	var keys []string
+	for _, line := range strings.Split(text, "\n") {
+		fields := strings.Fields(line)
+		for i := 0; i+1 < len(fields); i++ {
+			keyType := fields[i]
+			if !strings.HasPrefix(keyType, "ssh-") && !strings.HasPrefix(keyType, "ecdsa-") && !strings.HasPrefix(keyType, "sk-") {
+				continue
+			}
+			if _, err := base64.StdEncoding.DecodeString(fields[i+1]); err != nil {
+				continue
+			}
+			keys = append(keys, keyType+" "+fields[i+1])
+			break
+		}
+	}
+	return keys
+}
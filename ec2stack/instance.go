@@ -0,0 +1,154 @@
+package ec2stack
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	ec2types "github.com/aws/aws-sdk-go-v2/service/ec2/types"
+)
+
+// maxInstanceTypeAlternatives caps the suggestions for an unavailable type
+const maxInstanceTypeAlternatives = 5
+
+// regionInstanceTypes returns the instance types offered in the client's
+// region. Results are cached on the Client for the rest of the run.
+func (c *Client) regionInstanceTypes(ctx context.Context, ec2Client *ec2.Client, region string) ([]string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if offered, ok := c.instanceTypes[region]; ok {
+		return offered, nil
+	}
+
+	var offered []string
+	paginator := ec2.NewDescribeInstanceTypeOfferingsPaginator(ec2Client, &ec2.DescribeInstanceTypeOfferingsInput{
+		LocationType: ec2types.LocationTypeRegion,
+	})
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list instance type offerings: %w", err)
+		}
+		for _, offering := range page.InstanceTypeOfferings {
+			offered = append(offered, string(offering.InstanceType))
+		}
+	}
+	slices.Sort(offered)
+
+	if c.instanceTypes == nil {
+		c.instanceTypes = make(map[string][]string)
+	}
+	c.instanceTypes[region] = offered
+	return offered, nil
+}
+
+// checkInstanceTypeOffered fails early when the instance type is not offered
+// in the region, suggesting types from the same family that are
+func (c *Client) checkInstanceTypeOffered(ctx context.Context, ec2Client *ec2.Client, region, instanceType string) error {
+	offered, err := c.regionInstanceTypes(ctx, ec2Client, region)
+	if err != nil {
+		return err
+	}
+	if slices.Contains(offered, instanceType) {
+		return nil
+	}
+
+	family, _, _ := strings.Cut(instanceType, ".")
+	var alternatives []string
+	for _, t := range offered {
+		if strings.HasPrefix(t, family+".") {
+			alternatives = append(alternatives, t)
+			if len(alternatives) == maxInstanceTypeAlternatives {
+				break
+			}
+		}
+	}
+	if len(alternatives) == 0 {
+		return configErrorf("instance type %s is not offered in %s", instanceType, region)
+	}
+	return configErrorf("instance type %s is not offered in %s (available in the %s family: %s)",
+		instanceType, region, family, strings.Join(alternatives, ", "))
+}
+
+// describeImage returns the AMI's details
+func describeImage(ctx context.Context, ec2Client *ec2.Client, amiID string) (*ec2types.Image, error) {
+	images, err := ec2Client.DescribeImages(ctx, &ec2.DescribeImagesInput{
+		ImageIds: []string{amiID},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to describe AMI %s: %w", amiID, err)
+	}
+	if len(images.Images) == 0 {
+		return nil, configErrorf("AMI %s not found", amiID)
+	}
+	return &images.Images[0], nil
+}
+
+// checkSecondaryIPLimit fails when the instance type allows fewer IPs per
+// network interface than the primary plus secondary private IPs
+func checkSecondaryIPLimit(ctx context.Context, ec2Client *ec2.Client, instanceType string, secondary int) error {
+	typeInfo, err := ec2Client.DescribeInstanceTypes(ctx, &ec2.DescribeInstanceTypesInput{
+		InstanceTypes: []ec2types.InstanceType{ec2types.InstanceType(instanceType)},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to describe instance type %s: %w", instanceType, err)
+	}
+	if len(typeInfo.InstanceTypes) == 0 || typeInfo.InstanceTypes[0].NetworkInfo == nil {
+		return nil
+	}
+	limit := int(aws.ToInt32(typeInfo.InstanceTypes[0].NetworkInfo.Ipv4AddressesPerInterface))
+	if secondary+1 > limit {
+		return configErrorf("instance type %s allows %d IPv4 addresses per network interface, so at most %d secondary_private_ips, got %d",
+			instanceType, limit, limit-1, secondary)
+	}
+	debugf(ctx, "Instance type %s allows %d IPv4 addresses per interface", instanceType, limit)
+	return nil
+}
+
+// checkArchitecture fails when the AMI's architecture is not one the
+// instance type supports, e.g. an x86_64 AMI on a Graviton type
+func checkArchitecture(ctx context.Context, ec2Client *ec2.Client, image *ec2types.Image, instanceType string) error {
+	amiID := aws.ToString(image.ImageId)
+	arch := string(image.Architecture)
+
+	typeInfo, err := ec2Client.DescribeInstanceTypes(ctx, &ec2.DescribeInstanceTypesInput{
+		InstanceTypes: []ec2types.InstanceType{ec2types.InstanceType(instanceType)},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to describe instance type %s: %w", instanceType, err)
+	}
+	if len(typeInfo.InstanceTypes) == 0 || typeInfo.InstanceTypes[0].ProcessorInfo == nil {
+		return nil
+	}
+
+	var supported []string
+	for _, a := range typeInfo.InstanceTypes[0].ProcessorInfo.SupportedArchitectures {
+		supported = append(supported, string(a))
+	}
+	if !slices.Contains(supported, arch) {
+		return configErrorf("AMI %s is %s but instance type %s supports %s",
+			amiID, arch, instanceType, strings.Join(supported, ", "))
+	}
+	return nil
+}
+
+// checkSwapFits fails when a swap_size_gb swap file would leave less than
+// half of the image's root volume for the system
+func checkSwapFits(image *ec2types.Image, swapSizeGB int) error {
+	if swapSizeGB == 0 {
+		return nil
+	}
+	for _, mapping := range image.BlockDeviceMappings {
+		if aws.ToString(mapping.DeviceName) != aws.ToString(image.RootDeviceName) || mapping.Ebs == nil {
+			continue
+		}
+		size := int(aws.ToInt32(mapping.Ebs.VolumeSize))
+		if size > 0 && swapSizeGB*2 > size {
+			return configErrorf("swap_size_gb %d does not fit on the image's %d GiB root volume; use at most %d", swapSizeGB, size, size/2)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,56 @@
+package ec2stack
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strconv"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+)
+
+// launchTemplateIDPattern matches an EC2 launch template ID
+var launchTemplateIDPattern = regexp.MustCompile(`^lt-[0-9a-f]{8,17}$`)
+
+// launchTemplateVersionPattern matches a version number, $Latest or $Default
+var launchTemplateVersionPattern = regexp.MustCompile(`^([1-9][0-9]*|\$Latest|\$Default)$`)
+
+// launchTemplate is a launch template version and the settings it supplies
+type launchTemplate struct {
+	ID           string
+	Version      string
+	ImageID      string
+	InstanceType string
+}
+
+// describeLaunchTemplate resolves version, which defaults to $Default, to a
+// version number (CloudFormation does not accept $Latest or $Default) and
+// returns the image and instance type that version sets, if any
+func describeLaunchTemplate(ctx context.Context, ec2Client *ec2.Client, id, version string) (*launchTemplate, error) {
+	if version == "" {
+		version = "$Default"
+	}
+
+	result, err := ec2Client.DescribeLaunchTemplateVersions(ctx, &ec2.DescribeLaunchTemplateVersionsInput{
+		LaunchTemplateId: aws.String(id),
+		Versions:         []string{version},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to describe launch template %s: %w", id, err)
+	}
+	if len(result.LaunchTemplateVersions) == 0 {
+		return nil, configErrorf("launch template %s has no version %s", id, version)
+	}
+
+	v := result.LaunchTemplateVersions[0]
+	lt := &launchTemplate{
+		ID:      id,
+		Version: strconv.FormatInt(aws.ToInt64(v.VersionNumber), 10),
+	}
+	if data := v.LaunchTemplateData; data != nil {
+		lt.ImageID = aws.ToString(data.ImageId)
+		lt.InstanceType = string(data.InstanceType)
+	}
+	return lt, nil
+}
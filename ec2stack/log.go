@@ -0,0 +1,179 @@
+package ec2stack
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"slices"
+	"strings"
+	"sync"
+)
+
+// Progress output goes through log/slog so callers choose what is shown:
+// the CLI installs a ConsoleHandler at the level picked by -q/-v, or a JSON
+// handler for -log-format json. Library users get slog.Default unless they
+// set their own. Records carry a "stack" attribute once an operation has
+// attached its stack name to the context with withStack.
+
+type loggerKey struct{}
+
+// withStack returns a context whose log records carry the stack name,
+// replacing any stack set earlier (count members log under their own name)
+func withStack(ctx context.Context, stackName string) context.Context {
+	return context.WithValue(ctx, loggerKey{}, slog.Default().With("stack", stackName))
+}
+
+// loggerFrom returns the context's logger, or slog.Default
+func loggerFrom(ctx context.Context) *slog.Logger {
+	if logger, ok := ctx.Value(loggerKey{}).(*slog.Logger); ok {
+		return logger
+	}
+	return slog.Default()
+}
+
+// debugf logs detail that is only shown with -v
+func debugf(ctx context.Context, format string, args ...any) {
+	logf(ctx, slog.LevelDebug, format, args...)
+}
+
+// infof logs a progress line, hidden by -q
+func infof(ctx context.Context, format string, args ...any) {
+	logf(ctx, slog.LevelInfo, format, args...)
+}
+
+// warnf logs a problem that does not stop the operation
+func warnf(ctx context.Context, format string, args ...any) {
+	logf(ctx, slog.LevelWarn, format, args...)
+}
+
+// errorf logs error detail that accompanies a returned error
+func errorf(ctx context.Context, format string, args ...any) {
+	logf(ctx, slog.LevelError, format, args...)
+}
+
+// infoWith logs msg with structured fields, such as public_ip, for
+// handlers that record them; the console prints only msg
+func infoWith(ctx context.Context, msg string, args ...any) {
+	loggerFrom(ctx).Log(ctx, slog.LevelInfo, msg, args...)
+}
+
+func logf(ctx context.Context, level slog.Level, format string, args ...any) {
+	logger := loggerFrom(ctx)
+	if !logger.Enabled(ctx, level) {
+		return
+	}
+	logger.Log(ctx, level, fmt.Sprintf(format, args...))
+}
+
+// statusLiner is implemented by handlers that can show a status line, such
+// as a spinner during a wait, below the log lines. setStatus reports false
+// when the handler is not showing one.
+type statusLiner interface {
+	setStatus(key, text string) bool
+}
+
+// maxStatusWidth keeps the status line from wrapping, which would stop it
+// being redrawn in place
+const maxStatusWidth = 79
+
+// ConsoleHandler is a slog.Handler that prints just the message, one per
+// line, the way the CLI always has. Info and debug go to out; warnings and
+// errors go to errOut with a "Warning: " or "Error: " prefix. Attributes
+// are not printed.
+type ConsoleHandler struct {
+	mu     *sync.Mutex
+	out    io.Writer
+	errOut io.Writer
+	level  slog.Leveler
+
+	// status holds the status text of each stack being waited on, drawn
+	// on the last line of out when statusLine is enabled
+	statusLine bool
+	status     map[string]string
+}
+
+// NewConsoleHandler returns a ConsoleHandler that drops records below level
+func NewConsoleHandler(out, errOut io.Writer, level slog.Leveler) *ConsoleHandler {
+	return &ConsoleHandler{mu: &sync.Mutex{}, out: out, errOut: errOut, level: level}
+}
+
+// EnableStatusLine lets long waits show a spinner line that is redrawn in
+// place below the log lines. Only enable it when out is a terminal.
+func (h *ConsoleHandler) EnableStatusLine() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.statusLine = true
+	h.status = make(map[string]string)
+}
+
+func (h *ConsoleHandler) setStatus(key, text string) bool {
+	if !h.statusLine || h.level.Level() > slog.LevelInfo {
+		return false
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.clearStatus()
+	if text == "" {
+		delete(h.status, key)
+	} else {
+		h.status[key] = text
+	}
+	h.drawStatus()
+	return true
+}
+
+// clearStatus erases the status line; the caller holds mu
+func (h *ConsoleHandler) clearStatus() {
+	if len(h.status) > 0 {
+		io.WriteString(h.out, "\r\033[K")
+	}
+}
+
+// drawStatus writes the status line without a newline, so the next
+// clearStatus can erase it; the caller holds mu
+func (h *ConsoleHandler) drawStatus() {
+	if len(h.status) == 0 {
+		return
+	}
+	keys := make([]string, 0, len(h.status))
+	for key := range h.status {
+		keys = append(keys, key)
+	}
+	slices.Sort(keys)
+	parts := make([]string, len(keys))
+	for i, key := range keys {
+		parts[i] = h.status[key]
+	}
+	line := strings.Join(parts, " | ")
+	if len(line) > maxStatusWidth {
+		line = line[:maxStatusWidth-3] + "..."
+	}
+	io.WriteString(h.out, line)
+}
+
+func (h *ConsoleHandler) Enabled(_ context.Context, level slog.Level) bool {
+	return level >= h.level.Level()
+}
+
+func (h *ConsoleHandler) Handle(_ context.Context, r slog.Record) error {
+	w, prefix := h.out, ""
+	switch {
+	case r.Level >= slog.LevelError:
+		w, prefix = h.errOut, "Error: "
+	case r.Level >= slog.LevelWarn:
+		w, prefix = h.errOut, "Warning: "
+	}
+
+	// Concurrent creates and deletes share the handler
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.clearStatus()
+	_, err := io.WriteString(w, prefix+r.Message+"\n")
+	h.drawStatus()
+	return err
+}
+
+func (h *ConsoleHandler) WithAttrs([]slog.Attr) slog.Handler { return h }
+
+func (h *ConsoleHandler) WithGroup(string) slog.Handler { return h }
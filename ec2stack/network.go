@@ -0,0 +1,489 @@
+package ec2stack
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	ec2types "github.com/aws/aws-sdk-go-v2/service/ec2/types"
+	"github.com/aws/smithy-go"
+)
+
+func discoverVPC(ctx context.Context, ec2Client *ec2.Client) (string, error) {
+	// First try to find the default VPC
+	result, err := ec2Client.DescribeVpcs(ctx, &ec2.DescribeVpcsInput{
+		Filters: []ec2types.Filter{
+			{
+				Name:   aws.String("is-default"),
+				Values: []string{"true"},
+			},
+		},
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to describe VPCs: %w", err)
+	}
+
+	if len(result.Vpcs) > 0 {
+		return *result.Vpcs[0].VpcId, nil
+	}
+
+	// No default VPC, get any available VPC
+	result, err = ec2Client.DescribeVpcs(ctx, &ec2.DescribeVpcsInput{})
+	if err != nil {
+		return "", fmt.Errorf("failed to describe VPCs: %w", err)
+	}
+
+	if len(result.Vpcs) == 0 {
+		return "", nil
+	}
+
+	return *result.Vpcs[0].VpcId, nil
+}
+
+// discoverSubnet finds a subnet in vpcID, restricted to zone when one is
+// given
+func discoverSubnet(ctx context.Context, ec2Client *ec2.Client, vpcID, zone string) (string, error) {
+	// Find a public subnet (one that has MapPublicIpOnLaunch enabled or has a route to IGW)
+	filters := []ec2types.Filter{
+		{
+			Name:   aws.String("vpc-id"),
+			Values: []string{vpcID},
+		},
+	}
+	if zone != "" {
+		filters = append(filters, ec2types.Filter{
+			Name:   aws.String("availability-zone"),
+			Values: []string{zone},
+		})
+	}
+	result, err := ec2Client.DescribeSubnets(ctx, &ec2.DescribeSubnetsInput{
+		Filters: filters,
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to describe subnets: %w", err)
+	}
+
+	if len(result.Subnets) == 0 {
+		return "", nil
+	}
+
+	// Prefer subnets that auto-assign public IPs
+	for _, subnet := range result.Subnets {
+		if subnet.MapPublicIpOnLaunch != nil && *subnet.MapPublicIpOnLaunch {
+			return *subnet.SubnetId, nil
+		}
+	}
+
+	// Fall back to first subnet
+	return *result.Subnets[0].SubnetId, nil
+}
+
+type NetworkStack struct {
+	VpcID                 string
+	SubnetID              string
+	InternetGatewayID     string
+	RouteTableID          string
+	RouteTableAssociation string
+}
+
+// createNetworkStack creates a VPC with one public subnet, in zone when
+// one is given and otherwise in the region's first available zone
+func createNetworkStack(ctx context.Context, ec2Client *ec2.Client, stackName, zone string) (*NetworkStack, error) {
+	infof(ctx, "Creating new VPC and network infrastructure...")
+
+	result := &NetworkStack{}
+
+	// Create VPC
+	vpcOutput, err := ec2Client.CreateVpc(ctx, &ec2.CreateVpcInput{
+		CidrBlock: aws.String("10.0.0.0/16"),
+		TagSpecifications: []ec2types.TagSpecification{
+			{
+				ResourceType: ec2types.ResourceTypeVpc,
+				Tags: []ec2types.Tag{
+					{Key: aws.String("Name"), Value: aws.String(fmt.Sprintf("%s-vpc", stackName))},
+					{Key: aws.String("ManagedBy"), Value: aws.String("aws-ec2-tool")},
+				},
+			},
+		},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create VPC: %w", err)
+	}
+	result.VpcID = *vpcOutput.Vpc.VpcId
+	infof(ctx, "  Created VPC: %s", result.VpcID)
+
+	// Wait for VPC to be available
+	vpcWaiter := ec2.NewVpcAvailableWaiter(ec2Client)
+	err = waiterError(vpcWaiter.Wait(ctx, &ec2.DescribeVpcsInput{
+		VpcIds: []string{result.VpcID},
+	}, 2*time.Minute))
+	if err != nil {
+		return result, fmt.Errorf("VPC not available: %w", err)
+	}
+
+	// Enable DNS hostnames on VPC
+	_, err = ec2Client.ModifyVpcAttribute(ctx, &ec2.ModifyVpcAttributeInput{
+		VpcId:              aws.String(result.VpcID),
+		EnableDnsHostnames: &ec2types.AttributeBooleanValue{Value: aws.Bool(true)},
+	})
+	if err != nil {
+		return result, fmt.Errorf("failed to enable DNS hostnames: %w", err)
+	}
+
+	// Create Internet Gateway
+	igwOutput, err := ec2Client.CreateInternetGateway(ctx, &ec2.CreateInternetGatewayInput{
+		TagSpecifications: []ec2types.TagSpecification{
+			{
+				ResourceType: ec2types.ResourceTypeInternetGateway,
+				Tags: []ec2types.Tag{
+					{Key: aws.String("Name"), Value: aws.String(fmt.Sprintf("%s-igw", stackName))},
+					{Key: aws.String("ManagedBy"), Value: aws.String("aws-ec2-tool")},
+				},
+			},
+		},
+	})
+	if err != nil {
+		return result, fmt.Errorf("failed to create Internet Gateway: %w", err)
+	}
+	result.InternetGatewayID = *igwOutput.InternetGateway.InternetGatewayId
+	infof(ctx, "  Created Internet Gateway: %s", result.InternetGatewayID)
+
+	// Attach Internet Gateway to VPC
+	_, err = ec2Client.AttachInternetGateway(ctx, &ec2.AttachInternetGatewayInput{
+		InternetGatewayId: aws.String(result.InternetGatewayID),
+		VpcId:             aws.String(result.VpcID),
+	})
+	if err != nil {
+		return result, fmt.Errorf("failed to attach Internet Gateway: %w", err)
+	}
+	infof(ctx, "  Attached Internet Gateway to VPC")
+
+	// Get availability zones
+	az := zone
+	if az == "" {
+		azOutput, err := ec2Client.DescribeAvailabilityZones(ctx, &ec2.DescribeAvailabilityZonesInput{
+			Filters: []ec2types.Filter{
+				{
+					Name:   aws.String("state"),
+					Values: []string{"available"},
+				},
+			},
+		})
+		if err != nil {
+			return result, fmt.Errorf("failed to get availability zones: %w", err)
+		}
+		if len(azOutput.AvailabilityZones) == 0 {
+			return result, fmt.Errorf("no availability zones found")
+		}
+		az = *azOutput.AvailabilityZones[0].ZoneName
+	}
+
+	// Create public subnet
+	subnetOutput, err := ec2Client.CreateSubnet(ctx, &ec2.CreateSubnetInput{
+		VpcId:            aws.String(result.VpcID),
+		CidrBlock:        aws.String("10.0.1.0/24"),
+		AvailabilityZone: aws.String(az),
+		TagSpecifications: []ec2types.TagSpecification{
+			{
+				ResourceType: ec2types.ResourceTypeSubnet,
+				Tags: []ec2types.Tag{
+					{Key: aws.String("Name"), Value: aws.String(fmt.Sprintf("%s-public-subnet", stackName))},
+					{Key: aws.String("ManagedBy"), Value: aws.String("aws-ec2-tool")},
+				},
+			},
+		},
+	})
+	if err != nil {
+		return result, fmt.Errorf("failed to create subnet: %w", err)
+	}
+	result.SubnetID = *subnetOutput.Subnet.SubnetId
+	infof(ctx, "  Created Subnet: %s in %s", result.SubnetID, az)
+
+	// Enable auto-assign public IP on subnet
+	_, err = ec2Client.ModifySubnetAttribute(ctx, &ec2.ModifySubnetAttributeInput{
+		SubnetId:            aws.String(result.SubnetID),
+		MapPublicIpOnLaunch: &ec2types.AttributeBooleanValue{Value: aws.Bool(true)},
+	})
+	if err != nil {
+		return result, fmt.Errorf("failed to enable auto-assign public IP: %w", err)
+	}
+
+	// Create route table
+	rtOutput, err := ec2Client.CreateRouteTable(ctx, &ec2.CreateRouteTableInput{
+		VpcId: aws.String(result.VpcID),
+		TagSpecifications: []ec2types.TagSpecification{
+			{
+				ResourceType: ec2types.ResourceTypeRouteTable,
+				Tags: []ec2types.Tag{
+					{Key: aws.String("Name"), Value: aws.String(fmt.Sprintf("%s-public-rt", stackName))},
+					{Key: aws.String("ManagedBy"), Value: aws.String("aws-ec2-tool")},
+				},
+			},
+		},
+	})
+	if err != nil {
+		return result, fmt.Errorf("failed to create route table: %w", err)
+	}
+	result.RouteTableID = *rtOutput.RouteTable.RouteTableId
+	infof(ctx, "  Created Route Table: %s", result.RouteTableID)
+
+	// Add default route to Internet Gateway
+	_, err = ec2Client.CreateRoute(ctx, &ec2.CreateRouteInput{
+		RouteTableId:         aws.String(result.RouteTableID),
+		DestinationCidrBlock: aws.String("0.0.0.0/0"),
+		GatewayId:            aws.String(result.InternetGatewayID),
+	})
+	if err != nil {
+		return result, fmt.Errorf("failed to create route: %w", err)
+	}
+	infof(ctx, "  Added default route to Internet Gateway")
+
+	// Associate route table with subnet
+	assocOutput, err := ec2Client.AssociateRouteTable(ctx, &ec2.AssociateRouteTableInput{
+		RouteTableId: aws.String(result.RouteTableID),
+		SubnetId:     aws.String(result.SubnetID),
+	})
+	if err != nil {
+		return result, fmt.Errorf("failed to associate route table: %w", err)
+	}
+	result.RouteTableAssociation = *assocOutput.AssociationId
+	infof(ctx, "  Associated route table with subnet")
+
+	infof(ctx, "Network infrastructure created successfully")
+	return result, nil
+}
+
+// deleteNetworkStackNested deletes network stack using nested VM config
+func deleteNetworkStackNested(ctx context.Context, ec2Client *ec2.Client, vm *VMConfig) {
+	infof(ctx, "Deleting created network infrastructure...")
+
+	// Disassociate and delete route table
+	if vm.RouteTableAssociation != "" {
+		_, err := ec2Client.DisassociateRouteTable(ctx, &ec2.DisassociateRouteTableInput{
+			AssociationId: aws.String(vm.RouteTableAssociation),
+		})
+		if err != nil {
+			warnf(ctx, "failed to disassociate route table: %v", err)
+		}
+	}
+
+	if vm.RouteTableID != "" {
+		_, err := ec2Client.DeleteRouteTable(ctx, &ec2.DeleteRouteTableInput{
+			RouteTableId: aws.String(vm.RouteTableID),
+		})
+		if err != nil {
+			warnf(ctx, "failed to delete route table: %v", err)
+		} else {
+			infof(ctx, "  Deleted Route Table: %s", vm.RouteTableID)
+		}
+	}
+
+	// Delete subnet
+	if vm.CreatedSubnet && vm.SubnetID != "" {
+		_, err := ec2Client.DeleteSubnet(ctx, &ec2.DeleteSubnetInput{
+			SubnetId: aws.String(vm.SubnetID),
+		})
+		if err != nil {
+			warnf(ctx, "failed to delete subnet: %v", err)
+		} else {
+			infof(ctx, "  Deleted Subnet: %s", vm.SubnetID)
+		}
+	}
+
+	// Detach and delete Internet Gateway
+	if vm.InternetGatewayID != "" && vm.VpcID != "" {
+		_, err := ec2Client.DetachInternetGateway(ctx, &ec2.DetachInternetGatewayInput{
+			InternetGatewayId: aws.String(vm.InternetGatewayID),
+			VpcId:             aws.String(vm.VpcID),
+		})
+		if err != nil {
+			warnf(ctx, "failed to detach Internet Gateway: %v", err)
+		}
+
+		_, err = ec2Client.DeleteInternetGateway(ctx, &ec2.DeleteInternetGatewayInput{
+			InternetGatewayId: aws.String(vm.InternetGatewayID),
+		})
+		if err != nil {
+			warnf(ctx, "failed to delete Internet Gateway: %v", err)
+		} else {
+			infof(ctx, "  Deleted Internet Gateway: %s", vm.InternetGatewayID)
+		}
+	}
+
+	// Delete VPC
+	if vm.CreatedVPC && vm.VpcID != "" {
+		_, err := ec2Client.DeleteVpc(ctx, &ec2.DeleteVpcInput{
+			VpcId: aws.String(vm.VpcID),
+		})
+		if err != nil {
+			warnf(ctx, "failed to delete VPC: %v", err)
+		} else {
+			infof(ctx, "  Deleted VPC: %s", vm.VpcID)
+		}
+	}
+
+	infof(ctx, "Network cleanup complete")
+}
+
+// ensureNetwork fills in vm.VpcID and vm.SubnetID, discovering the default
+// network or creating one when the config does not name them. Created
+// resources are recorded on vm so DeleteStack can remove them.
+func ensureNetwork(ctx context.Context, ec2Client *ec2.Client, vm *VMConfig, stackName string) error {
+	// Discover or create VPC and Subnet
+	if vm.VpcID == "" {
+		infof(ctx, "Discovering VPC...")
+		vpcID, err := discoverVPC(ctx, ec2Client)
+		if err != nil {
+			return fmt.Errorf("failed to discover VPC: %w", err)
+		}
+
+		if vpcID == "" {
+			// No VPC found, create full network stack
+			netStack, err := createNetworkStack(ctx, ec2Client, stackName, vm.AvailabilityZone)
+			if err != nil {
+				return fmt.Errorf("failed to create network stack: %w", err)
+			}
+			vm.VpcID = netStack.VpcID
+			vm.SubnetID = netStack.SubnetID
+			vm.InternetGatewayID = netStack.InternetGatewayID
+			vm.RouteTableID = netStack.RouteTableID
+			vm.RouteTableAssociation = netStack.RouteTableAssociation
+			vm.CreatedVPC = true
+			vm.CreatedSubnet = true
+		} else {
+			vm.VpcID = vpcID
+			infof(ctx, "Using existing VPC: %s", vpcID)
+		}
+	}
+
+	if vm.SubnetID == "" {
+		infof(ctx, "Discovering subnet...")
+		subnetID, err := discoverSubnet(ctx, ec2Client, vm.VpcID, vm.AvailabilityZone)
+		if err != nil {
+			return fmt.Errorf("failed to discover subnet: %w", err)
+		}
+
+		if subnetID == "" {
+			// No suitable subnet found, create one
+			netStack, err := createNetworkStack(ctx, ec2Client, stackName, vm.AvailabilityZone)
+			if err != nil {
+				return fmt.Errorf("failed to create network stack: %w", err)
+			}
+			// Update with newly created resources
+			if vm.VpcID == "" {
+				vm.VpcID = netStack.VpcID
+				vm.CreatedVPC = true
+			}
+			vm.SubnetID = netStack.SubnetID
+			vm.InternetGatewayID = netStack.InternetGatewayID
+			vm.RouteTableID = netStack.RouteTableID
+			vm.RouteTableAssociation = netStack.RouteTableAssociation
+			vm.CreatedSubnet = true
+		} else {
+			vm.SubnetID = subnetID
+			infof(ctx, "Using existing Subnet: %s", subnetID)
+		}
+	}
+
+	// Validate VPC and Subnet are available
+	if vm.VpcID == "" {
+		return fmt.Errorf("VPC ID is required but could not be discovered or created")
+	}
+	if vm.SubnetID == "" {
+		return fmt.Errorf("Subnet ID is required but could not be discovered or created")
+	}
+	if vm.AvailabilityZone != "" {
+		return checkSubnetZone(ctx, ec2Client, vm.SubnetID, vm.AvailabilityZone)
+	}
+	return nil
+}
+
+// checkSubnetZone fails when subnetID, such as one given in the config,
+// is not in zone: EC2 launches the instance in its subnet's zone
+func checkSubnetZone(ctx context.Context, ec2Client *ec2.Client, subnetID, zone string) error {
+	result, err := ec2Client.DescribeSubnets(ctx, &ec2.DescribeSubnetsInput{
+		SubnetIds: []string{subnetID},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to describe subnet %s: %w", subnetID, err)
+	}
+	if len(result.Subnets) == 0 {
+		return configErrorf("subnet %s not found", subnetID)
+	}
+	if subnetZone := aws.ToString(result.Subnets[0].AvailabilityZone); subnetZone != zone {
+		return configErrorf("subnet %s is in %s, not availability_zone %s", subnetID, subnetZone, zone)
+	}
+	return nil
+}
+
+// checkPlacementGroup fails when the named placement group does not exist
+// in the region
+func checkPlacementGroup(ctx context.Context, ec2Client *ec2.Client, name string) error {
+	result, err := ec2Client.DescribePlacementGroups(ctx, &ec2.DescribePlacementGroupsInput{
+		Filters: []ec2types.Filter{
+			{
+				Name:   aws.String("group-name"),
+				Values: []string{name},
+			},
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to describe placement group %s: %w", name, err)
+	}
+	if len(result.PlacementGroups) == 0 {
+		return configErrorf("placement group %s not found; create it or set placement_strategy instead", name)
+	}
+	return nil
+}
+
+// checkSecurityGroups fails when any of the security groups does not exist
+// or is in a VPC other than vpcID, which EC2 would reject at launch
+func checkSecurityGroups(ctx context.Context, ec2Client *ec2.Client, ids []string, vpcID string) error {
+	result, err := ec2Client.DescribeSecurityGroups(ctx, &ec2.DescribeSecurityGroupsInput{
+		GroupIds: ids,
+	})
+	if err != nil {
+		var apiErr smithy.APIError
+		if errors.As(err, &apiErr) && apiErr.ErrorCode() == "InvalidGroup.NotFound" {
+			return configErrorf("additional_security_group_ids: %s", apiErr.ErrorMessage())
+		}
+		return fmt.Errorf("failed to describe security groups: %w", err)
+	}
+	for _, group := range result.SecurityGroups {
+		if groupVPC := aws.ToString(group.VpcId); groupVPC != vpcID {
+			return configErrorf("security group %s is in %s, not the instance's VPC %s", aws.ToString(group.GroupId), groupVPC, vpcID)
+		}
+	}
+	return nil
+}
+
+// describeElasticIP returns the address of an Elastic IP allocation, and
+// fails when it does not exist or is associated with anything but
+// instanceID, which may be empty
+func describeElasticIP(ctx context.Context, ec2Client *ec2.Client, allocationID, instanceID string) (string, error) {
+	result, err := ec2Client.DescribeAddresses(ctx, &ec2.DescribeAddressesInput{
+		AllocationIds: []string{allocationID},
+	})
+	if err != nil {
+		var apiErr smithy.APIError
+		if errors.As(err, &apiErr) && apiErr.ErrorCode() == "InvalidAllocationID.NotFound" {
+			return "", configErrorf("Elastic IP %s not found in this region", allocationID)
+		}
+		return "", fmt.Errorf("failed to describe Elastic IP %s: %w", allocationID, err)
+	}
+	if len(result.Addresses) == 0 {
+		return "", configErrorf("Elastic IP %s not found in this region", allocationID)
+	}
+	address := result.Addresses[0]
+	if address.AssociationId != nil && (instanceID == "" || aws.ToString(address.InstanceId) != instanceID) {
+		target := aws.ToString(address.InstanceId)
+		if target == "" {
+			target = aws.ToString(address.NetworkInterfaceId)
+		}
+		return "", configErrorf("Elastic IP %s (%s) is already associated with %s", allocationID, aws.ToString(address.PublicIp), target)
+	}
+	return aws.ToString(address.PublicIp), nil
+}
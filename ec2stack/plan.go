@@ -0,0 +1,192 @@
+package ec2stack
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/cloudformation"
+	"github.com/aws/aws-sdk-go-v2/service/cloudformation/types"
+)
+
+// changeSetTimeout bounds the wait for CloudFormation to work out a plan
+const changeSetTimeout = 5 * time.Minute
+
+// PlannedChange is a resource change CloudFormation reports for a plan
+type PlannedChange struct {
+	// Action is Add, Modify, Remove, Import or Dynamic
+	Action     string `json:"action"`
+	LogicalID  string `json:"logical_id"`
+	PhysicalID string `json:"physical_id,omitempty"`
+	Type       string `json:"type"`
+
+	// Replacement says whether a Modify replaces the resource: True,
+	// False or Conditional
+	Replacement string `json:"replacement,omitempty"`
+
+	// Scope lists what a Modify changes, such as Properties or Tags
+	Scope []string `json:"scope,omitempty"`
+}
+
+// PlanStack previews what deploying the stack's current config over the
+// deployed stack would change. The template is rendered as create would,
+// submitted as a change set, and the change set deleted again without
+// being executed. No changes returns an empty slice. Only the
+// CloudFormation stack is compared: DNS records are not.
+func (c *Client) PlanStack(ctx context.Context, stackName string) ([]PlannedChange, error) {
+	ctx = withStack(ctx, stackName)
+	if IsStackID(stackName) {
+		return nil, configErrorf("plan needs the stack's config, not its ID")
+	}
+	cfg, configFile, err := ReadConfig(stackName)
+	if err != nil {
+		return nil, err
+	}
+	if err := ValidateConfig(cfg); err != nil {
+		return nil, err
+	}
+	vm := cfg.VM
+	if vm == nil {
+		return nil, configErrorf("%s has no vm section, so there is no stack to plan", configFile)
+	}
+	if kind := memberKind(vm); kind != "" {
+		return nil, configErrorf("plan does not support %s configs; each member is its own stack", kind)
+	}
+	if vm.StackID == "" {
+		return nil, configErrorf("%s records no stack ID; has the stack been created?", configFile)
+	}
+
+	region, err := c.checkStackLocation(ctx, vm.Region, vm.StackID)
+	if err != nil {
+		return nil, err
+	}
+	vm.Region = region
+	awsCfg, err := c.LoadAWSConfig(ctx, vm.Region)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load AWS config: %w", err)
+	}
+	cfClient := cloudformation.NewFromConfig(awsCfg)
+
+	stack, err := c.DescribeStack(ctx, vm.StackID, vm.Region)
+	if err != nil {
+		return nil, err
+	}
+	if strings.HasSuffix(string(stack.StackStatus), "_IN_PROGRESS") {
+		return nil, fmt.Errorf("stack %s is %s; plan again once it settles", stackName, stack.StackStatus)
+	}
+
+	// Compare against the network and instance the stack was deployed with
+	for _, param := range stack.Parameters {
+		switch aws.ToString(param.ParameterKey) {
+		case "VpcId":
+			if vm.VpcID == "" {
+				vm.VpcID = aws.ToString(param.ParameterValue)
+			}
+		case "SubnetId":
+			if vm.SubnetID == "" {
+				vm.SubnetID = aws.ToString(param.ParameterValue)
+			}
+		}
+	}
+	instanceID := vm.InstanceID
+	for _, output := range stack.Outputs {
+		if aws.ToString(output.OutputKey) == "InstanceId" {
+			instanceID = aws.ToString(output.OutputValue)
+		}
+	}
+	if instanceID == "" {
+		return nil, fmt.Errorf("stack %s has no InstanceId output", stackName)
+	}
+
+	tmpl, err := c.buildStackTemplate(ctx, awsCfg, vm, cfg.DNS, stackName, instanceID)
+	if err != nil {
+		return nil, err
+	}
+
+	infof(ctx, "Creating change set...")
+	created, err := cfClient.CreateChangeSet(ctx, &cloudformation.CreateChangeSetInput{
+		StackName:     aws.String(vm.StackID),
+		ChangeSetName: aws.String(fmt.Sprintf("aws-ec2-plan-%d", time.Now().Unix())),
+		ChangeSetType: types.ChangeSetTypeUpdate,
+		Description:   aws.String("Preview from aws-ec2 plan; never executed"),
+		TemplateBody:  aws.String(tmpl.Body),
+		Parameters:    tmpl.Parameters,
+		Capabilities:  tmpl.Capabilities,
+		RoleARN:       c.cfnRoleARN(vm),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create change set: %w", explainRoleError(err, c.cfnRoleARN(vm)))
+	}
+	changeSetID := aws.ToString(created.Id)
+
+	// The change set is only a preview, so it goes even when interrupted
+	defer func() {
+		_, err := cfClient.DeleteChangeSet(context.WithoutCancel(ctx), &cloudformation.DeleteChangeSetInput{
+			ChangeSetName: aws.String(changeSetID),
+		})
+		if err != nil {
+			warnf(ctx, "failed to delete change set %s: %v", changeSetID, err)
+			return
+		}
+		debugf(ctx, "Deleted change set %s", changeSetID)
+	}()
+
+	waiter := cloudformation.NewChangeSetCreateCompleteWaiter(cfClient)
+	err = waiterError(waiter.Wait(ctx, &cloudformation.DescribeChangeSetInput{
+		ChangeSetName: aws.String(changeSetID),
+	}, changeSetTimeout))
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, fmt.Errorf("failed waiting for change set: %w", err)
+		}
+		// A change set with nothing to do fails rather than completing
+		desc, derr := cfClient.DescribeChangeSet(ctx, &cloudformation.DescribeChangeSetInput{
+			ChangeSetName: aws.String(changeSetID),
+		})
+		if derr == nil && desc.Status == types.ChangeSetStatusFailed {
+			reason := aws.ToString(desc.StatusReason)
+			if isNoChangesReason(reason) {
+				return []PlannedChange{}, nil
+			}
+			return nil, &waitError{ErrWaitFailed, fmt.Errorf("change set failed: %s", reason)}
+		}
+		return nil, fmt.Errorf("failed waiting for change set: %w", err)
+	}
+
+	changes := []PlannedChange{}
+	paginator := cloudformation.NewDescribeChangeSetPaginator(cfClient, &cloudformation.DescribeChangeSetInput{
+		ChangeSetName: aws.String(changeSetID),
+	})
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to describe change set: %w", err)
+		}
+		for _, change := range page.Changes {
+			rc := change.ResourceChange
+			if rc == nil {
+				continue
+			}
+			planned := PlannedChange{
+				Action:      string(rc.Action),
+				LogicalID:   aws.ToString(rc.LogicalResourceId),
+				PhysicalID:  aws.ToString(rc.PhysicalResourceId),
+				Type:        aws.ToString(rc.ResourceType),
+				Replacement: string(rc.Replacement),
+			}
+			for _, scope := range rc.Scope {
+				planned.Scope = append(planned.Scope, string(scope))
+			}
+			changes = append(changes, planned)
+		}
+	}
+	return changes, nil
+}
+
+// isNoChangesReason reports whether a failed change set's reason means the
+// template and parameters match the deployed stack
+func isNoChangesReason(reason string) bool {
+	return strings.Contains(reason, "didn't contain changes") || strings.Contains(reason, "No updates are to be performed")
+}
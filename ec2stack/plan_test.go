@@ -0,0 +1,160 @@
+package ec2stack
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestIsNoChangesReason(t *testing.T) {
+	tests := []struct {
+		reason string
+		want   bool
+	}{
+		{reason: "The submitted information didn't contain changes. Submit different information to create a change set.", want: true},
+		{reason: "No updates are to be performed.", want: true},
+		{reason: "Template format error: Unresolved resource dependencies [VPC]"},
+	}
+	for _, tt := range tests {
+		if got := isNoChangesReason(tt.reason); got != tt.want {
+			t.Errorf("isNoChangesReason(%q) = %t, want %t", tt.reason, got, tt.want)
+		}
+	}
+}
+
+// planConfig is a created single-stack config for PlanStack
+const planConfig = `{"vm": {"region": "us-west-2", "users": [{"username": "alice", "github_username": "alice"}],
+	"stack_id": "arn:aws:cloudformation:us-west-2:123456789012:stack/web/1", "instance_id": "i-1"}}`
+
+// changeSetResponse answers DescribeChangeSet with status, a reason and
+// the given <member> changes
+func changeSetResponse(status, reason string, changes ...string) string {
+	return `<DescribeChangeSetResponse><DescribeChangeSetResult><Status>` + status + `</Status><StatusReason>` + reason + `</StatusReason>` +
+		`<Changes>` + strings.Join(changes, "") + `</Changes></DescribeChangeSetResult></DescribeChangeSetResponse>`
+}
+
+func TestClientPlanStack(t *testing.T) {
+	const deployed = `<member><StackName>web</StackName><StackStatus>UPDATE_COMPLETE</StackStatus>` +
+		`<Parameters><member><ParameterKey>VpcId</ParameterKey><ParameterValue>vpc-1</ParameterValue></member>` +
+		`<member><ParameterKey>SubnetId</ParameterKey><ParameterValue>subnet-1</ParameterValue></member></Parameters>` +
+		`<Outputs><member><OutputKey>InstanceId</OutputKey><OutputValue>i-1</OutputValue></member></Outputs></member>`
+	tests := []struct {
+		name      string
+		changeSet string // DescribeChangeSet response
+		want      []PlannedChange
+		wantErr   string
+	}{
+		{
+			name: "changes",
+			changeSet: changeSetResponse("CREATE_COMPLETE", "",
+				`<member><Type>Resource</Type><ResourceChange><Action>Modify</Action><LogicalResourceId>EC2Instance</LogicalResourceId>`+
+					`<PhysicalResourceId>i-1</PhysicalResourceId><ResourceType>AWS::EC2::Instance</ResourceType><Replacement>True</Replacement>`+
+					`<Scope><member>Properties</member></Scope></ResourceChange></member>`),
+			want: []PlannedChange{{Action: "Modify", LogicalID: "EC2Instance", PhysicalID: "i-1", Type: "AWS::EC2::Instance", Replacement: "True", Scope: []string{"Properties"}}},
+		},
+		{
+			name:      "no changes",
+			changeSet: changeSetResponse("FAILED", "The submitted information didn't contain changes."),
+			want:      []PlannedChange{},
+		},
+		{
+			name:      "change set failed",
+			changeSet: changeSetResponse("FAILED", "Template format error"),
+			wantErr:   "change set failed: Template format error",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stub := &stubAWS{
+				callerARN: "arn:aws:iam::123456789012:user/alice",
+				responses: map[string][]string{
+					"DescribeStacks":                {describeStacksResponse(deployed)},
+					"DescribeInstanceTypeOfferings": {offeringsResponse("t3.micro")},
+					"AmazonSSM.GetParameter":        {`{"Parameter": {"Name": "ubuntu", "Value": "ami-0123456789abcdef0"}}`},
+					"DescribeImages":                {`<DescribeImagesResponse><imagesSet><item><imageId>ami-0123456789abcdef0</imageId><architecture>x86_64</architecture><rootDeviceName>/dev/sda1</rootDeviceName></item></imagesSet></DescribeImagesResponse>`},
+					"DescribeInstanceTypes":         {`<DescribeInstanceTypesResponse><instanceTypeSet></instanceTypeSet></DescribeInstanceTypesResponse>`},
+					"CreateChangeSet":               {`<CreateChangeSetResponse><CreateChangeSetResult><Id>arn:aws:cloudformation:us-west-2:123456789012:changeSet/plan/1</Id></CreateChangeSetResult></CreateChangeSetResponse>`},
+					"DescribeChangeSet":             {tt.changeSet},
+					"DeleteChangeSet":               {`<DeleteChangeSetResponse><DeleteChangeSetResult></DeleteChangeSetResult></DeleteChangeSetResponse>`},
+				},
+			}
+			c := newStubClient(t, stub)
+			c.NoAMICache = true
+
+			changes, err := c.PlanStack(context.Background(), writeTestConfig(t, planConfig))
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("PlanStack() error = %v, want it to contain %q", err, tt.wantErr)
+				}
+			} else if err != nil {
+				t.Fatalf("PlanStack() error = %v", err)
+			}
+			if tt.want != nil {
+				if changes == nil || len(changes) != len(tt.want) {
+					t.Fatalf("PlanStack() = %+v, want %+v", changes, tt.want)
+				}
+				for i := range changes {
+					got, want := changes[i], tt.want[i]
+					if got.Action != want.Action || got.LogicalID != want.LogicalID || got.PhysicalID != want.PhysicalID ||
+						got.Type != want.Type || got.Replacement != want.Replacement || strings.Join(got.Scope, ",") != strings.Join(want.Scope, ",") {
+						t.Errorf("PlanStack() change %d = %+v, want %+v", i, got, want)
+					}
+				}
+			}
+			created := stub.bodies["CreateChangeSet"]
+			if len(created) != 1 || !strings.Contains(created[0], "ChangeSetType=UPDATE") || !strings.Contains(created[0], "vpc-1") {
+				t.Errorf("CreateChangeSet requests = %v, want one update using the deployed VPC", created)
+			}
+			if got := stub.calls["DeleteChangeSet"]; got != 1 {
+				t.Errorf("DeleteChangeSet called %d times, want the preview deleted once", got)
+			}
+		})
+	}
+}
+
+func TestClientPlanStackErrors(t *testing.T) {
+	const users = `"users": [{"username": "alice", "github_username": "alice"}]`
+	tests := []struct {
+		name    string
+		stack   func(t *testing.T) string
+		wantErr string
+	}{
+		{
+			name:    "stack ID",
+			stack:   func(*testing.T) string { return "arn:aws:cloudformation:us-west-2:123456789012:stack/web/1" },
+			wantErr: "plan needs the stack's config, not its ID",
+		},
+		{
+			name:    "count config",
+			stack:   func(t *testing.T) string { return writeTestConfig(t, `{"vm": {`+users+`, "count": 2}}`) },
+			wantErr: "plan does not support count configs",
+		},
+		{
+			name:    "not created",
+			stack:   func(t *testing.T) string { return writeTestConfig(t, `{"vm": {`+users+`}}`) },
+			wantErr: "records no stack ID",
+		},
+		{
+			name: "other account",
+			stack: func(t *testing.T) string {
+				return writeTestConfig(t, strings.Replace(planConfig, "123456789012", "210987654321", 1))
+			},
+			wantErr: "was created in account 210987654321",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stub := &stubAWS{callerARN: "arn:aws:iam::123456789012:user/alice"}
+			c := newStubClient(t, stub)
+			_, err := c.PlanStack(context.Background(), tt.stack(t))
+			var cfgErr *ConfigError
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) || !errors.As(err, &cfgErr) {
+				t.Fatalf("PlanStack() error = %v, want a ConfigError containing %q", err, tt.wantErr)
+			}
+			if got := stub.calls["CreateChangeSet"]; got != 0 {
+				t.Errorf("CreateChangeSet called %d times, want none", got)
+			}
+		})
+	}
+}
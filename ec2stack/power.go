@@ -0,0 +1,288 @@
+package ec2stack
+
+import (
+	"context"
+	"fmt"
+	"maps"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	ec2types "github.com/aws/aws-sdk-go-v2/service/ec2/types"
+	"github.com/aws/aws-sdk-go-v2/service/route53"
+)
+
+// powerWaitTimeout bounds the wait for instances to stop or start
+const powerWaitTimeout = 10 * time.Minute
+
+// stackInstance is an instance of a stack, or of one member of a count or
+// regions config, with the config fields a start refreshes
+type stackInstance struct {
+	ID            string
+	Region        string
+	PublicIP      *string
+	PublicDNSName *string
+	PrivateIP     *string
+	DNS           *DNSConfig
+}
+
+// stackInstances returns the instances recorded in a stack's config
+func stackInstances(cfg *Config) []stackInstance {
+	if cfg.VM == nil {
+		return nil
+	}
+	if len(cfg.VM.Instances) == 0 {
+		if cfg.VM.InstanceID == "" {
+			return nil
+		}
+		return []stackInstance{{cfg.VM.InstanceID, cfg.VM.Region, &cfg.VM.PublicIP, &cfg.VM.PublicDNSName, &cfg.VM.PrivateIP, cfg.DNS}}
+	}
+	var instances []stackInstance
+	for i := range cfg.VM.Instances {
+		inst := &cfg.VM.Instances[i]
+		region := inst.Region
+		if region == "" {
+			region = cfg.VM.Region
+		}
+		if inst.InstanceID != "" {
+			instances = append(instances, stackInstance{inst.InstanceID, region, &inst.PublicIP, &inst.PublicDNSName, &inst.PrivateIP, inst.DNS})
+		}
+	}
+	return instances
+}
+
+// readInstances reads the stack's config and the instances it records
+func readInstances(stackName string) (*Config, string, []stackInstance, error) {
+	if IsStackID(stackName) {
+		return nil, "", nil, configErrorf("this command needs the stack's config, not its ID")
+	}
+	cfg, configFile, err := ReadConfig(stackName)
+	if err != nil {
+		return nil, "", nil, err
+	}
+	instances := stackInstances(cfg)
+	if len(instances) == 0 {
+		return nil, "", nil, configErrorf("%s records no instance ID; has the stack been created?", configFile)
+	}
+	return cfg, configFile, instances, nil
+}
+
+func instanceIDs(instances []stackInstance) []string {
+	ids := make([]string, len(instances))
+	for i, inst := range instances {
+		ids[i] = inst.ID
+	}
+	return ids
+}
+
+// regionGroup is the IDs of a stack's instances in one region, with an
+// EC2 client for that region
+type regionGroup struct {
+	region    string
+	ec2Client *ec2.Client
+	ids       []string
+}
+
+// groupByRegion groups the instances by region, in the order the regions
+// first appear. Only a regions config has more than one group.
+func (c *Client) groupByRegion(ctx context.Context, instances []stackInstance) ([]regionGroup, error) {
+	var groups []regionGroup
+	index := make(map[string]int)
+	for _, inst := range instances {
+		i, ok := index[inst.Region]
+		if !ok {
+			awsCfg, err := c.LoadAWSConfig(ctx, inst.Region)
+			if err != nil {
+				return nil, fmt.Errorf("failed to load AWS config: %w", err)
+			}
+			i = len(groups)
+			index[inst.Region] = i
+			groups = append(groups, regionGroup{region: inst.Region, ec2Client: ec2.NewFromConfig(awsCfg)})
+		}
+		groups[i].ids = append(groups[i].ids, inst.ID)
+	}
+	return groups, nil
+}
+
+// StopStack stops the stack's instance, or every member of a count or
+// regions config, keeping their volumes. Unless it is an Elastic IP, the
+// public IP is released and StartStack records the new one.
+func (c *Client) StopStack(ctx context.Context, stackName string) error {
+	ctx = withStack(ctx, stackName)
+	_, _, instances, err := readInstances(stackName)
+	if err != nil {
+		return err
+	}
+	groups, err := c.groupByRegion(ctx, instances)
+	if err != nil {
+		return err
+	}
+
+	// Stop every region's instances before waiting on any of them
+	for _, group := range groups {
+		elasticIPs, err := elasticIPsByInstance(ctx, group.ec2Client, group.ids)
+		if err != nil {
+			return err
+		}
+		for id, eip := range elasticIPs {
+			infof(ctx, "%s keeps its Elastic IP %s while stopped", id, eip)
+		}
+		infof(ctx, "Stopping %d instance(s) in %s...", len(group.ids), group.region)
+		if _, err := group.ec2Client.StopInstances(ctx, &ec2.StopInstancesInput{InstanceIds: group.ids}); err != nil {
+			return fmt.Errorf("failed to stop instances in %s: %w", group.region, err)
+		}
+	}
+	for _, group := range groups {
+		waiter := ec2.NewInstanceStoppedWaiter(group.ec2Client)
+		if err := waiterError(waiter.Wait(ctx, &ec2.DescribeInstancesInput{InstanceIds: group.ids}, powerWaitTimeout)); err != nil {
+			return fmt.Errorf("failed waiting for instances in %s to stop: %w", group.region, err)
+		}
+	}
+	infof(ctx, "Stopped; start again with -start -n %s", stackName)
+	return nil
+}
+
+// StartStack starts the stack's stopped instances, then records their new
+// addresses in the config and repoints the DNS records at them. An
+// instance with an Elastic IP keeps its address, so its DNS is untouched.
+func (c *Client) StartStack(ctx context.Context, stackName string) error {
+	ctx = withStack(ctx, stackName)
+	cfg, configFile, instances, err := readInstances(stackName)
+	if err != nil {
+		return err
+	}
+	awsCfg, err := c.LoadAWSConfig(ctx, cfg.VM.Region)
+	if err != nil {
+		return fmt.Errorf("failed to load AWS config: %w", err)
+	}
+	r53Client := route53.NewFromConfig(awsCfg)
+	groups, err := c.groupByRegion(ctx, instances)
+	if err != nil {
+		return err
+	}
+
+	for _, group := range groups {
+		infof(ctx, "Starting %d instance(s) in %s...", len(group.ids), group.region)
+		if _, err := group.ec2Client.StartInstances(ctx, &ec2.StartInstancesInput{InstanceIds: group.ids}); err != nil {
+			return fmt.Errorf("failed to start instances in %s: %w", group.region, err)
+		}
+	}
+	running := make(map[string]ec2types.Instance)
+	elasticIPs := make(map[string]string)
+	for _, group := range groups {
+		waiter := ec2.NewInstanceRunningWaiter(group.ec2Client)
+		if err := waiterError(waiter.Wait(ctx, &ec2.DescribeInstancesInput{InstanceIds: group.ids}, powerWaitTimeout)); err != nil {
+			return fmt.Errorf("failed waiting for instances in %s to start: %w", group.region, err)
+		}
+		described, err := describeInstances(ctx, group.ec2Client, group.ids)
+		if err != nil {
+			return err
+		}
+		maps.Copy(running, described)
+		eips, err := elasticIPsByInstance(ctx, group.ec2Client, group.ids)
+		if err != nil {
+			return err
+		}
+		maps.Copy(elasticIPs, eips)
+	}
+
+	// Records in a private zone, or for an instance without a public IP,
+	// point at the private IP, as on create
+	usePrivate := cfg.VM.NoPublicIP || (cfg.DNS != nil && cfg.DNS.PrivateZone)
+	var refreshErr error
+	for _, inst := range instances {
+		info, ok := running[inst.ID]
+		if !ok {
+			refreshErr = fmt.Errorf("instance %s not found after start", inst.ID)
+			continue
+		}
+		oldIP, newIP := *inst.PublicIP, aws.ToString(info.PublicIpAddress)
+		if usePrivate {
+			oldIP, newIP = *inst.PrivateIP, aws.ToString(info.PrivateIpAddress)
+		}
+		*inst.PublicIP = aws.ToString(info.PublicIpAddress)
+		*inst.PublicDNSName = aws.ToString(info.PublicDnsName)
+		*inst.PrivateIP = aws.ToString(info.PrivateIpAddress)
+
+		if eip, ok := elasticIPs[inst.ID]; ok {
+			infoWith(ctx, fmt.Sprintf("%s: Elastic IP %s, address unchanged", inst.ID, eip),
+				"instance_id", inst.ID, "public_ip", eip)
+			continue
+		}
+		infoWith(ctx, fmt.Sprintf("%s: public IP %s, private IP %s", inst.ID, *inst.PublicIP, *inst.PrivateIP),
+			"instance_id", inst.ID, "public_ip", *inst.PublicIP, "private_ip", *inst.PrivateIP)
+		if inst.DNS == nil || len(inst.DNS.DNSRecords) == 0 || oldIP == newIP {
+			continue
+		}
+		if newIP == "" {
+			refreshErr = fmt.Errorf("instance %s has no address for its DNS records", inst.ID)
+			continue
+		}
+		if err := updateDNSTarget(ctx, r53Client, inst.DNS, oldIP, newIP); err != nil {
+			refreshErr = err
+		}
+	}
+
+	if err := WriteConfig(configFile, cfg); err != nil {
+		return fmt.Errorf("failed to update config file: %w", err)
+	}
+	infof(ctx, "Config updated: %s", configFile)
+	return refreshErr
+}
+
+// describeInstances returns the instances with the given IDs by ID
+func describeInstances(ctx context.Context, ec2Client *ec2.Client, ids []string) (map[string]ec2types.Instance, error) {
+	result, err := ec2Client.DescribeInstances(ctx, &ec2.DescribeInstancesInput{InstanceIds: ids})
+	if err != nil {
+		return nil, fmt.Errorf("failed to describe instances: %w", err)
+	}
+	instances := make(map[string]ec2types.Instance)
+	for _, reservation := range result.Reservations {
+		for _, instance := range reservation.Instances {
+			instances[aws.ToString(instance.InstanceId)] = instance
+		}
+	}
+	return instances, nil
+}
+
+// secondaryPrivateIPs returns the secondary private IPs of an instance's
+// primary network interface
+func secondaryPrivateIPs(ctx context.Context, ec2Client *ec2.Client, instanceID string) ([]string, error) {
+	instances, err := describeInstances(ctx, ec2Client, []string{instanceID})
+	if err != nil {
+		return nil, err
+	}
+	var ips []string
+	for _, eni := range instances[instanceID].NetworkInterfaces {
+		if eni.Attachment == nil || aws.ToInt32(eni.Attachment.DeviceIndex) != 0 {
+			continue
+		}
+		for _, addr := range eni.PrivateIpAddresses {
+			if !aws.ToBool(addr.Primary) {
+				ips = append(ips, aws.ToString(addr.PrivateIpAddress))
+			}
+		}
+	}
+	return ips, nil
+}
+
+// elasticIPsByInstance returns the Elastic IP associated with each of the
+// instances that has one
+func elasticIPsByInstance(ctx context.Context, ec2Client *ec2.Client, ids []string) (map[string]string, error) {
+	result, err := ec2Client.DescribeAddresses(ctx, &ec2.DescribeAddressesInput{
+		Filters: []ec2types.Filter{
+			{
+				Name:   aws.String("instance-id"),
+				Values: ids,
+			},
+		},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to describe Elastic IPs: %w", err)
+	}
+	eips := make(map[string]string)
+	for _, address := range result.Addresses {
+		eips[aws.ToString(address.InstanceId)] = aws.ToString(address.PublicIp)
+	}
+	return eips, nil
+}
@@ -0,0 +1,170 @@
+package ec2stack
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// writeTestConfig writes a stack config to a temporary directory and
+// returns its path, which ReadConfig accepts as the stack name
+func writeTestConfig(t *testing.T, config string) string {
+	t.Helper()
+	ignoreUserDefaults(t)
+	path := filepath.Join(t.TempDir(), "web.json")
+	if err := os.WriteFile(path, []byte(config), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// instancesResponse answers DescribeInstances with instances in state,
+// each given as its ID or as ID=public IP
+func instancesResponse(state string, instances ...string) string {
+	var b strings.Builder
+	for _, inst := range instances {
+		id, ip, _ := strings.Cut(inst, "=")
+		b.WriteString(`<item><instanceId>` + id + `</instanceId><instanceState><name>` + state + `</name></instanceState>`)
+		if ip != "" {
+			b.WriteString(`<ipAddress>` + ip + `</ipAddress><privateIpAddress>10.0.0.5</privateIpAddress>`)
+		}
+		b.WriteString(`</item>`)
+	}
+	return `<DescribeInstancesResponse><reservationSet><item><instancesSet>` + b.String() + `</instancesSet></item></reservationSet></DescribeInstancesResponse>`
+}
+
+// addressesResponse answers DescribeAddresses with an Elastic IP for each
+// instance ID given
+func addressesResponse(ids ...string) string {
+	var b strings.Builder
+	for _, id := range ids {
+		b.WriteString(`<item><instanceId>` + id + `</instanceId><publicIp>198.51.100.9</publicIp></item>`)
+	}
+	return `<DescribeAddressesResponse><addressesSet>` + b.String() + `</addressesSet></DescribeAddressesResponse>`
+}
+
+func TestClientStopStack(t *testing.T) {
+	tests := []struct {
+		name      string
+		config    string
+		wantStops []string // the instance IDs of each StopInstances call
+	}{
+		{
+			name:      "count config",
+			config:    `{"vm": {"region": "us-west-2", "count": 2, "instances": [{"stack_name": "web-1", "instance_id": "i-1"}, {"stack_name": "web-2", "instance_id": "i-2"}]}}`,
+			wantStops: []string{"i-1 i-2"},
+		},
+		{
+			name:      "regions config",
+			config:    `{"vm": {"region": "us-east-1", "regions": ["us-east-1", "eu-west-1"], "instances": [{"stack_name": "web-us-east-1", "instance_id": "i-1", "region": "us-east-1"}, {"stack_name": "web-eu-west-1", "instance_id": "i-2", "region": "eu-west-1"}]}}`,
+			wantStops: []string{"i-1", "i-2"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stub := &stubAWS{responses: map[string][]string{
+				"DescribeAddresses": {addressesResponse("i-1")},
+				"StopInstances":     {`<StopInstancesResponse><instancesSet></instancesSet></StopInstancesResponse>`},
+				"DescribeInstances": {instancesResponse("stopped", "i-1", "i-2")},
+			}}
+			c := newStubClient(t, stub)
+			if err := c.StopStack(context.Background(), writeTestConfig(t, tt.config)); err != nil {
+				t.Fatalf("StopStack() error = %v", err)
+			}
+			var stops []string
+			for _, body := range stub.bodies["StopInstances"] {
+				var ids []string
+				for _, id := range []string{"i-1", "i-2"} {
+					if strings.Contains(body, "="+id) {
+						ids = append(ids, id)
+					}
+				}
+				stops = append(stops, strings.Join(ids, " "))
+			}
+			if strings.Join(stops, ",") != strings.Join(tt.wantStops, ",") {
+				t.Errorf("StopInstances called for %q, want %q", stops, tt.wantStops)
+			}
+		})
+	}
+}
+
+func TestClientStartStack(t *testing.T) {
+	const rrset = "POST /2013-04-01/hostedzone/Z0123456789ABC/rrset"
+	const config = `{"vm": {"region": "us-west-2", "instance_id": "i-1", "public_ip": "198.51.100.1", "private_ip": "10.0.0.4"},
+		"dns": {"hostname": "web", "domain": "example.com", "zone_id": "Z0123456789ABC", "target_ip": "198.51.100.1",
+			"dns_records": [{"name": "web.example.com", "type": "A", "value": "198.51.100.1", "ttl": 300}]}}`
+	tests := []struct {
+		name        string
+		addresses   string
+		wantIP      string
+		wantChanges int
+	}{
+		{name: "new public IP", addresses: addressesResponse(), wantIP: "203.0.113.7", wantChanges: 1},
+		{name: "Elastic IP", addresses: addressesResponse("i-1"), wantIP: "198.51.100.1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stub := &stubAWS{responses: map[string][]string{
+				"StartInstances":    {`<StartInstancesResponse><instancesSet></instancesSet></StartInstancesResponse>`},
+				"DescribeInstances": {instancesResponse("running", "i-1="+tt.wantIP)},
+				"DescribeAddresses": {tt.addresses},
+				rrset:               {changeRecordsResponse},
+			}}
+			c := newStubClient(t, stub)
+			path := writeTestConfig(t, config)
+			if err := c.StartStack(context.Background(), path); err != nil {
+				t.Fatalf("StartStack() error = %v", err)
+			}
+
+			cfg, _, err := ReadConfig(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if cfg.VM.PublicIP != tt.wantIP || cfg.VM.PrivateIP != "10.0.0.5" {
+				t.Errorf("StartStack() recorded public IP %s, private IP %s, want %s and 10.0.0.5", cfg.VM.PublicIP, cfg.VM.PrivateIP, tt.wantIP)
+			}
+			if got := cfg.DNS.DNSRecords[0].Value; got != tt.wantIP {
+				t.Errorf("StartStack() recorded the A record as %s, want %s", got, tt.wantIP)
+			}
+			changes := stub.bodies[rrset]
+			if len(changes) != tt.wantChanges {
+				t.Fatalf("ChangeResourceRecordSets called %d times, want %d", len(changes), tt.wantChanges)
+			}
+			if tt.wantChanges > 0 && !strings.Contains(changes[0], "<Value>"+tt.wantIP+"</Value>") {
+				t.Errorf("change batch = %s, want the record pointed at %s", changes[0], tt.wantIP)
+			}
+		})
+	}
+}
+
+func TestReadInstancesErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		stack   func(t *testing.T) string
+		wantErr string
+	}{
+		{
+			name:    "stack ID",
+			stack:   func(*testing.T) string { return "arn:aws:cloudformation:us-west-2:123456789012:stack/web/1" },
+			wantErr: "this command needs the stack's config, not its ID",
+		},
+		{
+			name:    "not created",
+			stack:   func(t *testing.T) string { return writeTestConfig(t, `{"vm": {"region": "us-west-2"}}`) },
+			wantErr: "records no instance ID",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newStubClient(t, &stubAWS{})
+			err := c.StopStack(context.Background(), tt.stack(t))
+			var cfgErr *ConfigError
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) || !errors.As(err, &cfgErr) {
+				t.Fatalf("StopStack() error = %v, want a ConfigError containing %q", err, tt.wantErr)
+			}
+		})
+	}
+}
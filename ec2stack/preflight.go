@@ -0,0 +1,198 @@
+package ec2stack
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/iam"
+	iamtypes "github.com/aws/aws-sdk-go-v2/service/iam/types"
+)
+
+// checkPermissions asks IAM's policy simulator whether the caller may
+// perform every action a create of cfg needs, and fails listing all of the
+// missing ones before anything is created. A check that cannot run, because
+// the caller may not call the simulator or is a principal it cannot
+// simulate, is warned about and the create goes ahead.
+func (c *Client) checkPermissions(ctx context.Context, cfg *Config) error {
+	region := defaultRegion
+	if cfg.VM != nil && cfg.VM.Region != "" {
+		region = cfg.VM.Region
+	}
+	awsCfg, err := c.LoadAWSConfig(ctx, region)
+	if err != nil {
+		return fmt.Errorf("failed to load AWS config: %w", err)
+	}
+	callerARN, err := c.CallerARN(ctx, region)
+	if err != nil {
+		return err
+	}
+	principal, ok := simulationPrincipal(callerARN)
+	if !ok {
+		warnf(ctx, "skipping the IAM permissions check: %s cannot be simulated", callerARN)
+		return nil
+	}
+
+	actions := c.requiredActions(cfg)
+	infof(ctx, "Checking IAM permissions (%d actions)...", len(actions))
+	missing, err := c.simulatePrincipalPolicy(ctx, awsCfg, principal, actions)
+	if err != nil {
+		warnf(ctx, "skipping the IAM permissions check: %v", err)
+		return nil
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("%s is missing permissions this create needs:\n  %s\n(checked against all resources; if your policies grant these on specific resources only, rerun with -skip-permission-check)",
+			principal, strings.Join(missing, "\n  "))
+	}
+	debugf(ctx, "IAM permissions: all %d actions allowed for %s", len(actions), principal)
+	return nil
+}
+
+// requiredActions lists the IAM actions a create of cfg calls. Actions on
+// the resources in the template are left to the service role when there is
+// one. VPC and subnet creation, which only happen when discovery finds
+// none, are not included.
+func (c *Client) requiredActions(cfg *Config) []string {
+	var actions []string
+	if vm := cfg.VM; vm != nil {
+		actions = append(actions,
+			"cloudformation:CreateStack",
+			"cloudformation:DescribeStacks",
+			"cloudformation:DescribeStackEvents",
+			"ec2:DescribeImages",
+			"ec2:DescribeInstanceTypes",
+		)
+		if vm.LaunchTemplateID != "" {
+			actions = append(actions, "ec2:DescribeLaunchTemplateVersions")
+		}
+		if vm.LaunchTemplateID == "" || vm.OS != "" {
+			actions = append(actions, "ssm:GetParameter")
+		}
+		if vm.VpcID == "" {
+			actions = append(actions, "ec2:DescribeVpcs")
+		}
+		if vm.SubnetID == "" || vm.AvailabilityZone != "" {
+			actions = append(actions, "ec2:DescribeSubnets")
+		}
+		if vm.PlacementGroup != "" {
+			actions = append(actions, "ec2:DescribePlacementGroups")
+		}
+		if vm.ElasticIPAllocationID != "" {
+			actions = append(actions, "ec2:DescribeAddresses")
+		}
+		if len(vm.AdditionalSecurityGroupIDs) > 0 {
+			actions = append(actions, "ec2:DescribeSecurityGroups")
+		}
+		if vm.TemplateFile != "" {
+			actions = append(actions, "cloudformation:ValidateTemplate")
+		}
+		if vm.EnableTerminationProtection {
+			actions = append(actions, "cloudformation:UpdateTerminationProtection")
+		}
+		if vm.StackPolicy != "" {
+			actions = append(actions, "cloudformation:SetStackPolicy")
+		}
+		if vm.UserDataBucket != "" {
+			actions = append(actions, "s3:PutObject")
+		}
+		if vm.WaitForCloudInit || vm.PostCreateCommand != "" {
+			actions = append(actions, "ssm:DescribeInstanceInformation", "ssm:SendCommand", "ssm:GetCommandInvocation")
+		}
+
+		if c.cfnRoleARN(vm) != nil {
+			actions = append(actions, "iam:PassRole")
+		} else {
+			actions = append(actions,
+				"ec2:RunInstances",
+				"ec2:CreateSecurityGroup",
+				"ec2:AuthorizeSecurityGroupIngress",
+				"ec2:CreateTags",
+			)
+			if vm.ElasticIPAllocationID != "" {
+				actions = append(actions, "ec2:AssociateAddress")
+			}
+			if vm.InstanceProfileName != "" {
+				actions = append(actions, "iam:PassRole")
+			} else if vm.EnableSSM {
+				actions = append(actions,
+					"iam:CreateRole",
+					"iam:AttachRolePolicy",
+					"iam:CreateInstanceProfile",
+					"iam:AddRoleToInstanceProfile",
+					"iam:PassRole",
+				)
+				if vm.InlinePolicy != "" {
+					actions = append(actions, "iam:PutRolePolicy")
+				}
+			}
+		}
+	}
+
+	if dns := cfg.DNS; dns != nil {
+		actions = append(actions,
+			"route53:ListHostedZonesByName",
+			"route53:ListResourceRecordSets",
+			"route53:ChangeResourceRecordSets",
+		)
+		if c.WaitDNS {
+			actions = append(actions, "route53:GetChange")
+		}
+		if dns.HealthCheck != nil {
+			actions = append(actions, "route53:CreateHealthCheck", "route53:ChangeTagsForResource")
+		}
+	}
+
+	slices.Sort(actions)
+	return slices.Compact(actions)
+}
+
+// simulationPrincipal returns the IAM ARN the policy simulator takes for
+// a caller. An assumed-role session maps to its role; ok is false for the
+// root user and federated users, which cannot be simulated.
+func simulationPrincipal(callerARN string) (principal string, ok bool) {
+	parts := strings.SplitN(callerARN, ":", 6)
+	if len(parts) != 6 || parts[0] != "arn" {
+		return "", false
+	}
+	partition, account, resource := parts[1], parts[4], parts[5]
+	switch {
+	case parts[2] == "iam" && (strings.HasPrefix(resource, "user/") || strings.HasPrefix(resource, "role/")):
+		return callerARN, true
+	case parts[2] == "sts" && strings.HasPrefix(resource, "assumed-role/"):
+		role, _, _ := strings.Cut(strings.TrimPrefix(resource, "assumed-role/"), "/")
+		// The session ARN drops the role's path. IAM Identity Center roles
+		// are the common case with one, and always use this path.
+		path := "/"
+		if strings.HasPrefix(role, "AWSReservedSSO_") {
+			path = "/aws-reserved/sso.amazonaws.com/"
+		}
+		return fmt.Sprintf("arn:%s:iam::%s:role%s%s", partition, account, path, role), true
+	}
+	return "", false
+}
+
+// simulatePrincipalPolicy returns the actions the simulator does not allow
+// principal, sorted
+func (c *Client) simulatePrincipalPolicy(ctx context.Context, awsCfg aws.Config, principal string, actions []string) ([]string, error) {
+	iamClient := iam.NewFromConfig(awsCfg)
+	paginator := iam.NewSimulatePrincipalPolicyPaginator(iamClient, &iam.SimulatePrincipalPolicyInput{
+		PolicySourceArn: aws.String(principal),
+		ActionNames:     actions,
+	})
+	var missing []string
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, err
+		}
+		for _, result := range page.EvaluationResults {
+			if result.EvalDecision != iamtypes.PolicyEvaluationDecisionTypeAllowed {
+				missing = append(missing, aws.ToString(result.EvalActionName))
+			}
+		}
+	}
+	slices.Sort(missing)
+	return missing, nil
+}
@@ -0,0 +1,72 @@
+package ec2stack
+
+// hoursPerMonth is the average month AWS uses for monthly estimates
+const hoursPerMonth = 730
+
+// priceRegion is the region the embedded price table was taken from
+const priceRegion = "us-east-1"
+
+// onDemandPrices holds Linux on-demand prices in USD per hour for common
+// instance types in us-east-1. The Pricing API is not used so that create
+// needs no extra permissions; other regions are usually within ~20%.
+var onDemandPrices = map[string]float64{
+	"t2.nano":   0.0058,
+	"t2.micro":  0.0116,
+	"t2.small":  0.023,
+	"t2.medium": 0.0464,
+	"t2.large":  0.0928,
+
+	"t3.nano":    0.0052,
+	"t3.micro":   0.0104,
+	"t3.small":   0.0208,
+	"t3.medium":  0.0416,
+	"t3.large":   0.0832,
+	"t3.xlarge":  0.1664,
+	"t3.2xlarge": 0.3328,
+
+	"t3a.nano":   0.0047,
+	"t3a.micro":  0.0094,
+	"t3a.small":  0.0188,
+	"t3a.medium": 0.0376,
+	"t3a.large":  0.0752,
+
+	"t4g.nano":   0.0042,
+	"t4g.micro":  0.0084,
+	"t4g.small":  0.0168,
+	"t4g.medium": 0.0336,
+	"t4g.large":  0.0672,
+
+	"m5.large":   0.096,
+	"m5.xlarge":  0.192,
+	"m6i.large":  0.096,
+	"m6i.xlarge": 0.192,
+	"m7g.large":  0.0816,
+	"c5.large":   0.085,
+	"c6i.large":  0.085,
+	"c7g.large":  0.0725,
+	"r5.large":   0.126,
+	"r6i.large":  0.126,
+}
+
+// CostEstimate is a rough on-demand price for an instance
+type CostEstimate struct {
+	Hourly  float64
+	Monthly float64
+
+	// Region the price applies to; it may differ from the stack's region
+	PriceRegion string
+}
+
+// EstimateCost returns the on-demand cost of instanceType, or false when
+// the type is not in the price table
+func EstimateCost(instanceType string) (CostEstimate, bool) {
+	hourly, ok := onDemandPrices[instanceType]
+	if !ok {
+		return CostEstimate{}, false
+	}
+	return CostEstimate{
+		Hourly:      hourly,
+		Monthly:     hourly * hoursPerMonth,
+		PriceRegion: priceRegion,
+	}, true
+}
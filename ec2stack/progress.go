@@ -0,0 +1,104 @@
+package ec2stack
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/cloudformation/types"
+)
+
+// spinnerInterval is how often the spinner on the status line turns
+const spinnerInterval = 250 * time.Millisecond
+
+// progressLogInterval is how often a wait logs a progress line when there
+// is no status line, e.g. when output is not a terminal or is JSON
+const progressLogInterval = 30 * time.Second
+
+var spinnerFrames = []string{"|", "/", "-", "\\"}
+
+// waitProgress tracks the resource a stack is working on, as seen in the
+// events tailed during a wait. A nil *waitProgress ignores events.
+type waitProgress struct {
+	mu       sync.Mutex
+	resource string
+}
+
+// update records the resource an event shows in progress, and forgets it
+// once an event shows it finished
+func (p *waitProgress) update(stackName string, event types.StackEvent) {
+	if p == nil {
+		return
+	}
+	id := aws.ToString(event.LogicalResourceId)
+	if id == stackName {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if strings.HasSuffix(string(event.ResourceStatus), "_IN_PROGRESS") {
+		p.resource = fmt.Sprintf("%s (%s)", id, aws.ToString(event.ResourceType))
+	} else if strings.HasPrefix(p.resource, id+" ") {
+		p.resource = ""
+	}
+}
+
+func (p *waitProgress) current() string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.resource
+}
+
+// showWaitProgress reports a wait on stackName until done is closed: as a
+// spinner with the elapsed time and current resource on the console's
+// status line, or as a log line every progressLogInterval otherwise
+func showWaitProgress(ctx context.Context, stackName string, p *waitProgress, done <-chan struct{}) {
+	start := time.Now()
+	status := func(frame int) string {
+		elapsed := time.Since(start).Truncate(time.Second)
+		text := fmt.Sprintf("%s %s: %s elapsed", spinnerFrames[frame%len(spinnerFrames)], stackName, elapsed)
+		if resource := p.current(); resource != "" {
+			text += ", creating " + resource
+		}
+		return text
+	}
+
+	liner, ok := loggerFrom(ctx).Handler().(statusLiner)
+	if ok && liner.setStatus(stackName, status(0)) {
+		defer liner.setStatus(stackName, "")
+		ticker := time.NewTicker(spinnerInterval)
+		defer ticker.Stop()
+		for frame := 1; ; frame++ {
+			select {
+			case <-done:
+				return
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				liner.setStatus(stackName, status(frame))
+			}
+		}
+	}
+
+	ticker := time.NewTicker(progressLogInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			elapsed := time.Since(start).Truncate(time.Second)
+			resource := p.current()
+			msg := fmt.Sprintf("Still waiting for stack (%s elapsed)", elapsed)
+			if resource != "" {
+				msg = fmt.Sprintf("Still waiting for stack (%s elapsed, creating %s)", elapsed, resource)
+			}
+			infoWith(ctx, msg, "elapsed_seconds", int(elapsed.Seconds()), "resource", resource)
+		}
+	}
+}
@@ -0,0 +1,160 @@
+package ec2stack
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/aws/aws-sdk-go-v2/service/cloudformation"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+)
+
+// regionMemberName returns the stack name of a regions config's member in
+// region
+func regionMemberName(stackName, region string) string {
+	return stackName + "-" + region
+}
+
+// regionMemberConfig returns a copy of cfg for its member in region: a
+// single stack there, with region-suffixed hostnames, that finds or creates
+// a network of its own. Under a DNS routing policy the members share the
+// unsuffixed DNS hostname, each with its own record in the routing set
+// and, for geolocation, the location given for its region.
+func regionMemberConfig(cfg *Config, region string) (*Config, error) {
+	member, err := copyMemberConfig(cfg, region)
+	if err != nil {
+		return nil, err
+	}
+	member.VM.Region = region
+	if member.DNS != nil && member.DNS.RoutingPolicy != nil {
+		policy := member.DNS.RoutingPolicy
+		member.DNS.Hostname = cfg.DNS.Hostname
+		if loc, ok := policy.Locations[region]; ok {
+			policy.Location = &loc
+		}
+		policy.Locations = nil
+	}
+	return member, nil
+}
+
+// memberNetwork returns the network a member created, or nil when it used
+// one that already existed
+func memberNetwork(vm *VMConfig) *MemberNetwork {
+	if !vm.CreatedVPC && !vm.CreatedSubnet && vm.InternetGatewayID == "" {
+		return nil
+	}
+	return &MemberNetwork{
+		VpcID:                 vm.VpcID,
+		SubnetID:              vm.SubnetID,
+		CreatedVPC:            vm.CreatedVPC,
+		CreatedSubnet:         vm.CreatedSubnet,
+		InternetGatewayID:     vm.InternetGatewayID,
+		RouteTableID:          vm.RouteTableID,
+		RouteTableAssociation: vm.RouteTableAssociation,
+	}
+}
+
+// vmConfig returns the network as the VMConfig fields the network cleanup
+// reads
+func (n *MemberNetwork) vmConfig() *VMConfig {
+	return &VMConfig{
+		VpcID:                 n.VpcID,
+		SubnetID:              n.SubnetID,
+		CreatedVPC:            n.CreatedVPC,
+		CreatedSubnet:         n.CreatedSubnet,
+		InternetGatewayID:     n.InternetGatewayID,
+		RouteTableID:          n.RouteTableID,
+		RouteTableAssociation: n.RouteTableAssociation,
+	}
+}
+
+// createRegionStacks creates a stack in each of cfg.VM.Regions concurrently.
+// Every name and instance type is checked in its region first, so a
+// problem in one region stops the create before anything is launched.
+// Members that got as far as a stack ID are recorded in cfg.VM.Instances,
+// as for a count config.
+func (c *Client) createRegionStacks(ctx context.Context, stackName string, cfg *Config) (*Config, error) {
+	vm := cfg.VM
+	infof(ctx, "\n=== Creating Stacks in %d Regions ===", len(vm.Regions))
+
+	for _, region := range vm.Regions {
+		awsCfg, err := c.LoadAWSConfig(ctx, region)
+		if err != nil {
+			return cfg, fmt.Errorf("failed to load AWS config for %s: %w", region, err)
+		}
+		if err := checkStackAbsent(ctx, cloudformation.NewFromConfig(awsCfg), regionMemberName(stackName, region)); err != nil {
+			return cfg, err
+		}
+		for _, instanceType := range vm.InstanceTypes() {
+			if err := c.checkInstanceTypeOffered(ctx, ec2.NewFromConfig(awsCfg), region, instanceType); err != nil {
+				return cfg, err
+			}
+		}
+	}
+
+	members := make([]*Config, len(vm.Regions))
+	for i, region := range vm.Regions {
+		var err error
+		members[i], err = regionMemberConfig(cfg, region)
+		if err != nil {
+			return cfg, err
+		}
+	}
+
+	errs := make([]error, len(members))
+	sem := make(chan struct{}, maxParallelStacks)
+	var wg sync.WaitGroup
+	for i, member := range members {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+			name := regionMemberName(stackName, vm.Regions[i])
+			_, errs[i] = c.createOne(withStack(ctx, name), name, member)
+		}()
+	}
+	wg.Wait()
+
+	vm.Instances = nil
+	var failures []error
+	for i, member := range members {
+		region := vm.Regions[i]
+		if errs[i] != nil {
+			failures = append(failures, fmt.Errorf("%s: %w", region, errs[i]))
+		}
+		if member.VM.StackID == "" {
+			// A network created before the stack failed is still recorded,
+			// so delete can remove it
+			if network := memberNetwork(member.VM); network != nil {
+				vm.Instances = append(vm.Instances, InstanceConfig{
+					StackName: regionMemberName(stackName, region),
+					Region:    region,
+					Network:   network,
+				})
+			}
+			continue
+		}
+		vm.Instances = append(vm.Instances, InstanceConfig{
+			StackName:            member.VM.StackName,
+			StackID:              member.VM.StackID,
+			InstanceID:           member.VM.InstanceID,
+			PublicIP:             member.VM.PublicIP,
+			PublicDNSName:        member.VM.PublicDNSName,
+			PrivateIP:            member.VM.PrivateIP,
+			Zone:                 member.VM.Zone,
+			DNS:                  member.DNS,
+			SecondaryIPs:         member.VM.SecondaryIPs,
+			UserDataObject:       member.VM.UserDataObject,
+			LaunchedInstanceType: member.VM.LaunchedInstanceType,
+			Region:               region,
+			Network:              memberNetwork(member.VM),
+		})
+	}
+
+	if len(failures) > 0 {
+		return cfg, fmt.Errorf("%d of %d regions failed to create: %w", len(failures), len(members), errors.Join(failures...))
+	}
+	return cfg, nil
+}
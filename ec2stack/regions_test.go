@@ -0,0 +1,168 @@
+package ec2stack
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+)
+
+func TestRegionMemberConfig(t *testing.T) {
+	tests := []struct {
+		name         string
+		policy       *DNSRoutingPolicy
+		wantHostname string
+		wantLocation string
+	}{
+		{name: "no routing policy", wantHostname: "app-eu-west-1"},
+		{
+			name: "geolocation",
+			policy: &DNSRoutingPolicy{Type: "geolocation", Locations: map[string]GeoLocation{
+				"us-east-1": {CountryCode: "*"},
+				"eu-west-1": {ContinentCode: "EU"},
+			}},
+			wantHostname: "app",
+			wantLocation: "EU",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := &Config{
+				VM:  &VMConfig{Region: "us-east-1", Regions: []string{"us-east-1", "eu-west-1"}, Hostname: "web", VpcID: "vpc-1"},
+				DNS: &DNSConfig{Hostname: "app", Domain: "example.com", RoutingPolicy: tt.policy},
+			}
+			member, err := regionMemberConfig(cfg, "eu-west-1")
+			if err != nil {
+				t.Fatalf("regionMemberConfig() error = %v", err)
+			}
+			if member.VM.Region != "eu-west-1" || member.VM.Regions != nil || member.VM.Hostname != "web-eu-west-1" {
+				t.Errorf("regionMemberConfig() region = %s, regions = %v, hostname = %s", member.VM.Region, member.VM.Regions, member.VM.Hostname)
+			}
+			if member.DNS.Hostname != tt.wantHostname {
+				t.Errorf("regionMemberConfig() dns hostname = %s, want %s", member.DNS.Hostname, tt.wantHostname)
+			}
+			if tt.policy != nil {
+				policy := member.DNS.RoutingPolicy
+				if policy.Location == nil || policy.Location.String() != tt.wantLocation || policy.Locations != nil {
+					t.Errorf("regionMemberConfig() routing policy = %+v, want location %s only", policy, tt.wantLocation)
+				}
+				if len(cfg.DNS.RoutingPolicy.Locations) != 2 || cfg.DNS.RoutingPolicy.Location != nil {
+					t.Errorf("regionMemberConfig() changed the parent's routing policy: %+v", cfg.DNS.RoutingPolicy)
+				}
+			}
+		})
+	}
+}
+
+func TestMemberNetwork(t *testing.T) {
+	if got := memberNetwork(&VMConfig{VpcID: "vpc-1", SubnetID: "subnet-1"}); got != nil {
+		t.Errorf("memberNetwork() = %+v for a network that already existed, want nil", got)
+	}
+	vm := &VMConfig{VpcID: "vpc-1", SubnetID: "subnet-1", CreatedVPC: true, CreatedSubnet: true, InternetGatewayID: "igw-1", RouteTableID: "rtb-1", RouteTableAssociation: "rtbassoc-1"}
+	network := memberNetwork(vm)
+	if network == nil {
+		t.Fatal("memberNetwork() = nil for a created network")
+	}
+	if got := *network.vmConfig(); got.VpcID != vm.VpcID || got.SubnetID != vm.SubnetID || !got.CreatedVPC || !got.CreatedSubnet ||
+		got.InternetGatewayID != vm.InternetGatewayID || got.RouteTableID != vm.RouteTableID || got.RouteTableAssociation != vm.RouteTableAssociation {
+		t.Errorf("vmConfig() = %+v, want the network of %+v", got, vm)
+	}
+}
+
+// offeringsResponse answers DescribeInstanceTypeOfferings with the given
+// instance types
+func offeringsResponse(types ...string) string {
+	var b strings.Builder
+	for _, t := range types {
+		b.WriteString(`<item><instanceType>` + t + `</instanceType><locationType>region</locationType></item>`)
+	}
+	return `<DescribeInstanceTypeOfferingsResponse><instanceTypeOfferingSet>` + b.String() + `</instanceTypeOfferingSet></DescribeInstanceTypeOfferingsResponse>`
+}
+
+func TestClientCreateRegionStacksChecksEveryRegion(t *testing.T) {
+	tests := []struct {
+		name      string
+		responses map[string][]string
+		wantErr   string
+	}{
+		{
+			name: "stack exists in a later region",
+			responses: map[string][]string{
+				"DescribeStacks":                {stackGoneResponse},
+				"DescribeStacks web-eu-west-1":  {stackResponse("web-eu-west-1", "CREATE_COMPLETE", false)},
+				"DescribeInstanceTypeOfferings": {offeringsResponse("t3.micro")},
+			},
+			wantErr: "stack web-eu-west-1 already exists",
+		},
+		{
+			name: "instance type not offered in a later region",
+			responses: map[string][]string{
+				"DescribeStacks":                {stackGoneResponse},
+				"DescribeInstanceTypeOfferings": {offeringsResponse("t3.micro"), offeringsResponse("t3.small")},
+			},
+			wantErr: "instance type t3.micro is not offered in eu-west-1 (available in the t3 family: t3.small)",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stub := &stubAWS{responses: tt.responses}
+			c := newStubClient(t, stub)
+			cfg := &Config{VM: &VMConfig{Region: "us-east-1", Regions: []string{"us-east-1", "eu-west-1"}, InstanceType: "t3.micro"}}
+			_, err := c.createRegionStacks(context.Background(), "web", cfg)
+			var cfgErr *ConfigError
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) || !errors.As(err, &cfgErr) {
+				t.Fatalf("createRegionStacks() error = %v, want a ConfigError containing %q", err, tt.wantErr)
+			}
+			if got := stub.calls["CreateStack"] + stub.calls["CreateVpc"]; got != 0 {
+				t.Errorf("createRegionStacks() made %d create calls, want none before every region is checked", got)
+			}
+		})
+	}
+}
+
+func TestClientDeleteStacksInMemberRegions(t *testing.T) {
+	stub := &stubAWS{responses: map[string][]string{
+		"DescribeStacks web-us-east-1": {stackResponse("web-us-east-1", "CREATE_COMPLETE", false), stackResponse("web-us-east-1", "CREATE_COMPLETE", false), stackGoneResponse},
+		"DescribeStacks web-eu-west-1": {stackResponse("web-eu-west-1", "CREATE_COMPLETE", false), stackResponse("web-eu-west-1", "CREATE_COMPLETE", false), stackGoneResponse},
+		"DeleteStack":                  {`<DeleteStackResponse></DeleteStackResponse>`},
+	}}
+	c := newStubClient(t, stub)
+	var mu sync.Mutex
+	var regions []string
+	load := c.LoadAWSConfig
+	c.LoadAWSConfig = func(ctx context.Context, region string) (aws.Config, error) {
+		mu.Lock()
+		regions = append(regions, region)
+		mu.Unlock()
+		return load(ctx, region)
+	}
+
+	cfg := &Config{VM: &VMConfig{
+		Region:  "us-east-1",
+		Regions: []string{"us-east-1", "eu-west-1"},
+		Instances: []InstanceConfig{
+			{StackName: "web-us-east-1", StackID: "arn:aws:cloudformation:us-east-1:123456789012:stack/web-us-east-1/1", Region: "us-east-1"},
+			{StackName: "web-eu-west-1", StackID: "arn:aws:cloudformation:eu-west-1:123456789012:stack/web-eu-west-1/2", Region: "eu-west-1"},
+		},
+	}}
+	awsCfg, err := load(context.Background(), "us-east-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.deleteStacks(context.Background(), awsCfg, cfg, ""); err != nil {
+		t.Fatalf("deleteStacks() error = %v", err)
+	}
+	if len(cfg.VM.Instances) != 0 {
+		t.Errorf("deleteStacks() left %+v", cfg.VM.Instances)
+	}
+	if got := stub.calls["DeleteStack"]; got != 2 {
+		t.Errorf("DeleteStack called %d times, want 2", got)
+	}
+	if !slices.Contains(regions, "eu-west-1") {
+		t.Errorf("deleteStacks() loaded configs for %v, want one for eu-west-1", regions)
+	}
+}
@@ -0,0 +1,152 @@
+package ec2stack
+
+import (
+	"fmt"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+)
+
+// continentCodes are the continents Route53 geolocation routing accepts
+var continentCodes = []string{"AF", "AN", "AS", "EU", "NA", "OC", "SA"}
+
+// countryCodePattern matches an ISO 3166-1 alpha-2 code, or * for the
+// default location
+var countryCodePattern = regexp.MustCompile(`^([A-Z]{2}|\*)$`)
+
+// subdivisionCodePattern matches an ISO 3166-2 subdivision code without
+// its country prefix, such as CA for California
+var subdivisionCodePattern = regexp.MustCompile(`^[A-Z0-9]{1,3}$`)
+
+// maxSetIdentifierLength is Route53's limit on a record's set identifier
+const maxSetIdentifierLength = 128
+
+// validateRoutingPolicy checks dns.routing_policy against the rest of cfg
+func validateRoutingPolicy(cfg *Config) error {
+	policy := cfg.DNS.RoutingPolicy
+	var regions []string
+	if cfg.VM != nil {
+		if cfg.VM.Count > 1 {
+			return fmt.Errorf("routing_policy cannot be used with count: members in one region would share a latency region or location")
+		}
+		regions = cfg.VM.Regions
+	}
+	if cfg.DNS.Hostname == "" {
+		return fmt.Errorf("routing_policy requires hostname: it applies to the primary record")
+	}
+	if len(policy.SetIdentifier) > maxSetIdentifierLength {
+		return fmt.Errorf("routing_policy.set_identifier is %d characters, maximum is %d", len(policy.SetIdentifier), maxSetIdentifierLength)
+	}
+	if len(regions) > 0 && (policy.SetIdentifier != "" || policy.Region != "") {
+		return fmt.Errorf("routing_policy.set_identifier and routing_policy.region cannot be used with regions: each region's record is identified by its region")
+	}
+
+	switch policy.Type {
+	case "latency":
+		if policy.Location != nil || len(policy.Locations) > 0 {
+			return fmt.Errorf("routing_policy.location and routing_policy.locations are for geolocation routing")
+		}
+		if cfg.VM == nil && policy.Region == "" {
+			return fmt.Errorf("latency routing_policy requires region when there is no vm section")
+		}
+		if policy.Region != "" && !regionPattern.MatchString(policy.Region) {
+			return fmt.Errorf("invalid routing_policy.region %q (expected a region such as us-east-1)", policy.Region)
+		}
+	case "geolocation":
+		if policy.Region != "" {
+			return fmt.Errorf("routing_policy.region is for latency routing")
+		}
+		if len(regions) == 0 {
+			if len(policy.Locations) > 0 {
+				return fmt.Errorf("routing_policy.locations requires regions; use routing_policy.location for a single stack")
+			}
+			if policy.Location == nil {
+				return fmt.Errorf("geolocation routing_policy requires location")
+			}
+			return validateGeoLocation("routing_policy.location", *policy.Location)
+		}
+		if policy.Location != nil {
+			return fmt.Errorf("routing_policy.location cannot be used with regions; give one per region in routing_policy.locations")
+		}
+		for _, region := range regions {
+			loc, ok := policy.Locations[region]
+			if !ok {
+				return fmt.Errorf("routing_policy.locations has no entry for region %s", region)
+			}
+			if err := validateGeoLocation("routing_policy.locations."+region, loc); err != nil {
+				return err
+			}
+		}
+		listed := make([]string, 0, len(policy.Locations))
+		for region := range policy.Locations {
+			listed = append(listed, region)
+		}
+		sort.Strings(listed)
+		for _, region := range listed {
+			if !slices.Contains(regions, region) {
+				return fmt.Errorf("routing_policy.locations lists %s, which is not in regions", region)
+			}
+		}
+	default:
+		return fmt.Errorf("routing_policy.type must be latency or geolocation, got %q", policy.Type)
+	}
+	return nil
+}
+
+// validateGeoLocation checks one geolocation; field names it in errors
+func validateGeoLocation(field string, loc GeoLocation) error {
+	switch {
+	case loc.ContinentCode != "" && (loc.CountryCode != "" || loc.SubdivisionCode != ""):
+		return fmt.Errorf("%s: give either continent_code or country_code, not both", field)
+	case loc.ContinentCode != "":
+		if !slices.Contains(continentCodes, loc.ContinentCode) {
+			return fmt.Errorf("%s: continent_code must be one of %s, got %q", field, strings.Join(continentCodes, ", "), loc.ContinentCode)
+		}
+	case loc.CountryCode == "":
+		return fmt.Errorf("%s: continent_code or country_code is required", field)
+	case !countryCodePattern.MatchString(loc.CountryCode):
+		return fmt.Errorf("%s: country_code must be a two-letter code such as US, or *, got %q", field, loc.CountryCode)
+	case loc.SubdivisionCode != "" && loc.CountryCode == "*":
+		return fmt.Errorf("%s: subdivision_code cannot be used with country_code *", field)
+	case loc.SubdivisionCode != "" && !subdivisionCodePattern.MatchString(loc.SubdivisionCode):
+		return fmt.Errorf("%s: invalid subdivision_code %q (expected a code such as CA)", field, loc.SubdivisionCode)
+	}
+	return nil
+}
+
+// String returns the location as a set identifier: the continent, or the
+// country with its subdivision, and "default" for country *
+func (l GeoLocation) String() string {
+	switch {
+	case l.ContinentCode != "":
+		return l.ContinentCode
+	case l.CountryCode == "*":
+		return "default"
+	case l.SubdivisionCode != "":
+		return l.CountryCode + "-" + l.SubdivisionCode
+	}
+	return l.CountryCode
+}
+
+// apply makes record the policy's member of its routing set for a stack in
+// region
+func (p *DNSRoutingPolicy) apply(record *DNSRecord, region string) {
+	switch p.Type {
+	case "latency":
+		record.LatencyRegion = p.Region
+		if record.LatencyRegion == "" {
+			record.LatencyRegion = region
+		}
+		record.SetIdentifier = record.LatencyRegion
+	case "geolocation":
+		if p.Location != nil {
+			loc := *p.Location
+			record.GeoLocation = &loc
+			record.SetIdentifier = loc.String()
+		}
+	}
+	if p.SetIdentifier != "" {
+		record.SetIdentifier = p.SetIdentifier
+	}
+}
@@ -0,0 +1,169 @@
+package ec2stack
+
+import (
+	"context"
+	"strings"
+	"testing"
+)
+
+func TestValidateRoutingPolicy(t *testing.T) {
+	const users = `"users": [{"username": "alice", "github_username": "alice"}]`
+	tests := []struct {
+		name    string
+		config  string
+		wantErr string
+	}{
+		{
+			name:   "latency",
+			config: `{"vm": {` + users + `}, "dns": {"hostname": "web", "domain": "example.com", "routing_policy": {"type": "latency"}}}`,
+		},
+		{
+			name:   "geolocation per region",
+			config: `{"vm": {` + users + `, "regions": ["us-east-1", "eu-west-1"]}, "dns": {"hostname": "web", "domain": "example.com", "routing_policy": {"type": "geolocation", "locations": {"us-east-1": {"country_code": "*"}, "eu-west-1": {"continent_code": "EU"}}}}}`,
+		},
+		{
+			name:    "with count",
+			config:  `{"vm": {` + users + `, "count": 2}, "dns": {"hostname": "web", "domain": "example.com", "routing_policy": {"type": "latency"}}}`,
+			wantErr: "routing_policy cannot be used with count",
+		},
+		{
+			name:    "no hostname",
+			config:  `{"vm": {` + users + `}, "dns": {"domain": "example.com", "routing_policy": {"type": "latency"}}}`,
+			wantErr: "routing_policy requires hostname",
+		},
+		{
+			name:    "dns only latency without region",
+			config:  `{"dns": {"hostname": "web", "domain": "example.com", "target_ip": "203.0.113.7", "routing_policy": {"type": "latency"}}}`,
+			wantErr: "latency routing_policy requires region when there is no vm section",
+		},
+		{
+			name:    "geolocation without location",
+			config:  `{"vm": {` + users + `}, "dns": {"hostname": "web", "domain": "example.com", "routing_policy": {"type": "geolocation"}}}`,
+			wantErr: "geolocation routing_policy requires location",
+		},
+		{
+			name:    "continent and country",
+			config:  `{"vm": {` + users + `}, "dns": {"hostname": "web", "domain": "example.com", "routing_policy": {"type": "geolocation", "location": {"continent_code": "EU", "country_code": "DE"}}}}`,
+			wantErr: "routing_policy.location: give either continent_code or country_code, not both",
+		},
+		{
+			name:    "subdivision of the default location",
+			config:  `{"vm": {` + users + `}, "dns": {"hostname": "web", "domain": "example.com", "routing_policy": {"type": "geolocation", "location": {"country_code": "*", "subdivision_code": "CA"}}}}`,
+			wantErr: "subdivision_code cannot be used with country_code *",
+		},
+		{
+			name:    "region missing from locations",
+			config:  `{"vm": {` + users + `, "regions": ["us-east-1", "eu-west-1"]}, "dns": {"hostname": "web", "domain": "example.com", "routing_policy": {"type": "geolocation", "locations": {"us-east-1": {"country_code": "US"}}}}}`,
+			wantErr: "routing_policy.locations has no entry for region eu-west-1",
+		},
+		{
+			name:    "set identifier with regions",
+			config:  `{"vm": {` + users + `, "regions": ["us-east-1", "eu-west-1"]}, "dns": {"hostname": "web", "domain": "example.com", "routing_policy": {"type": "latency", "set_identifier": "web"}}}`,
+			wantErr: "cannot be used with regions",
+		},
+		{
+			name:    "unknown type",
+			config:  `{"vm": {` + users + `}, "dns": {"hostname": "web", "domain": "example.com", "routing_policy": {"type": "weighted"}}}`,
+			wantErr: `routing_policy.type must be latency or geolocation, got "weighted"`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := ValidateConfig(parseTestConfig(t, tt.config))
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatalf("ValidateConfig() error = %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("ValidateConfig() error = %v, want it to contain %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestGeoLocationString(t *testing.T) {
+	tests := []struct {
+		loc  GeoLocation
+		want string
+	}{
+		{loc: GeoLocation{ContinentCode: "EU"}, want: "EU"},
+		{loc: GeoLocation{CountryCode: "DE"}, want: "DE"},
+		{loc: GeoLocation{CountryCode: "US", SubdivisionCode: "CA"}, want: "US-CA"},
+		{loc: GeoLocation{CountryCode: "*"}, want: "default"},
+	}
+	for _, tt := range tests {
+		if got := tt.loc.String(); got != tt.want {
+			t.Errorf("%+v.String() = %q, want %q", tt.loc, got, tt.want)
+		}
+	}
+}
+
+// listRecordsResponse answers ListResourceRecordSets with the given
+// <ResourceRecordSet> elements
+func listRecordsResponse(sets ...string) string {
+	return `<ListResourceRecordSetsResponse><ResourceRecordSets>` + strings.Join(sets, "") + `</ResourceRecordSets><IsTruncated>false</IsTruncated><MaxItems>100</MaxItems></ListResourceRecordSetsResponse>`
+}
+
+// changeRecordsResponse answers ChangeResourceRecordSets
+const changeRecordsResponse = `<ChangeResourceRecordSetsResponse><ChangeInfo><Id>/change/C1</Id><Status>PENDING</Status><SubmittedAt>2026-01-01T00:00:00Z</SubmittedAt></ChangeInfo></ChangeResourceRecordSetsResponse>`
+
+func TestClientCreateDNSResourcesRoutingPolicy(t *testing.T) {
+	const rrset = "/2013-04-01/hostedzone/Z0123456789ABC/rrset"
+	tests := []struct {
+		name     string
+		policy   *DNSRoutingPolicy
+		existing string // ListResourceRecordSets response
+		wantSet  string
+		want     []string // in the change batch
+	}{
+		{
+			name:     "latency in the stack's region",
+			policy:   &DNSRoutingPolicy{Type: "latency"},
+			existing: listRecordsResponse(),
+			wantSet:  "us-west-2",
+			want:     []string{"<Action>UPSERT</Action>", "<SetIdentifier>us-west-2</SetIdentifier>", "<Region>us-west-2</Region>"},
+		},
+		{
+			name:     "geolocation with set identifier",
+			policy:   &DNSRoutingPolicy{Type: "geolocation", SetIdentifier: "west", Location: &GeoLocation{CountryCode: "US", SubdivisionCode: "CA"}},
+			existing: listRecordsResponse(),
+			wantSet:  "west",
+			want:     []string{"<SetIdentifier>west</SetIdentifier>", "<GeoLocation><CountryCode>US</CountryCode><SubdivisionCode>CA</SubdivisionCode></GeoLocation>"},
+		},
+		{
+			name:   "plain record replaced",
+			policy: &DNSRoutingPolicy{Type: "latency", Region: "eu-west-1"},
+			existing: listRecordsResponse(`<ResourceRecordSet><Name>web.example.com.</Name><Type>A</Type><TTL>300</TTL>` +
+				`<ResourceRecords><ResourceRecord><Value>203.0.113.7</Value></ResourceRecord></ResourceRecords></ResourceRecordSet>`),
+			wantSet: "eu-west-1",
+			want:    []string{"<Action>DELETE</Action>", "<Action>CREATE</Action>", "<Region>eu-west-1</Region>"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stub := &stubAWS{responses: map[string][]string{
+				"GET " + rrset:  {tt.existing},
+				"POST " + rrset: {changeRecordsResponse},
+			}}
+			c := newStubClient(t, stub)
+			dns := &DNSConfig{Hostname: "web", Domain: "example.com", ZoneID: "Z0123456789ABC", RoutingPolicy: tt.policy}
+			if err := c.createDNSResources(context.Background(), dns, "203.0.113.7", nil, "us-west-2"); err != nil {
+				t.Fatalf("createDNSResources() error = %v", err)
+			}
+			if len(dns.DNSRecords) != 1 || dns.DNSRecords[0].SetIdentifier != tt.wantSet {
+				t.Fatalf("createDNSResources() records = %+v, want one with set identifier %s", dns.DNSRecords, tt.wantSet)
+			}
+			changes := stub.bodies["POST "+rrset]
+			if len(changes) != 1 {
+				t.Fatalf("ChangeResourceRecordSets called %d times, want 1", len(changes))
+			}
+			for _, want := range tt.want {
+				if !strings.Contains(changes[0], want) {
+					t.Errorf("change batch = %s, want it to contain %s", changes[0], want)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,143 @@
+package ec2stack
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awshttp "github.com/aws/aws-sdk-go-v2/aws/transport/http"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+// userDataURLExpiry is how long the instance has to fetch its user data
+// from S3. cloud-init reads it on first boot, minutes after the stack is
+// created; with temporary credentials the URL stops working sooner, when
+// they expire.
+const userDataURLExpiry = 6 * time.Hour
+
+// s3Object is a user data object uploaded to S3, recorded in the config
+// as s3://bucket/key so delete can remove it
+type s3Object struct {
+	Bucket string
+	Key    string
+}
+
+func (o s3Object) String() string {
+	return "s3://" + o.Bucket + "/" + o.Key
+}
+
+// parseS3Object parses an s3://bucket/key URI
+func parseS3Object(uri string) (s3Object, error) {
+	bucket, key, ok := strings.Cut(strings.TrimPrefix(uri, "s3://"), "/")
+	if !strings.HasPrefix(uri, "s3://") || !ok || bucket == "" || key == "" {
+		return s3Object{}, fmt.Errorf("invalid S3 object %q (expected s3://bucket/key)", uri)
+	}
+	return s3Object{Bucket: bucket, Key: key}, nil
+}
+
+// userDataObjectKey is where a stack's user data is uploaded
+func userDataObjectKey(stackName string) string {
+	return fmt.Sprintf("aws-ec2/%s/user-data", stackName)
+}
+
+// stageUserData uploads the user data to the VM's user_data_bucket and
+// returns the encoded user data that replaces it: a cloud-init #include
+// of a presigned URL for the object, so the instance needs no S3
+// permissions of its own. The object is recorded in vm.UserDataObject.
+func (c *Client) stageUserData(ctx context.Context, awsCfg aws.Config, vm *VMConfig, stackName, userData string) (string, error) {
+	obj := s3Object{Bucket: vm.UserDataBucket, Key: userDataObjectKey(stackName)}
+	if err := c.putS3Object(ctx, awsCfg, obj, []byte(userData)); err != nil {
+		return "", err
+	}
+	vm.UserDataObject = obj.String()
+	infof(ctx, "Uploaded user data (%d bytes) to %s", len(userData), obj)
+	return includeUserData(ctx, awsCfg, obj)
+}
+
+// includeUserData returns encoded user data that has cloud-init fetch obj
+// through a presigned URL
+func includeUserData(ctx context.Context, awsCfg aws.Config, obj s3Object) (string, error) {
+	url, err := presignS3Get(ctx, awsCfg, obj, userDataURLExpiry)
+	if err != nil {
+		return "", err
+	}
+	include := "#include\n" + url + "\n"
+	return base64.StdEncoding.EncodeToString([]byte(include)), nil
+}
+
+// deleteUserDataObject removes the user data a create uploaded. Failures
+// are only warned about, since the object does not affect the instance
+// once it has booted.
+func (c *Client) deleteUserDataObject(ctx context.Context, awsCfg aws.Config, uri string) {
+	obj, err := parseS3Object(uri)
+	if err != nil {
+		warnf(ctx, "%v", err)
+		return
+	}
+	if err := c.deleteS3Object(ctx, awsCfg, obj); err != nil {
+		warnf(ctx, "failed to delete user data %s: %v", obj, err)
+		return
+	}
+	infof(ctx, "Deleted user data %s", obj)
+}
+
+// newS3Client returns an S3 client for the config. A stub endpoint is
+// addressed path-style, since it has no per-bucket host names.
+func newS3Client(awsCfg aws.Config) *s3.Client {
+	return s3.NewFromConfig(awsCfg, func(o *s3.Options) {
+		o.UsePathStyle = awsCfg.BaseEndpoint != nil
+	})
+}
+
+func (c *Client) putS3Object(ctx context.Context, awsCfg aws.Config, obj s3Object, body []byte) error {
+	_, err := newS3Client(awsCfg).PutObject(ctx, &s3.PutObjectInput{
+		Bucket:      aws.String(obj.Bucket),
+		Key:         aws.String(obj.Key),
+		Body:        bytes.NewReader(body),
+		ContentType: aws.String("text/plain"),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to upload user data to %s: %w", obj, s3RegionError(awsCfg, err))
+	}
+	return nil
+}
+
+func (c *Client) deleteS3Object(ctx context.Context, awsCfg aws.Config, obj s3Object) error {
+	_, err := newS3Client(awsCfg).DeleteObject(ctx, &s3.DeleteObjectInput{
+		Bucket: aws.String(obj.Bucket),
+		Key:    aws.String(obj.Key),
+	})
+	return s3RegionError(awsCfg, err)
+}
+
+// presignS3Get returns a URL that reads obj without credentials until it
+// expires
+func presignS3Get(ctx context.Context, awsCfg aws.Config, obj s3Object, expiry time.Duration) (string, error) {
+	presigner := s3.NewPresignClient(newS3Client(awsCfg), s3.WithPresignExpires(expiry))
+	req, err := presigner.PresignGetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(obj.Bucket),
+		Key:    aws.String(obj.Key),
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to presign %s: %w", obj, err)
+	}
+	return req.URL, nil
+}
+
+// s3RegionError reports a bucket in another region than the config's as a
+// config error; other errors are returned as they are
+func s3RegionError(awsCfg aws.Config, err error) error {
+	var respErr *awshttp.ResponseError
+	if err == nil || !errors.As(err, &respErr) || respErr.Response == nil {
+		return err
+	}
+	if region := respErr.Response.Header.Get("X-Amz-Bucket-Region"); region != "" && region != awsCfg.Region {
+		return configErrorf("user_data_bucket is in %s, not the stack's region %s", region, awsCfg.Region)
+	}
+	return err
+}
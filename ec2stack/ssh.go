@@ -0,0 +1,188 @@
+package ec2stack
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// sshRetryInterval is the pause between SSH connection attempts
+const sshRetryInterval = 5 * time.Second
+
+// WaitForSSH dials port on host until a connection succeeds or timeout
+// elapses. CREATE_COMPLETE only means the instance is running; sshd may
+// still be starting.
+func WaitForSSH(ctx context.Context, host string, port int, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	addr := net.JoinHostPort(host, strconv.Itoa(port))
+	var dialer net.Dialer
+	for {
+		conn, err := dialer.DialContext(ctx, "tcp", addr)
+		if err == nil {
+			conn.Close()
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("SSH on %s not reachable after %s: %w", addr, timeout, err)
+		case <-time.After(sshRetryInterval):
+		}
+	}
+}
+
+// sshConfigMarker brackets the Host blocks this tool writes to ~/.ssh/config
+const sshConfigMarker = "aws-cf-ec2 managed"
+
+// sshConfigPath returns the path of the user's SSH config
+func sshConfigPath() (string, error) {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", fmt.Errorf("failed to find home directory: %w", err)
+	}
+	return filepath.Join(home, ".ssh", "config"), nil
+}
+
+// WriteSSHConfigEntry adds a Host block for the stack to ~/.ssh/config,
+// replacing any block previously written for the same stack. A port other
+// than 22 and a non-empty proxyJump are written as the block's Port and
+// ProxyJump.
+func WriteSSHConfigEntry(stackName, hostName, user string, port int, proxyJump string) (string, error) {
+	path, err := sshConfigPath()
+	if err != nil {
+		return "", err
+	}
+	data, err := os.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return "", fmt.Errorf("failed to read %s: %w", path, err)
+	}
+
+	content := removeSSHConfigBlock(string(data), stackName)
+	if content != "" && !strings.HasSuffix(content, "\n") {
+		content += "\n"
+	}
+	content += fmt.Sprintf("# BEGIN %s: %s\nHost %s\n    HostName %s\n    User %s\n", sshConfigMarker, stackName, stackName, hostName, user)
+	if port != defaultSSHPort {
+		content += fmt.Sprintf("    Port %d\n", port)
+	}
+	if proxyJump != "" {
+		content += fmt.Sprintf("    ProxyJump %s\n", proxyJump)
+	}
+	content += fmt.Sprintf("# END %s: %s\n", sshConfigMarker, stackName)
+
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return "", fmt.Errorf("failed to create %s: %w", filepath.Dir(path), err)
+	}
+	if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+		return "", fmt.Errorf("failed to write %s: %w", path, err)
+	}
+	return path, nil
+}
+
+// RemoveSSHConfigEntry removes the stack's Host block from ~/.ssh/config.
+// It reports whether a block was removed; a missing file is not an error.
+func RemoveSSHConfigEntry(stackName string) (bool, error) {
+	path, err := sshConfigPath()
+	if err != nil {
+		return false, err
+	}
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("failed to read %s: %w", path, err)
+	}
+
+	content := removeSSHConfigBlock(string(data), stackName)
+	if content == string(data) {
+		return false, nil
+	}
+	if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+		return false, fmt.Errorf("failed to write %s: %w", path, err)
+	}
+	return true, nil
+}
+
+// WriteKnownHosts adds a known_hosts line for hosts with each of keys to
+// path, first dropping any lines for the same hosts so a recreated
+// instance's new keys don't clash with the old ones
+func WriteKnownHosts(path string, hosts, keys []string) error {
+	data, err := os.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to read %s: %w", path, err)
+	}
+
+	var out strings.Builder
+	for _, line := range strings.SplitAfter(string(data), "\n") {
+		if line == "" || knownHostsLineMatches(line, hosts) {
+			continue
+		}
+		out.WriteString(line)
+		if !strings.HasSuffix(line, "\n") {
+			out.WriteString("\n")
+		}
+	}
+	for _, key := range keys {
+		fmt.Fprintf(&out, "%s %s\n", strings.Join(hosts, ","), key)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return fmt.Errorf("failed to create %s: %w", filepath.Dir(path), err)
+	}
+	if err := os.WriteFile(path, []byte(out.String()), 0600); err != nil {
+		return fmt.Errorf("failed to write %s: %w", path, err)
+	}
+	return nil
+}
+
+// knownHostsLineMatches reports whether a known_hosts line is for one of
+// hosts. Hashed entries are never matched.
+func knownHostsLineMatches(line string, hosts []string) bool {
+	fields := strings.Fields(line)
+	if len(fields) < 2 || strings.HasPrefix(fields[0], "#") {
+		return false
+	}
+	patterns := fields[0]
+	if strings.HasPrefix(patterns, "@") && len(fields) > 2 {
+		// @cert-authority or @revoked marker
+		patterns = fields[1]
+	}
+	for _, pattern := range strings.Split(patterns, ",") {
+		for _, host := range hosts {
+			if pattern == host {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// removeSSHConfigBlock drops the managed block for stackName, leaving every
+// other line untouched
+func removeSSHConfigBlock(content, stackName string) string {
+	begin := fmt.Sprintf("# BEGIN %s: %s", sshConfigMarker, stackName)
+	end := fmt.Sprintf("# END %s: %s", sshConfigMarker, stackName)
+
+	var out strings.Builder
+	inBlock := false
+	for _, line := range strings.SplitAfter(content, "\n") {
+		trimmed := strings.TrimSpace(line)
+		switch {
+		case trimmed == begin:
+			inBlock = true
+		case inBlock && trimmed == end:
+			inBlock = false
+		case !inBlock:
+			out.WriteString(line)
+		}
+	}
+	return out.String()
+}
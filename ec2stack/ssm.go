@@ -0,0 +1,174 @@
+package ec2stack
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ssm"
+	ssmtypes "github.com/aws/aws-sdk-go-v2/service/ssm/types"
+)
+
+const (
+	// ssmPollInterval is the pause between SSM status checks
+	ssmPollInterval = 5 * time.Second
+
+	// ssmRegisterTimeout bounds the wait for the instance's SSM agent to
+	// come online
+	ssmRegisterTimeout = 5 * time.Minute
+
+	// ssmCommandTimeout bounds a single command run through SSM
+	ssmCommandTimeout = 15 * time.Minute
+)
+
+// waitForSSMAgent waits until the instance is registered and online in SSM.
+// An instance that never shows up almost always lacks the instance profile
+// or the SSM agent.
+func waitForSSMAgent(ctx context.Context, ssmClient *ssm.Client, instanceID string) error {
+	ctx, cancel := context.WithTimeout(ctx, ssmRegisterTimeout)
+	defer cancel()
+
+	for {
+		result, err := ssmClient.DescribeInstanceInformation(ctx, &ssm.DescribeInstanceInformationInput{
+			Filters: []ssmtypes.InstanceInformationStringFilter{
+				{Key: aws.String("InstanceIds"), Values: []string{instanceID}},
+			},
+		})
+		if err == nil && len(result.InstanceInformationList) > 0 &&
+			result.InstanceInformationList[0].PingStatus == ssmtypes.PingStatusOnline {
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			if err != nil {
+				return fmt.Errorf("failed to query SSM for %s: %w", instanceID, err)
+			}
+			return fmt.Errorf("instance %s did not register with SSM within %s; check that enable_ssm is set and the AMI ships the SSM agent", instanceID, ssmRegisterTimeout)
+		case <-time.After(ssmPollInterval):
+		}
+	}
+}
+
+// runSSMCommand runs a shell script on the instance with AWS-RunShellScript
+// and waits for it to finish. The invocation is returned whatever its status;
+// err is only set when the command could not be run or polled.
+func runSSMCommand(ctx context.Context, ssmClient *ssm.Client, instanceID string, commands []string) (*ssm.GetCommandInvocationOutput, error) {
+	sent, err := ssmClient.SendCommand(ctx, &ssm.SendCommandInput{
+		DocumentName:   aws.String("AWS-RunShellScript"),
+		InstanceIds:    []string{instanceID},
+		Parameters:     map[string][]string{"commands": commands},
+		TimeoutSeconds: aws.Int32(int32(ssmCommandTimeout.Seconds())),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to send SSM command: %w", err)
+	}
+	commandID := aws.ToString(sent.Command.CommandId)
+
+	ctx, cancel := context.WithTimeout(ctx, ssmCommandTimeout)
+	defer cancel()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil, fmt.Errorf("timed out waiting for SSM command %s: %w", commandID, ctx.Err())
+		case <-time.After(ssmPollInterval):
+		}
+
+		invocation, err := ssmClient.GetCommandInvocation(ctx, &ssm.GetCommandInvocationInput{
+			CommandId:  aws.String(commandID),
+			InstanceId: aws.String(instanceID),
+		})
+		if err != nil {
+			// The invocation is not visible for a moment after SendCommand
+			var notYet *ssmtypes.InvocationDoesNotExist
+			if errors.As(err, &notYet) {
+				continue
+			}
+			return nil, fmt.Errorf("failed to get SSM command status: %w", err)
+		}
+
+		switch invocation.Status {
+		case ssmtypes.CommandInvocationStatusPending, ssmtypes.CommandInvocationStatusInProgress,
+			ssmtypes.CommandInvocationStatusDelayed, ssmtypes.CommandInvocationStatusCancelling:
+			continue
+		}
+		return invocation, nil
+	}
+}
+
+// runPostCreateSteps runs the SSM-based steps requested in the VM config:
+// waiting for cloud-init, then the post-create command
+func runPostCreateSteps(ctx context.Context, ssmClient *ssm.Client, vm *VMConfig) error {
+	infof(ctx, "Waiting for the SSM agent to come online...")
+	if err := waitForSSMAgent(ctx, ssmClient, vm.InstanceID); err != nil {
+		return err
+	}
+
+	if vm.WaitForCloudInit {
+		// A custom template may not pass the setup script to the instance
+		if err := waitForCloudInit(ctx, ssmClient, vm.InstanceID, vm.TemplateFile == ""); err != nil {
+			return err
+		}
+	}
+
+	if vm.PostCreateCommand != "" {
+		err := runPostCreateCommand(ctx, ssmClient, vm.InstanceID, vm.PostCreateCommand)
+		if err != nil && vm.ContinueOnError {
+			warnf(ctx, "%v (continue_on_error is set)", err)
+			return nil
+		}
+		return err
+	}
+
+	return nil
+}
+
+// runPostCreateCommand runs the user's command and prints its output
+func runPostCreateCommand(ctx context.Context, ssmClient *ssm.Client, instanceID, command string) error {
+	infof(ctx, "Running post-create command: %s", command)
+	invocation, err := runSSMCommand(ctx, ssmClient, instanceID, []string{command})
+	if err != nil {
+		return err
+	}
+
+	if out := aws.ToString(invocation.StandardOutputContent); out != "" {
+		infof(ctx, "%s", strings.TrimRight(out, "\n"))
+	}
+	if out := aws.ToString(invocation.StandardErrorContent); out != "" {
+		infof(ctx, "%s", strings.TrimRight(out, "\n"))
+	}
+	if invocation.Status != ssmtypes.CommandInvocationStatusSuccess {
+		return fmt.Errorf("post-create command failed (%s, exit code %d)", invocation.Status, invocation.ResponseCode)
+	}
+	return nil
+}
+
+// waitForCloudInit blocks until cloud-init has finished on the instance.
+// With checkMarker it also requires the setup script's bootstrapMarker, so
+// a setup script that stopped on an error fails the wait.
+func waitForCloudInit(ctx context.Context, ssmClient *ssm.Client, instanceID string, checkMarker bool) error {
+	infof(ctx, "Waiting for cloud-init to finish...")
+	commands := []string{"cloud-init status --wait --long"}
+	if checkMarker {
+		commands = []string{
+			"cloud-init status --wait --long || exit $?",
+			fmt.Sprintf("test -f %s || { echo 'the setup script did not complete: %s is missing' >&2; exit 1; }", bootstrapMarker, bootstrapMarker),
+		}
+	}
+	invocation, err := runSSMCommand(ctx, ssmClient, instanceID, commands)
+	if err != nil {
+		return err
+	}
+	if invocation.Status != ssmtypes.CommandInvocationStatusSuccess {
+		return fmt.Errorf("cloud-init did not finish cleanly (%s, exit code %d):\n%s%s",
+			invocation.Status, invocation.ResponseCode,
+			aws.ToString(invocation.StandardOutputContent), aws.ToString(invocation.StandardErrorContent))
+	}
+
+	infof(ctx, "cloud-init finished")
+	return nil
+}
@@ -0,0 +1,1363 @@
+// Package ec2stack creates and deletes EC2 instances and their Route53
+// records from a stack config. The aws-cf-ec2 CLI is a thin wrapper around it.
+package ec2stack
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os/user"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/aws/retry"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/credentials/stscreds"
+	"github.com/aws/aws-sdk-go-v2/service/cloudformation"
+	"github.com/aws/aws-sdk-go-v2/service/cloudformation/types"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	"github.com/aws/aws-sdk-go-v2/service/route53"
+	"github.com/aws/aws-sdk-go-v2/service/ssm"
+	"github.com/aws/aws-sdk-go-v2/service/sts"
+	"github.com/aws/smithy-go"
+)
+
+// defaultRegion is used when neither the config nor the AWS environment
+// names a region
+const defaultRegion = "us-east-1"
+
+// Client runs stack operations against AWS
+type Client struct {
+	// LoadAWSConfig builds the AWS config for a region. Replace it to point
+	// the client at stub endpoints or static credentials.
+	LoadAWSConfig func(ctx context.Context, region string) (aws.Config, error)
+
+	// HTTPClient is used to check users' GitHub keys
+	HTTPClient *http.Client
+
+	// ForceDNS overwrites existing DNS records that point elsewhere
+	ForceDNS bool
+
+	// KeepDNS makes DeleteStack leave the Route53 records and health check
+	// in place
+	KeepDNS bool
+
+	// WaitDNS waits for Route53 changes to reach all of the zone's name
+	// servers before DNS records are reported created or deleted
+	WaitDNS bool
+
+	// Force disables termination protection on a stack before deleting it
+	Force bool
+
+	// MaxAttempts bounds the retries of throttled or failed AWS calls in the
+	// default config loader
+	MaxAttempts int
+
+	// SkipKeyCheck skips checking that each user has SSH keys on GitHub,
+	// for offline runs
+	SkipKeyCheck bool
+
+	// SkipPermissionCheck skips simulating the caller's IAM permissions
+	// before a create
+	SkipPermissionCheck bool
+
+	// EventsSince, when set, limits the stack events printed while a create
+	// waits to those from this time on. By default all are printed: the
+	// stack is new, so they all belong to the create.
+	EventsSince time.Time
+
+	// Tags are extra tags for the stacks a create makes, passed on by
+	// CloudFormation to the instance and its other resources. They replace
+	// the tool's own tags of the same key; ParseTags rejects the keys it
+	// relies on.
+	Tags map[string]string
+
+	// NoAMICache skips the on-disk cache of AMI IDs resolved from SSM and
+	// always asks SSM
+	NoAMICache bool
+
+	// NoZoneCache skips the cache of hosted zone IDs looked up by domain,
+	// both this run's and the one on disk, and always asks Route53
+	NoZoneCache bool
+
+	// Profile selects a shared config profile in the default config loader
+	Profile string
+
+	// CloudFormationRoleARN, when set, is the service role for stack creates
+	// and deletes, overriding a config's cloudformation_role_arn
+	CloudFormationRoleARN string
+
+	// AssumeRoleARN, when set, makes the default config loader assume this
+	// role, with ExternalID if the role's trust policy requires one
+	AssumeRoleARN string
+	ExternalID    string
+
+	mu            sync.Mutex
+	instanceTypes map[string][]string // offered instance types by region
+	roleCreds     aws.CredentialsProvider
+	roleProfile   string // the Profile roleCreds were built from
+
+	zoneIDs  map[string]string // hosted zones looked up this run; see zoneCacheMu
+	accounts map[string]string // account IDs by Profile and AssumeRoleARN
+}
+
+const (
+	// DefaultMaxAttempts is how many times an AWS call is tried before a
+	// throttling or transient error is returned
+	DefaultMaxAttempts = 8
+
+	// maxRetryBackoff caps the exponential backoff between attempts
+	maxRetryBackoff = 30 * time.Second
+)
+
+// NewClient returns a Client that loads the default AWS config chain
+func NewClient() *Client {
+	c := &Client{
+		HTTPClient:  &http.Client{Timeout: 10 * time.Second},
+		MaxAttempts: DefaultMaxAttempts,
+	}
+	c.LoadAWSConfig = c.loadDefaultAWSConfig
+	return c
+}
+
+// loadDefaultAWSConfig loads the default config chain with a retryer that
+// backs off on throttling (Throttling, RequestLimitExceeded,
+// PriorRequestNotComplete, ...) and 5xx errors
+func (c *Client) loadDefaultAWSConfig(ctx context.Context, region string) (aws.Config, error) {
+	opts := []func(*config.LoadOptions) error{
+		config.WithRetryer(func() aws.Retryer {
+			return retry.NewStandard(func(o *retry.StandardOptions) {
+				o.MaxAttempts = c.MaxAttempts
+				o.MaxBackoff = maxRetryBackoff
+			})
+		}),
+	}
+	if region != "" {
+		opts = append(opts, config.WithRegion(region))
+	}
+	if c.Profile != "" {
+		opts = append(opts, config.WithSharedConfigProfile(c.Profile))
+	}
+	awsCfg, err := config.LoadDefaultConfig(ctx, opts...)
+	if err != nil || c.AssumeRoleARN == "" {
+		return awsCfg, err
+	}
+
+	// Share one set of role credentials across regions so the role is
+	// assumed once per run, not once per client. A config's aws_profile
+	// can change the source profile after the first load.
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.roleCreds == nil || c.roleProfile != c.Profile {
+		// STS needs a region even when the caller did not pick one
+		stsCfg := awsCfg.Copy()
+		if stsCfg.Region == "" {
+			stsCfg.Region = defaultRegion
+		}
+		provider := stscreds.NewAssumeRoleProvider(sts.NewFromConfig(stsCfg), c.AssumeRoleARN, func(o *stscreds.AssumeRoleOptions) {
+			o.RoleSessionName = fmt.Sprintf("aws-cf-ec2-%d", time.Now().Unix())
+			if c.ExternalID != "" {
+				o.ExternalID = aws.String(c.ExternalID)
+			}
+		})
+		c.roleCreds = aws.NewCredentialsCache(provider)
+		c.roleProfile = c.Profile
+	}
+	awsCfg.Credentials = c.roleCreds
+	return awsCfg, nil
+}
+
+// CallerARN returns the identity the client's AWS calls run as, which is
+// the assumed-role session when AssumeRoleARN is set
+func (c *Client) CallerARN(ctx context.Context, region string) (string, error) {
+	awsCfg, err := c.LoadAWSConfig(ctx, region)
+	if err != nil {
+		return "", fmt.Errorf("failed to load AWS config: %w", err)
+	}
+	if awsCfg.Region == "" {
+		awsCfg.Region = defaultRegion
+	}
+	identity, err := sts.NewFromConfig(awsCfg).GetCallerIdentity(ctx, &sts.GetCallerIdentityInput{})
+	if err != nil {
+		return "", fmt.Errorf("failed to get caller identity: %w", err)
+	}
+	return aws.ToString(identity.Arn), nil
+}
+
+// CreateStack creates a stack with the default Client
+func CreateStack(ctx context.Context, stackName string, cfg *Config) (*Config, error) {
+	return NewClient().CreateStack(ctx, stackName, cfg)
+}
+
+// DeleteStack deletes a stack with the default Client
+func DeleteStack(ctx context.Context, stackName string) error {
+	return NewClient().DeleteStack(ctx, stackName)
+}
+
+// createVMResources creates EC2 instance and returns public IP and region.
+// tags are added to the stack, which propagates them to the instance. dns
+// may be nil; it supplies the instance hostname and cloud-init template data.
+func (c *Client) createVMResources(ctx context.Context, vm *VMConfig, dns *DNSConfig, stackName string, tags []types.Tag) (string, string, error) {
+	// Load AWS config with region from VM config
+	awsCfg, err := c.LoadAWSConfig(ctx, vm.Region)
+	if err != nil {
+		return "", "", fmt.Errorf("failed to load AWS config: %w", err)
+	}
+
+	infoWith(ctx, fmt.Sprintf("Using AWS Region: %s", vm.Region), "region", vm.Region)
+	infof(ctx, "Stack Name: %s", stackName)
+	infof(ctx, "OS: %s", vm.OS)
+	infof(ctx, "Users to create: %d", len(vm.Users))
+	for _, user := range vm.Users {
+		infof(ctx, "  - %s (GitHub: %s)", user.Username, user.GitHubUsername)
+	}
+
+	cfClient := cloudformation.NewFromConfig(awsCfg)
+	ec2Client := ec2.NewFromConfig(awsCfg)
+
+	// User data uploaded to S3 for a stack that never got created is
+	// removed again
+	created := false
+	defer func() {
+		if !created && vm.UserDataObject != "" {
+			c.deleteUserDataObject(ctx, awsCfg, vm.UserDataObject)
+			vm.UserDataObject = ""
+		}
+	}()
+
+	// Stop before creating anything if the name is taken
+	if err := checkStackAbsent(ctx, cfClient, stackName); err != nil {
+		return "", "", err
+	}
+
+	tmpl, err := c.buildStackTemplate(ctx, awsCfg, vm, dns, stackName, "")
+	if err != nil {
+		return "", "", err
+	}
+
+	// Create CloudFormation stack
+	input := &cloudformation.CreateStackInput{
+		StackName:    aws.String(stackName),
+		TemplateBody: aws.String(tmpl.Body),
+		Parameters:   tmpl.Parameters,
+		Capabilities: tmpl.Capabilities,
+		RoleARN:      c.cfnRoleARN(vm),
+		Tags: append([]types.Tag{
+			{
+				Key:   aws.String("Purpose"),
+				Value: aws.String("EC2Instance"),
+			},
+		}, tags...),
+	}
+
+	if vm.StackPolicy != "" {
+		policy, err := stackPolicyBody(vm)
+		if err != nil {
+			return "", "", configErrorf("stack_policy: %v", err)
+		}
+		input.StackPolicyBody = aws.String(policy)
+		infof(ctx, "Stack policy: %s", vm.StackPolicy)
+	}
+
+	result, err := cfClient.CreateStack(ctx, input)
+	if err != nil {
+		// Another run may have created the stack since the check above
+		var exists *types.AlreadyExistsException
+		if errors.As(err, &exists) {
+			if serr := checkStackAbsent(ctx, cfClient, stackName); serr != nil {
+				return "", "", serr
+			}
+		}
+		err = explainStackPolicyError(explainRoleError(err, c.cfnRoleARN(vm)), vm)
+		return "", "", fmt.Errorf("failed to create stack: %w", err)
+	}
+
+	// Record the stack straight away so an interrupted create can be deleted
+	created = true
+	vm.StackName = stackName
+	vm.StackID = *result.StackId
+
+	infof(ctx, "Stack creation initiated!")
+	infoWith(ctx, fmt.Sprintf("Stack ID: %s", vm.StackID), "stack_id", vm.StackID)
+	infof(ctx, "Waiting for stack to complete...")
+
+	// Print stack events and progress while the waiter runs
+	done := make(chan struct{})
+	tailed := make(chan struct{})
+	progress := &waitProgress{}
+	go func() {
+		tailStackEvents(ctx, cfClient, stackName, c.EventsSince, done, progress)
+		close(tailed)
+	}()
+	shown := make(chan struct{})
+	go func() {
+		showWaitProgress(ctx, stackName, progress, done)
+		close(shown)
+	}()
+
+	waiter := cloudformation.NewStackCreateCompleteWaiter(cfClient)
+	err = waiterError(waiter.Wait(ctx, &cloudformation.DescribeStacksInput{
+		StackName: aws.String(stackName),
+	}, 10*time.Minute))
+	close(done)
+	<-tailed
+	<-shown
+	if err != nil {
+		if ctx.Err() != nil {
+			warnf(ctx, "interrupted: stack %s may still be creating (Stack ID: %s)", stackName, vm.StackID)
+		} else if errors.Is(err, ErrWaitFailed) {
+			printStackFailures(ctx, cfClient, stackName)
+		}
+		return "", "", fmt.Errorf("failed waiting for stack: %w", err)
+	}
+
+	// Get stack outputs
+	describeOutput, err := cfClient.DescribeStacks(ctx, &cloudformation.DescribeStacksInput{
+		StackName: aws.String(stackName),
+	})
+	if err != nil {
+		return "", "", fmt.Errorf("failed to describe stack: %w", err)
+	}
+
+	// Update VM config with outputs
+	for _, output := range describeOutput.Stacks[0].Outputs {
+		switch *output.OutputKey {
+		case "InstanceId":
+			vm.InstanceID = *output.OutputValue
+		case "InstanceType":
+			// Keep a type from the launch template out of the config, where
+			// it would read as an override on the next create
+			if vm.LaunchTemplateID == "" {
+				vm.InstanceType = *output.OutputValue
+			}
+		case "PublicIP":
+			vm.PublicIP = *output.OutputValue
+		case "PublicDnsName":
+			vm.PublicDNSName = *output.OutputValue
+		case "PrivateIP":
+			vm.PrivateIP = *output.OutputValue
+		case "AvailabilityZone":
+			vm.Zone = *output.OutputValue
+		case "SecurityGroupId":
+			vm.SecurityGroup = *output.OutputValue
+		case "SSMRoleName":
+			vm.SSMRoleName = *output.OutputValue
+		case "SSMInstanceProfile":
+			vm.SSMInstanceProfile = *output.OutputValue
+		}
+	}
+
+	if vm.SSMRoleName != "" {
+		infof(ctx, "SSM role: %s, instance profile: %s", vm.SSMRoleName, vm.SSMInstanceProfile)
+	}
+
+	// CloudFormation has no attribute for the secondary IPs, so read them
+	// from the instance's network interface
+	if vm.SecondaryPrivateIPs > 0 && vm.InstanceID != "" {
+		vm.SecondaryIPs, err = secondaryPrivateIPs(ctx, ec2Client, vm.InstanceID)
+		if err != nil {
+			return "", "", err
+		}
+		infoWith(ctx, fmt.Sprintf("Secondary private IPs: %s", strings.Join(vm.SecondaryIPs, ", ")), "secondary_ips", vm.SecondaryIPs)
+	}
+
+	// Protection is enabled only after a successful create, so a rolled
+	// back stack can still be deleted
+	if vm.EnableTerminationProtection {
+		_, err = cfClient.UpdateTerminationProtection(ctx, &cloudformation.UpdateTerminationProtectionInput{
+			StackName:                   aws.String(stackName),
+			EnableTerminationProtection: aws.Bool(true),
+		})
+		if err != nil {
+			return "", "", fmt.Errorf("failed to enable termination protection: %w", err)
+		}
+		infof(ctx, "Termination protection enabled")
+	}
+
+	return vm.PublicIP, vm.Region, nil
+}
+
+// stackTemplate is a rendered stack template with the parameters and
+// capabilities it is deployed with
+type stackTemplate struct {
+	Body         string
+	Parameters   []types.Parameter
+	Capabilities []types.Capability
+}
+
+// buildStackTemplate checks the config against the account, resolves the
+// image, network and user data, and renders the stack's template. A plan
+// passes the deployed instance's ID as planInstanceID: nothing is created
+// then, and the instance may already hold the Elastic IP.
+func (c *Client) buildStackTemplate(ctx context.Context, awsCfg aws.Config, vm *VMConfig, dns *DNSConfig, stackName, planInstanceID string) (*stackTemplate, error) {
+	plan := planInstanceID != ""
+	var err error
+	ssmClient := ssm.NewFromConfig(awsCfg)
+	ec2Client := ec2.NewFromConfig(awsCfg)
+	cfClient := cloudformation.NewFromConfig(awsCfg)
+
+	// A launch template supplies the image and instance type the config
+	// leaves unset. A plan uses the type a fallback list launched.
+	instanceType := vm.EffectiveInstanceType()
+	var lt *launchTemplate
+	if vm.LaunchTemplateID != "" {
+		lt, err = describeLaunchTemplate(ctx, ec2Client, vm.LaunchTemplateID, vm.LaunchTemplateVersion)
+		if err != nil {
+			return nil, err
+		}
+		infof(ctx, "Launch Template: %s (version %s)", lt.ID, lt.Version)
+		if instanceType == "" {
+			instanceType = lt.InstanceType
+		}
+		if instanceType == "" {
+			return nil, configErrorf("launch template %s sets no instance type; set instance_type", lt.ID)
+		}
+	}
+	infof(ctx, "Instance Type: %s", instanceType)
+	if vm.AvailabilityZone != "" {
+		infof(ctx, "Availability Zone: %s", vm.AvailabilityZone)
+	}
+	if vm.ShutdownBehavior == "terminate" {
+		warnf(ctx, "shutdown_behavior is terminate: shutting down inside the instance terminates it but leaves the stack, security group and DNS records behind; use -delete for a full cleanup")
+	}
+	if vm.DetailedMonitoring {
+		infof(ctx, "Detailed monitoring: on (1-minute CloudWatch metrics, billed separately)")
+	}
+	if vm.NoPublicIP {
+		warnf(ctx, "no_public_ip is set: the instance needs a NAT gateway or proxy in its subnet to fetch SSH keys from GitHub")
+	}
+	if vm.PlacementGroup != "" {
+		infof(ctx, "Placement Group: %s", vm.PlacementGroup)
+	} else if vm.PlacementStrategy != "" {
+		infof(ctx, "Placement Group: new %s group", vm.PlacementStrategy)
+	}
+	if vm.SecondaryPrivateIPs > 0 {
+		infof(ctx, "Secondary private IPs: %d", vm.SecondaryPrivateIPs)
+	}
+	if len(vm.AdditionalSecurityGroupIDs) > 0 {
+		infof(ctx, "Additional security groups: %s", strings.Join(vm.AdditionalSecurityGroupIDs, ", "))
+	}
+	if vm.InstanceProfileName != "" {
+		infof(ctx, "Instance profile: %s", vm.InstanceProfileName)
+	} else if vm.EnableSSM {
+		infof(ctx, "SSM: creating a role and instance profile with AmazonSSMManagedInstanceCore")
+		if vm.InlinePolicy != "" {
+			infof(ctx, "Adding inline_policy to the role")
+		}
+	}
+
+	// Check the instance type before creating any network resources
+	if err := c.checkInstanceTypeOffered(ctx, ec2Client, vm.Region, instanceType); err != nil {
+		return nil, err
+	}
+	if vm.SecondaryPrivateIPs > 0 {
+		if err := checkSecondaryIPLimit(ctx, ec2Client, instanceType, vm.SecondaryPrivateIPs); err != nil {
+			return nil, err
+		}
+	}
+
+	// A plan must not create anything, so it uses the recorded network
+	if plan {
+		if vm.VpcID == "" || vm.SubnetID == "" {
+			return nil, configErrorf("the stack's VPC and subnet are not known; set vpc_id and subnet_id")
+		}
+	} else if err := ensureNetwork(ctx, ec2Client, vm, stackName); err != nil {
+		return nil, err
+	}
+	if vm.PlacementGroup != "" {
+		if err := checkPlacementGroup(ctx, ec2Client, vm.PlacementGroup); err != nil {
+			return nil, err
+		}
+	}
+	var elasticIP string
+	if vm.ElasticIPAllocationID != "" {
+		if elasticIP, err = describeElasticIP(ctx, ec2Client, vm.ElasticIPAllocationID, planInstanceID); err != nil {
+			return nil, err
+		}
+		infof(ctx, "Elastic IP: %s (%s)", elasticIP, vm.ElasticIPAllocationID)
+	}
+	if len(vm.AdditionalSecurityGroupIDs) > 0 {
+		if err := checkSecurityGroups(ctx, ec2Client, vm.AdditionalSecurityGroupIDs, vm.VpcID); err != nil {
+			return nil, err
+		}
+	}
+
+	// Lookup AMI ID from SSM, unless the launch template provides it
+	var amiID string
+	imageFromTemplate := lt != nil && vm.OS == ""
+	if imageFromTemplate {
+		if lt.ImageID == "" {
+			return nil, configErrorf("launch template %s sets no image; set os", lt.ID)
+		}
+		amiID = lt.ImageID
+		infof(ctx, "Using AMI from launch template: %s", amiID)
+	} else {
+		infof(ctx, "Looking up AMI for %s...", vm.OS)
+		amiID, err = c.resolveAMI(ctx, ssmClient, vm.Region, vm.OS)
+		if err != nil {
+			return nil, fmt.Errorf("failed to lookup AMI: %w", err)
+		}
+		infoWith(ctx, fmt.Sprintf("Found AMI: %s", amiID), "ami_id", amiID)
+	}
+	image, err := describeImage(ctx, ec2Client, amiID)
+	if err != nil {
+		return nil, err
+	}
+	debugf(ctx, "AMI %s: %s (%s, root device %s)", amiID, aws.ToString(image.Name), image.Architecture, aws.ToString(image.RootDeviceName))
+	if err := checkArchitecture(ctx, ec2Client, image, instanceType); err != nil {
+		return nil, err
+	}
+	if err := checkSwapFits(image, vm.SwapSizeGB); err != nil {
+		return nil, err
+	}
+	vm.AMIID = amiID
+
+	// Generate UserData
+	// A custom cloud-init file receives the packages through its template
+	// data, so the default script only installs them when there is none
+	var packages []string
+	docker := false
+	if vm.CloudInitFile == "" {
+		packages = vm.Packages
+		docker = vm.InstallDocker
+	} else if vm.InstallDocker {
+		warnf(ctx, "install_docker is ignored with cloud_init_file; install Docker from your cloud-init file")
+	}
+	if docker {
+		infof(ctx, "Docker: installed by the setup script")
+	}
+	hostname, fqdn := instanceHostname(vm, dns)
+	if fqdn != "" {
+		infof(ctx, "Instance hostname: %s", fqdn)
+	}
+	var bakedKeys map[string]string
+	if vm.BakeKeys {
+		infof(ctx, "Fetching GitHub SSH keys to bake into the user data...")
+		bakedKeys, err = fetchGitHubKeys(ctx, c.HTTPClient, vm.Users)
+		if err != nil {
+			return nil, err
+		}
+	}
+	userScript := generateUserSetupScript(vm, hostname, fqdn, packages, docker, bakedKeys)
+
+	var cloudInitContent string
+	if vm.CloudInitFile != "" {
+		cloudInitPath := resolveCloudInitPath(vm.CloudInitFile)
+		infof(ctx, "Processing cloud-init file: %s", cloudInitPath)
+
+		cloudInitContent, err = processCloudInitTemplate(cloudInitPath, cloudInitTemplateData(vm, dns))
+		if err != nil {
+			return nil, fmt.Errorf("failed to process cloud-init: %w", err)
+		}
+	}
+
+	rawUserData := generateMultipartUserData(userScript, cloudInitContent)
+	// A plan leaves S3 alone and only presigns where the user data would
+	// go; the URL differs on every run, so the instance shows a change
+	staged := false
+	stage := func() (string, error) {
+		staged = true
+		if plan {
+			warnf(ctx, "user data would be hosted in S3, so its presigned URL always shows as a change to EC2Instance")
+			return includeUserData(ctx, awsCfg, s3Object{Bucket: vm.UserDataBucket, Key: userDataObjectKey(stackName)})
+		}
+		return c.stageUserData(ctx, awsCfg, vm, stackName, rawUserData)
+	}
+	userData, err := encodeUserData(ctx, rawUserData, vm.CompressUserData)
+	if errors.Is(err, errUserDataTooLarge) && vm.UserDataBucket != "" {
+		infof(ctx, "%v, hosting it in S3", err)
+		userData, err = stage()
+		if err != nil {
+			return nil, err
+		}
+	} else if errors.Is(err, errUserDataTooLarge) {
+		return nil, configErrorf("%v; set user_data_bucket to host it in S3", err)
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to encode user data: %w", err)
+	}
+
+	ingress, err := ingressRules(vm)
+	if err != nil {
+		return nil, fmt.Errorf("invalid ports: %w", err)
+	}
+	if vm.DefaultCIDR == "" {
+		for _, rule := range ingress {
+			if rule.CIDR == openCIDR {
+				warnf(ctx, "no default_cidr set, opening ports without an explicit @cidr to %s", openCIDR)
+				break
+			}
+		}
+	}
+
+	egressRules, err := parseRuleSpecs(vm.EgressRules, "0.0.0.0/0")
+	if err != nil {
+		return nil, fmt.Errorf("invalid egress_rules: %w", err)
+	}
+
+	inlinePolicy := ""
+	if vm.InlinePolicy != "" {
+		if inlinePolicy, err = compactPolicy(vm.InlinePolicy); err != nil {
+			return nil, configErrorf("%v", err)
+		}
+	}
+
+	// Generate CloudFormation template with embedded UserData
+	cfnData := CFNTemplateData{
+		UserData:                 userData,
+		NameTag:                  vm.NameTag,
+		SecurityGroupDescription: vm.SecurityGroupDescription,
+		IngressRules:             ingress,
+		EgressRules:              egressRules,
+		ExtraSecurityGroupIDs:    vm.AdditionalSecurityGroupIDs,
+		EnableSSM:                vm.EnableSSM,
+		InstanceProfileName:      vm.InstanceProfileName,
+		InlinePolicy:             inlinePolicy,
+		NoPublicIP:               vm.NoPublicIP,
+		DetailedMonitoring:       vm.DetailedMonitoring,
+		ShutdownBehavior:         vm.ShutdownBehavior,
+		SecondaryPrivateIPs:      vm.SecondaryPrivateIPs,
+		AvailabilityZone:         vm.AvailabilityZone,
+		PlacementGroup:           vm.PlacementGroup,
+		PlacementStrategy:        vm.PlacementStrategy,
+		RootDeviceName:           aws.ToString(image.RootDeviceName),
+		RootVolumeType:           vm.RootVolumeType,
+		RootVolumeIOPS:           vm.RootVolumeIOPS,
+		RootVolumeThroughput:     vm.RootVolumeThroughput,
+		EncryptRootVolume:        vm.EncryptRootVolume,
+		KMSKeyID:                 vm.KMSKeyID,
+		ImageFromTemplate:        imageFromTemplate,
+		InstanceTypeFromTemplate: lt != nil && vm.InstanceType == "",
+	}
+	if elasticIP != "" {
+		cfnData.ElasticIPAllocationID = vm.ElasticIPAllocationID
+		cfnData.ElasticIP = elasticIP
+	}
+	if lt != nil {
+		cfnData.LaunchTemplateID = lt.ID
+		cfnData.LaunchTemplateVersion = lt.Version
+	}
+	parameters := []types.Parameter{
+		{
+			ParameterKey:   aws.String("ImageId"),
+			ParameterValue: aws.String(amiID),
+		},
+		{
+			ParameterKey:   aws.String("InstanceType"),
+			ParameterValue: aws.String(instanceType),
+		},
+		{
+			ParameterKey:   aws.String("VpcId"),
+			ParameterValue: aws.String(vm.VpcID),
+		},
+		{
+			ParameterKey:   aws.String("SubnetId"),
+			ParameterValue: aws.String(vm.SubnetID),
+		},
+	}
+	capabilities := []types.Capability{types.CapabilityCapabilityIam}
+
+	var cfnTemplate string
+	if vm.TemplateFile != "" {
+		// A hand-written template replaces the generated one; it still gets
+		// the resolved image, network and user data if it asks for them
+		infof(ctx, "Using template file: %s", vm.TemplateFile)
+		cfnTemplate, err = readTemplateFile(vm)
+		if err != nil {
+			return nil, configErrorf("template_file: %v", err)
+		}
+		parameters, capabilities, err = templateParameters(ctx, cfClient, cfnTemplate, map[string]string{
+			"ImageId":      amiID,
+			"InstanceType": instanceType,
+			"VpcId":        vm.VpcID,
+			"SubnetId":     vm.SubnetID,
+			"UserData":     userData,
+		})
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		cfnTemplate, err = generateCloudFormationTemplate(cfnData)
+		if err != nil {
+			return nil, fmt.Errorf("failed to generate CloudFormation template: %w", err)
+		}
+		// The user data is embedded, so it can push the template past the
+		// inline limit even when it fits EC2's
+		if len(cfnTemplate) > maxTemplateBodySize && vm.UserDataBucket != "" && !staged {
+			infof(ctx, "CloudFormation template is %d bytes (limit %d), hosting the user data in S3", len(cfnTemplate), maxTemplateBodySize)
+			if userData, err = stage(); err != nil {
+				return nil, err
+			}
+			cfnData.UserData = userData
+			if cfnTemplate, err = generateCloudFormationTemplate(cfnData); err != nil {
+				return nil, fmt.Errorf("failed to generate CloudFormation template: %w", err)
+			}
+		}
+	}
+	debugf(ctx, "CloudFormation template: %d bytes, user data: %d bytes encoded", len(cfnTemplate), len(userData))
+
+	return &stackTemplate{
+		Body:         cfnTemplate,
+		Parameters:   parameters,
+		Capabilities: capabilities,
+	}, nil
+}
+
+// CreateStack validates cfg and creates the VM and DNS resources it
+// describes. Output fields (instance ID, public IP, DNS records, ...) are
+// filled in on cfg, which is also returned. The config file is not written;
+// callers persist the result with WriteConfig.
+func (c *Client) CreateStack(ctx context.Context, stackName string, cfg *Config) (*Config, error) {
+	ctx = withStack(ctx, stackName)
+	if err := ValidateConfig(cfg); err != nil {
+		return cfg, err
+	}
+
+	if cfg.VM != nil && !c.SkipKeyCheck {
+		infof(ctx, "Checking GitHub SSH keys...")
+		if err := verifyGitHubKeys(ctx, c.HTTPClient, cfg.VM.Users); err != nil {
+			return cfg, err
+		}
+	}
+
+	if !c.SkipPermissionCheck {
+		if err := c.checkPermissions(ctx, cfg); err != nil {
+			return cfg, err
+		}
+	}
+
+	// Generate random hostname if DNS section exists but hostname is empty
+	if cfg.DNS != nil && cfg.DNS.Hostname == "" && cfg.DNS.Domain != "" {
+		hostname, err := generateRandomHostname()
+		if err != nil {
+			return cfg, err
+		}
+		cfg.DNS.Hostname = hostname
+		infof(ctx, "Generated random hostname: %s", cfg.DNS.Hostname)
+	}
+
+	if cfg.VM != nil && len(cfg.VM.Regions) > 0 {
+		return c.createRegionStacks(ctx, stackName, cfg)
+	}
+	if cfg.VM != nil && cfg.VM.Count > 1 {
+		return c.createStacks(ctx, stackName, cfg)
+	}
+	return c.createOne(ctx, stackName, cfg)
+}
+
+// createOne creates the VM, DNS records and post-create steps of a single
+// validated config
+func (c *Client) createOne(ctx context.Context, stackName string, cfg *Config) (*Config, error) {
+	var publicIP string
+	var region string
+	var err error
+
+	// Create VM resources if configured
+	if cfg.VM != nil {
+		infof(ctx, "\n=== Creating VM Resources ===")
+		if len(c.Tags) > 0 {
+			infof(ctx, "Extra tags: %s", describeTags(c.Tags))
+		}
+		publicIP, region, err = c.createVMWithFallback(ctx, cfg.VM, cfg.DNS, stackName, mergeTags(traceTags(cfg), c.Tags))
+		if err != nil {
+			return cfg, fmt.Errorf("failed to create VM resources: %w", err)
+		}
+		infof(ctx, "\nVM Created Successfully")
+		if publicIP != "" {
+			infoWith(ctx, fmt.Sprintf("Public IP: %s", publicIP),
+				"public_ip", publicIP, "private_ip", cfg.VM.PrivateIP, "instance_id", cfg.VM.InstanceID)
+		} else {
+			infoWith(ctx, fmt.Sprintf("Private IP: %s (no public IP)", cfg.VM.PrivateIP),
+				"private_ip", cfg.VM.PrivateIP, "instance_id", cfg.VM.InstanceID)
+		}
+	}
+
+	if cfg.VM == nil && len(c.Tags) > 0 {
+		warnf(ctx, "-tags not applied: the config has no vm section, so there is no stack to tag")
+	}
+
+	// Create DNS resources if configured
+	if cfg.DNS != nil {
+		infof(ctx, "\n=== Creating DNS Resources ===")
+
+		// Use region from VM if available, otherwise default
+		if region == "" {
+			region = defaultRegion
+		}
+
+		// Records in a private zone, or for an instance without a public
+		// IP, point at the instance's private IP
+		recordIP := publicIP
+		if cfg.VM != nil && (cfg.DNS.PrivateZone || cfg.VM.NoPublicIP) {
+			recordIP = cfg.VM.PrivateIP
+		}
+
+		// Use the VM's IP if no target_ip specified
+		if cfg.DNS.TargetIP == "" && recordIP != "" {
+			cfg.DNS.TargetIP = recordIP
+		}
+
+		var secondaryIPs []string
+		if cfg.VM != nil {
+			secondaryIPs = cfg.VM.SecondaryIPs
+		}
+		err = c.createDNSResources(ctx, cfg.DNS, recordIP, secondaryIPs, region)
+		if err != nil {
+			return cfg, fmt.Errorf("failed to create DNS resources: %w", err)
+		}
+		infof(ctx, "\nDNS Created Successfully")
+		infoWith(ctx, fmt.Sprintf("FQDN: %s", cfg.DNS.FQDN), "fqdn", cfg.DNS.FQDN)
+	}
+
+	if cfg.VM != nil && (cfg.VM.WaitForCloudInit || cfg.VM.PostCreateCommand != "") {
+		infof(ctx, "\n=== Running Post-Create Steps ===")
+		awsCfg, err := c.LoadAWSConfig(ctx, cfg.VM.Region)
+		if err != nil {
+			return cfg, fmt.Errorf("failed to load AWS config: %w", err)
+		}
+		if err := runPostCreateSteps(ctx, ssm.NewFromConfig(awsCfg), cfg.VM); err != nil {
+			return cfg, err
+		}
+	}
+
+	return cfg, nil
+}
+
+// traceTags returns the tags that tie a stack back to the config and
+// person that created it
+func traceTags(cfg *Config) []types.Tag {
+	var tags []types.Tag
+	add := func(key, value string) {
+		if value != "" {
+			tags = append(tags, types.Tag{Key: aws.String(key), Value: aws.String(value)})
+		}
+	}
+
+	if cfg.DNS != nil && cfg.DNS.Domain != "" {
+		fqdn := cfg.DNS.Domain
+		if cfg.DNS.Hostname != "" {
+			fqdn = cfg.DNS.Hostname + "." + cfg.DNS.Domain
+		}
+		add("FQDN", fqdn)
+	}
+	if cfg.Source != "" {
+		if abs, err := filepath.Abs(cfg.Source); err == nil {
+			add("ConfigFile", abs)
+		} else {
+			add("ConfigFile", cfg.Source)
+		}
+	}
+
+	createdBy := ""
+	if cfg.VM != nil && len(cfg.VM.Users) > 0 {
+		createdBy = cfg.VM.Users[0].GitHubUsername
+	}
+	if createdBy == "" {
+		if u, err := user.Current(); err == nil {
+			createdBy = u.Username
+		}
+	}
+	add("CreatedBy", createdBy)
+
+	return tags
+}
+
+// DeleteStack deletes the DNS records, CloudFormation stack and created
+// network resources recorded in the stack's config file, then clears the
+// output fields in that file. A stack ARN is deleted without a config.
+func (c *Client) DeleteStack(ctx context.Context, stackName string) error {
+	ctx = withStack(ctx, stackName)
+	if IsStackID(stackName) {
+		return c.deleteStackByID(ctx, stackName)
+	}
+
+	// Read nested config
+	cfg, configFile, err := ReadConfig(stackName)
+	if err != nil {
+		warnf(ctx, "could not read config file: %v", err)
+		cfg = nil
+		configFile = ""
+	}
+
+	// Determine region
+	region := defaultRegion
+	if cfg != nil && cfg.VM != nil && cfg.VM.Region != "" {
+		region = cfg.VM.Region
+	}
+
+	// The recorded stack ID says where the stack was really created
+	if cfg != nil && cfg.VM != nil {
+		stackID := cfg.VM.StackID
+		if stackID == "" && len(cfg.VM.Instances) > 0 {
+			stackID = cfg.VM.Instances[0].StackID
+			// Members of a regions config each say where they are
+			if cfg.VM.Instances[0].Region != "" {
+				region = cfg.VM.Instances[0].Region
+			}
+		}
+		if stackID != "" {
+			region, err = c.checkStackLocation(ctx, region, stackID)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	// Load AWS config
+	awsCfg, err := c.LoadAWSConfig(ctx, region)
+	if err != nil {
+		return fmt.Errorf("failed to load AWS config: %w", err)
+	}
+
+	infof(ctx, "Using AWS Region: %s", region)
+	infof(ctx, "Deleting Stack: %s", stackName)
+
+	if cfg != nil && cfg.VM != nil && len(cfg.VM.Instances) > 0 {
+		return c.deleteStacks(ctx, awsCfg, cfg, configFile)
+	}
+
+	// Check protection before touching DNS so a refused delete changes nothing
+	if cfg != nil && cfg.VM != nil && cfg.VM.StackName != "" {
+		cfClient := cloudformation.NewFromConfig(awsCfg)
+		if err := c.checkTerminationProtection(ctx, cfClient, stackName); err != nil {
+			return err
+		}
+	}
+
+	// Delete DNS records first (if configured)
+	if cfg != nil && cfg.DNS != nil {
+		if c.KeepDNS {
+			infof(ctx, "Keeping DNS records (-keep-dns)")
+		} else {
+			deleteDNSResources(ctx, route53.NewFromConfig(awsCfg), cfg.DNS, c.WaitDNS)
+		}
+	}
+
+	// Delete CloudFormation stack (if VM configured)
+	if cfg != nil && cfg.VM != nil && cfg.VM.StackName != "" {
+		cfClient := cloudformation.NewFromConfig(awsCfg)
+		if err := deleteCloudFormationStack(ctx, cfClient, stackName, c.cfnRoleARN(cfg.VM)); err != nil {
+			return err
+		}
+
+		if cfg.VM.UserDataObject != "" {
+			c.deleteUserDataObject(ctx, awsCfg, cfg.VM.UserDataObject)
+		}
+
+		// Delete created network infrastructure
+		if cfg.VM.CreatedVPC || cfg.VM.CreatedSubnet || cfg.VM.InternetGatewayID != "" {
+			ec2Client := ec2.NewFromConfig(awsCfg)
+			deleteNetworkStackNested(ctx, ec2Client, cfg.VM)
+		}
+	}
+
+	// Clear output fields in config file
+	if cfg != nil && configFile != "" {
+		if cfg.VM != nil {
+			clearVMOutputs(cfg.VM)
+		}
+		if cfg.DNS != nil && !c.KeepDNS {
+			clearDNSOutputs(cfg.DNS)
+		}
+
+		if err := WriteConfig(configFile, cfg); err != nil {
+			warnf(ctx, "failed to update config file: %v", err)
+		} else {
+			infof(ctx, "Config cleared: %s", configFile)
+		}
+	}
+
+	infof(ctx, "Stack deleted successfully")
+
+	return nil
+}
+
+// checkStackAbsent fails with a config error naming the way out when a
+// stack called stackName already exists
+func checkStackAbsent(ctx context.Context, cfClient *cloudformation.Client, stackName string) error {
+	result, err := cfClient.DescribeStacks(ctx, &cloudformation.DescribeStacksInput{
+		StackName: aws.String(stackName),
+	})
+	if err != nil {
+		if isStackNotFound(err) {
+			return nil
+		}
+		return fmt.Errorf("failed to check for an existing stack: %w", err)
+	}
+	if len(result.Stacks) == 0 {
+		return nil
+	}
+
+	status := result.Stacks[0].StackStatus
+	switch status {
+	case types.StackStatusRollbackComplete:
+		return configErrorf("stack %s is in ROLLBACK_COMPLETE after a failed create; it cannot be updated or reused, run -delete -n %s first", stackName, stackName)
+	case types.StackStatusDeleteInProgress:
+		return configErrorf("stack %s is still being deleted; wait for the delete to finish and try again", stackName)
+	}
+	return configErrorf("stack %s already exists (%s); run -delete -n %s first or choose another name", stackName, status, stackName)
+}
+
+// cfnRoleARN returns the CloudFormation service role for vm's stack: the
+// Client's when set, then the config's. nil leaves CloudFormation to use
+// the role the stack was created with, or the caller's credentials.
+func (c *Client) cfnRoleARN(vm *VMConfig) *string {
+	if c.CloudFormationRoleARN != "" {
+		return aws.String(c.CloudFormationRoleARN)
+	}
+	if vm != nil && vm.CloudFormationRoleARN != "" {
+		return aws.String(vm.CloudFormationRoleARN)
+	}
+	return nil
+}
+
+// explainRoleError turns CloudFormation's refusals to use roleARN into a
+// config error saying what to fix. Other errors are returned unchanged.
+func explainRoleError(err error, roleARN *string) error {
+	if roleARN == nil {
+		return err
+	}
+	var apiErr smithy.APIError
+	if !errors.As(err, &apiErr) {
+		return err
+	}
+	msg := apiErr.ErrorMessage()
+	switch {
+	case strings.Contains(msg, "iam:PassRole"):
+		return configErrorf("your credentials may not pass the CloudFormation role %s (iam:PassRole is denied): %w", *roleARN, err)
+	case apiErr.ErrorCode() == "ValidationError" && strings.Contains(msg, *roleARN):
+		return configErrorf("CloudFormation cannot use the role %s; check that it exists and its trust policy allows cloudformation.amazonaws.com: %w", *roleARN, err)
+	}
+	return err
+}
+
+// isStackNotFound reports whether err is CloudFormation's ValidationError
+// for a stack that does not exist
+func isStackNotFound(err error) bool {
+	var apiErr smithy.APIError
+	return errors.As(err, &apiErr) && apiErr.ErrorCode() == "ValidationError" &&
+		strings.Contains(apiErr.ErrorMessage(), "does not exist")
+}
+
+// stackAlreadyDeleted reports whether a stack is gone: unknown by name, or
+// in DELETE_COMPLETE when looked up by ID
+func stackAlreadyDeleted(ctx context.Context, cfClient *cloudformation.Client, stackName string) (bool, error) {
+	result, err := cfClient.DescribeStacks(ctx, &cloudformation.DescribeStacksInput{
+		StackName: aws.String(stackName),
+	})
+	if err != nil {
+		if isStackNotFound(err) {
+			return true, nil
+		}
+		return false, fmt.Errorf("failed to check stack %s: %w", stackName, err)
+	}
+	return len(result.Stacks) == 0 || result.Stacks[0].StackStatus == types.StackStatusDeleteComplete, nil
+}
+
+// deleteCloudFormationStack deletes a stack and waits for it to be gone,
+// through the service role roleARN when it is not nil. A stack that is
+// already gone is not an error, so a repeated delete can still finish
+// cleaning up.
+func deleteCloudFormationStack(ctx context.Context, cfClient *cloudformation.Client, stackName string, roleARN *string) error {
+	gone, err := stackAlreadyDeleted(ctx, cfClient, stackName)
+	if err != nil {
+		return err
+	}
+	if gone {
+		infof(ctx, "Stack %s already deleted", stackName)
+		return nil
+	}
+
+	_, err = cfClient.DeleteStack(ctx, &cloudformation.DeleteStackInput{
+		StackName: aws.String(stackName),
+		RoleARN:   roleARN,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to delete stack: %w", explainRoleError(err, roleARN))
+	}
+
+	infof(ctx, "Stack deletion initiated for %s, waiting for completion...", stackName)
+
+	waiter := cloudformation.NewStackDeleteCompleteWaiter(cfClient)
+	err = waiterError(waiter.Wait(ctx, &cloudformation.DescribeStacksInput{
+		StackName: aws.String(stackName),
+	}, 10*time.Minute))
+	if err != nil {
+		return fmt.Errorf("failed waiting for stack deletion: %w", err)
+	}
+	return nil
+}
+
+// clearVMOutputs resets the fields create filled in, including the
+// discovered or created network
+func clearVMOutputs(vm *VMConfig) {
+	vm.StackName = ""
+	vm.StackID = ""
+	vm.InstanceID = ""
+	vm.PublicIP = ""
+	vm.PublicDNSName = ""
+	vm.PrivateIP = ""
+	vm.SecurityGroup = ""
+	vm.AMIID = ""
+	vm.Zone = ""
+	vm.LaunchedInstanceType = ""
+	vm.SecondaryIPs = nil
+	vm.SSMRoleName = ""
+	vm.SSMInstanceProfile = ""
+	vm.UserDataObject = ""
+	vm.Instances = nil
+	vm.CreatedVPC = false
+	vm.CreatedSubnet = false
+	vm.VpcID = ""
+	vm.SubnetID = ""
+	vm.InternetGatewayID = ""
+	vm.RouteTableID = ""
+	vm.RouteTableAssociation = ""
+}
+
+// DeleteDNS deletes only the stack's DNS records and health check, clears
+// the DNS output fields in its config file and leaves the CloudFormation
+// stack running
+func (c *Client) DeleteDNS(ctx context.Context, stackName string) error {
+	ctx = withStack(ctx, stackName)
+	cfg, configFile, err := ReadConfig(stackName)
+	if err != nil {
+		return err
+	}
+	if cfg.DNS == nil {
+		return configErrorf("config %s has no dns section", configFile)
+	}
+
+	region := defaultRegion
+	if cfg.VM != nil && cfg.VM.Region != "" {
+		region = cfg.VM.Region
+	}
+	awsCfg, err := c.LoadAWSConfig(ctx, region)
+	if err != nil {
+		return fmt.Errorf("failed to load AWS config: %w", err)
+	}
+
+	r53Client := route53.NewFromConfig(awsCfg)
+	deleteDNSResources(ctx, r53Client, cfg.DNS, c.WaitDNS)
+	clearDNSOutputs(cfg.DNS)
+	if cfg.VM != nil {
+		// Members whose stack is already gone were only kept for their records
+		var remaining []InstanceConfig
+		for _, inst := range cfg.VM.Instances {
+			if inst.DNS != nil {
+				deleteDNSResources(ctx, r53Client, inst.DNS, c.WaitDNS)
+				clearDNSOutputs(inst.DNS)
+			}
+			if inst.StackID != "" {
+				remaining = append(remaining, inst)
+			}
+		}
+		cfg.VM.Instances = remaining
+	}
+
+	if err := WriteConfig(configFile, cfg); err != nil {
+		return fmt.Errorf("failed to update config file: %w", err)
+	}
+	infof(ctx, "DNS fields cleared: %s", configFile)
+	return nil
+}
+
+// DescribeStack returns the live CloudFormation stack for stackName
+func (c *Client) DescribeStack(ctx context.Context, stackName, region string) (*types.Stack, error) {
+	awsCfg, err := c.LoadAWSConfig(ctx, region)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load AWS config: %w", err)
+	}
+	cfClient := cloudformation.NewFromConfig(awsCfg)
+
+	result, err := cfClient.DescribeStacks(ctx, &cloudformation.DescribeStacksInput{
+		StackName: aws.String(stackName),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to describe stack: %w", err)
+	}
+	if len(result.Stacks) == 0 {
+		return nil, configErrorf("stack %s not found in %s", stackName, awsCfg.Region)
+	}
+	return &result.Stacks[0], nil
+}
+
+// ListStacks returns the stacks tagged Purpose=EC2Instance in a region.
+// An empty region falls back to the AWS config, then us-east-1; the region
+// actually used is returned alongside the stacks.
+func (c *Client) ListStacks(ctx context.Context, region string) ([]types.Stack, string, error) {
+	awsCfg, err := c.LoadAWSConfig(ctx, region)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to load AWS config: %w", err)
+	}
+	if awsCfg.Region == "" {
+		awsCfg.Region = defaultRegion
+	}
+	cfClient := cloudformation.NewFromConfig(awsCfg)
+
+	var stacks []types.Stack
+	paginator := cloudformation.NewDescribeStacksPaginator(cfClient, &cloudformation.DescribeStacksInput{})
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, awsCfg.Region, fmt.Errorf("failed to list stacks: %w", err)
+		}
+		for _, stack := range page.Stacks {
+			if hasTag(stack.Tags, "Purpose", "EC2Instance") {
+				stacks = append(stacks, stack)
+			}
+		}
+	}
+
+	return stacks, awsCfg.Region, nil
+}
+
+func hasTag(tags []types.Tag, key, value string) bool {
+	for _, tag := range tags {
+		if aws.ToString(tag.Key) == key && aws.ToString(tag.Value) == value {
+			return true
+		}
+	}
+	return false
+}
+
+// deleteStackByID deletes a stack given its ARN, without a local config.
+// The region is taken from the ARN.
+func (c *Client) deleteStackByID(ctx context.Context, stackID string) error {
+	region, err := c.checkStackLocation(ctx, "", stackID)
+	if err != nil {
+		return err
+	}
+
+	awsCfg, err := c.LoadAWSConfig(ctx, region)
+	if err != nil {
+		return fmt.Errorf("failed to load AWS config: %w", err)
+	}
+
+	infof(ctx, "Using AWS Region: %s", region)
+	infof(ctx, "Deleting Stack: %s", stackID)
+	infof(ctx, "Note: no config file is used, so DNS records and network resources are not cleaned up")
+
+	cfClient := cloudformation.NewFromConfig(awsCfg)
+	gone, err := stackAlreadyDeleted(ctx, cfClient, stackID)
+	if err != nil {
+		return err
+	}
+	if gone {
+		infof(ctx, "Stack already deleted")
+		return nil
+	}
+	if err := c.checkTerminationProtection(ctx, cfClient, stackID); err != nil {
+		return err
+	}
+
+	roleARN := c.cfnRoleARN(nil)
+	_, err = cfClient.DeleteStack(ctx, &cloudformation.DeleteStackInput{
+		StackName: aws.String(stackID),
+		RoleARN:   roleARN,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to delete stack: %w", explainRoleError(err, roleARN))
+	}
+
+	infof(ctx, "Stack deletion initiated, waiting for completion...")
+
+	waiter := cloudformation.NewStackDeleteCompleteWaiter(cfClient)
+	err = waiterError(waiter.Wait(ctx, &cloudformation.DescribeStacksInput{
+		StackName: aws.String(stackID),
+	}, 10*time.Minute))
+	if err != nil {
+		return fmt.Errorf("failed waiting for stack deletion: %w", err)
+	}
+
+	infof(ctx, "Stack deleted successfully")
+
+	return nil
+}
+
+// checkTerminationProtection refuses to delete a protected stack unless
+// Force is set, in which case protection is turned off first. A stack that
+// cannot be described is left for DeleteStack to report.
+func (c *Client) checkTerminationProtection(ctx context.Context, cfClient *cloudformation.Client, stackName string) error {
+	result, err := cfClient.DescribeStacks(ctx, &cloudformation.DescribeStacksInput{
+		StackName: aws.String(stackName),
+	})
+	if err != nil || len(result.Stacks) == 0 {
+		return nil
+	}
+	if !aws.ToBool(result.Stacks[0].EnableTerminationProtection) {
+		return nil
+	}
+	if !c.Force {
+		return configErrorf("stack %s has termination protection enabled; use -force to disable it and delete", stackName)
+	}
+
+	_, err = cfClient.UpdateTerminationProtection(ctx, &cloudformation.UpdateTerminationProtectionInput{
+		StackName:                   aws.String(stackName),
+		EnableTerminationProtection: aws.Bool(false),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to disable termination protection: %w", err)
+	}
+	infof(ctx, "Termination protection disabled")
+	return nil
+}
+
+// checkStackLocation compares the region and account a stack ID was
+// created in with the config's region, if any, and the client's
+// credentials, and returns the region to delete in. A stack in another
+// region is deleted there, with a warning. A stack in another account is
+// refused: it would look already deleted, and the config would be
+// cleared while the stack lives on.
+func (c *Client) checkStackLocation(ctx context.Context, region, stackID string) (string, error) {
+	stackRegion, err := stackIDRegion(stackID)
+	if err != nil {
+		return "", err
+	}
+	if region != "" && stackRegion != region {
+		warnf(ctx, "the config's region is %s, but the stack was created in %s; deleting it in %s", region, stackRegion, stackRegion)
+		region = stackRegion
+	}
+
+	callerARN, err := c.CallerARN(ctx, region)
+	if err != nil {
+		warnf(ctx, "could not check the AWS account: %v", err)
+		return region, nil
+	}
+	if stackAccount, account := arnAccount(stackID), arnAccount(callerARN); stackAccount != account {
+		return "", configErrorf("stack %s was created in account %s, but the current credentials are for account %s; use -profile or -assume-role to switch", stackID, stackAccount, account)
+	}
+	return region, nil
+}
+
+// arnAccount returns the account ID field of an ARN
+func arnAccount(arn string) string {
+	parts := strings.Split(arn, ":")
+	if len(parts) < 5 {
+		return ""
+	}
+	return parts[4]
+}
+
+// stackIDPattern matches the start of a CloudFormation stack ARN in any
+// partition
+var stackIDPattern = regexp.MustCompile(`^arn:aws(-[a-z]+)*:cloudformation:`)
+
+// IsStackID reports whether name is a CloudFormation stack ARN
+func IsStackID(name string) bool {
+	return stackIDPattern.MatchString(name)
+}
+
+// stackIDRegion returns the region in a stack ID,
+// arn:aws:cloudformation:<region>:<account>:stack/<name>/<id>
+func stackIDRegion(stackID string) (string, error) {
+	parts := strings.Split(stackID, ":")
+	if len(parts) < 6 || !IsStackID(stackID) {
+		return "", configErrorf("invalid stack ID: %s", stackID)
+	}
+	return parts[3], nil
+}
@@ -0,0 +1,271 @@
+package ec2stack
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/credentials"
+)
+
+// stubAWS answers the AWS API calls a Client makes and counts them by
+// action. STS and IAM calls get built-in answers; any other call gets the
+// next of its responses, the last one repeating.
+type stubAWS struct {
+	callerARN string
+	denied    map[string]bool // actions the simulator does not allow
+	simulator int             // status of SimulatePrincipalPolicy, if not 200
+
+	// responses are the bodies answering other calls, keyed by query API
+	// action, by target for JSON APIs such as "AmazonSSM.GetParameter", or
+	// by method and path for Route53's REST API. A call on one
+	// CloudFormation stack takes the responses keyed by its action and
+	// stack name first, such as "DeleteStack web-2". A body holding an
+	// <Error> is sent with status 400.
+	responses map[string][]string
+
+	mu     sync.Mutex
+	calls  map[string]int
+	bodies map[string][]string // request bodies by action
+}
+
+func (s *stubAWS) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var form url.Values
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "application/x-www-form-urlencoded") {
+		if form, err = url.ParseQuery(string(body)); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	action := form.Get("Action")
+	if action == "" {
+		action = r.Header.Get("X-Amz-Target")
+	}
+	if action == "" {
+		action = r.Method + " " + strings.TrimSuffix(r.URL.Path, "/")
+	}
+	s.mu.Lock()
+	s.calls[action]++
+	s.bodies[action] = append(s.bodies[action], string(body))
+	key := action
+	if name := form.Get("StackName"); name != "" {
+		if _, ok := s.responses[action+" "+name]; ok {
+			key = action + " " + name
+		}
+	}
+	var response string
+	responses, ok := s.responses[key]
+	if ok {
+		response = responses[0]
+		if len(responses) > 1 {
+			s.responses[key] = responses[1:]
+		}
+	}
+	s.mu.Unlock()
+
+	w.Header().Set("Content-Type", "text/xml")
+	switch {
+	case ok:
+		if strings.Contains(response, "<Error>") {
+			w.WriteHeader(http.StatusBadRequest)
+		}
+		fmt.Fprint(w, response)
+	case action == "GetCallerIdentity":
+		fmt.Fprintf(w, `<GetCallerIdentityResponse><GetCallerIdentityResult><Arn>%s</Arn><Account>%s</Account></GetCallerIdentityResult></GetCallerIdentityResponse>`,
+			s.callerARN, arnAccount(s.callerARN))
+	case action == "SimulatePrincipalPolicy":
+		if s.simulator != 0 {
+			w.WriteHeader(s.simulator)
+			fmt.Fprint(w, `<ErrorResponse><Error><Type>Sender</Type><Code>AccessDenied</Code><Message>not allowed</Message></Error></ErrorResponse>`)
+			return
+		}
+		var b strings.Builder
+		for i := 1; ; i++ {
+			name := form.Get(fmt.Sprintf("ActionNames.member.%d", i))
+			if name == "" {
+				break
+			}
+			decision := "allowed"
+			if s.denied[name] {
+				decision = "implicitDeny"
+			}
+			fmt.Fprintf(&b, `<member><EvalActionName>%s</EvalActionName><EvalDecision>%s</EvalDecision></member>`, name, decision)
+		}
+		fmt.Fprintf(w, `<SimulatePrincipalPolicyResponse><SimulatePrincipalPolicyResult><IsTruncated>false</IsTruncated><EvaluationResults>%s</EvaluationResults></SimulatePrincipalPolicyResult></SimulatePrincipalPolicyResponse>`, b.String())
+	default:
+		http.Error(w, "unexpected action "+action, http.StatusBadRequest)
+	}
+}
+
+// newStubClient returns a Client whose AWS calls go to stub with static
+// credentials
+func newStubClient(t *testing.T, stub *stubAWS) *Client {
+	t.Helper()
+	stub.calls = make(map[string]int)
+	stub.bodies = make(map[string][]string)
+	server := httptest.NewServer(stub)
+	t.Cleanup(server.Close)
+
+	c := NewClient()
+	c.LoadAWSConfig = func(ctx context.Context, region string) (aws.Config, error) {
+		return aws.Config{
+			Region:       region,
+			BaseEndpoint: aws.String(server.URL),
+			Credentials:  credentials.NewStaticCredentialsProvider("AKIDEXAMPLE", "secret", ""),
+			HTTPClient:   server.Client(),
+		}, nil
+	}
+	return c
+}
+
+func TestClientCheckPermissions(t *testing.T) {
+	cfg := &Config{
+		VM:  &VMConfig{Region: "us-west-2", OS: "ubuntu-22.04"},
+		DNS: &DNSConfig{Hostname: "web", Domain: "example.com"},
+	}
+	tests := []struct {
+		name      string
+		callerARN string
+		denied    map[string]bool
+		simulator int
+		wantErr   string
+		wantCalls int // SimulatePrincipalPolicy calls
+	}{
+		{
+			name:      "all allowed",
+			callerARN: "arn:aws:iam::123456789012:user/alice",
+			wantCalls: 1,
+		},
+		{
+			name:      "missing actions listed",
+			callerARN: "arn:aws:sts::123456789012:assumed-role/deploy/session",
+			denied:    map[string]bool{"ec2:RunInstances": true, "route53:ChangeResourceRecordSets": true},
+			wantErr:   "arn:aws:iam::123456789012:role/deploy is missing permissions this create needs:\n  ec2:RunInstances\n  route53:ChangeResourceRecordSets\n",
+			wantCalls: 1,
+		},
+		{
+			name:      "simulator not allowed",
+			callerARN: "arn:aws:iam::123456789012:user/alice",
+			simulator: http.StatusForbidden,
+			wantCalls: 1,
+		},
+		{
+			name:      "root user skipped",
+			callerARN: "arn:aws:iam::123456789012:root",
+			wantCalls: 0,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stub := &stubAWS{callerARN: tt.callerARN, denied: tt.denied, simulator: tt.simulator}
+			c := newStubClient(t, stub)
+			err := c.checkPermissions(context.Background(), cfg)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("checkPermissions() error = %v, want it to contain %q", err, tt.wantErr)
+				}
+			} else if err != nil {
+				t.Fatalf("checkPermissions() error = %v", err)
+			}
+			if got := stub.calls["SimulatePrincipalPolicy"]; got != tt.wantCalls {
+				t.Errorf("SimulatePrincipalPolicy called %d times, want %d", got, tt.wantCalls)
+			}
+		})
+	}
+}
+
+func TestClientZoneCacheKey(t *testing.T) {
+	stub := &stubAWS{callerARN: "arn:aws:sts::210987654321:assumed-role/deploy/session"}
+	c := newStubClient(t, stub)
+	ctx := context.Background()
+
+	tests := []struct {
+		domain  string
+		private bool
+		want    string
+	}{
+		{domain: "example.com", want: "210987654321|public|example.com"},
+		{domain: "internal.example", private: true, want: "210987654321|private|internal.example"},
+	}
+	for _, tt := range tests {
+		got, err := c.zoneCacheKey(ctx, tt.domain, tt.private)
+		if err != nil {
+			t.Fatalf("zoneCacheKey(%q) error = %v", tt.domain, err)
+		}
+		if got != tt.want {
+			t.Errorf("zoneCacheKey(%q) = %q, want %q", tt.domain, got, tt.want)
+		}
+	}
+	if got := stub.calls["GetCallerIdentity"]; got != 1 {
+		t.Errorf("GetCallerIdentity called %d times, want the account looked up once", got)
+	}
+}
+
+// describeStacksResponse answers DescribeStacks with the given <member>
+// elements
+func describeStacksResponse(members ...string) string {
+	return `<DescribeStacksResponse><DescribeStacksResult><Stacks>` + strings.Join(members, "") + `</Stacks></DescribeStacksResult></DescribeStacksResponse>`
+}
+
+// stackGoneResponse is CloudFormation's error for a stack that does not exist
+const stackGoneResponse = `<ErrorResponse><Error><Type>Sender</Type><Code>ValidationError</Code><Message>Stack with id web does not exist</Message></Error></ErrorResponse>`
+
+func TestClientDescribeStack(t *testing.T) {
+	tests := []struct {
+		name       string
+		response   string
+		wantStatus string
+		wantErr    string
+		wantConfig bool // want a ConfigError
+	}{
+		{
+			name:       "found",
+			response:   describeStacksResponse(`<member><StackName>web</StackName><StackStatus>CREATE_COMPLETE</StackStatus></member>`),
+			wantStatus: "CREATE_COMPLETE",
+		},
+		{
+			name:       "no stacks returned",
+			response:   describeStacksResponse(),
+			wantErr:    "stack web not found in us-west-2",
+			wantConfig: true,
+		},
+		{
+			name:     "does not exist",
+			response: stackGoneResponse,
+			wantErr:  "failed to describe stack",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stub := &stubAWS{responses: map[string][]string{"DescribeStacks": {tt.response}}}
+			c := newStubClient(t, stub)
+			stack, err := c.DescribeStack(context.Background(), "web", "us-west-2")
+			if tt.wantErr != "" {
+				var cfgErr *ConfigError
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) || errors.As(err, &cfgErr) != tt.wantConfig {
+					t.Fatalf("DescribeStack() error = %v, want it to contain %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("DescribeStack() error = %v", err)
+			}
+			if got := string(stack.StackStatus); got != tt.wantStatus {
+				t.Errorf("DescribeStack() status = %s, want %s", got, tt.wantStatus)
+			}
+		})
+	}
+}
@@ -0,0 +1,121 @@
+package ec2stack
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+
+	"github.com/aws/smithy-go"
+)
+
+// defaultStackPolicy is the stack_policy "default": updates may change
+// anything but may not replace or remove the instance, whose root volume
+// holds its data
+const defaultStackPolicy = `{
+  "Statement": [
+    {"Effect": "Allow", "Principal": "*", "Action": "Update:*", "Resource": "*"},
+    {"Effect": "Deny", "Principal": "*", "Action": ["Update:Replace", "Update:Delete"], "Resource": "LogicalResourceId/EC2Instance"}
+  ]
+}`
+
+// maxStackPolicySize is the largest StackPolicyBody CloudFormation accepts
+const maxStackPolicySize = 16384
+
+// stackPolicyActions are the actions a stack policy statement may name
+var stackPolicyActions = []string{"Update:*", "Update:Modify", "Update:Replace", "Update:Delete"}
+
+// stackPolicyBody returns vm.StackPolicy as a compact policy document. The
+// setting is "default" for defaultStackPolicy, an inline JSON document, or
+// the path of a file holding one.
+func stackPolicyBody(vm *VMConfig) (string, error) {
+	doc := vm.StackPolicy
+	switch {
+	case doc == "default":
+		doc = defaultStackPolicy
+	case !strings.HasPrefix(strings.TrimSpace(doc), "{"):
+		data, err := os.ReadFile(resolveCloudInitPath(doc))
+		if err != nil {
+			return "", err
+		}
+		doc = string(data)
+	}
+
+	var policy struct {
+		Statement []map[string]json.RawMessage `json:"Statement"`
+	}
+	dec := json.NewDecoder(strings.NewReader(doc))
+	if err := dec.Decode(&policy); err != nil {
+		return "", fmt.Errorf("not a JSON policy document: %v", err)
+	}
+	if dec.More() {
+		return "", fmt.Errorf("data after the policy document")
+	}
+	if len(policy.Statement) == 0 {
+		return "", fmt.Errorf("the policy has no Statement")
+	}
+	for i, statement := range policy.Statement {
+		var effect string
+		if err := json.Unmarshal(statement["Effect"], &effect); err != nil || (effect != "Allow" && effect != "Deny") {
+			return "", fmt.Errorf("Statement[%d]: Effect must be Allow or Deny", i)
+		}
+		if statement["Principal"] == nil {
+			return "", fmt.Errorf("Statement[%d]: Principal is required (use \"*\")", i)
+		}
+		if statement["Resource"] == nil && statement["NotResource"] == nil {
+			return "", fmt.Errorf("Statement[%d]: Resource or NotResource is required", i)
+		}
+		field := "Action"
+		if statement["Action"] == nil {
+			field = "NotAction"
+		}
+		actions, err := stringOrList(statement[field])
+		if err != nil || len(actions) == 0 {
+			return "", fmt.Errorf("Statement[%d]: Action or NotAction is required", i)
+		}
+		for _, action := range actions {
+			if !slices.Contains(stackPolicyActions, action) {
+				return "", fmt.Errorf("Statement[%d]: unknown action %q (expected one of %s)", i, action, strings.Join(stackPolicyActions, ", "))
+			}
+		}
+	}
+
+	var compact bytes.Buffer
+	if err := json.Compact(&compact, []byte(doc)); err != nil {
+		return "", fmt.Errorf("not a JSON policy document: %v", err)
+	}
+	if compact.Len() > maxStackPolicySize {
+		return "", fmt.Errorf("the policy is %d characters without whitespace, maximum is %d", compact.Len(), maxStackPolicySize)
+	}
+	return compact.String(), nil
+}
+
+// stringOrList decodes a policy field that is either one string or a list
+func stringOrList(raw json.RawMessage) ([]string, error) {
+	if raw == nil {
+		return nil, nil
+	}
+	var one string
+	if err := json.Unmarshal(raw, &one); err == nil {
+		return []string{one}, nil
+	}
+	var list []string
+	err := json.Unmarshal(raw, &list)
+	return list, err
+}
+
+// explainStackPolicyError turns CloudFormation's rejection of the stack
+// policy into a config error naming the setting
+func explainStackPolicyError(err error, vm *VMConfig) error {
+	var apiErr smithy.APIError
+	if vm.StackPolicy == "" || !errors.As(err, &apiErr) {
+		return err
+	}
+	if apiErr.ErrorCode() == "ValidationError" && strings.Contains(strings.ToLower(apiErr.ErrorMessage()), "policy") {
+		return configErrorf("CloudFormation rejected stack_policy %q: %w", vm.StackPolicy, err)
+	}
+	return err
+}
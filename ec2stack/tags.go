@@ -0,0 +1,90 @@
+package ec2stack
+
+import (
+	"slices"
+	"sort"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/cloudformation/types"
+)
+
+// reservedTagKeys are the tags this tool relies on, which extra tags may
+// not replace: Purpose marks its stacks, Name names the instance and
+// security group, and FQDN lets force-delete find the DNS records
+var reservedTagKeys = []string{"Name", "Purpose", "FQDN"}
+
+// CloudFormation's limits on stack tags. Four of the 50 tags a stack may
+// have are set by this tool.
+const (
+	maxExtraTags      = 50 - 4
+	maxTagKeyLength   = 128
+	maxTagValueLength = 256
+)
+
+// ParseTags parses key=value tag specs, such as the -tags flag's, into the
+// tags for Client.Tags. A key may be given once; the value may be empty.
+func ParseTags(specs []string) (map[string]string, error) {
+	tags := make(map[string]string, len(specs))
+	for _, spec := range specs {
+		key, value, ok := strings.Cut(spec, "=")
+		key = strings.TrimSpace(key)
+		value = strings.TrimSpace(value)
+		switch {
+		case !ok || key == "":
+			return nil, configErrorf("invalid tag %q (expected key=value)", spec)
+		case slices.Contains(reservedTagKeys, key):
+			return nil, configErrorf("tag %s is reserved (reserved: %s)", key, strings.Join(reservedTagKeys, ", "))
+		case strings.HasPrefix(strings.ToLower(key), "aws:"):
+			return nil, configErrorf("tag key %s may not start with aws:", key)
+		case len(key) > maxTagKeyLength:
+			return nil, configErrorf("tag key %s is %d characters, maximum is %d", key, len(key), maxTagKeyLength)
+		case len(value) > maxTagValueLength:
+			return nil, configErrorf("tag %s has a %d character value, maximum is %d", key, len(value), maxTagValueLength)
+		}
+		if _, dup := tags[key]; dup {
+			return nil, configErrorf("tag %s is given more than once", key)
+		}
+		tags[key] = value
+	}
+	if len(tags) > maxExtraTags {
+		return nil, configErrorf("%d tags given, maximum is %d", len(tags), maxExtraTags)
+	}
+	return tags, nil
+}
+
+// mergeTags returns tags with extra applied: an extra tag replaces the tag
+// of the same key, and the rest are added in key order
+func mergeTags(tags []types.Tag, extra map[string]string) []types.Tag {
+	if len(extra) == 0 {
+		return tags
+	}
+	merged := make([]types.Tag, 0, len(tags)+len(extra))
+	for _, tag := range tags {
+		if value, ok := extra[aws.ToString(tag.Key)]; ok {
+			tag.Value = aws.String(value)
+		}
+		merged = append(merged, tag)
+	}
+	keys := make([]string, 0, len(extra))
+	for key := range extra {
+		if !slices.ContainsFunc(tags, func(tag types.Tag) bool { return aws.ToString(tag.Key) == key }) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		merged = append(merged, types.Tag{Key: aws.String(key), Value: aws.String(extra[key])})
+	}
+	return merged
+}
+
+// describeTags formats tags as key=value pairs in key order, for logging
+func describeTags(tags map[string]string) string {
+	pairs := make([]string, 0, len(tags))
+	for key, value := range tags {
+		pairs = append(pairs, key+"="+value)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ", ")
+}
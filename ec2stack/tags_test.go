@@ -0,0 +1,98 @@
+package ec2stack
+
+import (
+	"errors"
+	"fmt"
+	"maps"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/cloudformation/types"
+)
+
+func TestParseTags(t *testing.T) {
+	manyTags := make([]string, maxExtraTags+1)
+	for i := range manyTags {
+		manyTags[i] = fmt.Sprintf("k%d=v", i)
+	}
+
+	tests := []struct {
+		name    string
+		specs   []string
+		want    map[string]string
+		wantErr string
+	}{
+		{name: "none", specs: nil, want: map[string]string{}},
+		{
+			name:  "several",
+			specs: []string{"team=infra", " ticket = OPS-123 ", "empty="},
+			want:  map[string]string{"team": "infra", "ticket": "OPS-123", "empty": ""},
+		},
+		{name: "value with =", specs: []string{"query=a=b"}, want: map[string]string{"query": "a=b"}},
+		{name: "maximum count", specs: manyTags[:maxExtraTags], want: nil},
+
+		{name: "no =", specs: []string{"team"}, wantErr: `invalid tag "team" (expected key=value)`},
+		{name: "empty key", specs: []string{"=x"}, wantErr: `invalid tag "=x"`},
+		{name: "reserved", specs: []string{"Name=web"}, wantErr: "tag Name is reserved"},
+		{name: "aws prefix", specs: []string{"AWS:foo=x"}, wantErr: "may not start with aws:"},
+		{name: "long key", specs: []string{strings.Repeat("k", 129) + "=v"}, wantErr: "maximum is 128"},
+		{name: "long value", specs: []string{"k=" + strings.Repeat("v", 257)}, wantErr: "maximum is 256"},
+		{name: "duplicate", specs: []string{"team=a", "team=b"}, wantErr: "tag team is given more than once"},
+		{name: "too many", specs: manyTags, wantErr: "47 tags given, maximum is 46"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseTags(tt.specs)
+			if tt.wantErr != "" {
+				var cfgErr *ConfigError
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) || !errors.As(err, &cfgErr) {
+					t.Fatalf("ParseTags() error = %v, want a ConfigError containing %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ParseTags() error = %v", err)
+			}
+			if tt.want == nil {
+				if len(got) != len(tt.specs) {
+					t.Errorf("ParseTags() returned %d tags, want %d", len(got), len(tt.specs))
+				}
+				return
+			}
+			if !maps.Equal(got, tt.want) {
+				t.Errorf("ParseTags() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMergeTags(t *testing.T) {
+	base := []types.Tag{
+		{Key: aws.String("Purpose"), Value: aws.String("EC2Instance")},
+		{Key: aws.String("Owner"), Value: aws.String("alice")},
+	}
+	tests := []struct {
+		name  string
+		extra map[string]string
+		want  string
+	}{
+		{name: "no extra tags", extra: nil, want: "Purpose=EC2Instance Owner=alice"},
+		{name: "added in key order", extra: map[string]string{"b": "2", "a": "1"}, want: "Purpose=EC2Instance Owner=alice a=1 b=2"},
+		{name: "replaces in place", extra: map[string]string{"Owner": "bob", "z": "9"}, want: "Purpose=EC2Instance Owner=bob z=9"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var pairs []string
+			for _, tag := range mergeTags(base, tt.extra) {
+				pairs = append(pairs, aws.ToString(tag.Key)+"="+aws.ToString(tag.Value))
+			}
+			if got := strings.Join(pairs, " "); got != tt.want {
+				t.Errorf("mergeTags() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+	if aws.ToString(base[1].Value) != "alice" {
+		t.Errorf("mergeTags() changed the tags it was given")
+	}
+}
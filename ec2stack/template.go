@@ -0,0 +1,598 @@
+package ec2stack
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"text/template"
+)
+
+const cloudFormationTemplateStr = `
+AWSTemplateFormatVersion: '2010-09-09'
+Description: EC2 instance with SSH access
+
+Parameters:
+  ImageId:
+    Type: String
+    Description: AMI ID for the EC2 instance
+  InstanceType:
+    Type: String
+    Description: EC2 instance type
+    Default: t3.micro
+  VpcId:
+    Type: String
+    Description: VPC ID for the security group (required)
+  SubnetId:
+    Type: String
+    Description: Subnet ID for the EC2 instance (required)
+
+Resources:
+  SSHSecurityGroup:
+    Type: AWS::EC2::SecurityGroup
+    Properties:
+      GroupDescription: "{{.SecurityGroupDescription}}"
+      VpcId: !Ref VpcId
+      SecurityGroupIngress:
+{{- range .IngressRules}}
+        - IpProtocol: "{{.Protocol}}"
+          FromPort: {{.FromPort}}
+          ToPort: {{.ToPort}}
+{{- if .IPv6}}
+          CidrIpv6: "{{.CIDR}}"
+{{- else}}
+          CidrIp: {{.CIDR}}
+{{- end}}
+{{- end}}
+{{- if .EgressRules}}
+      SecurityGroupEgress:
+{{- range .EgressRules}}
+        - IpProtocol: "{{.Protocol}}"
+          FromPort: {{.FromPort}}
+          ToPort: {{.ToPort}}
+{{- if .IPv6}}
+          CidrIpv6: "{{.CIDR}}"
+{{- else}}
+          CidrIp: {{.CIDR}}
+{{- end}}
+{{- end}}
+{{- end}}
+      Tags:
+        - Key: Name
+{{- if .NameTag}}
+          Value: "{{.NameTag}}-sg"
+{{- else}}
+          Value: !Sub "${AWS::StackName}-sg"
+{{- end}}
+
+  EC2Instance:
+    Type: AWS::EC2::Instance
+    Properties:
+{{- if .LaunchTemplateID}}
+      LaunchTemplate:
+        LaunchTemplateId: {{.LaunchTemplateID}}
+        Version: "{{.LaunchTemplateVersion}}"
+{{- end}}
+{{- if not .InstanceTypeFromTemplate}}
+      InstanceType: !Ref InstanceType
+{{- end}}
+{{- if not .ImageFromTemplate}}
+      ImageId: !Ref ImageId
+{{- end}}
+{{- if .AvailabilityZone}}
+      AvailabilityZone: {{.AvailabilityZone}}
+{{- end}}
+{{- if .PlacementStrategy}}
+      PlacementGroupName: !Ref PlacementGroup
+{{- else if .PlacementGroup}}
+      PlacementGroupName: "{{.PlacementGroup}}"
+{{- end}}
+      NetworkInterfaces:
+        - DeviceIndex: "0"
+          SubnetId: !Ref SubnetId
+          AssociatePublicIpAddress: {{not .NoPublicIP}}
+{{- if .SecondaryPrivateIPs}}
+          SecondaryPrivateIpAddressCount: {{.SecondaryPrivateIPs}}
+{{- end}}
+          GroupSet:
+            - !GetAtt SSHSecurityGroup.GroupId
+{{- range .ExtraSecurityGroupIDs}}
+            - {{.}}
+{{- end}}
+      UserData: {{.UserData}}
+{{- if .DetailedMonitoring}}
+      Monitoring: true
+{{- end}}
+{{- if .ShutdownBehavior}}
+      InstanceInitiatedShutdownBehavior: {{.ShutdownBehavior}}
+{{- end}}
+{{- if or .RootVolumeType .EncryptRootVolume}}
+      BlockDeviceMappings:
+        - DeviceName: "{{.RootDeviceName}}"
+          Ebs:
+{{- if .RootVolumeType}}
+            VolumeType: {{.RootVolumeType}}
+{{- end}}
+{{- if .EncryptRootVolume}}
+            Encrypted: true
+{{- end}}
+{{- if .KMSKeyID}}
+            KmsKeyId: "{{.KMSKeyID}}"
+{{- end}}
+{{- if .RootVolumeIOPS}}
+            Iops: {{.RootVolumeIOPS}}
+{{- end}}
+{{- if .RootVolumeThroughput}}
+            Throughput: {{.RootVolumeThroughput}}
+{{- end}}
+{{- end}}
+{{- if .InstanceProfileName}}
+      IamInstanceProfile: "{{.InstanceProfileName}}"
+{{- else if .EnableSSM}}
+      IamInstanceProfile: !Ref SSMInstanceProfile
+{{- end}}
+      Tags:
+        - Key: Name
+{{- if .NameTag}}
+          Value: "{{.NameTag}}"
+{{- else}}
+          Value: !Ref AWS::StackName
+{{- end}}
+{{- if .ElasticIPAllocationID}}
+
+  EIPAssociation:
+    Type: AWS::EC2::EIPAssociation
+    Properties:
+      AllocationId: {{.ElasticIPAllocationID}}
+      InstanceId: !Ref EC2Instance
+{{- end}}
+{{- if .PlacementStrategy}}
+
+  PlacementGroup:
+    Type: AWS::EC2::PlacementGroup
+    Properties:
+      Strategy: {{.PlacementStrategy}}
+{{- end}}
+{{- if and .EnableSSM (not .InstanceProfileName)}}
+
+  SSMRole:
+    Type: AWS::IAM::Role
+    Properties:
+      AssumeRolePolicyDocument:
+        Version: '2012-10-17'
+        Statement:
+          - Effect: Allow
+            Principal:
+              Service: ec2.amazonaws.com
+            Action: sts:AssumeRole
+      ManagedPolicyArns:
+        - !Sub "arn:${AWS::Partition}:iam::aws:policy/AmazonSSMManagedInstanceCore"
+{{- if .InlinePolicy}}
+      Policies:
+        - PolicyName: InlinePolicy
+          PolicyDocument: {{.InlinePolicy}}
+{{- end}}
+
+  SSMInstanceProfile:
+    Type: AWS::IAM::InstanceProfile
+    Properties:
+      Roles:
+        - !Ref SSMRole
+{{- end}}
+
+Outputs:
+  InstanceId:
+    Description: Instance ID
+    Value: !Ref EC2Instance
+{{- if not .NoPublicIP}}
+  PublicIP:
+    Description: Public IP Address
+{{- if .ElasticIP}}
+    Value: {{.ElasticIP}}
+{{- else}}
+    Value: !GetAtt EC2Instance.PublicIp
+{{- end}}
+{{- if not .ElasticIP}}
+  PublicDnsName:
+    Description: Public DNS name assigned by EC2
+    Value: !GetAtt EC2Instance.PublicDnsName
+{{- end}}
+{{- end}}
+  PrivateIP:
+    Description: Private IP Address
+    Value: !GetAtt EC2Instance.PrivateIp
+  AvailabilityZone:
+    Description: Availability Zone
+    Value: !GetAtt EC2Instance.AvailabilityZone
+  InstanceType:
+    Description: Instance Type
+    Value: !Ref InstanceType
+  SecurityGroupId:
+    Description: Security Group ID
+    Value: !Ref SSHSecurityGroup
+{{- if and .EnableSSM (not .InstanceProfileName)}}
+  SSMRoleName:
+    Description: IAM role for SSM
+    Value: !Ref SSMRole
+  SSMInstanceProfile:
+    Description: Instance profile for SSM
+    Value: !Ref SSMInstanceProfile
+{{- end}}
+  VpcId:
+    Description: VPC ID
+    Value: !Ref VpcId
+  SubnetId:
+    Description: Subnet ID
+    Value: !Ref SubnetId
+`
+
+const defaultSecurityGroupDescription = "Allow SSH inbound traffic"
+
+// CFNTemplateData holds the values substituted into the CloudFormation template
+type CFNTemplateData struct {
+	UserData                 string
+	NameTag                  string
+	SecurityGroupDescription string
+	IngressRules             []SecurityGroupRule
+	EgressRules              []SecurityGroupRule
+	EnableSSM                bool
+	InstanceProfileName      string
+	InlinePolicy             string // compacted JSON, valid as YAML
+	NoPublicIP               bool
+	DetailedMonitoring       bool
+	ShutdownBehavior         string
+	SecondaryPrivateIPs      int
+
+	// Placement settings; PlacementStrategy creates a group in the stack,
+	// PlacementGroup references an existing one
+	AvailabilityZone  string
+	PlacementGroup    string
+	PlacementStrategy string
+
+	// Launch template settings; the instance only sets ImageId and
+	// InstanceType itself when they do not come from the template
+	LaunchTemplateID         string
+	LaunchTemplateVersion    string
+	ImageFromTemplate        bool
+	InstanceTypeFromTemplate bool
+
+	// Root volume settings; BlockDeviceMappings is only emitted when
+	// RootVolumeType or EncryptRootVolume is set
+	RootDeviceName       string
+	RootVolumeType       string
+	RootVolumeIOPS       int
+	RootVolumeThroughput int
+	EncryptRootVolume    bool
+	KMSKeyID             string
+
+	// ExtraSecurityGroupIDs are attached after the stack's own group
+	ExtraSecurityGroupIDs []string
+
+	// ElasticIPAllocationID is associated with the instance, and
+	// ElasticIP, its address, is output as the public IP
+	ElasticIPAllocationID string
+	ElasticIP             string
+}
+
+// defaultPorts are opened when the config does not list any ports
+var defaultPorts = []string{"22", "80", "443"}
+
+// openCIDR is used for ingress when neither the port nor default_cidr sets one
+const openCIDR = "0.0.0.0/0"
+
+// ingressRules parses the VM's inbound port rules. Per-port CIDRs take
+// precedence over default_cidr, which takes precedence over 0.0.0.0/0.
+func ingressRules(vm *VMConfig) ([]SecurityGroupRule, error) {
+	defaultCIDR := vm.DefaultCIDR
+	if defaultCIDR == "" {
+		defaultCIDR = openCIDR
+	} else if _, _, err := net.ParseCIDR(defaultCIDR); err != nil {
+		return nil, fmt.Errorf("invalid default_cidr %q", defaultCIDR)
+	}
+
+	sshPort := vm.SSHPortNumber()
+	ports := vm.Ports
+	if len(ports) == 0 {
+		ports = defaultPorts
+		if sshPort != defaultSSHPort {
+			ports = []string{strconv.Itoa(sshPort), "80", "443"}
+		}
+	}
+
+	rules, err := parseRuleSpecs(ports, defaultCIDR)
+	if err != nil {
+		return nil, err
+	}
+
+	// A moved SSH port is opened even when the listed ports leave it out
+	if sshPort != defaultSSHPort && !rulesAllowTCP(rules, sshPort) {
+		rules = append(rules, SecurityGroupRule{Protocol: "tcp", FromPort: sshPort, ToPort: sshPort, CIDR: defaultCIDR})
+	}
+	if vm.IPv6Ingress {
+		rules = mirrorIPv6(rules)
+	}
+	return rules, nil
+}
+
+// rulesAllowTCP reports whether a rule opens TCP port to any source
+func rulesAllowTCP(rules []SecurityGroupRule, port int) bool {
+	for _, rule := range rules {
+		if rule.Protocol == "-1" || (rule.Protocol == "tcp" && rule.FromPort <= port && port <= rule.ToPort) {
+			return true
+		}
+	}
+	return false
+}
+
+// SecurityGroupRule is a single parsed security group rule
+type SecurityGroupRule struct {
+	Protocol string
+	FromPort int
+	ToPort   int
+	CIDR     string
+}
+
+// IPv6 reports whether the rule's CIDR is an IPv6 range, which the
+// template emits as CidrIpv6
+func (r SecurityGroupRule) IPv6() bool {
+	return strings.Contains(r.CIDR, ":")
+}
+
+// openCIDRv6 is the IPv6 range ipv6_ingress mirrors open rules to
+const openCIDRv6 = "::/0"
+
+// mirrorIPv6 returns rules plus an IPv6 copy of each rule open to
+// 0.0.0.0/0, so the ports are reachable over IPv6 as well. Rules limited
+// to an IPv4 range have no IPv6 equivalent and are not copied, and
+// neither are ICMP rules for a single type.
+func mirrorIPv6(rules []SecurityGroupRule) []SecurityGroupRule {
+	mirrored := rules
+	for _, rule := range rules {
+		if rule.CIDR != openCIDR {
+			continue
+		}
+		// ICMP types are numbered differently in ICMPv6, so only a rule
+		// for every type carries over
+		if rule.Protocol == "icmp" {
+			if rule.FromPort != -1 {
+				continue
+			}
+			rule.Protocol = "icmpv6"
+		}
+		rule.CIDR = openCIDRv6
+		if !slices.Contains(mirrored, rule) {
+			mirrored = append(mirrored, rule)
+		}
+	}
+	return mirrored
+}
+
+// parseRuleSpec parses a rule of the form PORT[-PORT][/PROTO][@CIDR], where
+// PROTO is tcp (default), udp or icmp. The special port "all" matches every
+// protocol and port. defaultCIDR is used when no @CIDR is given.
+func parseRuleSpec(spec, defaultCIDR string) (SecurityGroupRule, error) {
+	rule := SecurityGroupRule{Protocol: "tcp", CIDR: defaultCIDR}
+
+	portPart := strings.TrimSpace(spec)
+	if at := strings.Index(portPart, "@"); at >= 0 {
+		rule.CIDR = portPart[at+1:]
+		portPart = portPart[:at]
+		if _, _, err := net.ParseCIDR(rule.CIDR); err != nil {
+			return rule, fmt.Errorf("rule %q: invalid CIDR %q", spec, rule.CIDR)
+		}
+	}
+
+	if slash := strings.Index(portPart, "/"); slash >= 0 {
+		rule.Protocol = strings.ToLower(portPart[slash+1:])
+		portPart = portPart[:slash]
+		switch rule.Protocol {
+		case "tcp", "udp", "icmp":
+		default:
+			return rule, fmt.Errorf("rule %q: unsupported protocol %q (use tcp, udp or icmp)", spec, rule.Protocol)
+		}
+	}
+
+	if portPart == "all" {
+		rule.Protocol = "-1"
+		rule.FromPort = -1
+		rule.ToPort = -1
+		return rule, nil
+	}
+
+	// A leading minus is a sign, as in ICMP's -1, not a range
+	rest := strings.TrimPrefix(portPart, "-")
+	from, to, isRange := strings.Cut(rest, "-")
+	if len(rest) < len(portPart) {
+		from = "-" + from
+	}
+	var err error
+	if rule.FromPort, err = strconv.Atoi(from); err != nil {
+		return rule, fmt.Errorf("rule %q: invalid port %q", spec, from)
+	}
+	rule.ToPort = rule.FromPort
+	if isRange {
+		if rule.ToPort, err = strconv.Atoi(to); err != nil {
+			return rule, fmt.Errorf("rule %q: invalid port %q", spec, to)
+		}
+	}
+
+	if rule.Protocol == "icmp" {
+		// For ICMP the "ports" are the type and code; -1 means all
+		if rule.FromPort < -1 || rule.FromPort > 255 || rule.ToPort < -1 || rule.ToPort > 255 {
+			return rule, fmt.Errorf("rule %q: ICMP type/code must be between -1 and 255", spec)
+		}
+		// Over IPv6 the protocol is ICMPv6
+		if rule.IPv6() {
+			rule.Protocol = "icmpv6"
+		}
+		return rule, nil
+	}
+
+	if rule.FromPort < 0 || rule.FromPort > 65535 || rule.ToPort < 0 || rule.ToPort > 65535 {
+		return rule, fmt.Errorf("rule %q: ports must be between 0 and 65535", spec)
+	}
+	if rule.FromPort > rule.ToPort {
+		return rule, fmt.Errorf("rule %q: port range start is greater than end", spec)
+	}
+
+	return rule, nil
+}
+
+// parseRuleSpecs parses a list of rule specs
+func parseRuleSpecs(specs []string, defaultCIDR string) ([]SecurityGroupRule, error) {
+	var rules []SecurityGroupRule
+	for _, spec := range specs {
+		rule, err := parseRuleSpec(spec, defaultCIDR)
+		if err != nil {
+			return nil, err
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+func generateCloudFormationTemplate(data CFNTemplateData) (string, error) {
+	tmpl, err := template.New("cfn").Parse(cloudFormationTemplateStr)
+	if err != nil {
+		return "", fmt.Errorf("failed to parse CFN template: %w", err)
+	}
+
+	if data.SecurityGroupDescription == "" {
+		data.SecurityGroupDescription = defaultSecurityGroupDescription
+	}
+
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, data); err != nil {
+		return "", fmt.Errorf("failed to execute CFN template: %w", err)
+	}
+
+	return buf.String(), nil
+}
+
+// validateRootVolume checks the root volume settings against the limits
+// of each volume type. IOPS and throughput are rejected for types that do
+// not accept them.
+func validateRootVolume(vm *VMConfig) error {
+	if vm.RootVolumeType == "" {
+		if vm.RootVolumeIOPS != 0 || vm.RootVolumeThroughput != 0 {
+			return fmt.Errorf("root_volume_iops and root_volume_throughput require root_volume_type")
+		}
+		return nil
+	}
+
+	switch vm.RootVolumeType {
+	case "gp2":
+		if vm.RootVolumeIOPS != 0 || vm.RootVolumeThroughput != 0 {
+			return fmt.Errorf("gp2 volumes do not accept root_volume_iops or root_volume_throughput")
+		}
+	case "gp3":
+		if vm.RootVolumeIOPS != 0 && (vm.RootVolumeIOPS < 3000 || vm.RootVolumeIOPS > 16000) {
+			return fmt.Errorf("gp3 root_volume_iops must be between 3000 and 16000, got %d", vm.RootVolumeIOPS)
+		}
+		if vm.RootVolumeThroughput != 0 && (vm.RootVolumeThroughput < 125 || vm.RootVolumeThroughput > 1000) {
+			return fmt.Errorf("gp3 root_volume_throughput must be between 125 and 1000 MiB/s, got %d", vm.RootVolumeThroughput)
+		}
+	case "io1":
+		if vm.RootVolumeIOPS < 100 || vm.RootVolumeIOPS > 64000 {
+			return fmt.Errorf("io1 root_volume_iops must be between 100 and 64000, got %d", vm.RootVolumeIOPS)
+		}
+		if vm.RootVolumeThroughput != 0 {
+			return fmt.Errorf("io1 volumes do not accept root_volume_throughput")
+		}
+	default:
+		return fmt.Errorf("unsupported root_volume_type %q (supported: gp2, gp3, io1)", vm.RootVolumeType)
+	}
+	return nil
+}
+
+// kmsKeyPattern matches a KMS key ID, alias, key ARN or alias ARN
+var kmsKeyPattern = regexp.MustCompile(`^(` +
+	`[0-9a-f]{8}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{12}|` +
+	`mrk-[0-9a-f]{32}|` +
+	`alias/[a-zA-Z0-9/_-]+|` +
+	`arn:aws[a-z-]*:kms:[a-z0-9-]+:[0-9]{12}:(key/(mrk-)?[0-9a-f-]+|alias/[a-zA-Z0-9/_-]+))$`)
+
+// validateKMSKey checks the root volume encryption settings
+func validateKMSKey(vm *VMConfig) error {
+	if vm.KMSKeyID == "" {
+		return nil
+	}
+	if !vm.EncryptRootVolume {
+		return fmt.Errorf("kms_key_id requires encrypt_root_volume")
+	}
+	if !kmsKeyPattern.MatchString(vm.KMSKeyID) {
+		return fmt.Errorf("invalid kms_key_id %q (expected a key ID, key ARN, alias/<name> or alias ARN)", vm.KMSKeyID)
+	}
+	return nil
+}
+
+// maxInlinePolicySize is IAM's limit on a role's inline policies, counted
+// without whitespace
+const maxInlinePolicySize = 10240
+
+// compactPolicy checks an inline_policy document and returns it as one
+// line of JSON. Re-encoding leaves only escapes that YAML's double-quoted
+// strings share with JSON, so the result is also valid YAML.
+func compactPolicy(doc string) (string, error) {
+	var policy map[string]any
+	dec := json.NewDecoder(strings.NewReader(doc))
+	dec.UseNumber()
+	if err := dec.Decode(&policy); err != nil {
+		return "", fmt.Errorf("inline_policy is not a JSON object: %v", err)
+	}
+	if dec.More() {
+		return "", fmt.Errorf("inline_policy has data after the policy document")
+	}
+	if _, ok := policy["Statement"]; !ok {
+		return "", fmt.Errorf("inline_policy has no Statement")
+	}
+	data, err := json.Marshal(policy)
+	if err != nil {
+		return "", fmt.Errorf("inline_policy: %v", err)
+	}
+	if len(data) > maxInlinePolicySize {
+		return "", fmt.Errorf("inline_policy is %d characters without whitespace, maximum is %d", len(data), maxInlinePolicySize)
+	}
+	return string(data), nil
+}
+
+// validateSecurityGroupDescription checks the EC2 constraints on group
+// descriptions: at most 255 characters from a restricted ASCII set.
+func validateSecurityGroupDescription(desc string) error {
+	if len(desc) > 255 {
+		return fmt.Errorf("security_group_description is %d characters, maximum is 255", len(desc))
+	}
+	const allowed = "._-:/()#,@[]+=&;{}!$* "
+	for _, ch := range desc {
+		if (ch >= 'a' && ch <= 'z') || (ch >= 'A' && ch <= 'Z') || (ch >= '0' && ch <= '9') || strings.ContainsRune(allowed, ch) {
+			continue
+		}
+		return fmt.Errorf("security_group_description contains invalid character %q (allowed: a-z, A-Z, 0-9, spaces and %s)", ch, strings.TrimSpace(allowed))
+	}
+	return nil
+}
+
+// maxNameTagLength leaves room for the -sg suffix within EC2's 256
+// character limit on tag values
+const maxNameTagLength = 253
+
+// validateNameTag checks a name_tag, which is quoted into the template as
+// is and so may not hold quotes, backslashes or control characters
+func validateNameTag(name string) error {
+	if len(name) > maxNameTagLength {
+		return fmt.Errorf("name_tag is %d characters, maximum is %d", len(name), maxNameTagLength)
+	}
+	for _, ch := range name {
+		if ch == '"' || ch == '\\' || ch < ' ' || ch == 0x7f {
+			return fmt.Errorf("name_tag contains invalid character %q", ch)
+		}
+	}
+	if strings.HasPrefix(strings.ToLower(name), "aws:") {
+		return fmt.Errorf("name_tag may not start with aws:")
+	}
+	return nil
+}
@@ -0,0 +1,54 @@
+package ec2stack
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseRuleSpec(t *testing.T) {
+	tests := []struct {
+		spec    string
+		want    SecurityGroupRule
+		wantErr string
+	}{
+		{spec: "22", want: SecurityGroupRule{Protocol: "tcp", FromPort: 22, ToPort: 22, CIDR: "0.0.0.0/0"}},
+		{spec: " 443 ", want: SecurityGroupRule{Protocol: "tcp", FromPort: 443, ToPort: 443, CIDR: "0.0.0.0/0"}},
+		{spec: "8000-8080", want: SecurityGroupRule{Protocol: "tcp", FromPort: 8000, ToPort: 8080, CIDR: "0.0.0.0/0"}},
+		{spec: "53/UDP", want: SecurityGroupRule{Protocol: "udp", FromPort: 53, ToPort: 53, CIDR: "0.0.0.0/0"}},
+		{spec: "5432@10.0.0.0/16", want: SecurityGroupRule{Protocol: "tcp", FromPort: 5432, ToPort: 5432, CIDR: "10.0.0.0/16"}},
+		{spec: "60000-61000/udp@203.0.113.7/32", want: SecurityGroupRule{Protocol: "udp", FromPort: 60000, ToPort: 61000, CIDR: "203.0.113.7/32"}},
+		{spec: "all", want: SecurityGroupRule{Protocol: "-1", FromPort: -1, ToPort: -1, CIDR: "0.0.0.0/0"}},
+		{spec: "all@10.0.0.0/8", want: SecurityGroupRule{Protocol: "-1", FromPort: -1, ToPort: -1, CIDR: "10.0.0.0/8"}},
+		{spec: "8/icmp", want: SecurityGroupRule{Protocol: "icmp", FromPort: 8, ToPort: 8, CIDR: "0.0.0.0/0"}},
+		{spec: "-1/icmp", want: SecurityGroupRule{Protocol: "icmp", FromPort: -1, ToPort: -1, CIDR: "0.0.0.0/0"}},
+		{spec: "3-4/icmp", want: SecurityGroupRule{Protocol: "icmp", FromPort: 3, ToPort: 4, CIDR: "0.0.0.0/0"}},
+		{spec: "128/icmp@::/0", want: SecurityGroupRule{Protocol: "icmpv6", FromPort: 128, ToPort: 128, CIDR: "::/0"}},
+		{spec: "22@2001:db8::/32", want: SecurityGroupRule{Protocol: "tcp", FromPort: 22, ToPort: 22, CIDR: "2001:db8::/32"}},
+
+		{spec: "ssh", wantErr: `invalid port "ssh"`},
+		{spec: "22-", wantErr: `invalid port ""`},
+		{spec: "22/sctp", wantErr: `unsupported protocol "sctp"`},
+		{spec: "22@10.0.0.1", wantErr: `invalid CIDR "10.0.0.1"`},
+		{spec: "70000", wantErr: "ports must be between 0 and 65535"},
+		{spec: "-5", wantErr: "ports must be between 0 and 65535"},
+		{spec: "9000-8000", wantErr: "port range start is greater than end"},
+		{spec: "256/icmp", wantErr: "ICMP type/code must be between -1 and 255"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.spec, func(t *testing.T) {
+			got, err := parseRuleSpec(tt.spec, "0.0.0.0/0")
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("parseRuleSpec(%q) error = %v, want it to contain %q", tt.spec, err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parseRuleSpec(%q) error = %v", tt.spec, err)
+			}
+			if got != tt.want {
+				t.Errorf("parseRuleSpec(%q) = %+v, want %+v", tt.spec, got, tt.want)
+			}
+		})
+	}
+}
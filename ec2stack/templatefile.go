@@ -0,0 +1,125 @@
+package ec2stack
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/cloudformation"
+	"github.com/aws/aws-sdk-go-v2/service/cloudformation/types"
+)
+
+// maxTemplateBodySize is the largest template CreateStack accepts inline
+const maxTemplateBodySize = 51200
+
+// yamlOutputKeyPattern matches a key directly under the Outputs section of
+// a YAML template
+var yamlOutputKeyPattern = regexp.MustCompile(`^(\s+)([A-Za-z0-9]+)\s*:`)
+
+// readTemplateFile reads a template_file and checks it declares the
+// outputs the config and DNS updates are filled in from
+func readTemplateFile(vm *VMConfig) (string, error) {
+	data, err := os.ReadFile(resolveCloudInitPath(vm.TemplateFile))
+	if err != nil {
+		return "", err
+	}
+	if len(data) > maxTemplateBodySize {
+		return "", fmt.Errorf("%s is %d bytes, maximum is %d", vm.TemplateFile, len(data), maxTemplateBodySize)
+	}
+	body := string(data)
+	outputs, err := templateOutputs(body)
+	if err != nil {
+		return "", err
+	}
+	required := []string{"InstanceId", "PublicIP"}
+	if vm.NoPublicIP {
+		required = []string{"InstanceId", "PrivateIP"}
+	}
+	var missing []string
+	for _, key := range required {
+		if !outputs[key] {
+			missing = append(missing, key)
+		}
+	}
+	if len(missing) > 0 {
+		return "", fmt.Errorf("%s does not declare the output(s) %s", vm.TemplateFile, strings.Join(missing, ", "))
+	}
+	return body, nil
+}
+
+// templateOutputs returns the output names a JSON or YAML template declares
+func templateOutputs(body string) (map[string]bool, error) {
+	outputs := make(map[string]bool)
+	if strings.HasPrefix(strings.TrimSpace(body), "{") {
+		var tmpl struct {
+			Outputs map[string]json.RawMessage `json:"Outputs"`
+		}
+		if err := json.Unmarshal([]byte(body), &tmpl); err != nil {
+			return nil, fmt.Errorf("invalid JSON template: %w", err)
+		}
+		for key := range tmpl.Outputs {
+			outputs[key] = true
+		}
+		return outputs, nil
+	}
+
+	// A YAML template is only scanned, not parsed: the output names are
+	// the keys at the first indentation level under a top-level Outputs:
+	inOutputs := false
+	indent := ""
+	for _, line := range strings.Split(body, "\n") {
+		line = strings.TrimRight(line, "\r")
+		if strings.TrimSpace(line) == "" || strings.HasPrefix(strings.TrimSpace(line), "#") {
+			continue
+		}
+		if line[0] != ' ' && line[0] != '\t' {
+			inOutputs = strings.HasPrefix(line, "Outputs:")
+			continue
+		}
+		if !inOutputs {
+			continue
+		}
+		m := yamlOutputKeyPattern.FindStringSubmatch(line)
+		if m == nil {
+			continue
+		}
+		if indent == "" {
+			indent = m[1]
+		}
+		if m[1] == indent {
+			outputs[m[2]] = true
+		}
+	}
+	return outputs, nil
+}
+
+// templateParameters returns the parameters for a template_file: those of
+// values that it declares, leaving out the rest, since CloudFormation
+// rejects undeclared parameters. It also returns the capabilities the
+// template needs.
+func templateParameters(ctx context.Context, cfClient *cloudformation.Client, body string, values map[string]string) ([]types.Parameter, []types.Capability, error) {
+	result, err := cfClient.ValidateTemplate(ctx, &cloudformation.ValidateTemplateInput{
+		TemplateBody: aws.String(body),
+	})
+	if err != nil {
+		return nil, nil, configErrorf("template_file is not a valid template: %v", err)
+	}
+	var params []types.Parameter
+	for _, declared := range result.Parameters {
+		key := aws.ToString(declared.ParameterKey)
+		value, ok := values[key]
+		if !ok {
+			debugf(ctx, "template_file parameter %s left to its default", key)
+			continue
+		}
+		params = append(params, types.Parameter{
+			ParameterKey:   aws.String(key),
+			ParameterValue: aws.String(value),
+		})
+	}
+	return params, result.Capabilities, nil
+}
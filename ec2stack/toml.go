@@ -0,0 +1,32 @@
+package ec2stack
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/pelletier/go-toml/v2"
+)
+
+// TOML configs are read into the same generic document as JSON configs, so
+// shared defaults, environment references and the legacy flat format work
+// the same for both. They are written from the config's toml tags.
+
+// tomlToJSON decodes a TOML document and returns it as JSON for ParseConfig
+func tomlToJSON(data []byte) ([]byte, error) {
+	var doc map[string]any
+	if err := toml.Unmarshal(data, &doc); err != nil {
+		var decodeErr *toml.DecodeError
+		if errors.As(err, &decodeErr) {
+			row, _ := decodeErr.Position()
+			return nil, fmt.Errorf("invalid TOML: line %d: %w", row, err)
+		}
+		return nil, fmt.Errorf("invalid TOML: %w", err)
+	}
+	return json.Marshal(doc)
+}
+
+// marshalTOML renders the config as TOML, its fields in struct order
+func marshalTOML(config *Config) ([]byte, error) {
+	return toml.Marshal(config)
+}
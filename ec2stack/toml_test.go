@@ -0,0 +1,136 @@
+package ec2stack
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestTOMLToJSON(t *testing.T) {
+	tests := []struct {
+		name    string
+		toml    string
+		want    string
+		wantErr string
+	}{
+		{
+			name: "tables and scalars",
+			toml: "# a stack\n[vm]\nregion = \"us-west-2\" # inline comment\nswap_size_gb = 2\nenable_ssm = true\n\n[dns]\nttl = 60\n",
+			want: `{"dns":{"ttl":60},"vm":{"enable_ssm":true,"region":"us-west-2","swap_size_gb":2}}`,
+		},
+		{
+			name: "arrays of tables",
+			toml: "[[vm.users]]\nusername = \"alice\"\n[[vm.users]]\nusername = \"bob\"\n",
+			want: `{"vm":{"users":[{"username":"alice"},{"username":"bob"}]}}`,
+		},
+		{
+			name: "dotted keys and inline tables",
+			toml: "vm.region = \"eu-west-1\"\ndns = { hostname = \"web\", domain = \"example.com\" }\n",
+			want: `{"dns":{"domain":"example.com","hostname":"web"},"vm":{"region":"eu-west-1"}}`,
+		},
+		{
+			name: "instance type list",
+			toml: "[vm]\ninstance_type = [\n  \"t3.micro\", # first choice\n  \"t3a.micro\",\n]\n",
+			want: `{"vm":{"instance_type":["t3.micro","t3a.micro"]}}`,
+		},
+		{
+			name:    "duplicate table",
+			toml:    "[vm]\nregion = \"us-east-1\"\n\n[vm]\nos = \"debian-12\"\n",
+			wantErr: "line 4: toml: table vm already exists",
+		},
+		{
+			name:    "duplicate key",
+			toml:    "a = 1\na = 2\n",
+			wantErr: "line 2: toml: key a is already defined",
+		},
+		{
+			name:    "table over a value",
+			toml:    "vm = 1\n[vm]\n",
+			wantErr: "invalid TOML: line 2",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tomlToJSON([]byte(tt.toml))
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("tomlToJSON() error = %v, want it to contain %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("tomlToJSON() error = %v", err)
+			}
+			if string(got) != tt.want {
+				t.Errorf("tomlToJSON() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMarshalTOML(t *testing.T) {
+	ttl := 60
+	cfg := &Config{
+		AWSProfile: "dev",
+		VM: &VMConfig{
+			Region:       "us-east-1",
+			InstanceType: "t3.micro,t3a.micro",
+			Packages:     []string{"git"},
+			Users:        []User{{Username: "alice", GitHubUsername: "alice"}, {Username: "bob", GitHubUsername: "bob"}},
+		},
+		DNS: &DNSConfig{
+			Hostname:   "web",
+			Domain:     "example.com",
+			TTL:        &ttl,
+			TXTRecords: map[string]string{"_check": `say "hi"`, "_acme": "x"},
+		},
+	}
+	got, err := marshalTOML(cfg)
+	if err != nil {
+		t.Fatalf("marshalTOML() error = %v", err)
+	}
+
+	// Fields come in struct order and unset ones are left out
+	want := `aws_profile = 'dev'
+
+[vm]
+region = 'us-east-1'
+instance_type = 't3.micro,t3a.micro'
+packages = ['git']
+
+[[vm.users]]
+username = 'alice'
+github_username = 'alice'
+
+[[vm.users]]
+username = 'bob'
+github_username = 'bob'
+
+[dns]
+hostname = 'web'
+domain = 'example.com'
+ttl = 60
+
+[dns.txt_records]
+_acme = 'x'
+_check = 'say "hi"'
+`
+	if string(got) != want {
+		t.Errorf("marshalTOML() =\n%s\nwant\n%s", got, want)
+	}
+
+	// What is written must read back as the same config
+	data, err := tomlToJSON(got)
+	if err != nil {
+		t.Fatalf("tomlToJSON() of the written TOML: %v", err)
+	}
+	var back Config
+	if err := json.Unmarshal(data, &back); err != nil {
+		t.Fatal(err)
+	}
+	wantJSON, _ := json.Marshal(cfg)
+	backJSON, _ := json.Marshal(&back)
+	if string(backJSON) != string(wantJSON) {
+		t.Errorf("written TOML reads back as %s, want %s", backJSON, wantJSON)
+	}
+}
@@ -0,0 +1,427 @@
+package ec2stack
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"text/template"
+)
+
+// githubKeysURL is where each user's SSH keys are fetched from, at boot or,
+// with bake_keys, when the user data is built
+const githubKeysURL = "https://github.com/%s.keys"
+
+// verifyGitHubKeys checks that every user has at least one public key on
+// GitHub. Without one the instance would boot with an empty authorized_keys.
+func verifyGitHubKeys(ctx context.Context, httpClient *http.Client, users []User) error {
+	_, err := fetchGitHubKeys(ctx, httpClient, users)
+	return err
+}
+
+// fetchGitHubKeys returns every user's public keys on GitHub by username,
+// failing for a user with none
+func fetchGitHubKeys(ctx context.Context, httpClient *http.Client, users []User) (map[string]string, error) {
+	keys := make(map[string]string, len(users))
+	for _, user := range users {
+		url := fmt.Sprintf(githubKeysURL, user.GitHubUsername)
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+		if err != nil {
+			return nil, fmt.Errorf("failed to build request for %s: %w", url, err)
+		}
+		resp, err := httpClient.Do(req)
+		if err != nil {
+			return nil, fmt.Errorf("failed to fetch SSH keys for GitHub user %s: %w", user.GitHubUsername, err)
+		}
+		body, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("failed to read SSH keys for GitHub user %s: %w", user.GitHubUsername, err)
+		}
+
+		if resp.StatusCode != http.StatusOK {
+			return nil, configErrorf("GitHub user %s: %s returned %s", user.GitHubUsername, url, resp.Status)
+		}
+		userKeys := strings.TrimSpace(string(body))
+		if userKeys == "" {
+			return nil, configErrorf("GitHub user %s has no public SSH keys at %s", user.GitHubUsername, url)
+		}
+		keys[user.Username] = userKeys
+	}
+	return keys, nil
+}
+
+// packageNamePattern matches package names, optionally with a version
+// pin (e.g. git, python3-pip, nginx=1.24.0-1). Anything else is rejected
+// because names are written unquoted into the setup script.
+var packageNamePattern = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9.+_:=~-]*$`)
+
+// validatePackages checks every package name against packageNamePattern
+func validatePackages(packages []string) error {
+	for _, pkg := range packages {
+		if !packageNamePattern.MatchString(pkg) {
+			return fmt.Errorf("invalid package name %q", pkg)
+		}
+	}
+	return nil
+}
+
+// packageInstallCommand returns the shell line that installs packages
+func packageInstallCommand(osFamily string, packages []string) string {
+	list := strings.Join(packages, " ")
+	if osFamily == "al2023" {
+		// yum is dnf on Amazon Linux 2023 and also works on Amazon Linux 2
+		return "yum install -y " + list
+	}
+	return "apt-get update && DEBIAN_FRONTEND=noninteractive apt-get install -y " + list
+}
+
+// localeCommands returns the shell lines that make locale the system
+// default. Amazon Linux ships locales in per-language langpacks; Debian and
+// Ubuntu generate them from /etc/locale.gen with the locales package.
+func localeCommands(osFamily, locale string) string {
+	lang, _, _ := strings.Cut(locale, "_")
+	lang, _, _ = strings.Cut(lang, ".")
+	builtin := lang == "C" || lang == "POSIX"
+
+	var b strings.Builder
+	if osFamily == "al2023" {
+		if !builtin {
+			fmt.Fprintf(&b, "yum install -y glibc-langpack-%s || true\n", lang)
+		}
+		fmt.Fprintf(&b, "localectl set-locale LANG=%s || echo 'WARNING: could not set locale %s' >&2\n", locale, locale)
+		return b.String()
+	}
+	if builtin {
+		fmt.Fprintf(&b, "update-locale LANG=%s || echo 'WARNING: could not set locale %s' >&2\n", locale, locale)
+		return b.String()
+	}
+	b.WriteString("command -v locale-gen >/dev/null || { apt-get update && DEBIAN_FRONTEND=noninteractive apt-get install -y locales; } || true\n")
+	fmt.Fprintf(&b, "sed -i -E 's/^# *(%s )/\\1/' /etc/locale.gen\n", regexp.QuoteMeta(locale))
+	fmt.Fprintf(&b, "{ locale-gen %s && update-locale LANG=%s; } || echo 'WARNING: could not set locale %s' >&2\n", locale, locale, locale)
+	return b.String()
+}
+
+// isValidHostname reports whether every dot-separated label of name
+// matches hostnamePattern
+func isValidHostname(name string) bool {
+	if name == "" {
+		return false
+	}
+	for _, label := range strings.Split(name, ".") {
+		if !hostnamePattern.MatchString(label) {
+			return false
+		}
+	}
+	return true
+}
+
+// instanceHostname returns the short name and FQDN to set on the instance.
+// vm.Hostname wins over the DNS hostname; without a domain both results are
+// the short name, and both are empty when no usable hostname is configured.
+func instanceHostname(vm *VMConfig, dns *DNSConfig) (string, string) {
+	hostname := vm.Hostname
+	if hostname == "" && dns != nil {
+		hostname = dns.Hostname
+	}
+	// A DNS hostname such as a wildcard is not a valid system hostname
+	if !isValidHostname(hostname) {
+		return "", ""
+	}
+	// The FQDN goes into the setup script unquoted, so a domain that is
+	// not a hostname is left out too
+	if dns != nil {
+		if domain := strings.TrimSuffix(dns.Domain, "."); isValidHostname(domain) {
+			return hostname, hostname + "." + domain
+		}
+	}
+	return hostname, hostname
+}
+
+// bootstrapMarker is written by the default setup script once every step
+// before it has succeeded
+const bootstrapMarker = "/var/lib/aws-ec2/bootstrap-done"
+
+// motdDelimiter ends the here-document that writes vm.motd
+const motdDelimiter = "EC2_MOTD"
+
+// maxSwapSizeGB bounds swap_size_gb; the root volume also has to hold it
+const maxSwapSizeGB = 64
+
+// generateUserSetupScript builds the default setup script for vm: it sets
+// the hostname when one is given, adds swap, creates the users, applies the
+// SSH port, timezone and locale and, when packages is not empty, installs
+// them, then Docker when docker is set. It ends by writing the welcome
+// message and bootstrapMarker. Users found in bakedKeys get those
+// keys written as they are; the others fetch theirs from GitHub at boot.
+func generateUserSetupScript(vm *VMConfig, hostname, fqdn string, packages []string, docker bool, bakedKeys map[string]string) string {
+	users, osFamily := vm.Users, vm.OSFamily
+	sshPort, swapSizeGB := vm.SSHPortNumber(), vm.SwapSizeGB
+
+	// Amazon Linux grants sudo via wheel and has no www-data group
+	groups := "sudo,www-data"
+	if osFamily == "al2023" {
+		groups = "wheel"
+	}
+
+	var script strings.Builder
+	script.WriteString("#!/bin/bash\n")
+	script.WriteString("set -e\n\n")
+	script.WriteString("# Auto-generated user setup script\n")
+
+	if fqdn != "" {
+		// preserve_hostname stops cloud-init resetting it on the next boot
+		script.WriteString(fmt.Sprintf("\n# Set hostname: %s\n", fqdn))
+		script.WriteString(fmt.Sprintf("hostnamectl set-hostname %s\n", fqdn))
+		script.WriteString("echo 'preserve_hostname: true' > /etc/cloud/cloud.cfg.d/99-hostname.cfg\n")
+		hosts := fqdn
+		if hostname != fqdn {
+			hosts += " " + hostname
+		}
+		script.WriteString("sed -i '/^127\\.0\\.1\\.1[[:space:]]/d' /etc/hosts\n")
+		script.WriteString(fmt.Sprintf("echo '127.0.1.1 %s' >> /etc/hosts\n", hosts))
+	}
+
+	if swapSizeGB > 0 {
+		// Before the packages, whose installs are what tends to run out of
+		// memory. Both ext4 (Ubuntu, Debian) and XFS (Amazon Linux) take a
+		// fallocated swap file; dd covers filesystems that do not.
+		script.WriteString(fmt.Sprintf("\n# Swap file: %d GiB\n", swapSizeGB))
+		script.WriteString("if ! swapon --show=NAME --noheadings | grep -qx /swapfile; then\n")
+		script.WriteString(fmt.Sprintf("  fallocate -l %dG /swapfile || dd if=/dev/zero of=/swapfile bs=1M count=%d\n", swapSizeGB, swapSizeGB*1024))
+		script.WriteString("  chmod 600 /swapfile\n")
+		script.WriteString("  mkswap /swapfile\n")
+		script.WriteString("  swapon /swapfile\n")
+		script.WriteString("  grep -q '^/swapfile ' /etc/fstab || echo '/swapfile none swap defaults 0 0' >> /etc/fstab\n")
+		script.WriteString("fi\n")
+	}
+
+	for _, user := range users {
+		script.WriteString(fmt.Sprintf("\n# Create user: %s (GitHub: %s)\n", user.Username, user.GitHubUsername))
+		script.WriteString(fmt.Sprintf("useradd -m -s /bin/bash %q || true\n", user.Username))
+		script.WriteString(fmt.Sprintf("usermod -a -G %s %s\n", groups, user.Username))
+		script.WriteString(fmt.Sprintf("echo '%s ALL=(ALL) NOPASSWD:ALL' > /etc/sudoers.d/%s\n", user.Username, user.Username))
+		script.WriteString(fmt.Sprintf("chmod 0440 /etc/sudoers.d/%s\n", user.Username))
+		script.WriteString(fmt.Sprintf("mkdir -p /home/%s/.ssh\n", user.Username))
+		script.WriteString(fmt.Sprintf("chmod 700 /home/%s/.ssh\n", user.Username))
+		if keys, ok := bakedKeys[user.Username]; ok {
+			// A quoted delimiter keeps the shell from expanding the keys
+			script.WriteString(fmt.Sprintf("cat > /home/%s/.ssh/authorized_keys <<'AUTHORIZED_KEYS'\n", user.Username))
+			script.WriteString(keys + "\nAUTHORIZED_KEYS\n")
+		} else {
+			script.WriteString(fmt.Sprintf("curl -s https://github.com/%s.keys > /home/%s/.ssh/authorized_keys\n", user.GitHubUsername, user.Username))
+		}
+		script.WriteString(fmt.Sprintf("chmod 600 /home/%s/.ssh/authorized_keys\n", user.Username))
+		script.WriteString(fmt.Sprintf("chown -R %s:%s /home/%s/.ssh\n", user.Username, user.Username, user.Username))
+		script.WriteString(fmt.Sprintf("echo 'User %s created with SSH keys from GitHub (%s)'\n", user.Username, user.GitHubUsername))
+	}
+
+	if sshPort != defaultSSHPort {
+		// Port goes first: it is not allowed after a Match block. Ubuntu
+		// 24.04 starts sshd from ssh.socket, whose port is generated from
+		// sshd_config on daemon-reload.
+		script.WriteString(fmt.Sprintf("\n# Move sshd to port %d\n", sshPort))
+		script.WriteString("sed -i -E '/^#?Port[[:space:]]/d' /etc/ssh/sshd_config\n")
+		script.WriteString(fmt.Sprintf("sed -i '1i Port %d' /etc/ssh/sshd_config\n", sshPort))
+		script.WriteString("if systemctl is-active --quiet ssh.socket; then\n")
+		script.WriteString("  systemctl daemon-reload\n")
+		script.WriteString("  systemctl restart ssh.socket\n")
+		script.WriteString("fi\n")
+		script.WriteString("systemctl restart sshd 2>/dev/null || systemctl restart ssh\n")
+	}
+
+	// A name the image does not know only warns, so the packages below
+	// are still installed
+	if vm.Timezone != "" {
+		script.WriteString(fmt.Sprintf("\n# Timezone: %s\n", vm.Timezone))
+		script.WriteString(fmt.Sprintf("timedatectl set-timezone %s || echo 'WARNING: could not set timezone %s' >&2\n", vm.Timezone, vm.Timezone))
+	}
+	if vm.Locale != "" {
+		script.WriteString(fmt.Sprintf("\n# Locale: %s\n", vm.Locale))
+		script.WriteString(localeCommands(osFamily, vm.Locale))
+	}
+
+	if len(packages) > 0 {
+		script.WriteString("\n# Install packages\n")
+		script.WriteString(packageInstallCommand(osFamily, packages) + "\n")
+	}
+
+	if docker {
+		// The distributions' own packages, so no third-party repository
+		// is needed
+		script.WriteString("\n# Install Docker\n")
+		if osFamily == "al2023" {
+			script.WriteString(packageInstallCommand(osFamily, []string{"docker"}) + "\n")
+		} else {
+			script.WriteString(packageInstallCommand(osFamily, []string{"docker.io"}) + "\n")
+		}
+		script.WriteString("systemctl enable --now docker\n")
+		for _, user := range users {
+			script.WriteString(fmt.Sprintf("usermod -a -G docker %s\n", user.Username))
+		}
+	}
+
+	// set -e means every step above succeeded once this is reached
+	script.WriteString("\n# Welcome message\n")
+	if fqdn != "" {
+		script.WriteString(fmt.Sprintf("echo 'Welcome to %s' > /etc/motd\n", fqdn))
+	} else {
+		script.WriteString("echo \"Welcome to $(hostname -f)\" > /etc/motd\n")
+	}
+	if vm.MOTD != "" {
+		// A quoted delimiter keeps the shell from expanding the message
+		script.WriteString(fmt.Sprintf("cat >> /etc/motd <<'%s'\n%s\n%s\n", motdDelimiter, strings.TrimRight(vm.MOTD, "\n"), motdDelimiter))
+	}
+	script.WriteString("\n# Bootstrap completion marker\n")
+	script.WriteString(fmt.Sprintf("mkdir -p %s\n", filepath.Dir(bootstrapMarker)))
+	script.WriteString(fmt.Sprintf("date -u +%%Y-%%m-%%dT%%H:%%M:%%SZ > %s\n", bootstrapMarker))
+
+	return script.String()
+}
+
+type CloudInitTemplateData struct {
+	Hostname     string
+	Domain       string
+	FQDN         string
+	Region       string
+	OS           string
+	WorkingDir   string
+	Packages     []string
+	Users        []User
+	SSHPort      int
+	IsApexDomain bool
+	CNAMEAliases []string
+}
+
+// resolveCloudInitPath resolves a cloud_init_file relative to the current
+// directory
+func resolveCloudInitPath(path string) string {
+	if filepath.IsAbs(path) {
+		return path
+	}
+	cwd, _ := os.Getwd()
+	return filepath.Join(cwd, path)
+}
+
+// cloudInitTemplateData returns the values a cloud-init file is rendered
+// with. dns may be nil.
+func cloudInitTemplateData(vm *VMConfig, dns *DNSConfig) CloudInitTemplateData {
+	// Default working directory
+	workingDir := vm.WorkingDir
+	if workingDir == "" {
+		workingDir = "/var/www/html"
+	}
+
+	hostname, fqdn := instanceHostname(vm, dns)
+	data := CloudInitTemplateData{
+		Region:     vm.Region,
+		OS:         vm.OS,
+		WorkingDir: workingDir,
+		Packages:   vm.Packages,
+		Users:      vm.Users,
+		Hostname:   hostname,
+		FQDN:       fqdn,
+		SSHPort:    vm.SSHPortNumber(),
+	}
+	if dns != nil {
+		data.Domain = dns.Domain
+		data.IsApexDomain = dns.IsApexDomain
+		data.CNAMEAliases = dns.CNAMEAliases
+	}
+	return data
+}
+
+func processCloudInitTemplate(templatePath string, data CloudInitTemplateData) (string, error) {
+	content, err := os.ReadFile(templatePath)
+	if err != nil {
+		return "", fmt.Errorf("failed to read cloud-init file: %w", err)
+	}
+
+	tmpl, err := template.New("cloud-init").Parse(string(content))
+	if err != nil {
+		return "", fmt.Errorf("failed to parse cloud-init template: %w", err)
+	}
+
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, data); err != nil {
+		return "", fmt.Errorf("failed to execute cloud-init template: %w", err)
+	}
+
+	return buf.String(), nil
+}
+
+// maxUserDataSize is the EC2 limit on user data before base64 encoding.
+const maxUserDataSize = 16 * 1024
+
+// errUserDataTooLarge is returned by encodeUserData when the user data
+// does not fit even compressed
+var errUserDataTooLarge = errors.New("user data exceeds the EC2 limit")
+
+func generateMultipartUserData(userScript string, cloudInitContent string) string {
+	boundary := "MIMEBOUNDARY"
+	var buf bytes.Buffer
+
+	buf.WriteString("Content-Type: multipart/mixed; boundary=\"" + boundary + "\"\n")
+	buf.WriteString("MIME-Version: 1.0\n\n")
+
+	// Part 1: Shell script for user setup
+	buf.WriteString("--" + boundary + "\n")
+	buf.WriteString("Content-Type: text/x-shellscript; charset=\"utf-8\"\n")
+	buf.WriteString("Content-Disposition: attachment; filename=\"setup-users.sh\"\n\n")
+	buf.WriteString(userScript)
+	buf.WriteString("\n")
+
+	// Part 2: Cloud-init config (if provided)
+	if cloudInitContent != "" {
+		buf.WriteString("--" + boundary + "\n")
+		buf.WriteString("Content-Type: text/cloud-config; charset=\"utf-8\"\n")
+		buf.WriteString("Content-Disposition: attachment; filename=\"cloud-config.yaml\"\n\n")
+		buf.WriteString(cloudInitContent)
+		buf.WriteString("\n")
+	}
+
+	buf.WriteString("--" + boundary + "--\n")
+
+	return buf.String()
+}
+
+// encodeUserData base64-encodes the user data, gzipping it first when
+// requested or when it would not otherwise fit. cloud-init detects the gzip
+// header and decompresses before processing the MIME parts.
+func encodeUserData(ctx context.Context, userData string, compress bool) (string, error) {
+	raw := []byte(userData)
+
+	if !compress && len(raw) > maxUserDataSize {
+		infof(ctx, "User data is %d bytes (limit %d), compressing with gzip", len(raw), maxUserDataSize)
+		compress = true
+	}
+
+	if compress {
+		var buf bytes.Buffer
+		zw, err := gzip.NewWriterLevel(&buf, gzip.BestCompression)
+		if err != nil {
+			return "", fmt.Errorf("failed to create gzip writer: %w", err)
+		}
+		if _, err := zw.Write(raw); err != nil {
+			return "", fmt.Errorf("failed to compress user data: %w", err)
+		}
+		if err := zw.Close(); err != nil {
+			return "", fmt.Errorf("failed to compress user data: %w", err)
+		}
+		raw = buf.Bytes()
+	}
+
+	if len(raw) > maxUserDataSize {
+		return "", fmt.Errorf("%w: %d bytes compressed, limit %d", errUserDataTooLarge, len(raw), maxUserDataSize)
+	}
+
+	return base64.StdEncoding.EncodeToString(raw), nil
+}
@@ -0,0 +1,40 @@
+package ec2stack
+
+import (
+	"errors"
+	"strings"
+)
+
+// ErrWaitTimeout and ErrWaitFailed mark an error from waiting on AWS: the
+// wait ran out of time, or what it waited on ended in a failed state, such
+// as a stack that rolled back
+var (
+	ErrWaitTimeout = errors.New("timed out waiting for AWS")
+	ErrWaitFailed  = errors.New("AWS resource reached a failed state")
+)
+
+// waitError is an error marked with the ErrWait sentinel it matches. Its
+// text is the underlying error's.
+type waitError struct {
+	kind error
+	err  error
+}
+
+func (e *waitError) Error() string { return e.err.Error() }
+
+func (e *waitError) Unwrap() []error { return []error{e.kind, e.err} }
+
+// waiterError marks an error from an SDK waiter's Wait with ErrWaitTimeout
+// or ErrWaitFailed. The waiters return both as plain errors, so this is
+// the one place their text is matched.
+func waiterError(err error) error {
+	switch {
+	case err == nil:
+		return nil
+	case strings.Contains(err.Error(), "exceeded max wait time"):
+		return &waitError{ErrWaitTimeout, err}
+	case strings.Contains(err.Error(), "waiter state transitioned to Failure"):
+		return &waitError{ErrWaitFailed, err}
+	}
+	return err
+}
@@ -0,0 +1,109 @@
+package ec2stack
+
+import (
+	"context"
+	"fmt"
+	"maps"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	ec2types "github.com/aws/aws-sdk-go-v2/service/ec2/types"
+	"github.com/aws/aws-sdk-go-v2/service/route53"
+)
+
+// MinWatchInterval is the shortest pause WatchStack accepts between checks
+const MinWatchInterval = 10 * time.Second
+
+// WatchStack checks the stack's instances every interval until ctx is
+// canceled. When a running instance's address differs from the config, its
+// DNS records are repointed and the config rewritten, as StartStack does.
+// Stopped instances are skipped until they run again. The config is read
+// afresh on every check, so edits made meanwhile are kept. Cancellation is
+// a clean stop and returns nil; failed checks are warned about and retried.
+func (c *Client) WatchStack(ctx context.Context, stackName string, interval time.Duration) error {
+	ctx = withStack(ctx, stackName)
+	if interval < MinWatchInterval {
+		return configErrorf("watch interval must be at least %s, got %s", MinWatchInterval, interval)
+	}
+	cfg, _, instances, err := readInstances(stackName)
+	if err != nil {
+		return err
+	}
+	awsCfg, err := c.LoadAWSConfig(ctx, cfg.VM.Region)
+	if err != nil {
+		return fmt.Errorf("failed to load AWS config: %w", err)
+	}
+	r53Client := route53.NewFromConfig(awsCfg)
+
+	infof(ctx, "Watching %d instance(s) every %s; press Ctrl-C to stop", len(instances), interval)
+	for {
+		if err := c.syncAddresses(ctx, r53Client, stackName); err != nil && ctx.Err() == nil {
+			warnf(ctx, "%v; retrying in %s", err, interval)
+		}
+		select {
+		case <-ctx.Done():
+			infof(ctx, "Stopped watching %s", stackName)
+			return nil
+		case <-time.After(interval):
+		}
+	}
+}
+
+// syncAddresses makes one watch check. The config is only written when
+// every DNS update succeeded, so a failed one is retried by the next check.
+func (c *Client) syncAddresses(ctx context.Context, r53Client *route53.Client, stackName string) error {
+	cfg, configFile, instances, err := readInstances(stackName)
+	if err != nil {
+		return err
+	}
+	groups, err := c.groupByRegion(ctx, instances)
+	if err != nil {
+		return err
+	}
+	current := make(map[string]ec2types.Instance)
+	for _, group := range groups {
+		described, err := describeInstances(ctx, group.ec2Client, group.ids)
+		if err != nil {
+			return err
+		}
+		maps.Copy(current, described)
+	}
+
+	usePrivate := cfg.VM.NoPublicIP || (cfg.DNS != nil && cfg.DNS.PrivateZone)
+	changed := false
+	for _, inst := range instances {
+		info, ok := current[inst.ID]
+		if !ok || info.State == nil || info.State.Name != ec2types.InstanceStateNameRunning {
+			continue
+		}
+		publicIP, privateIP := aws.ToString(info.PublicIpAddress), aws.ToString(info.PrivateIpAddress)
+		if publicIP == *inst.PublicIP && privateIP == *inst.PrivateIP {
+			continue
+		}
+		oldIP, newIP := *inst.PublicIP, publicIP
+		if usePrivate {
+			oldIP, newIP = *inst.PrivateIP, privateIP
+		}
+		infoWith(ctx, fmt.Sprintf("%s: public IP %s -> %s", inst.ID, *inst.PublicIP, publicIP),
+			"instance_id", inst.ID, "public_ip", publicIP, "private_ip", privateIP)
+		if inst.DNS != nil && len(inst.DNS.DNSRecords) > 0 && oldIP != newIP && newIP != "" {
+			if err := updateDNSTarget(ctx, r53Client, inst.DNS, oldIP, newIP); err != nil {
+				return err
+			}
+		}
+		*inst.PublicIP = publicIP
+		*inst.PublicDNSName = aws.ToString(info.PublicDnsName)
+		*inst.PrivateIP = privateIP
+		changed = true
+	}
+	if !changed {
+		debugf(ctx, "Addresses unchanged")
+		return nil
+	}
+
+	if err := WriteConfig(configFile, cfg); err != nil {
+		return fmt.Errorf("failed to update config file: %w", err)
+	}
+	infof(ctx, "Config updated: %s", configFile)
+	return nil
+}
@@ -0,0 +1,147 @@
+package ec2stack
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/route53"
+)
+
+// zoneCacheTTL is how long a hosted zone ID looked up by name is reused.
+// Zones are rarely recreated, and a stale ID is dropped the first time
+// Route53 reports it missing.
+const zoneCacheTTL = 24 * time.Hour
+
+// zoneCacheMu serializes reads and writes of the zone cache file and of
+// Client.zoneIDs
+var zoneCacheMu sync.Mutex
+
+// zoneCacheEntry is one hosted zone in the cache file
+type zoneCacheEntry struct {
+	ZoneID     string    `json:"zone_id"`
+	ResolvedAt time.Time `json:"resolved_at"`
+}
+
+// zoneCacheKey keys the cache by the caller's account as well as the
+// domain, since the same name is a different zone in every account. The
+// profile and role name the account only some of the time: environment
+// credentials and AWS_PROFILE leave both empty.
+func (c *Client) zoneCacheKey(ctx context.Context, domain string, private bool) (string, error) {
+	account, err := c.callerAccount(ctx)
+	if err != nil {
+		return "", err
+	}
+	kind := "public"
+	if private {
+		kind = "private"
+	}
+	return account + "|" + kind + "|" + domain, nil
+}
+
+// callerAccount returns the account ID of the client's credentials, asking
+// STS once per profile and role
+func (c *Client) callerAccount(ctx context.Context) (string, error) {
+	who := c.Profile + "|" + c.AssumeRoleARN
+	c.mu.Lock()
+	account := c.accounts[who]
+	c.mu.Unlock()
+	if account != "" {
+		return account, nil
+	}
+
+	arn, err := c.CallerARN(ctx, "")
+	if err != nil {
+		return "", err
+	}
+	if account = arnAccount(arn); account == "" {
+		return "", fmt.Errorf("no account ID in caller ARN %s", arn)
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.accounts == nil {
+		c.accounts = make(map[string]string)
+	}
+	c.accounts[who] = account
+	return account, nil
+}
+
+// resolveZoneID returns the hosted zone for domain, from this run's lookups
+// or the on-disk cache when a fresh entry exists, and from Route53
+// otherwise. cached reports an ID that did not come from Route53 just now.
+// Like the AMI cache, problems with the file are only logged at debug
+// level.
+func (c *Client) resolveZoneID(ctx context.Context, r53Client *route53.Client, domain string, private bool) (zoneID string, cached bool, err error) {
+	if c.NoZoneCache {
+		zoneID, err = lookupZoneID(ctx, r53Client, domain, private)
+		return zoneID, false, err
+	}
+	key, err := c.zoneCacheKey(ctx, domain, private)
+	if err != nil {
+		debugf(ctx, "zone cache disabled: %v", err)
+		zoneID, err = lookupZoneID(ctx, r53Client, domain, private)
+		return zoneID, false, err
+	}
+	path, pathErr := cachePath("zones.json")
+
+	zoneCacheMu.Lock()
+	zoneID = c.zoneIDs[key]
+	if zoneID == "" && pathErr == nil {
+		entry := readCacheFile[zoneCacheEntry](path)[key]
+		if entry.ZoneID != "" && time.Since(entry.ResolvedAt) < zoneCacheTTL {
+			debugf(ctx, "Zone ID for %s from cache %s (resolved %s)", domain, path, entry.ResolvedAt.Format(time.RFC3339))
+			zoneID = entry.ZoneID
+		}
+	}
+	zoneCacheMu.Unlock()
+	if zoneID != "" {
+		return zoneID, true, nil
+	}
+
+	zoneID, err = lookupZoneID(ctx, r53Client, domain, private)
+	if err != nil {
+		return "", false, err
+	}
+
+	zoneCacheMu.Lock()
+	defer zoneCacheMu.Unlock()
+	if c.zoneIDs == nil {
+		c.zoneIDs = make(map[string]string)
+	}
+	c.zoneIDs[key] = zoneID
+	if pathErr != nil {
+		debugf(ctx, "zone cache disabled: %v", pathErr)
+		return zoneID, false, nil
+	}
+	entries := readCacheFile[zoneCacheEntry](path)
+	entries[key] = zoneCacheEntry{ZoneID: zoneID, ResolvedAt: time.Now().UTC()}
+	if err := writeCacheFile(path, entries); err != nil {
+		debugf(ctx, "failed to update zone cache %s: %v", path, err)
+	}
+	return zoneID, false, nil
+}
+
+// forgetZoneID drops a cached zone that Route53 no longer knows, so the
+// next lookup asks Route53 again
+func (c *Client) forgetZoneID(ctx context.Context, domain string, private bool) {
+	key, err := c.zoneCacheKey(ctx, domain, private)
+	if err != nil {
+		return
+	}
+	zoneCacheMu.Lock()
+	defer zoneCacheMu.Unlock()
+	delete(c.zoneIDs, key)
+	path, err := cachePath("zones.json")
+	if err != nil {
+		return
+	}
+	entries := readCacheFile[zoneCacheEntry](path)
+	if _, ok := entries[key]; !ok {
+		return
+	}
+	delete(entries, key)
+	if err := writeCacheFile(path, entries); err != nil {
+		debugf(ctx, "failed to update zone cache %s: %v", path, err)
+	}
+}
@@ -1,271 +1,219 @@
 package main
 
 import (
+	"bufio"
 	"bytes"
 	"context"
-	"crypto/rand"
-	"encoding/base64"
+	"encoding/csv"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
-	"log"
-	"math/big"
+	"io"
+	"log/slog"
 	"os"
+	"os/exec"
+	"os/signal"
 	"path/filepath"
+	"slices"
+	"strconv"
 	"strings"
+	"sync"
+	"syscall"
 	"text/template"
 	"time"
 
+	"aws-cf-ec2/ec2stack"
+
 	"github.com/aws/aws-sdk-go-v2/aws"
-	"github.com/aws/aws-sdk-go-v2/config"
-	"github.com/aws/aws-sdk-go-v2/service/cloudformation"
 	"github.com/aws/aws-sdk-go-v2/service/cloudformation/types"
-	"github.com/aws/aws-sdk-go-v2/service/ec2"
-	ec2types "github.com/aws/aws-sdk-go-v2/service/ec2/types"
-	"github.com/aws/aws-sdk-go-v2/service/route53"
-	r53types "github.com/aws/aws-sdk-go-v2/service/route53/types"
-	"github.com/aws/aws-sdk-go-v2/service/ssm"
+	"github.com/aws/smithy-go"
 )
 
-type User struct {
-	Username       string `json:"username"`
-	GitHubUsername string `json:"github_username"`
-}
+// Exit codes returned by main
+const (
+	exitConfigError  = 1
+	exitAWSError     = 2
+	exitTimeoutError = 3
+	exitOtherError   = 4
+	exitInterrupted  = 130
+)
 
-type DNSRecord struct {
-	Name  string `json:"name"`
-	Type  string `json:"type"`
-	Value string `json:"value"`
-	TTL   int    `json:"ttl"`
+// usageError marks an error in how the tool was run, such as a flag the
+// config cannot take, which exits like an invalid config
+type usageError struct {
+	err error
 }
 
-// New nested configuration structure
-type Config struct {
-	VM  *VMConfig  `json:"vm,omitempty"`
-	DNS *DNSConfig `json:"dns,omitempty"`
-}
+func (e *usageError) Error() string { return e.err.Error() }
 
-type VMConfig struct {
-	Region        string   `json:"region,omitempty"`
-	OS            string   `json:"os,omitempty"`
-	InstanceType  string   `json:"instance_type,omitempty"`
-	CloudInitFile string   `json:"cloud_init_file,omitempty"`
-	WorkingDir    string   `json:"working_dir,omitempty"`
-	Packages      []string `json:"packages,omitempty"`
-	Users         []User   `json:"users,omitempty"`
-	VpcID         string   `json:"vpc_id,omitempty"`
-	SubnetID      string   `json:"subnet_id,omitempty"`
-
-	// Output fields
-	StackName     string `json:"stack_name,omitempty"`
-	StackID       string `json:"stack_id,omitempty"`
-	InstanceID    string `json:"instance_id,omitempty"`
-	PublicIP      string `json:"public_ip,omitempty"`
-	SecurityGroup string `json:"security_group,omitempty"`
-	AMIID         string `json:"ami_id,omitempty"`
-
-	// Network resources for cleanup
-	CreatedVPC            bool   `json:"created_vpc,omitempty"`
-	CreatedSubnet         bool   `json:"created_subnet,omitempty"`
-	InternetGatewayID     string `json:"internet_gateway_id,omitempty"`
-	RouteTableID          string `json:"route_table_id,omitempty"`
-	RouteTableAssociation string `json:"route_table_association_id,omitempty"`
+func (e *usageError) Unwrap() error { return e.err }
+
+func usageErrorf(format string, args ...any) error {
+	return &usageError{fmt.Errorf(format, args...)}
 }
 
-type DNSConfig struct {
-	Hostname     string   `json:"hostname,omitempty"`
-	Domain       string   `json:"domain,omitempty"`
-	TTL          int      `json:"ttl,omitempty"`
-	IsApexDomain bool     `json:"is_apex_domain,omitempty"`
-	CNAMEAliases []string `json:"cname_aliases,omitempty"`
-	TargetIP     string   `json:"target_ip,omitempty"`
-
-	// Output fields
-	ZoneID     string      `json:"zone_id,omitempty"`
-	FQDN       string      `json:"fqdn,omitempty"`
-	DNSRecords []DNSRecord `json:"dns_records,omitempty"`
+// exitCode maps an error from a command to the process exit status
+func exitCode(err error) int {
+	var cfgErr *ec2stack.ConfigError
+	var useErr *usageError
+	var apiErr smithy.APIError
+	switch {
+	case errors.As(err, &cfgErr), errors.As(err, &useErr):
+		return exitConfigError
+	case errors.Is(err, context.Canceled):
+		return exitInterrupted
+	case errors.Is(err, context.DeadlineExceeded), errors.Is(err, ec2stack.ErrWaitTimeout):
+		return exitTimeoutError
+	case errors.As(err, &apiErr), errors.Is(err, ec2stack.ErrWaitFailed):
+		return exitAWSError
+	}
+	return exitOtherError
 }
 
-// Legacy flat configuration structure (kept for backward compatibility)
-type StackConfig struct {
-	// Input fields (user provides)
-	GitHubUsername string   `json:"github_username,omitempty"`
-	Users          []User   `json:"users,omitempty"`
-	InstanceType   string   `json:"instance_type,omitempty"`
-	OS             string   `json:"os,omitempty"`
-	CloudInitFile  string   `json:"cloud_init_file,omitempty"`
-	WorkingDir     string   `json:"working_dir,omitempty"`
-	Packages       []string `json:"packages,omitempty"`
-	Hostname       string   `json:"hostname,omitempty"`
-	Domain         string   `json:"domain,omitempty"`
-	TTL            int      `json:"ttl,omitempty"`
-	IsApexDomain   bool     `json:"is_apex_domain,omitempty"`
-	CNAMEAliases   []string `json:"cname_aliases,omitempty"`
-	VpcID          string   `json:"vpc_id,omitempty"`
-	SubnetID       string   `json:"subnet_id,omitempty"`
-
-	// Output fields (program fills in)
-	StackName     string      `json:"stack_name,omitempty"`
-	StackID       string      `json:"stack_id,omitempty"`
-	Region        string      `json:"region,omitempty"`
-	AMIID         string      `json:"ami_id,omitempty"`
-	InstanceID    string      `json:"instance_id,omitempty"`
-	PublicIP      string      `json:"public_ip,omitempty"`
-	SecurityGroup string      `json:"security_group,omitempty"`
-	ZoneID        string      `json:"zone_id,omitempty"`
-	FQDN          string      `json:"fqdn,omitempty"`
-	SSHCommand    string      `json:"ssh_command,omitempty"`
-	DNSRecords    []DNSRecord `json:"dns_records,omitempty"`
-
-	// Network resources created by this tool (for cleanup)
-	CreatedVPC            bool   `json:"created_vpc,omitempty"`
-	CreatedSubnet         bool   `json:"created_subnet,omitempty"`
-	InternetGatewayID     string `json:"internet_gateway_id,omitempty"`
-	RouteTableID          string `json:"route_table_id,omitempty"`
-	RouteTableAssociation string `json:"route_table_association_id,omitempty"`
+// jsonResult collects what -json prints when the command ends; it is nil
+// without -json
+var jsonResult *commandResult
+
+// jsonCommands are the commands -json supports. The others prompt, run
+// until interrupted or only work on local files.
+var jsonCommands = []string{"create", "delete", "status", "list", "stop", "start", "plan", "describe-instance"}
+
+// commandResult is the single JSON object -json prints on stdout. Which
+// fields are set depends on the command; error is null on success.
+type commandResult struct {
+	Command   string                     `json:"command"`
+	Name      string                     `json:"name,omitempty"`
+	Region    string                     `json:"region,omitempty"`
+	Stack     *ec2stack.Config           `json:"stack,omitempty"`
+	Stacks    []stackStatus              `json:"stacks,omitempty"`
+	Changes   *[]ec2stack.PlannedChange  `json:"changes,omitempty"`
+	Instances []ec2stack.InstanceDetails `json:"instances,omitempty"`
+	SSH       []string                   `json:"ssh,omitempty"`
+	Error     *commandError              `json:"error"`
 }
 
-var osSSMPaths = map[string]string{
-	"amazon-linux-2023": "/aws/service/ami-amazon-linux-latest/al2023-ami-kernel-default-x86_64",
-	"amazon-linux-2":    "/aws/service/ami-amazon-linux-latest/amzn2-ami-hvm-x86_64-gp2",
-	"ubuntu-24.04":      "/aws/service/canonical/ubuntu/server/24.04/stable/current/amd64/hvm/ebs-gp2/ami-id",
-	"ubuntu-22.04":      "/aws/service/canonical/ubuntu/server/22.04/stable/current/amd64/hvm/ebs-gp2/ami-id",
-	"ubuntu-20.04":      "/aws/service/canonical/ubuntu/server/20.04/stable/current/amd64/hvm/ebs-gp2/ami-id",
-	"debian-12":         "/aws/service/debian/release/12/latest/amd64",
-	"debian-11":         "/aws/service/debian/release/11/latest/amd64",
+// commandError is a failed command's error in the -json result
+type commandError struct {
+	Message  string `json:"message"`
+	ExitCode int    `json:"exit_code"`
 }
 
-const cloudFormationTemplateStr = `
-AWSTemplateFormatVersion: '2010-09-09'
-Description: EC2 instance with SSH access
-
-Parameters:
-  ImageId:
-    Type: String
-    Description: AMI ID for the EC2 instance
-  InstanceType:
-    Type: String
-    Description: EC2 instance type
-    Default: t3.micro
-  VpcId:
-    Type: String
-    Description: VPC ID for the security group (required)
-  SubnetId:
-    Type: String
-    Description: Subnet ID for the EC2 instance (required)
-
-Resources:
-  SSHSecurityGroup:
-    Type: AWS::EC2::SecurityGroup
-    Properties:
-      GroupDescription: Allow SSH inbound traffic
-      VpcId: !Ref VpcId
-      SecurityGroupIngress:
-        - IpProtocol: tcp
-          FromPort: 22
-          ToPort: 22
-          CidrIp: 0.0.0.0/0
-        - IpProtocol: tcp
-          FromPort: 80
-          ToPort: 80
-          CidrIp: 0.0.0.0/0
-        - IpProtocol: tcp
-          FromPort: 443
-          ToPort: 443
-          CidrIp: 0.0.0.0/0
-      Tags:
-        - Key: Name
-          Value: !Sub "${AWS::StackName}-sg"
-
-  EC2Instance:
-    Type: AWS::EC2::Instance
-    Properties:
-      InstanceType: !Ref InstanceType
-      ImageId: !Ref ImageId
-      NetworkInterfaces:
-        - DeviceIndex: "0"
-          SubnetId: !Ref SubnetId
-          AssociatePublicIpAddress: true
-          GroupSet:
-            - !GetAtt SSHSecurityGroup.GroupId
-      UserData: {{.UserData}}
-      Tags:
-        - Key: Name
-          Value: !Ref AWS::StackName
-
-Outputs:
-  InstanceId:
-    Description: Instance ID
-    Value: !Ref EC2Instance
-  PublicIP:
-    Description: Public IP Address
-    Value: !GetAtt EC2Instance.PublicIp
-  InstanceType:
-    Description: Instance Type
-    Value: !Ref InstanceType
-  SecurityGroupId:
-    Description: Security Group ID
-    Value: !Ref SSHSecurityGroup
-  VpcId:
-    Description: VPC ID
-    Value: !Ref VpcId
-  SubnetId:
-    Description: Subnet ID
-    Value: !Ref SubnetId
-`
-
-func generateCloudFormationTemplate(userData string) (string, error) {
-	tmpl, err := template.New("cfn").Parse(cloudFormationTemplateStr)
+// printJSONResult prints jsonResult on stdout, with err as its error
+func printJSONResult(err error) {
 	if err != nil {
-		return "", fmt.Errorf("failed to parse CFN template: %w", err)
-	}
-
-	var buf bytes.Buffer
-	data := struct {
-		UserData string
-	}{
-		UserData: userData,
+		jsonResult.Error = &commandError{Message: err.Error(), ExitCode: exitCode(err)}
 	}
-
-	if err := tmpl.Execute(&buf, data); err != nil {
-		return "", fmt.Errorf("failed to execute CFN template: %w", err)
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetEscapeHTML(false)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(jsonResult); err != nil {
+		slog.Error(err.Error())
+		os.Exit(exitConfigError)
 	}
-
-	return buf.String(), nil
 }
 
-func generateRandomHostname() string {
-	const charset = "abcdefghijklmnopqrstuvwxyz0123456789"
-	const length = 8
-	result := make([]byte, length)
-
-	for i := range result {
-		num, err := rand.Int(rand.Reader, big.NewInt(int64(len(charset))))
-		if err != nil {
-			log.Fatalf("failed to generate random hostname: %v", err)
-		}
-		result[i] = charset[num.Int64()]
-	}
+// sshWaitTimeout bounds -wait-ssh
+const sshWaitTimeout = 5 * time.Minute
 
-	return string(result)
-}
+// commands are the subcommands accepted as the first argument
+var commands = []string{"create", "delete", "force-delete", "status", "list", "delete-all", "validate", "show-config", "clone", "stop", "start", "plan", "watch", "describe-instance"}
 
 func main() {
 	createCmd := flag.Bool("create", false, "Create a new EC2 instance")
 	createShort := flag.Bool("c", false, "Create a new EC2 instance (shorthand)")
 	deleteCmd := flag.Bool("delete", false, "Delete an existing stack")
 	deleteShort := flag.Bool("d", false, "Delete an existing stack (shorthand)")
+	forceDeleteCmd := flag.Bool("force-delete", false, "Delete a stack by name without a config file, finding its DNS records from the stack")
+	statusCmd := flag.Bool("status", false, "Show stack status and outputs")
+	listCmd := flag.Bool("list", false, "List stacks created by this tool")
+	deleteAllCmd := flag.Bool("delete-all", false, "Delete every stack created by this tool in the region")
+	validateCmd := flag.Bool("validate", false, "Check configs offline, without calling AWS")
+	showConfigCmd := flag.Bool("show-config", false, "Print the effective config, after defaults and environment variables, without calling AWS")
+	cloneCmd := flag.Bool("clone", false, "Copy a stack's config to a new name with the create outputs cleared")
+	stopCmd := flag.Bool("stop", false, "Stop a stack's instance, keeping its disk")
+	startCmd := flag.Bool("start", false, "Start a stopped instance and update its IP and DNS records")
+	planCmd := flag.Bool("plan", false, "Preview what the config would change in the deployed stack, without changing it")
+	watchCmd := flag.Bool("watch", false, "Keep running and repoint the DNS records whenever the instance's IP changes")
+	describeInstanceCmd := flag.Bool("describe-instance", false, "Show the instance's live EC2 state, launch time, addresses and security groups")
 	stackName := flag.String("name", "", "Stack name (required)")
 	stackNameShort := flag.String("n", "", "Stack name (shorthand)")
+	forceDNS := flag.Bool("force-dns", false, "Overwrite existing DNS records that point elsewhere")
+	skipKeyCheck := flag.Bool("skip-key-check", false, "Do not check that users have SSH keys on GitHub")
+	skipPermissionCheck := flag.Bool("skip-permission-check", false, "Do not check IAM permissions before create")
+	noCache := flag.Bool("no-cache", false, "Look up the AMI and hosted zone instead of using cached IDs")
+	yes := flag.Bool("yes", false, "Delete without asking for confirmation")
+	yesShort := flag.Bool("y", false, "Delete without asking for confirmation (shorthand)")
+	force := flag.Bool("force", false, "With delete, disable termination protection first; with clone, overwrite an existing config")
+	waitSSH := flag.Bool("wait-ssh", false, "After create, wait until SSH accepts connections")
+	knownHosts := flag.String("known-hosts", "", "After create, read the instance's SSH host keys and add them to this known_hosts file")
+	sshConfig := flag.Bool("ssh-config", false, "After create, add a Host entry for the stack to ~/.ssh/config")
+	envOut := flag.String("env-out", "", "After create, write the stack outputs as shell exports to this file")
+	resultOut := flag.String("result-out", "", "After create, also write the resulting config with its outputs as JSON to this file")
+	eventsOut := flag.String("events-out", "", "After create or delete, write the stack's CloudFormation events to this file (.csv for CSV, otherwise JSON)")
+	since := flag.Duration("since", 0, "Only show and write stack events from this long ago on (default: since the create or delete began)")
+	enableSSM := flag.Bool("enable-ssm", false, "With create, set enable_ssm: give the instance a role and instance profile for SSM Session Manager")
+	ipv6 := flag.Bool("ipv6", false, "With create, set ipv6_ingress: also open every port open to 0.0.0.0/0 to ::/0")
+	instanceType := flag.String("instance-type", "", "With create, use this instance type, or comma-separated fallback list, instead of the config's")
+	ports := flag.String("ports", "", "With create, open these comma-separated ports instead of the config's (e.g. 22,443,8080@10.0.0.0/8)")
+	hostname := flag.String("hostname", "", "With create, use this dns.hostname instead of the config's")
+	tags := flag.String("tags", "", "With create, add these comma-separated key=value tags to the stack and its resources, replacing tags of the same key")
+	noWrite := flag.Bool("no-write", false, "With create, keep the -instance-type, -ports, -hostname, -enable-ssm and -ipv6 values out of the config written back")
+	configStdin := flag.Bool("config-stdin", false, "With create, read the config from stdin and print the result instead of writing a file")
+	maxAttempts := flag.Int("max-attempts", ec2stack.DefaultMaxAttempts, "Attempts per AWS call before throttling or transient errors fail")
+	dnsOnly := flag.Bool("dns-only", false, "With delete, remove only the DNS records and keep the stack")
+	keepDNS := flag.Bool("keep-dns", false, "With delete, keep the DNS records")
+	waitDNS := flag.Bool("wait-dns", false, "After creating or deleting DNS records, wait until Route53 reports them in sync")
+	watchInterval := flag.Duration("watch-interval", time.Minute, "With watch, how often to check the instance's IP")
+	region := flag.String("region", "", "AWS region for list, delete-all and force-delete (default from AWS config)")
+	profile := flag.String("profile", "", "AWS shared config profile (default from AWS_PROFILE)")
+	assumeRole := flag.String("assume-role", "", "ARN of an IAM role to assume for all AWS calls")
+	externalID := flag.String("external-id", "", "External ID to pass when assuming -assume-role")
+	cfnRole := flag.String("cfn-role", "", "ARN of the service role CloudFormation uses to create and delete stacks (overrides cloudformation_role_arn)")
+	verbose := flag.Bool("v", false, "Verbose: also print debug detail such as the AMI, template size and Route53 changes")
+	quiet := flag.Bool("q", false, "Quiet: print only results, warnings and errors")
+	format := flag.String("format", "json", "Output format for show-config: json or toml")
+	outputTemplate := flag.String("template", "", "Go template printed instead of the config, for create or show-config (e.g. '{{.FQDN}} {{.PublicIP}}')")
+	logFormat := flag.String("log-format", "text", "Log format: text, or json for one JSON object per line on stderr")
+	jsonOut := flag.Bool("json", false, "Print the result, or the error, as one JSON object on stdout; progress goes to stderr")
 
 	flag.Usage = func() {
-		fmt.Fprintf(os.Stderr, "Usage: %s [options]\n\n", os.Args[0])
-		fmt.Fprintf(os.Stderr, "Options:\n")
+		fmt.Fprintf(os.Stderr, "Usage: %s [command] [options]\n\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "Commands:\n")
+		fmt.Fprintf(os.Stderr, "  create    Create a stack (same as -c)\n")
+		fmt.Fprintf(os.Stderr, "  delete    Delete a stack by name or stack ID (same as -d)\n")
+		fmt.Fprintf(os.Stderr, "  force-delete  Delete a stack by name without a config file\n")
+		fmt.Fprintf(os.Stderr, "  status    Show stack status and outputs\n")
+		fmt.Fprintf(os.Stderr, "  list      List stacks created by this tool\n")
+		fmt.Fprintf(os.Stderr, "  delete-all  Delete every stack created by this tool in the region\n")
+		fmt.Fprintf(os.Stderr, "  validate  Check configs offline, without calling AWS\n")
+		fmt.Fprintf(os.Stderr, "  show-config  Print the effective config after defaults and environment variables\n")
+		fmt.Fprintf(os.Stderr, "  clone     Copy a config to a new stack name, ready to create\n")
+		fmt.Fprintf(os.Stderr, "  stop      Stop a stack's instance, keeping its disk\n")
+		fmt.Fprintf(os.Stderr, "  start     Start a stopped instance and update its IP and DNS records\n")
+		fmt.Fprintf(os.Stderr, "  plan      Preview what the config would change in the deployed stack\n")
+		fmt.Fprintf(os.Stderr, "  watch     Keep the DNS records pointed at the instance as its IP changes\n")
+		fmt.Fprintf(os.Stderr, "  describe-instance  Show the instance's live state from EC2\n")
+		fmt.Fprintf(os.Stderr, "\nOptions:\n")
 		flag.PrintDefaults()
 		fmt.Fprintf(os.Stderr, "\nExamples:\n")
 		fmt.Fprintf(os.Stderr, "  %s -c -n mystack    Create stack using stacks/mystack.json\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "  %s -c               Create a stack with a generated name from stacks/default.json\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "  %s -c -n mystack -instance-type t3.large -ports 22,443 -no-write\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "  %s -c -n mystack -tags team=infra,ticket=OPS-123\n", os.Args[0])
 		fmt.Fprintf(os.Stderr, "  %s -d -n mystack    Delete stack 'mystack'\n", os.Args[0])
-		fmt.Fprintf(os.Stderr, "\nThe tool looks for stacks/<name>.json first, then treats name as a path.\n")
+		fmt.Fprintf(os.Stderr, "  %s -d -y -n mystack Delete without confirmation\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "  %s delete -n arn:aws:cloudformation:...    Delete a stack by ID\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "  %s force-delete -n mystack -region us-west-2\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "  %s status -n mystack\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "  %s describe-instance -n mystack\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "  %s plan -n mystack\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "  %s watch -n mystack -watch-interval 5m\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "  %s list -region us-west-2\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "  %s validate stacks/*.json\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "  %s show-config -n mystack -format toml\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "  %s clone mystack mystack2\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "\nThe tool looks for stacks/<name>.json (or .toml) first, then treats name as a path.\n")
 		fmt.Fprintf(os.Stderr, "\nConfig file format (stacks/mystack.json):\n")
 		fmt.Fprintf(os.Stderr, `  {
     "region": "us-east-1",
@@ -281,1940 +229,1594 @@ func main() {
 		fmt.Fprintf(os.Stderr, "\nSupported OS values:\n")
 		fmt.Fprintf(os.Stderr, "  amazon-linux-2023, amazon-linux-2, ubuntu-24.04, ubuntu-22.04,\n")
 		fmt.Fprintf(os.Stderr, "  ubuntu-20.04, debian-12, debian-11\n")
+		fmt.Fprintf(os.Stderr, "\nSupported os_family values (used when os is not set):\n")
+		fmt.Fprintf(os.Stderr, "  al2023, ubuntu, debian\n")
+	}
+
+	// A leading subcommand is equivalent to the matching flag
+	args := os.Args[1:]
+	command := ""
+	if len(args) > 0 && slices.Contains(commands, args[0]) {
+		command = args[0]
+		args = args[1:]
+	}
+	flag.CommandLine.Parse(args)
+	if *jsonOut {
+		jsonResult = &commandResult{Command: command}
+	}
+
+	// Progress goes through slog; -q and -v move the threshold
+	logLevel := slog.LevelInfo
+	if *verbose {
+		logLevel = slog.LevelDebug
+	}
+	if *quiet {
+		logLevel = slog.LevelWarn
+	}
+	switch *logFormat {
+	case "json":
+		slog.SetDefault(slog.New(slog.NewJSONHandler(os.Stderr, &slog.HandlerOptions{
+			Level:       logLevel,
+			ReplaceAttr: trimMessage,
+		})))
+	default:
+		// With -json, stdout is kept for the result
+		progress := os.Stdout
+		if *jsonOut {
+			progress = os.Stderr
+		}
+		handler := ec2stack.NewConsoleHandler(progress, os.Stderr, logLevel)
+		// Waits show a spinner on a terminal and periodic lines otherwise
+		if info, err := progress.Stat(); err == nil && info.Mode()&os.ModeCharDevice != 0 {
+			handler.EnableStatusLine()
+		}
+		slog.SetDefault(slog.New(handler))
+	}
+	if *logFormat != "text" && *logFormat != "json" {
+		fatalf("-log-format must be text or json, got %q", *logFormat)
+	}
+	if *verbose && *quiet {
+		fatalf("-v and -q cannot be combined")
+	}
+
+	selected := map[string]bool{
+		"create":            *createCmd || *createShort,
+		"delete":            *deleteCmd || *deleteShort,
+		"force-delete":      *forceDeleteCmd,
+		"status":            *statusCmd,
+		"list":              *listCmd,
+		"delete-all":        *deleteAllCmd,
+		"validate":          *validateCmd,
+		"show-config":       *showConfigCmd,
+		"clone":             *cloneCmd,
+		"stop":              *stopCmd,
+		"start":             *startCmd,
+		"plan":              *planCmd,
+		"watch":             *watchCmd,
+		"describe-instance": *describeInstanceCmd,
+	}
+	if command != "" {
+		selected[command] = true
+	}
+	var chosen []string
+	for _, c := range commands {
+		if selected[c] {
+			chosen = append(chosen, c)
+		}
+	}
+	if len(chosen) == 0 && jsonResult != nil {
+		fatalf("no command given")
+	}
+	if len(chosen) == 0 {
+		flag.Usage()
+		os.Exit(1)
 	}
-
-	flag.Parse()
-
-	doCreate := *createCmd || *createShort
-	doDelete := *deleteCmd || *deleteShort
-
-	name := *stackName
-	if *stackNameShort != "" {
-		name = *stackNameShort
+	if len(chosen) > 1 {
+		fatalf("cannot combine commands: %s", strings.Join(chosen, ", "))
 	}
-
-	// If no -n flag, check for positional argument (config file path)
-	if name == "" && flag.NArg() > 0 {
-		configPath := flag.Arg(0)
-		// Extract stack name from filename (remove path and .json extension)
-		name = strings.TrimSuffix(configPath, ".json")
-		if lastSlash := strings.LastIndex(name, "/"); lastSlash >= 0 {
-			name = name[lastSlash+1:]
+	command = chosen[0]
+	if jsonResult != nil {
+		jsonResult.Command = command
+		if !slices.Contains(jsonCommands, command) {
+			fatalf("-json is not supported by %s, only by %s", command, strings.Join(jsonCommands, ", "))
 		}
+		defer printJSONResult(nil)
 	}
 
-	if name == "" {
-		log.Fatal("Stack name required: use -n <name> or provide a config file path")
+	if *format != "json" && *format != "toml" {
+		fatalf("-format must be json or toml, got %q (use -template for a Go template)", *format)
+	}
+	if *format != "json" && command != "show-config" {
+		fatalf("-format can only be used with show-config")
 	}
 
-	if !doCreate && !doDelete {
-		flag.Usage()
-		os.Exit(1)
+	// validate never touches AWS, so it runs before any client setup
+	if command == "validate" {
+		names := flag.Args()
+		if *stackNameShort != "" {
+			names = append([]string{*stackNameShort}, names...)
+		}
+		if *stackName != "" {
+			names = append([]string{*stackName}, names...)
+		}
+		if len(names) == 0 {
+			fatalf("validate needs a config: use -n <name> or list config files")
+		}
+		exitOnError(validateConfigs(names))
+		return
+	}
+	if command == "show-config" {
+		name := *stackName
+		if name == "" {
+			name = *stackNameShort
+		}
+		if name == "" && flag.NArg() == 1 {
+			name = flag.Arg(0)
+		}
+		if name == "" {
+			fatalf("show-config needs a config: use -n <name>")
+		}
+		var tmpl *template.Template
+		if *outputTemplate != "" {
+			if *format != "json" {
+				fatalf("-template cannot be combined with -format")
+			}
+			tmpl = parseOutputTemplate(*outputTemplate)
+		}
+		exitOnError(showConfig(name, *format == "toml", tmpl))
+		return
 	}
 
-	if doCreate && doDelete {
-		log.Fatal("Cannot specify both --create and --delete")
+	if command == "clone" {
+		names := flag.Args()
+		if *stackNameShort != "" {
+			names = append([]string{*stackNameShort}, names...)
+		}
+		if *stackName != "" {
+			names = append([]string{*stackName}, names...)
+		}
+		if len(names) != 2 {
+			fatalf("clone needs a source and a new name: clone <name> <new-name>")
+		}
+		exitOnError(cloneConfig(names[0], names[1], *force))
+		return
 	}
 
-	if doCreate {
-		createStackNested(name)
-	} else if doDelete {
-		deleteStackNested(name)
+	// Cancel in-flight AWS calls and waiters on Ctrl-C or termination
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	client := ec2stack.NewClient()
+	client.ForceDNS = *forceDNS
+	client.SkipKeyCheck = *skipKeyCheck
+	client.SkipPermissionCheck = *skipPermissionCheck
+	client.NoAMICache = *noCache
+	client.NoZoneCache = *noCache
+	client.Force = *force
+	client.KeepDNS = *keepDNS
+	client.WaitDNS = *waitDNS
+	if *dnsOnly && *keepDNS {
+		fatalf("-dns-only and -keep-dns cannot be combined")
 	}
-}
+	if *maxAttempts < 1 {
+		fatalf("-max-attempts must be at least 1")
+	}
+	client.MaxAttempts = *maxAttempts
+	if *since < 0 {
+		fatalf("-since cannot be negative")
+	}
+	if *since > 0 {
+		client.EventsSince = time.Now().Add(-*since)
+	}
+	if *externalID != "" && *assumeRole == "" {
+		fatalf("-external-id requires -assume-role")
+	}
+	client.Profile = *profile
+	client.AssumeRoleARN = *assumeRole
+	client.ExternalID = *externalID
+	if *cfnRole != "" && !ec2stack.IsRoleARN(*cfnRole) {
+		fatalf("invalid -cfn-role %q (expected arn:aws:iam::<account>:role/<name>)", *cfnRole)
+	}
+	client.CloudFormationRoleARN = *cfnRole
 
-func resolveConfigPath(stackName string) string {
-	// First, check if ./stacks/<stackName>.json exists
-	stacksPath := fmt.Sprintf("stacks/%s.json", stackName)
-	if _, err := os.Stat(stacksPath); err == nil {
-		return stacksPath
+	skipConfirm := *yes || *yesShort
+	if jsonResult != nil && command == "delete" && !skipConfirm {
+		fatalf("delete with -json needs -yes: the prompt cannot share stdout with the result")
 	}
 
-	// Otherwise, treat stackName as a path (with or without .json)
-	if strings.HasSuffix(stackName, ".json") {
-		return stackName
+	switch command {
+	case "list", "delete-all":
+		// These work without a config, so no aws_profile applies
+		if *assumeRole != "" {
+			exitOnError(checkAssumedRole(ctx, client, *region))
+		}
+	}
+	switch command {
+	case "list":
+		exitOnError(listStacks(ctx, client, *region))
+		return
+	case "delete-all":
+		exitOnError(deleteAllStacks(ctx, client, *region, skipConfirm))
+		return
 	}
-	return fmt.Sprintf("%s.json", stackName)
-}
 
-func readConfig(stackName string) (*StackConfig, string, error) {
-	filename := resolveConfigPath(stackName)
-	data, err := os.ReadFile(filename)
-	if err != nil {
-		return nil, filename, fmt.Errorf("failed to read config file %s: %w", filename, err)
+	name := *stackName
+	if *stackNameShort != "" {
+		name = *stackNameShort
 	}
 
-	var cfg StackConfig
-	if err := json.Unmarshal(data, &cfg); err != nil {
-		return nil, filename, fmt.Errorf("failed to parse config file: %w", err)
+	// If no -n flag, check for positional argument (config file path or stack ID)
+	if name == "" && flag.NArg() > 0 {
+		name = flag.Arg(0)
+		if !ec2stack.IsStackID(name) {
+			// Extract stack name from filename (remove path and .json/.toml extension)
+			name = strings.TrimSuffix(strings.TrimSuffix(name, ".json"), ".toml")
+			if lastSlash := strings.LastIndex(name, "/"); lastSlash >= 0 {
+				name = name[lastSlash+1:]
+			}
+		}
 	}
 
-	// Set defaults
-	if cfg.InstanceType == "" {
-		cfg.InstanceType = "t3.micro"
+	var tmpl *template.Template
+	if *outputTemplate != "" {
+		if command != "create" {
+			fatalf("-template can only be used with create and show-config")
+		}
+		if jsonResult != nil {
+			fatalf("-template cannot be combined with -json")
+		}
+		tmpl = parseOutputTemplate(*outputTemplate)
 	}
-	if cfg.TTL == 0 {
-		cfg.TTL = 300
+	if *tags != "" {
+		if command != "create" {
+			fatalf("-tags can only be used with create")
+		}
+		extra, err := ec2stack.ParseTags(splitList(*tags))
+		exitOnError(err)
+		client.Tags = extra
+	}
+	if *configStdin && command != "create" {
+		fatalf("-config-stdin can only be used with create")
 	}
-	if cfg.Region == "" {
-		cfg.Region = "us-east-1"
+	if *configStdin && name == "" {
+		fatalf("-config-stdin requires a stack name: use -n <name>")
 	}
-	if cfg.OS == "" {
-		cfg.OS = "amazon-linux-2023"
+
+	// A create without a name gets a generated one and its own copy of the
+	// default config
+	if name == "" && command == "create" {
+		var err error
+		name, err = newGeneratedStack()
+		exitOnError(err)
 	}
 
-	return &cfg, filename, nil
+	if name == "" {
+		fatalf("stack name required: use -n <name> or provide a config file path")
+	}
+	if jsonResult != nil {
+		jsonResult.Name = name
+	}
+
+	// A stack's config can name the profile for its account; -profile wins.
+	// A config on stdin is read, and its profile applied, by createStack.
+	profileChecked := false
+	if *profile == "" && !*configStdin && !ec2stack.IsStackID(name) {
+		if cfg, _, err := ec2stack.ReadConfig(name); err == nil {
+			exitOnError(useConfigProfile(ctx, client, cfg))
+			profileChecked = cfg.AWSProfile != ""
+		}
+	}
+	// The role is assumed with the profile in use, so it is checked once
+	// that is known. useConfigProfile has already shown the identity.
+	if *assumeRole != "" && !profileChecked && !*configStdin {
+		exitOnError(checkAssumedRole(ctx, client, *region))
+	}
+
+	var err error
+	switch command {
+	case "create":
+		err = createStack(ctx, client, name, createOptions{
+			waitSSH:     *waitSSH,
+			sshConfig:   *sshConfig,
+			knownHosts:  *knownHosts,
+			envOut:      *envOut,
+			eventsOut:   *eventsOut,
+			resultOut:   *resultOut,
+			configStdin: *configStdin,
+			template:    tmpl,
+			overrides: configOverrides{
+				enableSSM:    *enableSSM,
+				ipv6:         *ipv6,
+				instanceType: *instanceType,
+				ports:        splitList(*ports),
+				hostname:     *hostname,
+				noWrite:      *noWrite,
+			},
+		})
+	case "delete":
+		if !skipConfirm {
+			err = confirmDelete(name)
+		}
+		if err == nil && *dnsOnly {
+			err = client.DeleteDNS(ctx, name)
+			break
+		}
+		if err == nil {
+			// Read the members and outputs before the delete clears them
+			// from the config
+			hosts := []string{name}
+			ids := []string{name}
+			var deleted *ec2stack.Config
+			if !ec2stack.IsStackID(name) {
+				ids = nil
+				if cfg, _, rerr := ec2stack.ReadConfig(name); rerr == nil {
+					deleted = cfg
+				}
+				if deleted != nil && deleted.VM != nil {
+					for _, inst := range deleted.VM.Instances {
+						hosts = append(hosts, inst.StackName)
+					}
+					ids = stackIDs(deleted)
+				}
+			}
+			started := time.Now()
+			err = client.DeleteStack(ctx, name)
+			if *eventsOut != "" {
+				writeEventsFile(ctx, client, *eventsOut, ids, eventsFrom(client, started))
+			}
+			if err == nil {
+				for _, host := range hosts {
+					removeSSHConfigEntry(host)
+				}
+				if deleted != nil && deleted.PostDeleteCommand != "" {
+					runPostDeleteCommand(ctx, name, deleted)
+				}
+			}
+		}
+	case "force-delete":
+		if !skipConfirm {
+			err = confirmDelete(name)
+		}
+		if err == nil {
+			err = client.ForceDeleteStack(ctx, name, *region)
+			if err == nil {
+				removeSSHConfigEntry(name)
+			}
+		}
+	case "status":
+		err = showStackStatus(ctx, client, name)
+	case "stop":
+		err = client.StopStack(ctx, name)
+		recordStack(name)
+	case "start":
+		err = client.StartStack(ctx, name)
+		recordStack(name)
+	case "plan":
+		err = planStack(ctx, client, name)
+	case "watch":
+		err = client.WatchStack(ctx, name, *watchInterval)
+	case "describe-instance":
+		err = describeInstances(ctx, client, name)
+	}
+	exitOnError(err)
 }
 
-func writeConfig(filename string, cfg *StackConfig) error {
-	data, err := json.MarshalIndent(cfg, "", "  ")
-	if err != nil {
-		return fmt.Errorf("failed to marshal config: %w", err)
+// trimMessage drops the blank lines console messages use for spacing
+func trimMessage(groups []string, a slog.Attr) slog.Attr {
+	if len(groups) == 0 && a.Key == slog.MessageKey {
+		a.Value = slog.StringValue(strings.TrimSpace(a.Value.String()))
 	}
-	return os.WriteFile(filename, data, 0644)
+	return a
 }
 
-func readNestedConfig(stackName string) (*Config, string, error) {
-	filename := resolveConfigPath(stackName)
-	data, err := os.ReadFile(filename)
-	if err != nil {
-		return nil, filename, fmt.Errorf("failed to read config file %s: %w", filename, err)
-	}
+// infof prints a progress line, hidden by -q
+func infof(format string, args ...any) {
+	slog.Info(fmt.Sprintf(format, args...))
+}
 
-	// Try nested format first
-	var config Config
-	if err := json.Unmarshal(data, &config); err == nil {
-		if config.VM != nil || config.DNS != nil {
-			// Apply defaults
-			applyConfigDefaults(&config)
-			return &config, filename, nil
-		}
-	}
+// warnf prints a warning, shown even with -q
+func warnf(format string, args ...any) {
+	slog.Warn(fmt.Sprintf(format, args...))
+}
 
-	// Fall back to flat format for backward compatibility
-	var flatConfig StackConfig
-	if err := json.Unmarshal(data, &flatConfig); err != nil {
-		return nil, filename, fmt.Errorf("failed to parse config file: %w", err)
+// fatalf prints an error and exits with status 1. With -json the error
+// goes into the result instead.
+func fatalf(format string, args ...any) {
+	if jsonResult != nil {
+		printJSONResult(errors.New(fmt.Sprintf(format, args...)))
+	} else {
+		slog.Error(fmt.Sprintf(format, args...))
 	}
+	os.Exit(1)
+}
 
-	fmt.Println("Note: Using legacy flat config format (still supported)")
-	config = *convertFlatToNested(&flatConfig)
-	applyConfigDefaults(&config)
-	return &config, filename, nil
+// exitOnError logs err and exits with the matching exit code. With -json
+// the error goes into the result instead.
+func exitOnError(err error) {
+	if err == nil {
+		return
+	}
+	if jsonResult != nil {
+		printJSONResult(err)
+	} else {
+		slog.Error(err.Error())
+	}
+	os.Exit(exitCode(err))
 }
 
-func writeNestedConfig(filename string, config *Config) error {
-	data, err := json.MarshalIndent(config, "", "  ")
-	if err != nil {
-		return fmt.Errorf("failed to marshal config: %w", err)
+// printf prints a line of command output on stdout, or as a progress line
+// with -json, where stdout holds only the result
+func printf(format string, args ...any) {
+	if jsonResult != nil {
+		infof(format, args...)
+		return
 	}
-	return os.WriteFile(filename, data, 0644)
+	fmt.Printf(format+"\n", args...)
 }
 
-func convertFlatToNested(flat *StackConfig) *Config {
-	config := &Config{}
-
-	// Determine if we have VM configuration
-	hasVM := len(flat.Users) > 0 || flat.GitHubUsername != "" || flat.InstanceType != ""
-
-	// Create VM section if we have VM-related fields
-	if hasVM {
-		config.VM = &VMConfig{
-			Region:                flat.Region,
-			OS:                    flat.OS,
-			InstanceType:          flat.InstanceType,
-			CloudInitFile:         flat.CloudInitFile,
-			WorkingDir:            flat.WorkingDir,
-			Packages:              flat.Packages,
-			Users:                 flat.Users,
-			VpcID:                 flat.VpcID,
-			SubnetID:              flat.SubnetID,
-			StackName:             flat.StackName,
-			StackID:               flat.StackID,
-			InstanceID:            flat.InstanceID,
-			PublicIP:              flat.PublicIP,
-			SecurityGroup:         flat.SecurityGroup,
-			AMIID:                 flat.AMIID,
-			CreatedVPC:            flat.CreatedVPC,
-			CreatedSubnet:         flat.CreatedSubnet,
-			InternetGatewayID:     flat.InternetGatewayID,
-			RouteTableID:          flat.RouteTableID,
-			RouteTableAssociation: flat.RouteTableAssociation,
-		}
-
-		// Handle legacy github_username field
-		if flat.GitHubUsername != "" && len(flat.Users) == 0 {
-			config.VM.Users = []User{{Username: flat.GitHubUsername, GitHubUsername: flat.GitHubUsername}}
-		}
-	}
-
-	// Create DNS section if we have DNS-related fields
-	if flat.Domain != "" {
-		config.DNS = &DNSConfig{
-			Hostname:     flat.Hostname,
-			Domain:       flat.Domain,
-			TTL:          flat.TTL,
-			IsApexDomain: flat.IsApexDomain,
-			CNAMEAliases: flat.CNAMEAliases,
-			TargetIP:     flat.PublicIP, // Use PublicIP from VM if present
-			ZoneID:       flat.ZoneID,
-			FQDN:         flat.FQDN,
-			DNSRecords:   flat.DNSRecords,
-		}
-	}
-
-	return config
+// recordStack puts the stack's config, as the command left it, in the
+// -json result
+func recordStack(stackName string) {
+	if jsonResult == nil {
+		return
+	}
+	if cfg, _, err := ec2stack.ReadConfig(stackName); err == nil {
+		jsonResult.Stack = cfg
+	}
 }
 
-func applyConfigDefaults(config *Config) {
-	if config.VM != nil {
-		if config.VM.Region == "" {
-			config.VM.Region = "us-east-1"
+// confirmDelete shows what is about to be deleted and asks the user to type
+// the stack name or y. It refuses when stdin is not a terminal.
+func confirmDelete(stackName string) error {
+	fmt.Printf("About to delete stack: %s\n", stackName)
+	if cfg, _, err := ec2stack.ReadConfig(stackName); err == nil {
+		if cfg.VM != nil && cfg.VM.InstanceID != "" {
+			fmt.Printf("  Instance: %s\n", cfg.VM.InstanceID)
 		}
-		if config.VM.OS == "" {
-			config.VM.OS = "ubuntu-22.04"
-		}
-		if config.VM.InstanceType == "" {
-			config.VM.InstanceType = "t3.micro"
+		if cfg.DNS != nil && cfg.DNS.FQDN != "" {
+			fmt.Printf("  FQDN:     %s (DNS records will be removed)\n", cfg.DNS.FQDN)
 		}
 	}
 
-	if config.DNS != nil {
-		if config.DNS.TTL == 0 {
-			config.DNS.TTL = 300
-		}
-	}
+	return confirm("Type the stack name or 'y' to confirm: ", stackName, "y")
 }
 
-func lookupAMI(ctx context.Context, ssmClient *ssm.Client, osName string) (string, error) {
-	ssmPath, ok := osSSMPaths[osName]
-	if !ok {
-		var supported []string
-		for k := range osSSMPaths {
-			supported = append(supported, k)
-		}
-		return "", fmt.Errorf("unsupported OS %q, supported: %v", osName, supported)
+// confirm prompts on stdin and succeeds only if the answer is one of
+// accepted. It refuses when stdin is not a terminal.
+func confirm(prompt string, accepted ...string) error {
+	info, err := os.Stdin.Stat()
+	if err != nil || info.Mode()&os.ModeCharDevice == 0 {
+		return usageErrorf("refusing to delete without confirmation: stdin is not a terminal (use -yes)")
 	}
 
-	result, err := ssmClient.GetParameter(ctx, &ssm.GetParameterInput{
-		Name: aws.String(ssmPath),
-	})
-	if err != nil {
-		return "", fmt.Errorf("failed to lookup AMI for %s: %w", osName, err)
+	fmt.Print(prompt)
+	answer, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && answer == "" {
+		return fmt.Errorf("failed to read confirmation: %w", err)
 	}
-
-	return *result.Parameter.Value, nil
+	if !slices.Contains(accepted, strings.TrimSpace(answer)) {
+		return usageErrorf("delete cancelled")
+	}
+	return nil
 }
 
-func discoverVPC(ctx context.Context, ec2Client *ec2.Client) (string, error) {
-	// First try to find the default VPC
-	result, err := ec2Client.DescribeVpcs(ctx, &ec2.DescribeVpcsInput{
-		Filters: []ec2types.Filter{
-			{
-				Name:   aws.String("is-default"),
-				Values: []string{"true"},
-			},
-		},
-	})
+// deleteAllWorkers bounds how many stacks delete-all removes at once
+const deleteAllWorkers = 4
+
+// deleteAllStacks deletes every stack tagged Purpose=EC2Instance in the
+// region. Stacks with a local config are deleted by name so their DNS
+// records and network resources are cleaned up too; the rest by stack ID.
+func deleteAllStacks(ctx context.Context, client *ec2stack.Client, region string, skipConfirm bool) error {
+	stacks, region, err := client.ListStacks(ctx, region)
 	if err != nil {
-		return "", fmt.Errorf("failed to describe VPCs: %w", err)
+		return err
 	}
-
-	if len(result.Vpcs) > 0 {
-		return *result.Vpcs[0].VpcId, nil
+	if len(stacks) == 0 {
+		fmt.Printf("No stacks to delete in %s\n", region)
+		return nil
 	}
 
-	// No default VPC, get any available VPC
-	result, err = ec2Client.DescribeVpcs(ctx, &ec2.DescribeVpcsInput{})
-	if err != nil {
-		return "", fmt.Errorf("failed to describe VPCs: %w", err)
+	fmt.Printf("About to delete %d stack(s) in %s:\n", len(stacks), region)
+	for _, stack := range stacks {
+		fmt.Printf("  %-30s %s\n", aws.ToString(stack.StackName), stack.StackStatus)
 	}
-
-	if len(result.Vpcs) == 0 {
-		return "", nil
+	if !skipConfirm {
+		if err := confirm("Type 'delete all' to confirm: ", "delete all"); err != nil {
+			return err
+		}
 	}
 
-	return *result.Vpcs[0].VpcId, nil
-}
+	type result struct {
+		name string
+		err  error
+	}
+	jobs := make(chan types.Stack)
+	results := make(chan result)
+	var wg sync.WaitGroup
+	for range deleteAllWorkers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for stack := range jobs {
+				name := aws.ToString(stack.StackName)
+				target := aws.ToString(stack.StackId)
+				cfg, _, err := ec2stack.ReadConfig(name)
+				if err == nil && cfg.VM != nil && cfg.VM.StackName == name {
+					target = name
+				}
+				err = client.DeleteStack(ctx, target)
+				if err == nil {
+					removeSSHConfigEntry(name)
+					if target == name && cfg.PostDeleteCommand != "" {
+						runPostDeleteCommand(ctx, name, cfg)
+					}
+				}
+				results <- result{name, err}
+			}
+		}()
+	}
+	go func() {
+		for _, stack := range stacks {
+			jobs <- stack
+		}
+		close(jobs)
+		wg.Wait()
+		close(results)
+	}()
+
+	var failures []error
+	var summary []string
+	for r := range results {
+		if r.err != nil {
+			failures = append(failures, fmt.Errorf("%s: %w", r.name, r.err))
+			summary = append(summary, fmt.Sprintf("  %-30s FAILED: %v", r.name, r.err))
+		} else {
+			summary = append(summary, fmt.Sprintf("  %-30s deleted", r.name))
+		}
+	}
+	slices.Sort(summary)
 
-func discoverSubnet(ctx context.Context, ec2Client *ec2.Client, vpcID string) (string, error) {
-	// Find a public subnet (one that has MapPublicIpOnLaunch enabled or has a route to IGW)
-	result, err := ec2Client.DescribeSubnets(ctx, &ec2.DescribeSubnetsInput{
-		Filters: []ec2types.Filter{
-			{
-				Name:   aws.String("vpc-id"),
-				Values: []string{vpcID},
-			},
-		},
-	})
-	if err != nil {
-		return "", fmt.Errorf("failed to describe subnets: %w", err)
+	fmt.Println("\n=== Delete All Summary ===")
+	for _, line := range summary {
+		fmt.Println(line)
 	}
+	if len(failures) > 0 {
+		return fmt.Errorf("%d of %d stacks failed to delete: %w", len(failures), len(stacks), errors.Join(failures...))
+	}
+	return nil
+}
 
-	if len(result.Subnets) == 0 {
-		return "", nil
+// writeEnvFile writes the stack outputs as export statements for a shell
+func writeEnvFile(path, stackName string, cfg *ec2stack.Config) error {
+	var b strings.Builder
+	for _, v := range stackEnv(stackName, cfg) {
+		fmt.Fprintf(&b, "export %s=%s\n", v[0], shellQuote(v[1]))
 	}
+	return os.WriteFile(path, []byte(b.String()), 0644)
+}
 
-	// Prefer subnets that auto-assign public IPs
-	for _, subnet := range result.Subnets {
-		if subnet.MapPublicIpOnLaunch != nil && *subnet.MapPublicIpOnLaunch {
-			return *subnet.SubnetId, nil
+// stackEnv returns the stack outputs as environment variable names and
+// values
+func stackEnv(stackName string, cfg *ec2stack.Config) [][2]string {
+	vars := [][2]string{{"STACK_NAME", stackName}}
+	if cfg.VM != nil {
+		vars = append(vars,
+			[2]string{"STACK_ID", cfg.VM.StackID},
+			[2]string{"REGION", cfg.VM.Region},
+			[2]string{"INSTANCE_ID", cfg.VM.InstanceID},
+			[2]string{"PUBLIC_IP", cfg.VM.PublicIP},
+			[2]string{"PUBLIC_DNS_NAME", cfg.VM.PublicDNSName},
+			[2]string{"PRIVATE_IP", cfg.VM.PrivateIP},
+		)
+		if len(cfg.VM.Users) > 0 {
+			vars = append(vars, [2]string{"SSH_USER", cfg.VM.Users[0].Username})
+		}
+		vars = append(vars, [2]string{"SSH_PORT", strconv.Itoa(cfg.VM.SSHPortNumber())})
+		if len(cfg.VM.Instances) > 0 {
+			// Space-separated lists, one entry per member in order
+			var names, regions, ids, publicIPs, privateIPs, fqdns []string
+			for _, inst := range cfg.VM.Instances {
+				names = append(names, inst.StackName)
+				regions = append(regions, inst.Region)
+				ids = append(ids, inst.InstanceID)
+				publicIPs = append(publicIPs, inst.PublicIP)
+				privateIPs = append(privateIPs, inst.PrivateIP)
+				if inst.DNS != nil && inst.DNS.FQDN != "" {
+					fqdns = append(fqdns, inst.DNS.FQDN)
+				}
+			}
+			vars = append(vars,
+				[2]string{"STACK_NAMES", strings.Join(names, " ")},
+				[2]string{"INSTANCE_IDS", strings.Join(ids, " ")},
+				[2]string{"PUBLIC_IPS", strings.Join(publicIPs, " ")},
+				[2]string{"PRIVATE_IPS", strings.Join(privateIPs, " ")},
+				[2]string{"FQDNS", strings.Join(fqdns, " ")},
+			)
+			if len(cfg.VM.Regions) > 0 {
+				vars = append(vars, [2]string{"REGIONS", strings.Join(regions, " ")})
+			}
 		}
 	}
+	if cfg.DNS != nil {
+		vars = append(vars, [2]string{"FQDN", cfg.DNS.FQDN})
+	}
+	return vars
+}
 
-	// Fall back to first subnet
-	return *result.Subnets[0].SubnetId, nil
+// runPostDeleteCommand runs the config's post_delete_command through the
+// local shell, with the outputs the deleted stack had in its environment.
+// A failing command is only warned about: the stack is already gone.
+func runPostDeleteCommand(ctx context.Context, stackName string, cfg *ec2stack.Config) {
+	infof("Running post_delete_command...")
+	cmd := exec.CommandContext(ctx, "sh", "-c", cfg.PostDeleteCommand)
+	cmd.Stdout = os.Stdout
+	if jsonResult != nil {
+		cmd.Stdout = os.Stderr
+	}
+	cmd.Stderr = os.Stderr
+	cmd.Env = os.Environ()
+	for _, v := range stackEnv(stackName, cfg) {
+		cmd.Env = append(cmd.Env, v[0]+"="+v[1])
+	}
+	if err := cmd.Run(); err != nil {
+		warnf("post_delete_command failed: %v", err)
+		return
+	}
+	infof("post_delete_command exited with status 0")
 }
 
-type NetworkStack struct {
-	VpcID                 string
-	SubnetID              string
-	InternetGatewayID     string
-	RouteTableID          string
-	RouteTableAssociation string
+// shellQuote wraps s in single quotes so the shell takes it literally
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
 }
 
-func createNetworkStack(ctx context.Context, ec2Client *ec2.Client, stackName string) (*NetworkStack, error) {
-	fmt.Println("Creating new VPC and network infrastructure...")
-
-	result := &NetworkStack{}
-
-	// Create VPC
-	vpcOutput, err := ec2Client.CreateVpc(ctx, &ec2.CreateVpcInput{
-		CidrBlock: aws.String("10.0.0.0/16"),
-		TagSpecifications: []ec2types.TagSpecification{
-			{
-				ResourceType: ec2types.ResourceTypeVpc,
-				Tags: []ec2types.Tag{
-					{Key: aws.String("Name"), Value: aws.String(fmt.Sprintf("%s-vpc", stackName))},
-					{Key: aws.String("ManagedBy"), Value: aws.String("aws-ec2-tool")},
-				},
-			},
-		},
-	})
-	if err != nil {
-		return nil, fmt.Errorf("failed to create VPC: %w", err)
+// printCostEstimate prints the rough on-demand cost of the instance, or of
+// all of them for a count config, with printf
+func printCostEstimate(vm *ec2stack.VMConfig, printf func(format string, args ...any)) {
+	instanceType := vm.EffectiveInstanceType()
+	if instanceType == "" {
+		printf("Estimated cost: unavailable, the instance type comes from the launch template")
+		return
 	}
-	result.VpcID = *vpcOutput.Vpc.VpcId
-	fmt.Printf("  Created VPC: %s\n", result.VpcID)
+	cost, ok := ec2stack.EstimateCost(instanceType)
+	if !ok {
+		printf("Estimated cost: cost unavailable for %s", instanceType)
+		return
+	}
+	note := "on-demand"
+	if vm.Region != cost.PriceRegion {
+		note = fmt.Sprintf("on-demand %s price, %s may differ", cost.PriceRegion, vm.Region)
+	}
+	if n := len(vm.Regions); n > 0 {
+		note = fmt.Sprintf("%d instances, on-demand %s price, regional prices may differ", n, cost.PriceRegion)
+		cost.Hourly *= float64(n)
+		cost.Monthly *= float64(n)
+	} else if vm.Count > 1 {
+		note = fmt.Sprintf("%d instances, %s", vm.Count, note)
+		cost.Hourly *= float64(vm.Count)
+		cost.Monthly *= float64(vm.Count)
+	}
+	printf("Estimated cost: $%.4f/hour, ~$%.2f/month (%s)", cost.Hourly, cost.Monthly, note)
+}
 
-	// Wait for VPC to be available
-	vpcWaiter := ec2.NewVpcAvailableWaiter(ec2Client)
-	err = vpcWaiter.Wait(ctx, &ec2.DescribeVpcsInput{
-		VpcIds: []string{result.VpcID},
-	}, 2*time.Minute)
+// removeSSHConfigEntry drops the Host block -ssh-config wrote for the stack
+func removeSSHConfigEntry(stackName string) {
+	removed, err := ec2stack.RemoveSSHConfigEntry(stackName)
 	if err != nil {
-		return result, fmt.Errorf("VPC not available: %w", err)
+		warnf("failed to update SSH config: %v", err)
+	} else if removed {
+		infof("Removed Host %s from SSH config", stackName)
 	}
+}
 
-	// Enable DNS hostnames on VPC
-	_, err = ec2Client.ModifyVpcAttribute(ctx, &ec2.ModifyVpcAttributeInput{
-		VpcId:              aws.String(result.VpcID),
-		EnableDnsHostnames: &ec2types.AttributeBooleanValue{Value: aws.Bool(true)},
-	})
-	if err != nil {
-		return result, fmt.Errorf("failed to enable DNS hostnames: %w", err)
-	}
-
-	// Create Internet Gateway
-	igwOutput, err := ec2Client.CreateInternetGateway(ctx, &ec2.CreateInternetGatewayInput{
-		TagSpecifications: []ec2types.TagSpecification{
-			{
-				ResourceType: ec2types.ResourceTypeInternetGateway,
-				Tags: []ec2types.Tag{
-					{Key: aws.String("Name"), Value: aws.String(fmt.Sprintf("%s-igw", stackName))},
-					{Key: aws.String("ManagedBy"), Value: aws.String("aws-ec2-tool")},
-				},
-			},
-		},
-	})
-	if err != nil {
-		return result, fmt.Errorf("failed to create Internet Gateway: %w", err)
-	}
-	result.InternetGatewayID = *igwOutput.InternetGateway.InternetGatewayId
-	fmt.Printf("  Created Internet Gateway: %s\n", result.InternetGatewayID)
+// sshHost is an instance to connect to and the SSH config alias for it.
+// jump is the bastion to reach it through, if any.
+type sshHost struct {
+	name       string
+	target     string
+	ip         string
+	instanceID string
+	jump       string
+	port       int
+}
 
-	// Attach Internet Gateway to VPC
-	_, err = ec2Client.AttachInternetGateway(ctx, &ec2.AttachInternetGatewayInput{
-		InternetGatewayId: aws.String(result.InternetGatewayID),
-		VpcId:             aws.String(result.VpcID),
-	})
-	if err != nil {
-		return result, fmt.Errorf("failed to attach Internet Gateway: %w", err)
+// sshHosts returns the instance of a single stack, or every member of a
+// count config, addressed by FQDN when there is one and by private IP when
+// there is no public IP. An instance without a public IP is reached
+// through the bastion when the config names one.
+func sshHosts(stackName string, cfg *ec2stack.Config) []sshHost {
+	port := cfg.VM.SSHPortNumber()
+	host := func(name, publicIP, privateIP, instanceID string, dns *ec2stack.DNSConfig) sshHost {
+		if publicIP == "" && cfg.VM.BastionHost != "" {
+			return sshHost{name, privateIP, privateIP, instanceID, cfg.VM.ProxyJump(), port}
+		}
+		target := publicIP
+		if target == "" {
+			target = privateIP
+		}
+		ip := target
+		if dns != nil && dns.FQDN != "" {
+			target = dns.FQDN
+		}
+		return sshHost{name, target, ip, instanceID, "", port}
 	}
-	fmt.Println("  Attached Internet Gateway to VPC")
 
-	// Get availability zones
-	azOutput, err := ec2Client.DescribeAvailabilityZones(ctx, &ec2.DescribeAvailabilityZonesInput{
-		Filters: []ec2types.Filter{
-			{
-				Name:   aws.String("state"),
-				Values: []string{"available"},
-			},
-		},
-	})
-	if err != nil {
-		return result, fmt.Errorf("failed to get availability zones: %w", err)
-	}
-	if len(azOutput.AvailabilityZones) == 0 {
-		return result, fmt.Errorf("no availability zones found")
-	}
-	az := *azOutput.AvailabilityZones[0].ZoneName
-
-	// Create public subnet
-	subnetOutput, err := ec2Client.CreateSubnet(ctx, &ec2.CreateSubnetInput{
-		VpcId:            aws.String(result.VpcID),
-		CidrBlock:        aws.String("10.0.1.0/24"),
-		AvailabilityZone: aws.String(az),
-		TagSpecifications: []ec2types.TagSpecification{
-			{
-				ResourceType: ec2types.ResourceTypeSubnet,
-				Tags: []ec2types.Tag{
-					{Key: aws.String("Name"), Value: aws.String(fmt.Sprintf("%s-public-subnet", stackName))},
-					{Key: aws.String("ManagedBy"), Value: aws.String("aws-ec2-tool")},
-				},
-			},
-		},
-	})
-	if err != nil {
-		return result, fmt.Errorf("failed to create subnet: %w", err)
+	if len(cfg.VM.Instances) == 0 {
+		return []sshHost{host(stackName, cfg.VM.PublicIP, cfg.VM.PrivateIP, cfg.VM.InstanceID, cfg.DNS)}
+	}
+	var hosts []sshHost
+	for _, inst := range cfg.VM.Instances {
+		hosts = append(hosts, host(inst.StackName, inst.PublicIP, inst.PrivateIP, inst.InstanceID, inst.DNS))
 	}
-	result.SubnetID = *subnetOutput.Subnet.SubnetId
-	fmt.Printf("  Created Subnet: %s in %s\n", result.SubnetID, az)
+	return hosts
+}
 
-	// Enable auto-assign public IP on subnet
-	_, err = ec2Client.ModifySubnetAttribute(ctx, &ec2.ModifySubnetAttributeInput{
-		SubnetId:            aws.String(result.SubnetID),
-		MapPublicIpOnLaunch: &ec2types.AttributeBooleanValue{Value: aws.Bool(true)},
-	})
-	if err != nil {
-		return result, fmt.Errorf("failed to enable auto-assign public IP: %w", err)
-	}
-
-	// Create route table
-	rtOutput, err := ec2Client.CreateRouteTable(ctx, &ec2.CreateRouteTableInput{
-		VpcId: aws.String(result.VpcID),
-		TagSpecifications: []ec2types.TagSpecification{
-			{
-				ResourceType: ec2types.ResourceTypeRouteTable,
-				Tags: []ec2types.Tag{
-					{Key: aws.String("Name"), Value: aws.String(fmt.Sprintf("%s-public-rt", stackName))},
-					{Key: aws.String("ManagedBy"), Value: aws.String("aws-ec2-tool")},
-				},
-			},
-		},
-	})
-	if err != nil {
-		return result, fmt.Errorf("failed to create route table: %w", err)
+// sshCommand returns the command that logs in to the host as user
+func (h sshHost) sshCommand(user string) string {
+	cmd := "ssh"
+	if h.jump != "" {
+		cmd += " -J " + h.jump
+	}
+	if h.port != 22 {
+		cmd += fmt.Sprintf(" -p %d", h.port)
 	}
-	result.RouteTableID = *rtOutput.RouteTable.RouteTableId
-	fmt.Printf("  Created Route Table: %s\n", result.RouteTableID)
+	return fmt.Sprintf("%s %s@%s", cmd, user, h.target)
+}
 
-	// Add default route to Internet Gateway
-	_, err = ec2Client.CreateRoute(ctx, &ec2.CreateRouteInput{
-		RouteTableId:         aws.String(result.RouteTableID),
-		DestinationCidrBlock: aws.String("0.0.0.0/0"),
-		GatewayId:            aws.String(result.InternetGatewayID),
-	})
-	if err != nil {
-		return result, fmt.Errorf("failed to create route: %w", err)
+// knownHostsName returns how known_hosts names the host at name: plain
+// on port 22, as [name]:port otherwise
+func (h sshHost) knownHostsName(name string) string {
+	if h.port == 22 {
+		return name
 	}
-	fmt.Println("  Added default route to Internet Gateway")
+	return fmt.Sprintf("[%s]:%d", name, h.port)
+}
 
-	// Associate route table with subnet
-	assocOutput, err := ec2Client.AssociateRouteTable(ctx, &ec2.AssociateRouteTableInput{
-		RouteTableId: aws.String(result.RouteTableID),
-		SubnetId:     aws.String(result.SubnetID),
-	})
-	if err != nil {
-		return result, fmt.Errorf("failed to associate route table: %w", err)
+// createdAttrs returns the outputs of a created stack as log attributes
+func createdAttrs(stackName, configFile string, cfg *ec2stack.Config) []any {
+	attrs := []any{"stack", stackName}
+	if configFile != "" {
+		attrs = append(attrs, "config_file", configFile)
 	}
-	result.RouteTableAssociation = *assocOutput.AssociationId
-	fmt.Println("  Associated route table with subnet")
+	if cfg.DNS != nil && cfg.DNS.FQDN != "" {
+		attrs = append(attrs, "fqdn", cfg.DNS.FQDN)
+	}
+	if cfg.VM == nil {
+		return attrs
+	}
+	attrs = append(attrs, "region", cfg.VM.Region)
 
-	fmt.Println("Network infrastructure created successfully")
-	return result, nil
+	var sshCommands []string
+	if len(cfg.VM.Users) > 0 {
+		for _, host := range sshHosts(stackName, cfg) {
+			sshCommands = append(sshCommands, host.sshCommand(cfg.VM.Users[0].Username))
+		}
+	}
+	if len(cfg.VM.Instances) > 0 {
+		return append(attrs, "instances", cfg.VM.Instances, "ssh_commands", sshCommands)
+	}
+	attrs = append(attrs,
+		"stack_id", cfg.VM.StackID,
+		"instance_id", cfg.VM.InstanceID,
+		"public_ip", cfg.VM.PublicIP,
+		"private_ip", cfg.VM.PrivateIP,
+		"zone", cfg.VM.Zone,
+	)
+	if len(sshCommands) > 0 {
+		attrs = append(attrs, "ssh_command", sshCommands[0])
+	}
+	return attrs
 }
 
-func deleteNetworkStack(ctx context.Context, ec2Client *ec2.Client, cfg *StackConfig) {
-	fmt.Println("Deleting created network infrastructure...")
+// defaultConfigFile is copied for a create without a stack name
+const defaultConfigFile = "stacks/default.json"
 
-	// Disassociate and delete route table
-	if cfg.RouteTableAssociation != "" {
-		_, err := ec2Client.DisassociateRouteTable(ctx, &ec2.DisassociateRouteTableInput{
-			AssociationId: aws.String(cfg.RouteTableAssociation),
-		})
-		if err != nil {
-			fmt.Printf("  Warning: failed to disassociate route table: %v\n", err)
-		}
+// newGeneratedStack picks a stack name, writes stacks/<name>.json from
+// the default config and returns the name
+func newGeneratedStack() (string, error) {
+	cfg, _, err := ec2stack.ReadConfig(defaultConfigFile)
+	if err != nil {
+		return "", usageErrorf("no stack name given and no default config: %w", err)
 	}
 
-	if cfg.RouteTableID != "" {
-		_, err := ec2Client.DeleteRouteTable(ctx, &ec2.DeleteRouteTableInput{
-			RouteTableId: aws.String(cfg.RouteTableID),
-		})
-		if err != nil {
-			fmt.Printf("  Warning: failed to delete route table: %v\n", err)
-		} else {
-			fmt.Printf("  Deleted Route Table: %s\n", cfg.RouteTableID)
-		}
+	owner := ""
+	if cfg.VM != nil && len(cfg.VM.Users) > 0 {
+		owner = cfg.VM.Users[0].GitHubUsername
 	}
+	name := generateStackName(owner, time.Now())
 
-	// Delete subnet
-	if cfg.CreatedSubnet && cfg.SubnetID != "" {
-		_, err := ec2Client.DeleteSubnet(ctx, &ec2.DeleteSubnetInput{
-			SubnetId: aws.String(cfg.SubnetID),
-		})
-		if err != nil {
-			fmt.Printf("  Warning: failed to delete subnet: %v\n", err)
-		} else {
-			fmt.Printf("  Deleted Subnet: %s\n", cfg.SubnetID)
-		}
+	configFile := filepath.Join("stacks", name+".json")
+	if _, err := os.Stat(configFile); err == nil {
+		return "", usageErrorf("generated config %s already exists", configFile)
+	}
+	if err := ec2stack.WriteConfig(configFile, cfg); err != nil {
+		return "", err
 	}
 
-	// Detach and delete Internet Gateway
-	if cfg.InternetGatewayID != "" && cfg.VpcID != "" {
-		_, err := ec2Client.DetachInternetGateway(ctx, &ec2.DetachInternetGatewayInput{
-			InternetGatewayId: aws.String(cfg.InternetGatewayID),
-			VpcId:             aws.String(cfg.VpcID),
-		})
-		if err != nil {
-			fmt.Printf("  Warning: failed to detach Internet Gateway: %v\n", err)
-		}
+	printf("\n*** Generated stack name: %s ***", name)
+	printf("Config: %s (delete with: -d -n %s)\n", configFile, name)
+	return name, nil
+}
 
-		_, err = ec2Client.DeleteInternetGateway(ctx, &ec2.DeleteInternetGatewayInput{
-			InternetGatewayId: aws.String(cfg.InternetGatewayID),
-		})
-		if err != nil {
-			fmt.Printf("  Warning: failed to delete Internet Gateway: %v\n", err)
+// generateStackName returns ec2-<owner>-<timestamp>, reduced to the letters,
+// digits and hyphens CloudFormation allows in a stack name
+func generateStackName(owner string, now time.Time) string {
+	var b strings.Builder
+	for _, r := range strings.ToLower(owner) {
+		if (r >= 'a' && r <= 'z') || (r >= '0' && r <= '9') {
+			b.WriteRune(r)
 		} else {
-			fmt.Printf("  Deleted Internet Gateway: %s\n", cfg.InternetGatewayID)
+			b.WriteRune('-')
 		}
 	}
 
-	// Delete VPC
-	if cfg.CreatedVPC && cfg.VpcID != "" {
-		_, err := ec2Client.DeleteVpc(ctx, &ec2.DeleteVpcInput{
-			VpcId: aws.String(cfg.VpcID),
-		})
-		if err != nil {
-			fmt.Printf("  Warning: failed to delete VPC: %v\n", err)
-		} else {
-			fmt.Printf("  Deleted VPC: %s\n", cfg.VpcID)
-		}
+	parts := []string{"ec2"}
+	if owner := strings.Trim(b.String(), "-"); owner != "" {
+		parts = append(parts, owner)
 	}
-
-	fmt.Println("Network cleanup complete")
-}
-
-func generateUserSetupScript(users []User) string {
-	var script strings.Builder
-	script.WriteString("#!/bin/bash\n")
-	script.WriteString("set -e\n\n")
-	script.WriteString("# Auto-generated user setup script\n")
-
-	for _, user := range users {
-		script.WriteString(fmt.Sprintf("\n# Create user: %s (GitHub: %s)\n", user.Username, user.GitHubUsername))
-		script.WriteString(fmt.Sprintf("useradd -m -s /bin/bash %q || true\n", user.Username))
-		script.WriteString(fmt.Sprintf("usermod -a -G sudo,www-data %s\n", user.Username))
-		script.WriteString(fmt.Sprintf("echo '%s ALL=(ALL) NOPASSWD:ALL' > /etc/sudoers.d/%s\n", user.Username, user.Username))
-		script.WriteString(fmt.Sprintf("chmod 0440 /etc/sudoers.d/%s\n", user.Username))
-		script.WriteString(fmt.Sprintf("mkdir -p /home/%s/.ssh\n", user.Username))
-		script.WriteString(fmt.Sprintf("chmod 700 /home/%s/.ssh\n", user.Username))
-		script.WriteString(fmt.Sprintf("curl -s https://github.com/%s.keys > /home/%s/.ssh/authorized_keys\n", user.GitHubUsername, user.Username))
-		script.WriteString(fmt.Sprintf("chmod 600 /home/%s/.ssh/authorized_keys\n", user.Username))
-		script.WriteString(fmt.Sprintf("chown -R %s:%s /home/%s/.ssh\n", user.Username, user.Username, user.Username))
-		script.WriteString(fmt.Sprintf("echo 'User %s created with SSH keys from GitHub (%s)'\n", user.Username, user.GitHubUsername))
-	}
-
-	return script.String()
+	parts = append(parts, now.Format("20060102-150405"))
+	return strings.Join(parts, "-")
 }
 
-type CloudInitTemplateData struct {
-	Hostname      string
-	Domain        string
-	FQDN          string
-	Region        string
-	OS            string
-	WorkingDir    string
-	Packages      []string
-	Users         []User
-	IsApexDomain  bool
-	CNAMEAliases  []string
-}
+// createOptions are the CLI-only steps run after a successful create
+type createOptions struct {
+	waitSSH    bool
+	sshConfig  bool
+	knownHosts string
+	envOut     string
+	eventsOut  string
 
-func processCloudInitTemplate(templatePath string, data CloudInitTemplateData) (string, error) {
-	content, err := os.ReadFile(templatePath)
-	if err != nil {
-		return "", fmt.Errorf("failed to read cloud-init file: %w", err)
-	}
+	// resultOut receives the created config, outputs included, so
+	// downstream tooling need not read the source config
+	resultOut string
 
-	tmpl, err := template.New("cloud-init").Parse(string(content))
-	if err != nil {
-		return "", fmt.Errorf("failed to parse cloud-init template: %w", err)
-	}
+	// configStdin reads the config from stdin; with no file to write back
+	// to, the updated config is only printed
+	configStdin bool
 
-	var buf bytes.Buffer
-	if err := tmpl.Execute(&buf, data); err != nil {
-		return "", fmt.Errorf("failed to execute cloud-init template: %w", err)
-	}
+	// template, from -template, replaces the config printed after the
+	// create
+	template *template.Template
 
-	return buf.String(), nil
+	overrides configOverrides
 }
 
-func generateMultipartUserData(userScript string, cloudInitContent string) string {
-	boundary := "MIMEBOUNDARY"
-	var buf bytes.Buffer
-
-	buf.WriteString("Content-Type: multipart/mixed; boundary=\"" + boundary + "\"\n")
-	buf.WriteString("MIME-Version: 1.0\n\n")
+// configOverrides are config values given on the command line for one
+// create
+type configOverrides struct {
+	// enableSSM turns on enable_ssm as if the config set it
+	enableSSM bool
 
-	// Part 1: Shell script for user setup
-	buf.WriteString("--" + boundary + "\n")
-	buf.WriteString("Content-Type: text/x-shellscript; charset=\"utf-8\"\n")
-	buf.WriteString("Content-Disposition: attachment; filename=\"setup-users.sh\"\n\n")
-	buf.WriteString(userScript)
-	buf.WriteString("\n")
-
-	// Part 2: Cloud-init config (if provided)
-	if cloudInitContent != "" {
-		buf.WriteString("--" + boundary + "\n")
-		buf.WriteString("Content-Type: text/cloud-config; charset=\"utf-8\"\n")
-		buf.WriteString("Content-Disposition: attachment; filename=\"cloud-config.yaml\"\n\n")
-		buf.WriteString(cloudInitContent)
-		buf.WriteString("\n")
-	}
+	// ipv6 turns on ipv6_ingress as if the config set it
+	ipv6 bool
 
-	buf.WriteString("--" + boundary + "--\n")
+	// instanceType, ports and hostname replace the config's values when set
+	instanceType string
+	ports        []string
+	hostname     string
 
-	return base64.StdEncoding.EncodeToString(buf.Bytes())
+	// noWrite keeps the overridden fields at the file's values in the
+	// config written back, which still records the outputs
+	noWrite bool
 }
 
-func lookupZoneID(ctx context.Context, r53Client *route53.Client, domain string) (string, error) {
-	// Ensure domain ends with a dot for Route53
-	if !strings.HasSuffix(domain, ".") {
-		domain = domain + "."
+// apply sets the overridden fields on cfg and returns a function that
+// gives the config to write back
+func (o configOverrides) apply(cfg *ec2stack.Config) (func(*ec2stack.Config) *ec2stack.Config, error) {
+	needVM := func(flag string) error {
+		if cfg.VM == nil {
+			return usageErrorf("-%s needs a config with a vm section", flag)
+		}
+		return nil
 	}
-
-	input := &route53.ListHostedZonesByNameInput{
-		DNSName: aws.String(domain),
+	var vm ec2stack.VMConfig
+	if cfg.VM != nil {
+		vm = *cfg.VM
 	}
-
-	result, err := r53Client.ListHostedZonesByName(ctx, input)
-	if err != nil {
-		return "", fmt.Errorf("failed to list hosted zones: %w", err)
+	var dns ec2stack.DNSConfig
+	if cfg.DNS != nil {
+		dns = *cfg.DNS
 	}
 
-	for _, zone := range result.HostedZones {
-		if *zone.Name == domain {
-			// Zone ID format: /hostedzone/Z1234567890ABC
-			zoneID := strings.TrimPrefix(*zone.Id, "/hostedzone/")
-			return zoneID, nil
+	if o.enableSSM {
+		if err := needVM("enable-ssm"); err != nil {
+			return nil, err
 		}
+		cfg.VM.EnableSSM = true
 	}
-
-	return "", fmt.Errorf("hosted zone not found for domain: %s", domain)
-}
-
-func validateUserConfig(cfg *StackConfig) error {
-	// Normalize: convert legacy github_username to users array
-	if len(cfg.Users) == 0 && cfg.GitHubUsername != "" {
-		cfg.Users = []User{
-			{
-				Username:       cfg.GitHubUsername,
-				GitHubUsername: cfg.GitHubUsername,
-			},
+	if o.ipv6 {
+		if err := needVM("ipv6"); err != nil {
+			return nil, err
 		}
+		cfg.VM.IPv6Ingress = true
 	}
-
-	// Require at least one user
-	if len(cfg.Users) == 0 {
-		return fmt.Errorf("at least one user required: specify 'github_username' or 'users'")
+	if o.instanceType != "" {
+		if err := needVM("instance-type"); err != nil {
+			return nil, err
+		}
+		infof("Instance type: %s (from -instance-type)", o.instanceType)
+		cfg.VM.InstanceType = o.instanceType
 	}
-
-	// Validate each user
-	seen := make(map[string]bool)
-	for i, user := range cfg.Users {
-		if user.Username == "" {
-			return fmt.Errorf("user[%d]: username cannot be empty", i)
+	if len(o.ports) > 0 {
+		if err := needVM("ports"); err != nil {
+			return nil, err
 		}
-		if user.GitHubUsername == "" {
-			return fmt.Errorf("user[%d]: github_username cannot be empty", i)
+		infof("Ports: %s (from -ports)", strings.Join(o.ports, ", "))
+		cfg.VM.Ports = o.ports
+	}
+	if o.hostname != "" {
+		if cfg.DNS == nil {
+			return nil, usageErrorf("-hostname needs a config with a dns section")
 		}
+		infof("Hostname: %s (from -hostname)", o.hostname)
+		cfg.DNS.Hostname = o.hostname
+	}
 
-		// Check for duplicate usernames
-		if seen[user.Username] {
-			return fmt.Errorf("duplicate username: %s", user.Username)
+	if !o.noWrite {
+		return func(c *ec2stack.Config) *ec2stack.Config { return c }, nil
+	}
+	return func(c *ec2stack.Config) *ec2stack.Config {
+		out := *c
+		if c.VM != nil {
+			v := *c.VM
+			v.EnableSSM, v.IPv6Ingress = vm.EnableSSM, vm.IPv6Ingress
+			if o.instanceType != "" {
+				v.InstanceType = vm.InstanceType
+				// A plan must use the type that was launched
+				if len(vm.InstanceTypes()) > 1 {
+					v.LaunchedInstanceType = c.VM.EffectiveInstanceType()
+				}
+			}
+			if len(o.ports) > 0 {
+				v.Ports = vm.Ports
+			}
+			out.VM = &v
+		}
+		if c.DNS != nil && o.hostname != "" {
+			d := *c.DNS
+			d.Hostname = dns.Hostname
+			out.DNS = &d
 		}
-		seen[user.Username] = true
+		return &out
+	}, nil
+}
 
-		// Validate username format
-		if !isValidLinuxUsername(user.Username) {
-			return fmt.Errorf("invalid username format: %s (must be lowercase alphanumeric, start with letter)", user.Username)
+// splitList splits a comma-separated flag value, dropping empty entries
+func splitList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
 		}
 	}
+	return items
+}
 
+// useConfigProfile switches the client to the config's aws_profile, if it
+// names one, and prints the identity it resolves to so a stack is never
+// touched in the wrong account unnoticed
+func useConfigProfile(ctx context.Context, client *ec2stack.Client, cfg *ec2stack.Config) error {
+	if cfg.AWSProfile == "" {
+		return nil
+	}
+	client.Profile = cfg.AWSProfile
+	region := ""
+	if cfg.VM != nil {
+		region = cfg.VM.Region
+	}
+	arn, err := client.CallerARN(ctx, region)
+	if err != nil {
+		return fmt.Errorf("aws_profile %s: %w", cfg.AWSProfile, err)
+	}
+	infof("AWS profile %s (from config): %s", cfg.AWSProfile, arn)
 	return nil
 }
 
-func isValidLinuxUsername(username string) bool {
-	if len(username) == 0 || len(username) > 32 {
-		return false
+// checkAssumedRole fails fast on an -assume-role role that the credentials
+// in use cannot assume, and shows the identity it gives
+func checkAssumedRole(ctx context.Context, client *ec2stack.Client, region string) error {
+	arn, err := client.CallerARN(ctx, region)
+	if err != nil {
+		return err
 	}
+	infof("Assumed role: %s", arn)
+	return nil
+}
 
-	// Must start with lowercase letter
-	if username[0] < 'a' || username[0] > 'z' {
-		return false
+// loadCreateConfig returns the config to create from and the file to write
+// the outputs back to, which is empty for a config read from stdin
+func loadCreateConfig(stackName string, opts createOptions) (*ec2stack.Config, string, error) {
+	if !opts.configStdin {
+		return ec2stack.ReadConfig(stackName)
 	}
-
-	// Rest can be alphanumeric, underscore, or hyphen
-	for _, ch := range username {
-		if !((ch >= 'a' && ch <= 'z') || (ch >= '0' && ch <= '9') || ch == '_' || ch == '-') {
-			return false
-		}
+	data, err := io.ReadAll(os.Stdin)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to read config from stdin: %w", err)
 	}
-
-	return true
+	cfg, err := ec2stack.ParseConfig(data)
+	if err != nil {
+		return nil, "", fmt.Errorf("stdin: %w", err)
+	}
+	return cfg, "", nil
 }
 
-func validateDNSConfig(cfg *StackConfig) error {
-	// Validate CNAME aliases
-	if len(cfg.CNAMEAliases) > 0 {
-		if cfg.Hostname == "" || cfg.Domain == "" {
-			return fmt.Errorf("cname_aliases requires both hostname and domain")
-		}
+// createStack reads the stack's config, creates it and writes the outputs back
+func createStack(ctx context.Context, client *ec2stack.Client, stackName string, opts createOptions) error {
+	cfg, configFile, err := loadCreateConfig(stackName, opts)
+	if err != nil {
+		return err
+	}
 
-		// Check for duplicates and empty strings
-		seen := make(map[string]bool)
-		for _, alias := range cfg.CNAMEAliases {
-			if alias == "" {
-				return fmt.Errorf("cname_aliases cannot contain empty strings")
+	if configFile != "" {
+		infof("Config File: %s", configFile)
+	} else {
+		infof("Config: stdin")
+		if client.Profile == "" && cfg.AWSProfile != "" {
+			if err := useConfigProfile(ctx, client, cfg); err != nil {
+				return err
 			}
-			if alias == cfg.Hostname {
-				return fmt.Errorf("cname_aliases cannot duplicate primary hostname: %s", alias)
+		} else if client.AssumeRoleARN != "" {
+			region := ""
+			if cfg.VM != nil {
+				region = cfg.VM.Region
 			}
-			if seen[alias] {
-				return fmt.Errorf("duplicate cname_alias: %s", alias)
+			if err := checkAssumedRole(ctx, client, region); err != nil {
+				return err
 			}
-			seen[alias] = true
 		}
 	}
-
-	// Validate apex domain
-	if cfg.IsApexDomain && cfg.Domain == "" {
-		return fmt.Errorf("is_apex_domain requires domain to be specified")
+	fileConfig, err := opts.overrides.apply(cfg)
+	if err != nil {
+		return err
 	}
 
-	return nil
-}
-
-func encodeUsers(users []User) string {
-	var parts []string
-	for _, user := range users {
-		parts = append(parts, fmt.Sprintf("%s:%s", user.Username, user.GitHubUsername))
+	started := time.Now()
+	cfg, err = client.CreateStack(ctx, stackName, cfg)
+	if opts.eventsOut != "" {
+		writeEventsFile(ctx, client, opts.eventsOut, stackIDs(cfg), eventsFrom(client, started))
 	}
-	return strings.Join(parts, ",")
-}
-
-func createARecord(ctx context.Context, r53Client *route53.Client, zoneID, name, ip string, ttl int) error {
-	if !strings.HasSuffix(name, ".") {
-		name = name + "."
-	}
-
-	input := &route53.ChangeResourceRecordSetsInput{
-		HostedZoneId: aws.String(zoneID),
-		ChangeBatch: &r53types.ChangeBatch{
-			Changes: []r53types.Change{
-				{
-					Action: r53types.ChangeActionUpsert,
-					ResourceRecordSet: &r53types.ResourceRecordSet{
-						Name: aws.String(name),
-						Type: r53types.RRTypeA,
-						TTL:  aws.Int64(int64(ttl)),
-						ResourceRecords: []r53types.ResourceRecord{
-							{Value: aws.String(ip)},
-						},
-					},
-				},
-			},
-		},
-	}
-
-	_, err := r53Client.ChangeResourceRecordSets(ctx, input)
-	return err
-}
-
-func createCNAMERecord(ctx context.Context, r53Client *route53.Client, zoneID, name, target string, ttl int) error {
-	if !strings.HasSuffix(name, ".") {
-		name = name + "."
-	}
-	if !strings.HasSuffix(target, ".") {
-		target = target + "."
-	}
-
-	input := &route53.ChangeResourceRecordSetsInput{
-		HostedZoneId: aws.String(zoneID),
-		ChangeBatch: &r53types.ChangeBatch{
-			Changes: []r53types.Change{
-				{
-					Action: r53types.ChangeActionUpsert,
-					ResourceRecordSet: &r53types.ResourceRecordSet{
-						Name: aws.String(name),
-						Type: r53types.RRTypeCname,
-						TTL:  aws.Int64(int64(ttl)),
-						ResourceRecords: []r53types.ResourceRecord{
-							{Value: aws.String(target)},
-						},
-					},
-				},
-			},
-		},
-	}
-
-	_, err := r53Client.ChangeResourceRecordSets(ctx, input)
-	return err
-}
-
-func deleteARecord(ctx context.Context, r53Client *route53.Client, zoneID, name, ip string, ttl int) error {
-	if !strings.HasSuffix(name, ".") {
-		name = name + "."
-	}
-
-	input := &route53.ChangeResourceRecordSetsInput{
-		HostedZoneId: aws.String(zoneID),
-		ChangeBatch: &r53types.ChangeBatch{
-			Changes: []r53types.Change{
-				{
-					Action: r53types.ChangeActionDelete,
-					ResourceRecordSet: &r53types.ResourceRecordSet{
-						Name: aws.String(name),
-						Type: r53types.RRTypeA,
-						TTL:  aws.Int64(int64(ttl)),
-						ResourceRecords: []r53types.ResourceRecord{
-							{Value: aws.String(ip)},
-						},
-					},
-				},
-			},
-		},
-	}
-
-	_, err := r53Client.ChangeResourceRecordSets(ctx, input)
-	return err
-}
-
-func deleteCNAMERecord(ctx context.Context, r53Client *route53.Client, zoneID, name, target string, ttl int) error {
-	if !strings.HasSuffix(name, ".") {
-		name = name + "."
-	}
-	if !strings.HasSuffix(target, ".") {
-		target = target + "."
-	}
-
-	input := &route53.ChangeResourceRecordSetsInput{
-		HostedZoneId: aws.String(zoneID),
-		ChangeBatch: &r53types.ChangeBatch{
-			Changes: []r53types.Change{
-				{
-					Action: r53types.ChangeActionDelete,
-					ResourceRecordSet: &r53types.ResourceRecordSet{
-						Name: aws.String(name),
-						Type: r53types.RRTypeCname,
-						TTL:  aws.Int64(int64(ttl)),
-						ResourceRecords: []r53types.ResourceRecord{
-							{Value: aws.String(target)},
-						},
-					},
-				},
-			},
-		},
-	}
-
-	_, err := r53Client.ChangeResourceRecordSets(ctx, input)
-	return err
-}
-
-func deleteCreatedRecords(ctx context.Context, r53Client *route53.Client, zoneID string, records []DNSRecord) {
-	for _, record := range records {
-		if record.Type == "A" {
-			deleteARecord(ctx, r53Client, zoneID, record.Name, record.Value, record.TTL)
-		} else if record.Type == "CNAME" {
-			deleteCNAMERecord(ctx, r53Client, zoneID, record.Name, record.Value, record.TTL)
-		}
-	}
-}
-
-func createDNSRecords(ctx context.Context, r53Client *route53.Client, cfg *StackConfig) ([]DNSRecord, error) {
-	var createdRecords []DNSRecord
-
-	if cfg.Domain == "" {
-		return createdRecords, nil
-	}
-
-	// 1. Create primary A record (hostname.domain -> IP)
-	if cfg.Hostname != "" {
-		fqdn := fmt.Sprintf("%s.%s", cfg.Hostname, cfg.Domain)
-		err := createARecord(ctx, r53Client, cfg.ZoneID, fqdn, cfg.PublicIP, cfg.TTL)
-		if err != nil {
-			return createdRecords, fmt.Errorf("failed to create primary A record: %w", err)
-		}
-		createdRecords = append(createdRecords, DNSRecord{
-			Name:  fqdn,
-			Type:  "A",
-			Value: cfg.PublicIP,
-			TTL:   cfg.TTL,
-		})
-	}
-
-	// 2. Create CNAME records (alias.domain -> hostname.domain)
-	if cfg.Hostname != "" && len(cfg.CNAMEAliases) > 0 {
-		targetFQDN := fmt.Sprintf("%s.%s", cfg.Hostname, cfg.Domain)
-		for _, alias := range cfg.CNAMEAliases {
-			aliasFQDN := fmt.Sprintf("%s.%s", alias, cfg.Domain)
-			err := createCNAMERecord(ctx, r53Client, cfg.ZoneID, aliasFQDN, targetFQDN, cfg.TTL)
-			if err != nil {
-				deleteCreatedRecords(ctx, r53Client, cfg.ZoneID, createdRecords)
-				return nil, fmt.Errorf("failed to create CNAME %s: %w", aliasFQDN, err)
-			}
-			createdRecords = append(createdRecords, DNSRecord{
-				Name:  aliasFQDN,
-				Type:  "CNAME",
-				Value: targetFQDN,
-				TTL:   cfg.TTL,
-			})
+	partial := cfg.VM != nil && (cfg.VM.StackID != "" || len(cfg.VM.Instances) > 0)
+	if opts.resultOut != "" && (err == nil || partial) {
+		if werr := writeResultFile(opts.resultOut, cfg); werr != nil {
+			warnf("failed to write result file: %v", werr)
+		} else {
+			infof("Result written to %s", opts.resultOut)
 		}
 	}
-
-	// 3. Create apex A record (domain -> IP)
-	if cfg.IsApexDomain {
-		err := createARecord(ctx, r53Client, cfg.ZoneID, cfg.Domain, cfg.PublicIP, cfg.TTL)
-		if err != nil {
-			deleteCreatedRecords(ctx, r53Client, cfg.ZoneID, createdRecords)
-			return nil, fmt.Errorf("failed to create apex A record: %w", err)
-		}
-		createdRecords = append(createdRecords, DNSRecord{
-			Name:  cfg.Domain,
-			Type:  "A",
-			Value: cfg.PublicIP,
-			TTL:   cfg.TTL,
-		})
+	if jsonResult != nil && (err == nil || partial) {
+		jsonResult.Stack = cfg
 	}
-
-	return createdRecords, nil
-}
-
-// createVMResources creates EC2 instance and returns public IP and region
-func createVMResources(ctx context.Context, vm *VMConfig, stackName string) (string, string, error) {
-	// Load AWS config with region from VM config
-	awsCfg, err := config.LoadDefaultConfig(ctx, config.WithRegion(vm.Region))
 	if err != nil {
-		return "", "", fmt.Errorf("failed to load AWS config: %w", err)
-	}
-
-	fmt.Printf("Using AWS Region: %s\n", vm.Region)
-	fmt.Printf("Stack Name: %s\n", stackName)
-	fmt.Printf("OS: %s\n", vm.OS)
-	fmt.Printf("Users to create: %d\n", len(vm.Users))
-	for _, user := range vm.Users {
-		fmt.Printf("  - %s (GitHub: %s)\n", user.Username, user.GitHubUsername)
-	}
-	fmt.Printf("Instance Type: %s\n", vm.InstanceType)
-
-	cfClient := cloudformation.NewFromConfig(awsCfg)
-	ssmClient := ssm.NewFromConfig(awsCfg)
-	ec2Client := ec2.NewFromConfig(awsCfg)
-
-	// Discover or create VPC and Subnet
-	if vm.VpcID == "" {
-		fmt.Println("Discovering VPC...")
-		vpcID, err := discoverVPC(ctx, ec2Client)
-		if err != nil {
-			return "", "", fmt.Errorf("failed to discover VPC: %w", err)
-		}
-
-		if vpcID == "" {
-			// No VPC found, create full network stack
-			netStack, err := createNetworkStack(ctx, ec2Client, stackName)
-			if err != nil {
-				return "", "", fmt.Errorf("failed to create network stack: %w", err)
+		// Keep a partially created stack in the config so -delete can find it
+		if partial {
+			if configFile == "" && jsonResult != nil {
+				warnf("save the result's stack as %s.json and run -delete -n %s to clean up", stackName, stackName)
+			} else if configFile == "" {
+				jsonData, _ := json.MarshalIndent(cfg, "", "  ")
+				fmt.Println(string(jsonData))
+				warnf("save the config above as %s.json and run -delete -n %s to clean up", stackName, stackName)
+			} else if werr := ec2stack.WriteConfig(configFile, fileConfig(cfg)); werr != nil {
+				warnf("failed to write config: %v", werr)
+			} else {
+				warnf("stack ID saved to %s; run -delete -n %s to clean up", configFile, stackName)
 			}
-			vm.VpcID = netStack.VpcID
-			vm.SubnetID = netStack.SubnetID
-			vm.InternetGatewayID = netStack.InternetGatewayID
-			vm.RouteTableID = netStack.RouteTableID
-			vm.RouteTableAssociation = netStack.RouteTableAssociation
-			vm.CreatedVPC = true
-			vm.CreatedSubnet = true
-		} else {
-			vm.VpcID = vpcID
-			fmt.Printf("Using existing VPC: %s\n", vpcID)
 		}
+		return err
 	}
 
-	if vm.SubnetID == "" {
-		fmt.Println("Discovering subnet...")
-		subnetID, err := discoverSubnet(ctx, ec2Client, vm.VpcID)
-		if err != nil {
-			return "", "", fmt.Errorf("failed to discover subnet: %w", err)
+	// Write updated config
+	if configFile != "" {
+		if err := ec2stack.WriteConfig(configFile, fileConfig(cfg)); err != nil {
+			warnf("failed to write config: %v", err)
 		}
+	}
 
-		if subnetID == "" {
-			// No suitable subnet found, create one
-			netStack, err := createNetworkStack(ctx, ec2Client, stackName)
-			if err != nil {
-				return "", "", fmt.Errorf("failed to create network stack: %w", err)
-			}
-			// Update with newly created resources
-			if vm.VpcID == "" {
-				vm.VpcID = netStack.VpcID
-				vm.CreatedVPC = true
-			}
-			vm.SubnetID = netStack.SubnetID
-			vm.InternetGatewayID = netStack.InternetGatewayID
-			vm.RouteTableID = netStack.RouteTableID
-			vm.RouteTableAssociation = netStack.RouteTableAssociation
-			vm.CreatedSubnet = true
-		} else {
-			vm.SubnetID = subnetID
-			fmt.Printf("Using existing Subnet: %s\n", subnetID)
+	// Print summary; the log record carries the outputs for -log-format json
+	slog.Info("\n=== Stack Created Successfully ===", createdAttrs(stackName, configFile, cfg)...)
+	var templateErr error
+	if opts.template != nil {
+		if err := printTemplate(opts.template, stackName, cfg); err != nil {
+			templateErr = usageErrorf("the stack was created, but -template failed: %w", err)
 		}
+	} else if jsonResult == nil {
+		jsonData, _ := json.MarshalIndent(cfg, "", "  ")
+		fmt.Println(string(jsonData))
 	}
 
-	// Validate VPC and Subnet are available
-	if vm.VpcID == "" {
-		return "", "", fmt.Errorf("VPC ID is required but could not be discovered or created")
-	}
-	if vm.SubnetID == "" {
-		return "", "", fmt.Errorf("Subnet ID is required but could not be discovered or created")
+	// A piped config's result, or the -template output, is the only thing on
+	// stdout, so it can be captured; the lines below become progress output
+	result := printf
+	if opts.configStdin || opts.template != nil {
+		result = infof
 	}
-
-	// Lookup AMI ID from SSM
-	fmt.Printf("Looking up AMI for %s...\n", vm.OS)
-	amiID, err := lookupAMI(ctx, ssmClient, vm.OS)
-	if err != nil {
-		return "", "", fmt.Errorf("failed to lookup AMI: %w", err)
+	if configFile != "" {
+		result("\nConfig updated: %s", configFile)
 	}
-	fmt.Printf("Found AMI: %s\n", amiID)
-	vm.AMIID = amiID
 
-	// Generate UserData
-	userScript := generateUserSetupScript(vm.Users)
-
-	var cloudInitContent string
-	if vm.CloudInitFile != "" {
-		// Resolve path relative to current directory
-		cloudInitPath := vm.CloudInitFile
-		if !filepath.IsAbs(cloudInitPath) {
-			cwd, _ := os.Getwd()
-			cloudInitPath = filepath.Join(cwd, cloudInitPath)
-		}
+	// Print SSH command if VM was created
+	if cfg.VM != nil && len(cfg.VM.Users) > 0 {
+		for _, host := range sshHosts(stackName, cfg) {
+			if opts.waitSSH && host.jump != "" {
+				infof("Not waiting for SSH on %s: it is only reachable through %s", host.target, host.jump)
+			} else if opts.waitSSH {
+				infof("Waiting for SSH on %s...", host.target)
+				if err := ec2stack.WaitForSSH(ctx, host.target, host.port, sshWaitTimeout); err != nil {
+					warnf("%v; the instance may not be ready yet", err)
+				} else {
+					infof("SSH ready")
+				}
+			}
+			result("SSH: %s", host.sshCommand(cfg.VM.Users[0].Username))
+			if jsonResult != nil {
+				jsonResult.SSH = append(jsonResult.SSH, host.sshCommand(cfg.VM.Users[0].Username))
+			}
 
-		fmt.Printf("Processing cloud-init file: %s\n", cloudInitPath)
+			if opts.knownHosts != "" {
+				writeKnownHosts(ctx, client, cfg.VM, host, opts.knownHosts)
+			}
 
-		// Default working directory
-		workingDir := vm.WorkingDir
-		if workingDir == "" {
-			workingDir = "/var/www/html"
+			if opts.sshConfig {
+				path, err := ec2stack.WriteSSHConfigEntry(host.name, host.target, cfg.VM.Users[0].Username, host.port, host.jump)
+				if err != nil {
+					warnf("failed to update SSH config: %v", err)
+				} else {
+					infof("Added Host %s to %s (ssh %s)", host.name, path, host.name)
+				}
+			}
 		}
-
-		templateData := CloudInitTemplateData{
-			Region:     vm.Region,
-			OS:         vm.OS,
-			WorkingDir: workingDir,
-			Packages:   vm.Packages,
-			Users:      vm.Users,
+		if cfg.VM.InstallDocker && cfg.VM.CloudInitFile == "" {
+			result("Docker: installed at boot; %s can run docker without sudo", cfg.VM.Users[0].Username)
 		}
+		printCostEstimate(cfg.VM, result)
+	}
 
-		cloudInitContent, err = processCloudInitTemplate(cloudInitPath, templateData)
-		if err != nil {
-			return "", "", fmt.Errorf("failed to process cloud-init: %w", err)
+	if opts.envOut != "" {
+		if err := writeEnvFile(opts.envOut, stackName, cfg); err != nil {
+			warnf("failed to write env file: %v", err)
+		} else {
+			infof("Outputs written to %s (source it to use them)", opts.envOut)
 		}
 	}
 
-	userData := generateMultipartUserData(userScript, cloudInitContent)
+	return templateErr
+}
 
-	// Generate CloudFormation template with embedded UserData
-	cfnTemplate, err := generateCloudFormationTemplate(userData)
-	if err != nil {
-		return "", "", fmt.Errorf("failed to generate CloudFormation template: %w", err)
-	}
+// templateData is what the -template template is executed against: the
+// config as .VM and .DNS, plus the outputs a template most often wants at
+// the top level, under the names of the flat config format. SSHCommand is
+// only set for a single instance; a count or regions config has its
+// members in .VM.Instances.
+type templateData struct {
+	*ec2stack.Config
+	StackName  string
+	StackID    string
+	Region     string
+	InstanceID string
+	PublicIP   string
+	PrivateIP  string
+	FQDN       string
+	SSHCommand string
+}
 
-	// Create CloudFormation stack
-	input := &cloudformation.CreateStackInput{
-		StackName:    aws.String(stackName),
-		TemplateBody: aws.String(cfnTemplate),
-		Parameters: []types.Parameter{
-			{
-				ParameterKey:   aws.String("ImageId"),
-				ParameterValue: aws.String(amiID),
-			},
-			{
-				ParameterKey:   aws.String("InstanceType"),
-				ParameterValue: aws.String(vm.InstanceType),
-			},
-			{
-				ParameterKey:   aws.String("VpcId"),
-				ParameterValue: aws.String(vm.VpcID),
-			},
-			{
-				ParameterKey:   aws.String("SubnetId"),
-				ParameterValue: aws.String(vm.SubnetID),
-			},
-		},
-		Capabilities: []types.Capability{
-			types.CapabilityCapabilityIam,
+// parseOutputTemplate parses the -template template, exiting on a syntax
+// error before anything is created. Besides the built-in functions, json
+// marshals a value and join is strings.Join.
+func parseOutputTemplate(text string) *template.Template {
+	tmpl, err := template.New("output").Funcs(template.FuncMap{
+		"json": func(v any) (string, error) {
+			data, err := json.Marshal(v)
+			return string(data), err
 		},
-		Tags: []types.Tag{
-			{
-				Key:   aws.String("Purpose"),
-				Value: aws.String("EC2Instance"),
-			},
-		},
-	}
-
-	result, err := cfClient.CreateStack(ctx, input)
-	if err != nil {
-		return "", "", fmt.Errorf("failed to create stack: %w", err)
-	}
-
-	fmt.Printf("Stack creation initiated!\n")
-	fmt.Printf("Stack ID: %s\n", *result.StackId)
-	fmt.Printf("Waiting for stack to complete...\n")
-
-	waiter := cloudformation.NewStackCreateCompleteWaiter(cfClient)
-	err = waiter.Wait(ctx, &cloudformation.DescribeStacksInput{
-		StackName: aws.String(stackName),
-	}, 10*time.Minute)
+		"join": strings.Join,
+	}).Parse(text)
 	if err != nil {
-		return "", "", fmt.Errorf("failed waiting for stack: %w", err)
+		fatalf("invalid -template: %v", err)
 	}
+	return tmpl
+}
 
-	// Get stack outputs
-	describeOutput, err := cfClient.DescribeStacks(ctx, &cloudformation.DescribeStacksInput{
-		StackName: aws.String(stackName),
-	})
-	if err != nil {
-		return "", "", fmt.Errorf("failed to describe stack: %w", err)
+// printTemplate executes tmpl against the stack's config and prints the
+// result on stdout, ending it with a newline if it has none
+func printTemplate(tmpl *template.Template, stackName string, cfg *ec2stack.Config) error {
+	data := templateData{Config: cfg, StackName: stackName}
+	if cfg.DNS != nil {
+		data.FQDN = cfg.DNS.FQDN
 	}
-
-	// Update VM config with outputs
-	vm.StackName = stackName
-	vm.StackID = *result.StackId
-
-	for _, output := range describeOutput.Stacks[0].Outputs {
-		switch *output.OutputKey {
-		case "InstanceId":
-			vm.InstanceID = *output.OutputValue
-		case "InstanceType":
-			vm.InstanceType = *output.OutputValue
-		case "PublicIP":
-			vm.PublicIP = *output.OutputValue
-		case "SecurityGroupId":
-			vm.SecurityGroup = *output.OutputValue
+	if vm := cfg.VM; vm != nil {
+		data.StackID, data.Region, data.InstanceID = vm.StackID, vm.Region, vm.InstanceID
+		data.PublicIP, data.PrivateIP = vm.PublicIP, vm.PrivateIP
+		if vm.InstanceID != "" && len(vm.Instances) == 0 && len(vm.Users) > 0 {
+			data.SSHCommand = sshHosts(stackName, cfg)[0].sshCommand(vm.Users[0].Username)
 		}
 	}
 
-	return vm.PublicIP, vm.Region, nil
+	var b strings.Builder
+	if err := tmpl.Execute(&b, data); err != nil {
+		return err
+	}
+	out := b.String()
+	if out != "" && !strings.HasSuffix(out, "\n") {
+		out += "\n"
+	}
+	fmt.Print(out)
+	return nil
 }
 
-// createDNSResources creates DNS records and returns created records
-func createDNSResources(ctx context.Context, dns *DNSConfig, publicIP, region string) error {
-	// Load AWS config with region
-	awsCfg, err := config.LoadDefaultConfig(ctx, config.WithRegion(region))
+// writeResultFile writes the config a create produced to path as JSON,
+// with environment references expanded
+func writeResultFile(path string, cfg *ec2stack.Config) error {
+	data, err := ec2stack.MarshalConfig(cfg, false)
 	if err != nil {
-		return fmt.Errorf("failed to load AWS config: %w", err)
+		return err
 	}
+	return os.WriteFile(path, append(data, '\n'), 0644)
+}
 
-	r53Client := route53.NewFromConfig(awsCfg)
-
-	// Lookup zone ID
-	fmt.Printf("Looking up zone ID for %s...\n", dns.Domain)
-	zoneID, err := lookupZoneID(ctx, r53Client, dns.Domain)
+// writeKnownHosts records the host keys of a new instance in path under
+// its FQDN and IP, so the first ssh does not have to trust them blindly.
+// Failures are only warnings: the stack itself was created.
+func writeKnownHosts(ctx context.Context, client *ec2stack.Client, vm *ec2stack.VMConfig, host sshHost, path string) {
+	if host.instanceID == "" {
+		return
+	}
+	infof("Reading host keys of %s...", host.instanceID)
+	keys, err := client.HostKeys(ctx, vm, host.instanceID)
 	if err != nil {
-		return fmt.Errorf("failed to lookup zone ID: %w", err)
+		warnf("no known_hosts entry for %s: %v", host.target, err)
+		return
 	}
-	fmt.Printf("Found Zone ID: %s\n", zoneID)
-	dns.ZoneID = zoneID
-
-	// Determine target IP
-	targetIP := publicIP
-	if dns.TargetIP != "" {
-		targetIP = dns.TargetIP
+	names := []string{host.knownHostsName(host.target)}
+	if host.ip != "" && host.ip != host.target {
+		names = append(names, host.knownHostsName(host.ip))
 	}
+	if err := ec2stack.WriteKnownHosts(path, names, keys); err != nil {
+		warnf("failed to update known_hosts: %v", err)
+		return
+	}
+	infof("Added %d host key(s) for %s to %s", len(keys), strings.Join(names, ","), path)
+}
 
-	var createdRecords []DNSRecord
-
-	// 1. Create primary A record (hostname.domain -> IP)
-	if dns.Hostname != "" {
-		fqdn := fmt.Sprintf("%s.%s", dns.Hostname, dns.Domain)
-		err := createARecord(ctx, r53Client, dns.ZoneID, fqdn, targetIP, dns.TTL)
-		if err != nil {
-			return fmt.Errorf("failed to create primary A record: %w", err)
+// validateConfigs reads and checks each named config without calling AWS,
+// printing OK or the problems found, and fails if any config has problems
+func validateConfigs(names []string) error {
+	failed := 0
+	for _, name := range names {
+		// A glob over stacks/ also matches the shared defaults
+		if ec2stack.IsDefaultsFile(name) {
+			fmt.Printf("SKIP %s: shared defaults, not a stack\n", name)
+			continue
 		}
-		createdRecords = append(createdRecords, DNSRecord{
-			Name:  fqdn,
-			Type:  "A",
-			Value: targetIP,
-			TTL:   dns.TTL,
-		})
-		dns.FQDN = fqdn
-	}
-
-	// 2. Create CNAME records (alias.domain -> hostname.domain)
-	if dns.Hostname != "" && len(dns.CNAMEAliases) > 0 {
-		targetFQDN := fmt.Sprintf("%s.%s", dns.Hostname, dns.Domain)
-		for _, alias := range dns.CNAMEAliases {
-			aliasFQDN := fmt.Sprintf("%s.%s", alias, dns.Domain)
-			err := createCNAMERecord(ctx, r53Client, dns.ZoneID, aliasFQDN, targetFQDN, dns.TTL)
-			if err != nil {
-				deleteCreatedRecords(ctx, r53Client, dns.ZoneID, createdRecords)
-				return fmt.Errorf("failed to create CNAME %s: %w", aliasFQDN, err)
-			}
-			createdRecords = append(createdRecords, DNSRecord{
-				Name:  aliasFQDN,
-				Type:  "CNAME",
-				Value: targetFQDN,
-				TTL:   dns.TTL,
-			})
+		cfg, configFile, err := ec2stack.ReadConfig(name)
+		if err == nil {
+			err = ec2stack.ValidateConfig(cfg)
 		}
-	}
-
-	// 3. Create apex A record (domain -> IP)
-	if dns.IsApexDomain {
-		err := createARecord(ctx, r53Client, dns.ZoneID, dns.Domain, targetIP, dns.TTL)
 		if err != nil {
-			deleteCreatedRecords(ctx, r53Client, dns.ZoneID, createdRecords)
-			return fmt.Errorf("failed to create apex A record: %w", err)
-		}
-		createdRecords = append(createdRecords, DNSRecord{
-			Name:  dns.Domain,
-			Type:  "A",
-			Value: targetIP,
-			TTL:   dns.TTL,
-		})
-		if dns.FQDN == "" {
-			dns.FQDN = dns.Domain
+			failed++
+			fmt.Printf("FAIL %s: %v\n", configFile, err)
+			continue
 		}
+		fmt.Printf("OK   %s\n", configFile)
+	}
+	if failed > 0 {
+		return usageErrorf("%d of %d configs failed validation", failed, len(names))
 	}
-
-	fmt.Printf("Created %d DNS record(s) successfully\n", len(createdRecords))
-	dns.DNSRecords = createdRecords
-
 	return nil
 }
 
-// createStackNested creates stack using nested config structure
-func createStackNested(stackName string) {
-	ctx := context.Background()
-
-	// Read nested config
-	cfg, configFile, err := readNestedConfig(stackName)
+// showConfig prints the config as create would use it: read, merged with
+// the shared defaults, expanded and defaulted. Validation problems are
+// reported after the config, so it can be inspected either way.
+func showConfig(name string, toml bool, tmpl *template.Template) error {
+	cfg, configFile, err := ec2stack.ReadConfig(name)
 	if err != nil {
-		log.Fatalf("Error: %v", err)
+		return err
 	}
-
-	// Validate config
-	if cfg.VM == nil && cfg.DNS == nil {
-		log.Fatal("Config must have at least one of 'vm' or 'dns' sections")
-	}
-
-	// Validate VM users if VM section exists
-	if cfg.VM != nil {
-		if len(cfg.VM.Users) == 0 {
-			log.Fatal("VM section requires at least one user in 'users' array")
-		}
-		// Validate each user
-		seen := make(map[string]bool)
-		for i, user := range cfg.VM.Users {
-			if user.Username == "" {
-				log.Fatalf("vm.users[%d]: username cannot be empty", i)
-			}
-			if user.GitHubUsername == "" {
-				log.Fatalf("vm.users[%d]: github_username cannot be empty", i)
-			}
-			if seen[user.Username] {
-				log.Fatalf("duplicate username: %s", user.Username)
-			}
-			seen[user.Username] = true
-			if !isValidLinuxUsername(user.Username) {
-				log.Fatalf("invalid username format: %s (must be lowercase alphanumeric, start with letter)", user.Username)
-			}
+	verr := ec2stack.ValidateConfig(cfg)
+	if tmpl != nil {
+		stackName := strings.TrimSuffix(strings.TrimSuffix(filepath.Base(configFile), ".json"), ".toml")
+		if err := printTemplate(tmpl, stackName, cfg); err != nil {
+			return usageErrorf("-template: %w", err)
 		}
-	}
-
-	// Validate DNS config if DNS section exists
-	if cfg.DNS != nil {
-		if len(cfg.DNS.CNAMEAliases) > 0 {
-			if cfg.DNS.Hostname == "" || cfg.DNS.Domain == "" {
-				log.Fatal("cname_aliases requires both hostname and domain")
-			}
-			seen := make(map[string]bool)
-			for _, alias := range cfg.DNS.CNAMEAliases {
-				if alias == "" {
-					log.Fatal("cname_aliases cannot contain empty strings")
-				}
-				if alias == cfg.DNS.Hostname {
-					log.Fatalf("cname_aliases cannot duplicate primary hostname: %s", alias)
-				}
-				if seen[alias] {
-					log.Fatalf("duplicate cname_alias: %s", alias)
-				}
-				seen[alias] = true
-			}
+	} else {
+		data, err := ec2stack.MarshalConfig(cfg, toml)
+		if err != nil {
+			return err
 		}
-		if cfg.DNS.IsApexDomain && cfg.DNS.Domain == "" {
-			log.Fatal("is_apex_domain requires domain to be specified")
+		fmt.Print(string(data))
+		if !strings.HasSuffix(string(data), "\n") {
+			fmt.Println()
 		}
 	}
-
-	// Generate random hostname if DNS section exists but hostname is empty
-	if cfg.DNS != nil && cfg.DNS.Hostname == "" && cfg.DNS.Domain != "" {
-		cfg.DNS.Hostname = generateRandomHostname()
-		fmt.Printf("Generated random hostname: %s\n", cfg.DNS.Hostname)
+	if verr != nil {
+		return fmt.Errorf("%s: %w", configFile, verr)
 	}
+	return nil
+}
 
-	fmt.Printf("Config File: %s\n", configFile)
-
-	var publicIP string
-	var region string
-
-	// Create VM resources if configured
-	if cfg.VM != nil {
-		fmt.Println("\n=== Creating VM Resources ===")
-		publicIP, region, err = createVMResources(ctx, cfg.VM, stackName)
-		if err != nil {
-			log.Fatalf("Failed to create VM resources: %v", err)
-		}
-		fmt.Printf("\nVM Created Successfully\n")
-		fmt.Printf("Public IP: %s\n", publicIP)
+// cloneConfig copies the config of stack src for a new stack dst
+func cloneConfig(src, dst string, overwrite bool) error {
+	configFile, err := ec2stack.CloneConfig(src, dst, overwrite)
+	if err != nil {
+		return err
 	}
+	infof("Config written: %s (create with: -c -n %s)", configFile, dst)
 
-	// Create DNS resources if configured
-	if cfg.DNS != nil {
-		fmt.Println("\n=== Creating DNS Resources ===")
-
-		// Use region from VM if available, otherwise default
-		if region == "" {
-			region = "us-east-1"
-		}
-
-		// Use publicIP from VM if no target_ip specified
-		if cfg.DNS.TargetIP == "" && publicIP != "" {
-			cfg.DNS.TargetIP = publicIP
-		}
-
-		err = createDNSResources(ctx, cfg.DNS, publicIP, region)
-		if err != nil {
-			log.Fatalf("Failed to create DNS resources: %v", err)
-		}
-		fmt.Printf("\nDNS Created Successfully\n")
-		fmt.Printf("FQDN: %s\n", cfg.DNS.FQDN)
+	cfg, _, err := ec2stack.ReadConfig(dst)
+	if err == nil && cfg.DNS != nil && cfg.DNS.Hostname != "" {
+		warnf("dns.hostname is still %q: change it before create, or the new stack's records collide with %s's", cfg.DNS.Hostname, src)
 	}
+	return nil
+}
 
-	// Write updated config
-	if err := writeNestedConfig(configFile, cfg); err != nil {
-		log.Printf("Warning: failed to write config: %v", err)
+// stackIDs returns the IDs of the stacks a config records, one per member
+// of a count config
+func stackIDs(cfg *ec2stack.Config) []string {
+	if cfg == nil || cfg.VM == nil {
+		return nil
 	}
-
-	// Print summary
-	fmt.Printf("\n=== Stack Created Successfully ===\n")
-	jsonData, _ := json.MarshalIndent(cfg, "", "  ")
-	fmt.Println(string(jsonData))
-	fmt.Printf("\nConfig updated: %s\n", configFile)
-
-	// Print SSH command if VM was created
-	if cfg.VM != nil && len(cfg.VM.Users) > 0 {
-		sshTarget := cfg.VM.PublicIP
-		if cfg.DNS != nil && cfg.DNS.FQDN != "" {
-			sshTarget = cfg.DNS.FQDN
+	var ids []string
+	if cfg.VM.StackID != "" {
+		ids = append(ids, cfg.VM.StackID)
+	}
+	for _, inst := range cfg.VM.Instances {
+		if inst.StackID != "" {
+			ids = append(ids, inst.StackID)
 		}
-		fmt.Printf("SSH: ssh %s@%s\n", cfg.VM.Users[0].Username, sshTarget)
 	}
+	return ids
 }
 
-// deleteNetworkStackNested deletes network stack using nested VM config
-func deleteNetworkStackNested(ctx context.Context, ec2Client *ec2.Client, vm *VMConfig) {
-	fmt.Println("Deleting created network infrastructure...")
-
-	// Disassociate and delete route table
-	if vm.RouteTableAssociation != "" {
-		_, err := ec2Client.DisassociateRouteTable(ctx, &ec2.DisassociateRouteTableInput{
-			AssociationId: aws.String(vm.RouteTableAssociation),
-		})
-		if err != nil {
-			fmt.Printf("  Warning: failed to disassociate route table: %v\n", err)
-		}
+// writeEventsFile writes the events of the stacks from since on to path,
+// as CSV when it ends in .csv and as a JSON array otherwise. Failures are
+// only warnings: the create or delete itself has already finished.
+func writeEventsFile(ctx context.Context, client *ec2stack.Client, path string, ids []string, since time.Time) {
+	if len(ids) == 0 {
+		warnf("no stack ID recorded, not writing %s", path)
+		return
 	}
-
-	if vm.RouteTableID != "" {
-		_, err := ec2Client.DeleteRouteTable(ctx, &ec2.DeleteRouteTableInput{
-			RouteTableId: aws.String(vm.RouteTableID),
-		})
-		if err != nil {
-			fmt.Printf("  Warning: failed to delete route table: %v\n", err)
-		} else {
-			fmt.Printf("  Deleted Route Table: %s\n", vm.RouteTableID)
-		}
+	events, err := client.StackEvents(ctx, ids, since)
+	if err != nil {
+		warnf("failed to fetch stack events: %v", err)
+		return
 	}
 
-	// Delete subnet
-	if vm.CreatedSubnet && vm.SubnetID != "" {
-		_, err := ec2Client.DeleteSubnet(ctx, &ec2.DeleteSubnetInput{
-			SubnetId: aws.String(vm.SubnetID),
-		})
-		if err != nil {
-			fmt.Printf("  Warning: failed to delete subnet: %v\n", err)
-		} else {
-			fmt.Printf("  Deleted Subnet: %s\n", vm.SubnetID)
+	var buf bytes.Buffer
+	if strings.HasSuffix(path, ".csv") {
+		w := csv.NewWriter(&buf)
+		w.Write([]string{"timestamp", "stack_name", "logical_resource_id", "physical_resource_id", "resource_type", "resource_status", "resource_status_reason"})
+		for _, e := range events {
+			w.Write([]string{e.Timestamp.UTC().Format(time.RFC3339), e.StackName, e.LogicalResourceID, e.PhysicalResourceID, e.ResourceType, e.ResourceStatus, e.ResourceStatusReason})
 		}
+		w.Flush()
+	} else {
+		data, _ := json.MarshalIndent(events, "", "  ")
+		buf.Write(append(data, '\n'))
 	}
-
-	// Detach and delete Internet Gateway
-	if vm.InternetGatewayID != "" && vm.VpcID != "" {
-		_, err := ec2Client.DetachInternetGateway(ctx, &ec2.DetachInternetGatewayInput{
-			InternetGatewayId: aws.String(vm.InternetGatewayID),
-			VpcId:             aws.String(vm.VpcID),
-		})
-		if err != nil {
-			fmt.Printf("  Warning: failed to detach Internet Gateway: %v\n", err)
-		}
-
-		_, err = ec2Client.DeleteInternetGateway(ctx, &ec2.DeleteInternetGatewayInput{
-			InternetGatewayId: aws.String(vm.InternetGatewayID),
-		})
-		if err != nil {
-			fmt.Printf("  Warning: failed to delete Internet Gateway: %v\n", err)
-		} else {
-			fmt.Printf("  Deleted Internet Gateway: %s\n", vm.InternetGatewayID)
-		}
+	if err := os.WriteFile(path, buf.Bytes(), 0644); err != nil {
+		warnf("failed to write %s: %v", path, err)
+		return
 	}
+	infof("%d stack events written to %s", len(events), path)
+}
 
-	// Delete VPC
-	if vm.CreatedVPC && vm.VpcID != "" {
-		_, err := ec2Client.DeleteVpc(ctx, &ec2.DeleteVpcInput{
-			VpcId: aws.String(vm.VpcID),
-		})
-		if err != nil {
-			fmt.Printf("  Warning: failed to delete VPC: %v\n", err)
-		} else {
-			fmt.Printf("  Deleted VPC: %s\n", vm.VpcID)
-		}
+// eventsFrom returns the time stack events are written from: -since when
+// given, otherwise started, when the create or delete began
+func eventsFrom(client *ec2stack.Client, started time.Time) time.Time {
+	if !client.EventsSince.IsZero() {
+		return client.EventsSince
 	}
-
-	fmt.Println("Network cleanup complete")
+	return started
 }
 
-// deleteStackNested deletes stack using nested config structure
-func deleteStackNested(stackName string) {
-	ctx := context.Background()
-
-	// Read nested config
-	cfg, configFile, err := readNestedConfig(stackName)
+// planStack prints the resource changes deploying the stack's config
+// would make
+func planStack(ctx context.Context, client *ec2stack.Client, stackName string) error {
+	changes, err := client.PlanStack(ctx, stackName)
 	if err != nil {
-		fmt.Printf("Warning: could not read config file: %v\n", err)
-		cfg = nil
-		configFile = ""
+		return err
 	}
-
-	// Determine region
-	region := "us-east-1"
-	if cfg != nil && cfg.VM != nil && cfg.VM.Region != "" {
-		region = cfg.VM.Region
+	if jsonResult != nil {
+		jsonResult.Changes = &changes
+		return nil
 	}
-
-	// Load AWS config
-	awsCfg, err := config.LoadDefaultConfig(ctx, config.WithRegion(region))
-	if err != nil {
-		log.Fatalf("failed to load AWS config: %v", err)
+	if len(changes) == 0 {
+		fmt.Printf("No changes: stack %s matches its config\n", stackName)
+		return nil
 	}
 
-	fmt.Printf("Using AWS Region: %s\n", region)
-	fmt.Printf("Deleting Stack: %s\n", stackName)
-
-	// Delete DNS records first (if configured)
-	if cfg != nil && cfg.DNS != nil && cfg.DNS.ZoneID != "" && len(cfg.DNS.DNSRecords) > 0 {
-		fmt.Printf("Deleting %d DNS record(s)...\n", len(cfg.DNS.DNSRecords))
-		r53Client := route53.NewFromConfig(awsCfg)
-
-		for _, record := range cfg.DNS.DNSRecords {
-			fmt.Printf("  Deleting %s record: %s -> %s\n", record.Type, record.Name, record.Value)
-
-			var err error
-			if record.Type == "A" {
-				err = deleteARecord(ctx, r53Client, cfg.DNS.ZoneID, record.Name, record.Value, record.TTL)
-			} else if record.Type == "CNAME" {
-				err = deleteCNAMERecord(ctx, r53Client, cfg.DNS.ZoneID, record.Name, record.Value, record.TTL)
+	fmt.Printf("Changes to stack %s:\n", stackName)
+	for _, change := range changes {
+		line := fmt.Sprintf("  %-7s %-20s %s", change.Action, change.LogicalID, change.Type)
+		if change.PhysicalID != "" {
+			line += " (" + change.PhysicalID + ")"
+		}
+		if change.Action == string(types.ChangeActionModify) {
+			line += fmt.Sprintf(", replacement: %s", change.Replacement)
+			if len(change.Scope) > 0 {
+				line += ", changes: " + strings.Join(change.Scope, ", ")
 			}
+		}
+		fmt.Println(line)
+	}
+	return nil
+}
 
-			if err != nil {
-				log.Printf("Warning: failed to delete DNS record %s: %v", record.Name, err)
+// describeInstances prints the live EC2 details of a stack's instances
+func describeInstances(ctx context.Context, client *ec2stack.Client, stackName string) error {
+	details, err := client.DescribeStackInstances(ctx, stackName)
+	if err != nil {
+		return err
+	}
+	if jsonResult != nil {
+		jsonResult.Instances = details
+		for _, d := range details {
+			if d.Gone() {
+				warnf("%s: instance %s was terminated outside this tool. Run delete -n %s to clean up the stack", stackName, d.InstanceID, stackName)
 			}
 		}
-		fmt.Println("DNS records deleted")
+		return nil
 	}
-
-	// Delete CloudFormation stack (if VM configured)
-	if cfg != nil && cfg.VM != nil && cfg.VM.StackName != "" {
-		cfClient := cloudformation.NewFromConfig(awsCfg)
-
-		_, err = cfClient.DeleteStack(ctx, &cloudformation.DeleteStackInput{
-			StackName: aws.String(stackName),
-		})
-		if err != nil {
-			log.Fatalf("failed to delete stack: %v", err)
+	for i, d := range details {
+		if i > 0 {
+			fmt.Println()
 		}
-
-		fmt.Println("Stack deletion initiated, waiting for completion...")
-
-		waiter := cloudformation.NewStackDeleteCompleteWaiter(cfClient)
-		err = waiter.Wait(ctx, &cloudformation.DescribeStacksInput{
-			StackName: aws.String(stackName),
-		}, 10*time.Minute)
-		if err != nil {
-			log.Fatalf("failed waiting for stack deletion: %v", err)
+		fmt.Printf("Instance:          %s\n", d.InstanceID)
+		fmt.Printf("State:             %s\n", d.State)
+		if d.StateReason != "" {
+			fmt.Printf("Reason:            %s\n", d.StateReason)
 		}
-
-		// Delete created network infrastructure
-		if cfg.VM.CreatedVPC || cfg.VM.CreatedSubnet || cfg.VM.InternetGatewayID != "" {
-			ec2Client := ec2.NewFromConfig(awsCfg)
-			deleteNetworkStackNested(ctx, ec2Client, cfg.VM)
+		if d.State == ec2stack.InstanceStateNotFound {
+			warnf("%s: EC2 no longer knows instance %s; it was terminated outside this tool. Run delete -n %s to clean up the stack", stackName, d.InstanceID, stackName)
+			continue
 		}
-	}
-
-	// Clear output fields in config file
-	if cfg != nil && configFile != "" {
-		if cfg.VM != nil {
-			cfg.VM.StackName = ""
-			cfg.VM.StackID = ""
-			cfg.VM.InstanceID = ""
-			cfg.VM.PublicIP = ""
-			cfg.VM.SecurityGroup = ""
-			cfg.VM.AMIID = ""
-			cfg.VM.CreatedVPC = false
-			cfg.VM.CreatedSubnet = false
-			cfg.VM.VpcID = ""
-			cfg.VM.SubnetID = ""
-			cfg.VM.InternetGatewayID = ""
-			cfg.VM.RouteTableID = ""
-			cfg.VM.RouteTableAssociation = ""
+		fmt.Printf("Instance type:     %s\n", d.InstanceType)
+		if d.LaunchTime != nil {
+			fmt.Printf("Launched:          %s\n", d.LaunchTime.Local().Format(time.RFC1123))
 		}
-		if cfg.DNS != nil {
-			cfg.DNS.ZoneID = ""
-			cfg.DNS.FQDN = ""
-			cfg.DNS.DNSRecords = []DNSRecord{}
+		fmt.Printf("Availability zone: %s\n", d.AvailabilityZone)
+		if d.PublicIP != "" {
+			fmt.Printf("Public IP:         %s\n", d.PublicIP)
 		}
-
-		if err := writeNestedConfig(configFile, cfg); err != nil {
-			log.Printf("Warning: failed to update config file: %v", err)
-		} else {
-			fmt.Printf("Config cleared: %s\n", configFile)
+		if d.PrivateIP != "" {
+			fmt.Printf("Private IP:        %s\n", d.PrivateIP)
+		}
+		if len(d.SecurityGroups) > 0 {
+			fmt.Printf("Security groups:   %s\n", strings.Join(d.SecurityGroups, ", "))
+		}
+		if d.Gone() {
+			warnf("%s: instance %s was terminated outside this tool. Run delete -n %s to clean up the stack", stackName, d.InstanceID, stackName)
 		}
 	}
-
-	fmt.Println("Stack deleted successfully")
+	return nil
 }
 
-func createStack(stackName string) {
-	ctx := context.Background()
+// stackStatus is a live stack as status and list report it
+type stackStatus struct {
+	Name    string            `json:"name"`
+	ID      string            `json:"id,omitempty"`
+	Region  string            `json:"region,omitempty"`
+	Status  string            `json:"status"`
+	Reason  string            `json:"reason,omitempty"`
+	Created *time.Time        `json:"created,omitempty"`
+	Outputs map[string]string `json:"outputs,omitempty"`
+	FQDN    string            `json:"fqdn,omitempty"`
+}
 
-	// Read config
-	stackCfg, configFile, err := readConfig(stackName)
-	if err != nil {
-		log.Fatalf("Error: %v", err)
+// newStackStatus summarizes a described stack
+func newStackStatus(stack *types.Stack, region string) stackStatus {
+	status := stackStatus{
+		Name:    aws.ToString(stack.StackName),
+		ID:      aws.ToString(stack.StackId),
+		Region:  region,
+		Status:  string(stack.StackStatus),
+		Reason:  aws.ToString(stack.StackStatusReason),
+		Created: stack.CreationTime,
 	}
-
-	// Generate random hostname if not specified (helps avoid Let's Encrypt rate limits)
-	if stackCfg.Hostname == "" && stackCfg.Domain != "" {
-		stackCfg.Hostname = generateRandomHostname()
-		fmt.Printf("Generated random hostname: %s\n", stackCfg.Hostname)
-
-		// Save the generated hostname back to config
-		if err := writeConfig(configFile, stackCfg); err != nil {
-			log.Fatalf("failed to save generated hostname to config: %v", err)
+	for _, output := range stack.Outputs {
+		if status.Outputs == nil {
+			status.Outputs = make(map[string]string)
 		}
+		status.Outputs[aws.ToString(output.OutputKey)] = aws.ToString(output.OutputValue)
 	}
+	return status
+}
 
-	// Validate user configuration
-	if err := validateUserConfig(stackCfg); err != nil {
-		log.Fatalf("Invalid user configuration: %v", err)
-	}
-
-	// Validate DNS configuration
-	if err := validateDNSConfig(stackCfg); err != nil {
-		log.Fatalf("Invalid DNS configuration: %v", err)
-	}
-
-	// Load AWS config with region from JSON config
-	awsCfg, err := config.LoadDefaultConfig(ctx, config.WithRegion(stackCfg.Region))
-	if err != nil {
-		log.Fatalf("failed to load AWS config: %v", err)
-	}
-
-	fmt.Printf("Using AWS Region: %s\n", stackCfg.Region)
-	fmt.Printf("Config File: %s\n", configFile)
-	fmt.Printf("Stack Name: %s\n", stackName)
-	fmt.Printf("OS: %s\n", stackCfg.OS)
-	fmt.Printf("Users to create: %d\n", len(stackCfg.Users))
-	for _, user := range stackCfg.Users {
-		fmt.Printf("  - %s (GitHub: %s)\n", user.Username, user.GitHubUsername)
+// showStackStatus prints the live status and outputs of a stack
+func showStackStatus(ctx context.Context, client *ec2stack.Client, stackName string) error {
+	region := "us-east-1"
+	cfg, _, err := ec2stack.ReadConfig(stackName)
+	if err == nil && cfg.VM != nil && cfg.VM.Region != "" {
+		region = cfg.VM.Region
 	}
-	fmt.Printf("Instance Type: %s\n", stackCfg.InstanceType)
-
-	cfClient := cloudformation.NewFromConfig(awsCfg)
-	r53Client := route53.NewFromConfig(awsCfg)
-	ssmClient := ssm.NewFromConfig(awsCfg)
-	ec2Client := ec2.NewFromConfig(awsCfg)
-
-	// Discover or create VPC and Subnet
-	if stackCfg.VpcID == "" {
-		fmt.Println("Discovering VPC...")
-		vpcID, err := discoverVPC(ctx, ec2Client)
-		if err != nil {
-			log.Fatalf("failed to discover VPC: %v", err)
-		}
 
-		if vpcID == "" {
-			// No VPC found, create full network stack
-			netStack, err := createNetworkStack(ctx, ec2Client, stackName)
-			if err != nil {
-				log.Fatalf("failed to create network stack: %v", err)
+	if cfg != nil && cfg.VM != nil && len(cfg.VM.Instances) > 0 {
+		for i, inst := range cfg.VM.Instances {
+			if i > 0 && jsonResult == nil {
+				fmt.Println()
 			}
-			stackCfg.VpcID = netStack.VpcID
-			stackCfg.SubnetID = netStack.SubnetID
-			stackCfg.InternetGatewayID = netStack.InternetGatewayID
-			stackCfg.RouteTableID = netStack.RouteTableID
-			stackCfg.RouteTableAssociation = netStack.RouteTableAssociation
-			stackCfg.CreatedVPC = true
-			stackCfg.CreatedSubnet = true
-		} else {
-			stackCfg.VpcID = vpcID
-			fmt.Printf("Using existing VPC: %s\n", vpcID)
-		}
-	}
-
-	if stackCfg.SubnetID == "" {
-		fmt.Println("Discovering subnet...")
-		subnetID, err := discoverSubnet(ctx, ec2Client, stackCfg.VpcID)
-		if err != nil {
-			log.Fatalf("failed to discover subnet: %v", err)
-		}
-
-		if subnetID == "" {
-			// No suitable subnet found, create one
-			netStack, err := createNetworkStack(ctx, ec2Client, stackName)
-			if err != nil {
-				log.Fatalf("failed to create network stack: %v", err)
+			instRegion := region
+			if inst.Region != "" {
+				instRegion = inst.Region
 			}
-			// Update with newly created resources
-			if stackCfg.VpcID == "" {
-				stackCfg.VpcID = netStack.VpcID
-				stackCfg.CreatedVPC = true
+			if err := printStackStatus(ctx, client, inst.StackName, instRegion, inst.DNS); err != nil {
+				return err
 			}
-			stackCfg.SubnetID = netStack.SubnetID
-			stackCfg.InternetGatewayID = netStack.InternetGatewayID
-			stackCfg.RouteTableID = netStack.RouteTableID
-			stackCfg.RouteTableAssociation = netStack.RouteTableAssociation
-			stackCfg.CreatedSubnet = true
-		} else {
-			stackCfg.SubnetID = subnetID
-			fmt.Printf("Using existing Subnet: %s\n", subnetID)
 		}
+		return nil
 	}
 
-	// Validate VPC and Subnet are available (required for CloudFormation)
-	if stackCfg.VpcID == "" {
-		log.Fatal("VPC ID is required but could not be discovered or created")
-	}
-	if stackCfg.SubnetID == "" {
-		log.Fatal("Subnet ID is required but could not be discovered or created")
+	var dns *ec2stack.DNSConfig
+	if cfg != nil {
+		dns = cfg.DNS
 	}
+	return printStackStatus(ctx, client, stackName, region, dns)
+}
 
-	// Lookup AMI ID from SSM
-	fmt.Printf("Looking up AMI for %s...\n", stackCfg.OS)
-	amiID, err := lookupAMI(ctx, ssmClient, stackCfg.OS)
+// printStackStatus prints one live stack and, when dns has one, its FQDN.
+// With -json the stack is added to the result instead.
+func printStackStatus(ctx context.Context, client *ec2stack.Client, stackName, region string, dns *ec2stack.DNSConfig) error {
+	stack, err := client.DescribeStack(ctx, stackName, region)
 	if err != nil {
-		log.Fatalf("failed to lookup AMI: %v", err)
+		return err
 	}
-	fmt.Printf("Found AMI: %s\n", amiID)
-	stackCfg.AMIID = amiID
-
-	// Lookup zone ID if domain is specified
-	var zoneID string
-	if stackCfg.Domain != "" {
-		fmt.Printf("Looking up zone ID for %s...\n", stackCfg.Domain)
-		zoneID, err = lookupZoneID(ctx, r53Client, stackCfg.Domain)
-		if err != nil {
-			log.Fatalf("failed to lookup zone ID: %v", err)
-		}
-		fmt.Printf("Found Zone ID: %s\n", zoneID)
+	status := newStackStatus(stack, region)
+	if dns != nil {
+		status.FQDN = dns.FQDN
 	}
-
-	// Generate UserData
-	userScript := generateUserSetupScript(stackCfg.Users)
-
-	var cloudInitContent string
-	if stackCfg.CloudInitFile != "" {
-		// Resolve path relative to config file
-		cloudInitPath := stackCfg.CloudInitFile
-		if !filepath.IsAbs(cloudInitPath) {
-			configDir := filepath.Dir(configFile)
-			cloudInitPath = filepath.Join(configDir, cloudInitPath)
-		}
-
-		fmt.Printf("Processing cloud-init file: %s\n", cloudInitPath)
-
-		// Calculate FQDN for template
-		fqdn := ""
-		if stackCfg.Hostname != "" && stackCfg.Domain != "" {
-			fqdn = fmt.Sprintf("%s.%s", stackCfg.Hostname, stackCfg.Domain)
-		}
-
-		// Default working directory
-		workingDir := stackCfg.WorkingDir
-		if workingDir == "" {
-			workingDir = "/var/www/html"
-		}
-
-		templateData := CloudInitTemplateData{
-			Hostname:     stackCfg.Hostname,
-			Domain:       stackCfg.Domain,
-			FQDN:         fqdn,
-			Region:       stackCfg.Region,
-			OS:           stackCfg.OS,
-			WorkingDir:   workingDir,
-			Packages:     stackCfg.Packages,
-			Users:        stackCfg.Users,
-			IsApexDomain: stackCfg.IsApexDomain,
-			CNAMEAliases: stackCfg.CNAMEAliases,
-		}
-
-		cloudInitContent, err = processCloudInitTemplate(cloudInitPath, templateData)
-		if err != nil {
-			log.Fatalf("failed to process cloud-init: %v", err)
-		}
-	}
-
-	userData := generateMultipartUserData(userScript, cloudInitContent)
-
-	// Generate CloudFormation template with embedded UserData
-	cfnTemplate, err := generateCloudFormationTemplate(userData)
-	if err != nil {
-		log.Fatalf("failed to generate CloudFormation template: %v", err)
-	}
-
-	// Create CloudFormation stack
-	input := &cloudformation.CreateStackInput{
-		StackName:    &stackName,
-		TemplateBody: aws.String(cfnTemplate),
-		Parameters: []types.Parameter{
-			{
-				ParameterKey:   aws.String("ImageId"),
-				ParameterValue: aws.String(amiID),
-			},
-			{
-				ParameterKey:   aws.String("InstanceType"),
-				ParameterValue: aws.String(stackCfg.InstanceType),
-			},
-			{
-				ParameterKey:   aws.String("VpcId"),
-				ParameterValue: aws.String(stackCfg.VpcID),
-			},
-			{
-				ParameterKey:   aws.String("SubnetId"),
-				ParameterValue: aws.String(stackCfg.SubnetID),
-			},
-		},
-		Capabilities: []types.Capability{
-			types.CapabilityCapabilityIam,
-		},
-		Tags: []types.Tag{
-			{
-				Key:   aws.String("Purpose"),
-				Value: aws.String("EC2Instance"),
-			},
-		},
+	if jsonResult != nil {
+		jsonResult.Stacks = append(jsonResult.Stacks, status)
+		return nil
 	}
 
-	result, err := cfClient.CreateStack(ctx, input)
-	if err != nil {
-		log.Fatalf("failed to create stack: %v", err)
+	fmt.Printf("Stack:   %s\n", status.Name)
+	fmt.Printf("Region:  %s\n", region)
+	fmt.Printf("Status:  %s\n", status.Status)
+	if status.Reason != "" {
+		fmt.Printf("Reason:  %s\n", status.Reason)
 	}
-
-	fmt.Printf("Stack creation initiated!\n")
-	fmt.Printf("Stack ID: %s\n", *result.StackId)
-	fmt.Printf("Waiting for stack to complete...\n")
-
-	waiter := cloudformation.NewStackCreateCompleteWaiter(cfClient)
-	err = waiter.Wait(ctx, &cloudformation.DescribeStacksInput{
-		StackName: &stackName,
-	}, 10*time.Minute)
-	if err != nil {
-		log.Fatalf("failed waiting for stack: %v", err)
+	if status.Created != nil {
+		fmt.Printf("Created: %s\n", status.Created.Local().Format(time.RFC1123))
 	}
-
-	// Get stack outputs
-	describeOutput, err := cfClient.DescribeStacks(ctx, &cloudformation.DescribeStacksInput{
-		StackName: &stackName,
-	})
-	if err != nil {
-		log.Fatalf("failed to describe stack: %v", err)
-	}
-
-	// Update config with outputs
-	stackCfg.StackName = stackName
-	stackCfg.StackID = *result.StackId
-	stackCfg.Region = awsCfg.Region
-
-	for _, output := range describeOutput.Stacks[0].Outputs {
-		switch *output.OutputKey {
-		case "InstanceId":
-			stackCfg.InstanceID = *output.OutputValue
-		case "InstanceType":
-			stackCfg.InstanceType = *output.OutputValue
-		case "PublicIP":
-			stackCfg.PublicIP = *output.OutputValue
-		case "SecurityGroupId":
-			stackCfg.SecurityGroup = *output.OutputValue
-		}
-	}
-
-	// Create DNS records if configured
-	if zoneID != "" {
-		fmt.Println("Creating DNS records...")
-		stackCfg.ZoneID = zoneID
-		dnsRecords, err := createDNSRecords(ctx, r53Client, stackCfg)
-		if err != nil {
-			log.Printf("Warning: failed to create DNS records: %v", err)
-		} else {
-			fmt.Printf("Created %d DNS record(s) successfully\n", len(dnsRecords))
-			stackCfg.DNSRecords = dnsRecords
-
-			// Set FQDN to primary hostname or apex if no hostname
-			if stackCfg.Hostname != "" {
-				stackCfg.FQDN = fmt.Sprintf("%s.%s", stackCfg.Hostname, stackCfg.Domain)
-			} else if stackCfg.IsApexDomain {
-				stackCfg.FQDN = stackCfg.Domain
-			}
+	if len(stack.Outputs) > 0 {
+		fmt.Println("Outputs:")
+		for _, output := range stack.Outputs {
+			fmt.Printf("  %-16s %s\n", aws.ToString(output.OutputKey), aws.ToString(output.OutputValue))
 		}
 	}
-
-	// Set SSH command
-	if stackCfg.FQDN != "" {
-		stackCfg.SSHCommand = fmt.Sprintf("ssh %s@%s", stackCfg.Users[0].Username, stackCfg.FQDN)
-	} else {
-		stackCfg.SSHCommand = fmt.Sprintf("ssh %s@%s", stackCfg.Users[0].Username, stackCfg.PublicIP)
-	}
-
-	// Write updated config
-	if err := writeConfig(configFile, stackCfg); err != nil {
-		log.Printf("Warning: failed to write config: %v", err)
+	if status.FQDN != "" {
+		fmt.Printf("FQDN:    %s\n", status.FQDN)
 	}
 
-	fmt.Printf("\n=== Stack Created Successfully ===\n")
-	jsonData, _ := json.MarshalIndent(stackCfg, "", "  ")
-	fmt.Println(string(jsonData))
-	fmt.Printf("\nConfig updated: %s\n", configFile)
-	fmt.Printf("SSH: %s\n", stackCfg.SSHCommand)
+	return nil
 }
 
-func deleteStack(stackName string) {
-	ctx := context.Background()
-
-	// Try to read config for DNS cleanup
-	stackCfg, configFile, err := readConfig(stackName)
-	if err != nil {
-		fmt.Printf("Warning: could not read config file: %v\n", err)
-		stackCfg = nil
-		configFile = ""
-	}
-
-	// Determine region (from config or default)
-	region := "us-east-1"
-	if stackCfg != nil && stackCfg.Region != "" {
-		region = stackCfg.Region
-	}
-
-	// Load AWS config with region from JSON config
-	awsCfg, err := config.LoadDefaultConfig(ctx, config.WithRegion(region))
+// listStacks prints the stacks tagged Purpose=EC2Instance in a region
+func listStacks(ctx context.Context, client *ec2stack.Client, region string) error {
+	stacks, region, err := client.ListStacks(ctx, region)
 	if err != nil {
-		log.Fatalf("failed to load AWS config: %v", err)
+		return err
 	}
-
-	fmt.Printf("Using AWS Region: %s\n", region)
-	fmt.Printf("Deleting Stack: %s\n", stackName)
-
-	cfClient := cloudformation.NewFromConfig(awsCfg)
-
-	// Delete DNS records if they were configured
-	if stackCfg != nil && stackCfg.ZoneID != "" && len(stackCfg.DNSRecords) > 0 {
-		fmt.Printf("Deleting %d DNS record(s)...\n", len(stackCfg.DNSRecords))
-		r53Client := route53.NewFromConfig(awsCfg)
-
-		for _, record := range stackCfg.DNSRecords {
-			fmt.Printf("  Deleting %s record: %s -> %s\n", record.Type, record.Name, record.Value)
-
-			var err error
-			if record.Type == "A" {
-				err = deleteARecord(ctx, r53Client, stackCfg.ZoneID, record.Name, record.Value, record.TTL)
-			} else if record.Type == "CNAME" {
-				err = deleteCNAMERecord(ctx, r53Client, stackCfg.ZoneID, record.Name, record.Value, record.TTL)
-			}
-
-			if err != nil {
-				log.Printf("Warning: failed to delete DNS record %s: %v", record.Name, err)
-			}
+	if jsonResult != nil {
+		jsonResult.Region = region
+		jsonResult.Stacks = []stackStatus{}
+		for _, stack := range stacks {
+			status := newStackStatus(&stack, "")
+			jsonResult.Stacks = append(jsonResult.Stacks, status)
 		}
-		fmt.Println("DNS records deleted")
-	}
-
-	// Delete CloudFormation stack
-	_, err = cfClient.DeleteStack(ctx, &cloudformation.DeleteStackInput{
-		StackName: &stackName,
-	})
-	if err != nil {
-		log.Fatalf("failed to delete stack: %v", err)
+		return nil
 	}
 
-	fmt.Println("Stack deletion initiated, waiting for completion...")
-
-	waiter := cloudformation.NewStackDeleteCompleteWaiter(cfClient)
-	err = waiter.Wait(ctx, &cloudformation.DescribeStacksInput{
-		StackName: &stackName,
-	}, 10*time.Minute)
-	if err != nil {
-		log.Fatalf("failed waiting for stack deletion: %v", err)
-	}
-
-	// Delete created network infrastructure
-	if stackCfg != nil && (stackCfg.CreatedVPC || stackCfg.CreatedSubnet || stackCfg.InternetGatewayID != "") {
-		ec2Client := ec2.NewFromConfig(awsCfg)
-		deleteNetworkStack(ctx, ec2Client, stackCfg)
-	}
-
-	// Clear output fields in config file (preserve input fields like Region)
-	if stackCfg != nil && configFile != "" {
-		stackCfg.StackName = ""
-		stackCfg.StackID = ""
-		stackCfg.InstanceID = ""
-		stackCfg.PublicIP = ""
-		stackCfg.SecurityGroup = ""
-		stackCfg.ZoneID = ""
-		stackCfg.FQDN = ""
-		stackCfg.SSHCommand = ""
-		stackCfg.DNSRecords = []DNSRecord{}
-		stackCfg.CreatedVPC = false
-		stackCfg.CreatedSubnet = false
-		stackCfg.VpcID = ""
-		stackCfg.SubnetID = ""
-		stackCfg.InternetGatewayID = ""
-		stackCfg.RouteTableID = ""
-		stackCfg.RouteTableAssociation = ""
-		if err := writeConfig(configFile, stackCfg); err != nil {
-			log.Printf("Warning: failed to update config file: %v", err)
-		} else {
-			fmt.Printf("Config cleared: %s\n", configFile)
+	fmt.Printf("Stacks in %s:\n", region)
+	for _, stack := range stacks {
+		created := ""
+		if stack.CreationTime != nil {
+			created = stack.CreationTime.Local().Format("2006-01-02 15:04")
 		}
+		fmt.Printf("  %-30s %-22s %s\n", aws.ToString(stack.StackName), stack.StackStatus, created)
+	}
+	if len(stacks) == 0 {
+		fmt.Println("  (none)")
 	}
 
-	fmt.Println("Stack deleted successfully")
+	return nil
 }